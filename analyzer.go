@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+// 文字フィルタ、トークナイザ、単語フィルタをまとめたもの。言語ごとに用意する
+type Analyzer interface {
+	// 文字フィルタを通した文章と、そのトークン
+	Analyze(text []string) ([]string, [][]types.AnalyzedToken)
+	// 検索クエリ。副フィールドがあれば重みの違う複数のクエリになる
+	AnalyzeQuery(text string) []types.Query
+	// 入力途中の検索クエリ。最後のトークンを前方一致で検索する
+	AnalyzePrefixQuery(text string) []types.Query
+	// 設定や辞書が変わると変わる値。インデックスを作り直す必要があるかの判定に使う
+	Version() string
+}
+
+// 設定によって出力が変わる部品が実装する
+type versioned interface {
+	Version() string
+}
+
+// queryTokenizerは検索クエリのトークン化に使う
+func newAnalyzer(
+	tokenizer Tokenizer,
+	queryTokenizer Tokenizer,
+	charFilter []CharFilter,
+	termFilter []TermFilter,
+	wordFilter []WordFilter,
+) (*analyzerImpl, error) {
+	return &analyzerImpl{
+		tokenizer:      tokenizer,
+		queryTokenizer: queryTokenizer,
+		charFilter:     charFilter,
+		termFilter:     termFilter,
+		wordFilter:     wordFilter,
+	}, nil
+}
+
+type analyzerImpl struct {
+	tokenizer      Tokenizer
+	queryTokenizer Tokenizer
+	charFilter     []CharFilter
+	termFilter     []TermFilter
+	wordFilter     []WordFilter
+}
+
+func (a *analyzerImpl) Analyze(text []string) ([]string, [][]types.AnalyzedToken) {
+	return a.analyze(a.tokenizer, text)
+}
+
+func (a *analyzerImpl) AnalyzeQuery(text string) []types.Query {
+	_, tokens := a.analyze(a.queryTokenizer, []string{text})
+	if len(tokens[0]) == 0 {
+		return []types.Query{}
+	}
+	return []types.Query{{Tokens: tokenTexts(tokens)[0], Weight: 1}}
+}
+
+// 前方一致用の副フィールドがなければ通常のクエリと同じ
+func (a *analyzerImpl) AnalyzePrefixQuery(text string) []types.Query {
+	return a.AnalyzeQuery(text)
+}
+
+func (a *analyzerImpl) analyze(tokenizer Tokenizer, text []string) ([]string, [][]types.AnalyzedToken) {
+	// 前処理
+	for _, f := range a.charFilter {
+		text = f.Filter(text)
+	}
+	// トークン化
+	terms := tokenizer.Analyze(text)
+	// 品詞などを使う後処理
+	for _, f := range a.termFilter {
+		terms = f.FilterTerms(terms)
+	}
+	// 文字列だけの後処理。単語フィルタはトークンごとに働くので、語ごとに1行にして通し、語の位置を保つ
+	rows := [][]string{}
+	for _, terms := range terms {
+		for _, term := range terms {
+			rows = append(rows, []string{term.Text})
+		}
+	}
+	for _, f := range a.wordFilter {
+		rows = f.Filter(rows)
+	}
+	tokens := make([][]types.AnalyzedToken, len(terms))
+	row := 0
+	for i, terms := range terms {
+		tokens[i] = []types.AnalyzedToken{}
+		for _, term := range terms {
+			for _, text := range rows[row] {
+				tokens[i] = append(tokens[i], types.AnalyzedToken{Text: text, Position: term.Position})
+			}
+			row++
+		}
+	}
+	return text, tokens
+}
+
+// トークンの文字列だけを取り出す
+func tokenTexts(tokens [][]types.AnalyzedToken) [][]string {
+	result := make([][]string, len(tokens))
+	for i, tokens := range tokens {
+		result[i] = make([]string, len(tokens))
+		for j, token := range tokens {
+			result[i][j] = token.Text
+		}
+	}
+	return result
+}
+
+// トークンの位置とドキュメントの長さの数え方。変えたら上げて、登録済みのドキュメントを古いものとして作り直させる
+const analyzerFormat = "2"
+
+// 検索クエリ用のトークナイザはインデックスに影響しないので含めない
+func (a *analyzerImpl) Version() string {
+	components := []interface{}{a.tokenizer}
+	for _, f := range a.charFilter {
+		components = append(components, f)
+	}
+	for _, f := range a.termFilter {
+		components = append(components, f)
+	}
+	for _, f := range a.wordFilter {
+		components = append(components, f)
+	}
+	versions := []string{"format=" + analyzerFormat}
+	for _, c := range components {
+		version := fmt.Sprintf("%T", c)
+		if v, ok := c.(versioned); ok {
+			version += "=" + v.Version()
+		}
+		versions = append(versions, version)
+	}
+	return fingerprint([]byte(strings.Join(versions, ",")))
+}
+
+// 副フィールド。トークンに「name:」を付けて本来のトークンと同じインデックスに登録する。
+// ドキュメントの長さには数えない
+type analyzerField struct {
+	name   string
+	weight float64
+	// 副フィールドの解析結果の文章は使わない
+	analyzer Analyzer
+	// 前方一致のクエリだけに使う。最後のトークンをそのまま副フィールドで検索する
+	prefix bool
+}
+
+// 形態素解析で拾えない語をn-gramなどの副フィールドで補う
+func newFieldAnalyzer(analyzer Analyzer, fields []*analyzerField) (*fieldAnalyzer, error) {
+	for _, field := range fields {
+		if field.name == "" || strings.Contains(field.name, ":") {
+			return nil, fmt.Errorf("invalid field name: %q", field.name)
+		}
+	}
+	return &fieldAnalyzer{
+		analyzer: analyzer,
+		fields:   fields,
+	}, nil
+}
+
+type fieldAnalyzer struct {
+	analyzer Analyzer
+	fields   []*analyzerField
+}
+
+func (a *fieldAnalyzer) Analyze(text []string) ([]string, [][]types.AnalyzedToken) {
+	filtered, tokens := a.analyzer.Analyze(text)
+	for _, field := range a.fields {
+		_, fieldTokens := field.analyzer.Analyze(text)
+		for i := range tokens {
+			for _, token := range fieldTokens[i] {
+				token.Text = fieldToken(field.name, token.Text)
+				token.Field = field.name
+				tokens[i] = append(tokens[i], token)
+			}
+		}
+	}
+	return filtered, tokens
+}
+
+// 副フィールドのクエリは重みを掛けてスコアを低くする。
+// n-gramなどは一部のトークンだけを含むドキュメントも一致させ、含むトークンが多いほど高くする
+func (a *fieldAnalyzer) AnalyzeQuery(text string) []types.Query {
+	queries := a.analyzer.AnalyzeQuery(text)
+	for _, field := range a.fields {
+		if field.prefix {
+			continue
+		}
+		for _, query := range field.analyzer.AnalyzeQuery(text) {
+			tokens := make([]string, len(query.Tokens))
+			fields := make([]string, len(query.Tokens))
+			for i, token := range query.Tokens {
+				tokens[i] = fieldToken(field.name, token)
+				fields[i] = field.name
+			}
+			queries = append(queries, types.Query{Tokens: tokens, Fields: fields, Weight: query.Weight * field.weight, Any: true})
+		}
+	}
+	return queries
+}
+
+// 通常のクエリに加えて、最後のトークンを前方一致用の副フィールドに置き換えたクエリを返す
+func (a *fieldAnalyzer) AnalyzePrefixQuery(text string) []types.Query {
+	queries := a.AnalyzeQuery(text)
+	for _, field := range a.fields {
+		if !field.prefix {
+			continue
+		}
+		for _, query := range a.analyzer.AnalyzeQuery(text) {
+			tokens := append([]string{}, query.Tokens...)
+			tokens[len(tokens)-1] = fieldToken(field.name, tokens[len(tokens)-1])
+			fields := make([]string, len(tokens))
+			fields[len(fields)-1] = field.name
+			queries = append(queries, types.Query{Tokens: tokens, Fields: fields, Weight: query.Weight * field.weight})
+		}
+	}
+	return queries
+}
+
+func (a *fieldAnalyzer) Version() string {
+	versions := []string{a.analyzer.Version()}
+	for _, field := range a.fields {
+		versions = append(versions, field.name+"="+field.analyzer.Version())
+	}
+	return fingerprint([]byte(strings.Join(versions, ",")))
+}
+
+func fieldToken(field string, token string) string {
+	return field + ":" + token
+}
+
+// en-US、ja_JPなどを言語コードだけにする
+func normalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+	switch lang {
+	case "nb", "nn":
+		return "no"
+	}
+	return lang
+}
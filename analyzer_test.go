@@ -0,0 +1,219 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/mock"
+	"github.com/hrntknr/searcher/types"
+)
+
+// 文字列だけのトークンをモックの戻り値にする
+func textTerms(tokens [][]string) [][]types.Term {
+	terms := make([][]types.Term, len(tokens))
+	for i, tokens := range tokens {
+		terms[i] = make([]types.Term, len(tokens))
+		for j, token := range tokens {
+			terms[i][j] = types.Term{Text: token, Surface: token, Reading: token, Position: j}
+		}
+	}
+	return terms
+}
+
+func TestAnalyzer(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	charFilter := mock.NewMockCharFilter(ctrl)
+	wordFilter := mock.NewMockWordFilter(ctrl)
+	gomock.InOrder(
+		charFilter.EXPECT().Filter([]string{":)"}).Return([]string{"happy"}),
+		tokenizer.EXPECT().Analyze([]string{"happy"}).Return(textTerms([][]string{{"happy"}})),
+		wordFilter.EXPECT().Filter([][]string{{"happy"}}).Return([][]string{{"happi"}}),
+	)
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{charFilter}, []TermFilter{}, []WordFilter{wordFilter})
+
+	text, tokens := analyzer.Analyze([]string{":)"})
+	if diff := cmp.Diff([]string{"happy"}, text); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([][]types.AnalyzedToken{{{Text: "happi"}}}, tokens); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAnalyzerTermFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	wordFilter := mock.NewMockWordFilter(ctrl)
+	gomock.InOrder(
+		tokenizer.EXPECT().Analyze([]string{"これは"}).Return([][]types.Term{{
+			{Text: "コレ", POS: []string{"名詞", "代名詞", "一般"}},
+			{Text: "ハ", POS: []string{"助詞", "係助詞"}, Position: 1},
+		}}),
+		wordFilter.EXPECT().Filter([][]string{{"コレ"}}).Return([][]string{{"コレ"}}),
+	)
+	posFilter, _ := newPOSFilter([]string{}, []string{"助詞"})
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{posFilter}, []WordFilter{wordFilter})
+
+	_, tokens := analyzer.Analyze([]string{"これは"})
+	if diff := cmp.Diff([][]types.AnalyzedToken{{{Text: "コレ"}}}, tokens); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAnalyzerPositions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	wordFilter := mock.NewMockWordFilter(ctrl)
+	wordFilter.EXPECT().Filter([][]string{{"橋"}, {"ハシ"}, {"ヲ"}, {"渡っ"}, {"渡る"}, {"ワタッ"}, {"タ"}}).Return(
+		[][]string{{"橋"}, {"ハシ"}, {}, {"渡っ"}, {"渡る"}, {"ワタッ"}, {"タ"}},
+	)
+	tokenizer, _ := newTokenizer("combined", "", "")
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{wordFilter})
+
+	// 同じ語の別の形は同じ位置になり、除いた語の位置は空く
+	_, tokens := analyzer.Analyze([]string{"橋を渡った"})
+	if diff := cmp.Diff([][]types.AnalyzedToken{{
+		{Text: "橋", Position: 0},
+		{Text: "ハシ", Position: 0},
+		{Text: "渡っ", Position: 2},
+		{Text: "渡る", Position: 2},
+		{Text: "ワタッ", Position: 2},
+		{Text: "タ", Position: 3},
+	}}, tokens); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAnalyzerQuery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	queryTokenizer := mock.NewMockTokenizer(ctrl)
+	queryTokenizer.EXPECT().Analyze([]string{"はし"}).Return(textTerms([][]string{{"ハシ"}}))
+
+	analyzer, _ := newAnalyzer(mock.NewMockTokenizer(ctrl), queryTokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+
+	if diff := cmp.Diff([]types.Query{{Tokens: []string{"ハシ"}, Weight: 1}}, analyzer.AnalyzeQuery("はし")); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAnalyzerVersion(t *testing.T) {
+	tokenizer, _ := newTokenizer("reading", "", "")
+	posFilter, _ := newPOSFilter(nil, []string{"助詞"})
+	otherPOSFilter, _ := newPOSFilter(nil, []string{"助詞", "記号"})
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer.ForQuery(), []CharFilter{}, []TermFilter{posFilter}, []WordFilter{})
+	same, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{posFilter}, []WordFilter{})
+	other, _ := newAnalyzer(tokenizer, tokenizer.ForQuery(), []CharFilter{}, []TermFilter{otherPOSFilter}, []WordFilter{})
+
+	// クエリ用のトークナイザはインデックスに影響しない
+	if diff := cmp.Diff(analyzer.Version(), same.Version()); diff != "" {
+		t.Errorf(diff)
+	}
+	if analyzer.Version() == other.Version() {
+		t.Errorf("version should change with filters")
+	}
+}
+
+func TestFieldAnalyzer(t *testing.T) {
+	tokenizer, _ := newTokenizer("surface", "", "")
+	ngramTokenizer, _ := newNgramTokenizer(2)
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	ngramAnalyzer, _ := newAnalyzer(ngramTokenizer, ngramTokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	fieldAnalyzer, err := newFieldAnalyzer(analyzer, []*analyzerField{
+		{name: "ngram", weight: 0.5, analyzer: ngramAnalyzer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, tokens := fieldAnalyzer.Analyze([]string{"東京タワー"})
+	if diff := cmp.Diff([]string{"東京タワー"}, text); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([][]string{{"東京", "タワー", "ngram:東京", "ngram:京タ", "ngram:タワ", "ngram:ワー"}}, tokenTexts(tokens)); diff != "" {
+		t.Errorf(diff)
+	}
+	// 副フィールドのトークンは長さに数えないように区別する
+	if diff := cmp.Diff(types.AnalyzedToken{Text: "ngram:京タ", Position: 1, Field: "ngram"}, tokens[0][3]); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		[]types.Query{
+			{Tokens: []string{"京", "タ"}, Weight: 1},
+			{Tokens: []string{"ngram:京タ"}, Fields: []string{"ngram"}, Weight: 0.5, Any: true},
+		},
+		fieldAnalyzer.AnalyzeQuery("京タ"),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if fieldAnalyzer.Version() == analyzer.Version() {
+		t.Errorf("version should change with fields")
+	}
+
+	if _, err := newFieldAnalyzer(analyzer, []*analyzerField{{name: "a:b", analyzer: ngramAnalyzer}}); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestFieldAnalyzerPrefix(t *testing.T) {
+	tokenizer, _ := newTokenizer("reading", "", "")
+	edgeNgramFilter, _ := newEdgeNgramFilter(1, 10)
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	edgeAnalyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{edgeNgramFilter})
+	fieldAnalyzer, _ := newFieldAnalyzer(analyzer, []*analyzerField{
+		{name: "edge", weight: 0.8, analyzer: edgeAnalyzer, prefix: true},
+	})
+
+	_, tokens := fieldAnalyzer.Analyze([]string{"東京タワー"})
+	if diff := cmp.Diff(
+		[][]string{{"トウキョウ", "タワー", "edge:ト", "edge:トウ", "edge:トウキ", "edge:トウキョ", "edge:トウキョウ", "edge:タ", "edge:タワ", "edge:タワー"}},
+		tokenTexts(tokens),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 前方一致用のフィールドは通常のクエリには使わない
+	if diff := cmp.Diff(
+		[]types.Query{{Tokens: []string{"トウキョウ", "タ"}, Weight: 1}},
+		fieldAnalyzer.AnalyzeQuery("東京タ"),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// 入力途中の「東京タ」で「東京タワー」に一致する
+	if diff := cmp.Diff(
+		[]types.Query{
+			{Tokens: []string{"トウキョウ", "タ"}, Weight: 1},
+			{Tokens: []string{"トウキョウ", "edge:タ"}, Fields: []string{"", "edge"}, Weight: 0.8},
+		},
+		fieldAnalyzer.AnalyzePrefixQuery("東京タ"),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		[]types.Query{{Tokens: []string{"トウキョウ"}, Weight: 1}},
+		analyzer.AnalyzePrefixQuery("東京"),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	for lang, expected := range map[string]string{
+		"ja":    "ja",
+		"en-US": "en",
+		"ja_JP": "ja",
+		" DE ":  "de",
+		"nb-NO": "no",
+		"":      "",
+	} {
+		if diff := cmp.Diff(expected, normalizeLanguage(lang)); diff != "" {
+			t.Errorf("%q: %s", lang, diff)
+		}
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
-import "strings"
+import (
+	"html"
+	"strings"
+
+	"github.com/hrntknr/searcher/types"
+)
 
 type CharFilter interface {
 	Filter([]string) []string
 }
 
+type HTMLFilter interface {
+	CharFilter
+	// タイトル、meta description、見出し、本文のブロックを抽出
+	Extract(body string) *types.HTMLDocument
+}
+
 func newMappingCharFilter(mapper map[string]string) (*mappingCharFilter, error) {
 	return &mappingCharFilter{
 		mapper: mapper,
@@ -26,3 +37,234 @@ func (f *mappingCharFilter) Filter(str []string) []string {
 	}
 	return result
 }
+
+// 中身ごと捨てる要素
+var htmlRawTextElements = map[string]struct{}{
+	"script": {}, "style": {}, "noscript": {}, "template": {}, "textarea": {},
+}
+
+// ボイラープレートとして捨てる要素
+var htmlDropElements = map[string]struct{}{
+	"nav": {}, "aside": {}, "footer": {}, "iframe": {}, "svg": {}, "form": {}, "button": {}, "select": {},
+}
+
+// 文の区切りとして扱う要素
+var htmlBlockElements = map[string]struct{}{
+	"address": {}, "article": {}, "blockquote": {}, "br": {}, "caption": {}, "dd": {}, "details": {},
+	"div": {}, "dl": {}, "dt": {}, "fieldset": {}, "figcaption": {}, "figure": {}, "header": {},
+	"hr": {}, "li": {}, "main": {}, "ol": {}, "p": {}, "pre": {}, "section": {}, "summary": {},
+	"table": {}, "td": {}, "th": {}, "tr": {}, "ul": {}, "body": {}, "head": {}, "html": {},
+	"h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {}, "title": {},
+}
+
+var htmlHeadingElements = map[string]struct{}{
+	"h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+}
+
+func newHTMLStripCharFilter() (*htmlStripCharFilter, error) {
+	return &htmlStripCharFilter{}, nil
+}
+
+type htmlStripCharFilter struct {
+}
+
+// ブロック要素ごとに分割したテキストを返す
+func (f *htmlStripCharFilter) Filter(str []string) []string {
+	result := []string{}
+	for _, s := range str {
+		result = append(result, f.Extract(s).Blocks...)
+	}
+	return result
+}
+
+func (f *htmlStripCharFilter) Extract(body string) *types.HTMLDocument {
+	document := &types.HTMLDocument{
+		Headings: []string{},
+		Blocks:   []string{},
+	}
+	text := strings.Builder{}
+	capture := ""
+	dropDepth := 0
+
+	flush := func() {
+		str := normalizeHTMLText(text.String())
+		text.Reset()
+		if str == "" {
+			return
+		}
+		switch capture {
+		case "title":
+			if document.Title == "" {
+				document.Title = str
+			}
+		case "heading":
+			document.Headings = append(document.Headings, str)
+		default:
+			document.Blocks = append(document.Blocks, str)
+		}
+	}
+
+	for i := 0; i < len(body); {
+		if body[i] != '<' {
+			end := strings.IndexByte(body[i:], '<')
+			if end < 0 {
+				end = len(body) - i
+			}
+			if dropDepth == 0 {
+				text.WriteString(body[i : i+end])
+			}
+			i += end
+			continue
+		}
+		// コメント、doctype
+		if strings.HasPrefix(body[i:], "<!--") {
+			end := strings.Index(body[i+4:], "-->")
+			if end < 0 {
+				break
+			}
+			i += 4 + end + 3
+			continue
+		}
+		if strings.HasPrefix(body[i:], "<!") || strings.HasPrefix(body[i:], "<?") {
+			end := strings.IndexByte(body[i:], '>')
+			if end < 0 {
+				break
+			}
+			i += end + 1
+			continue
+		}
+
+		end := htmlTagEnd(body, i+1)
+		if end < 0 {
+			// タグとして閉じていないものは文字として扱う
+			if dropDepth == 0 {
+				text.WriteString(body[i:])
+			}
+			break
+		}
+		name, attrs, closing := parseHTMLTag(body[i+1 : end])
+		i = end + 1
+		if name == "" {
+			continue
+		}
+
+		if _, ok := htmlRawTextElements[name]; ok && !closing {
+			closeTag := strings.Index(strings.ToLower(body[i:]), "</"+name)
+			if closeTag < 0 {
+				break
+			}
+			i += closeTag
+			continue
+		}
+		if _, ok := htmlDropElements[name]; ok {
+			if closing {
+				if dropDepth > 0 {
+					dropDepth--
+				}
+			} else if !strings.HasSuffix(body[:end], "/") {
+				dropDepth++
+			}
+			continue
+		}
+		if dropDepth > 0 {
+			continue
+		}
+		if name == "html" && !closing {
+			document.Lang = attrs["lang"]
+		}
+		if name == "meta" && strings.ToLower(attrs["name"]) == "description" {
+			document.Description = strings.Join(strings.Fields(attrs["content"]), " ")
+			continue
+		}
+		if _, ok := htmlBlockElements[name]; !ok {
+			continue
+		}
+
+		flush()
+		if closing {
+			capture = ""
+			continue
+		}
+		if name == "title" {
+			capture = "title"
+		} else if _, ok := htmlHeadingElements[name]; ok {
+			capture = "heading"
+		} else {
+			capture = ""
+		}
+	}
+	flush()
+
+	return document
+}
+
+// 属性値のクォートを考慮してタグの終端を探す
+func htmlTagEnd(body string, start int) int {
+	var quote byte
+	for i := start; i < len(body); i++ {
+		switch {
+		case quote != 0:
+			if body[i] == quote {
+				quote = 0
+			}
+		case body[i] == '"' || body[i] == '\'':
+			quote = body[i]
+		case body[i] == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseHTMLTag(tag string) (string, map[string]string, bool) {
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+	tag = strings.TrimSuffix(tag, "/")
+	nameEnd := strings.IndexAny(tag, " \t\r\n/")
+	if nameEnd < 0 {
+		nameEnd = len(tag)
+	}
+	name := strings.ToLower(tag[:nameEnd])
+
+	attrs := map[string]string{}
+	rest := tag[nameEnd:]
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n/")
+		if rest == "" {
+			break
+		}
+		keyEnd := strings.IndexAny(rest, "= \t\r\n")
+		if keyEnd < 0 {
+			attrs[strings.ToLower(rest)] = ""
+			break
+		}
+		key := strings.ToLower(rest[:keyEnd])
+		rest = strings.TrimLeft(rest[keyEnd:], " \t\r\n")
+		if !strings.HasPrefix(rest, "=") {
+			attrs[key] = ""
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\r\n")
+		value := ""
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			valueEnd := strings.IndexByte(rest[1:], rest[0])
+			if valueEnd < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:1+valueEnd], rest[2+valueEnd:]
+			}
+		} else {
+			valueEnd := strings.IndexAny(rest, " \t\r\n")
+			if valueEnd < 0 {
+				valueEnd = len(rest)
+			}
+			value, rest = rest[:valueEnd], rest[valueEnd:]
+		}
+		attrs[key] = html.UnescapeString(value)
+	}
+	return name, attrs, closing
+}
+
+func normalizeHTMLText(str string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(str)), " ")
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
 )
 
 func TestMappingCharFilter(t *testing.T) {
@@ -18,3 +19,49 @@ func TestMappingCharFilter(t *testing.T) {
 		t.Errorf(diff)
 	}
 }
+
+func TestHTMLStripCharFilter(t *testing.T) {
+	filter, _ := newHTMLStripCharFilter()
+	actual := filter.Extract(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+	<title>桃 &amp; すもも</title>
+	<meta name="description" content="果物の&quot;説明&quot;">
+	<style>body { color: red; }</style>
+	<script>if (a < b) { alert("<p>"); }</script>
+</head>
+<body>
+	<nav><ul><li>ホーム</li><li>一覧</li></ul></nav>
+	<h1>すもも</h1>
+	<p>すもももももも<b>もものうち</b></p>
+	<div>猿も木から落ちる<br>桃栗三年柿八年</div>
+	<!-- <p>comment</p> -->
+	<footer>copyright</footer>
+</body>
+</html>`)
+
+	if diff := cmp.Diff(
+		&types.HTMLDocument{
+			Lang:        "ja",
+			Title:       "桃 & すもも",
+			Description: "果物の\"説明\"",
+			Headings:    []string{"すもも"},
+			Blocks:      []string{"すもももももももものうち", "猿も木から落ちる", "桃栗三年柿八年"},
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestHTMLStripCharFilterFilter(t *testing.T) {
+	filter, _ := newHTMLStripCharFilter()
+	actual := filter.Filter([]string{"<p>a&lt;b</p><p>c</p>"})
+
+	if diff := cmp.Diff(
+		[]string{"a<b", "c"},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type stats struct {
+	Documents uint
+	Tokens    uint
+	Postings  uint
+	Sentences uint
+	TopTerms  []struct {
+		Token         string
+		DocumentCount uint
+	}
+	StaleDocuments uint
+}
+
+type fsckReport struct {
+	OrphanPostings []struct {
+		TokenID    uint
+		DocumentID uint
+	}
+	DuplicateTokens []struct {
+		Token string
+		Count uint
+	}
+	TokenCountMismatches []struct {
+		DocumentID         uint
+		Uri                string
+		TokenCount         uint
+		SentenceTokenCount uint
+	}
+}
+
+type snapshotReport struct {
+	Documents uint
+	Tokens    uint
+	Postings  uint
+}
+
+type importReport struct {
+	Documents uint
+	Failures  []struct {
+		Line  uint
+		Uri   string
+		Error string
+	}
+}
+
+type dictionaryToken struct {
+	Surface  string
+	BaseForm string
+	Reading  string
+	POS      []string
+	User     bool
+}
+
+type compactReport struct {
+	Documents uint
+	Sentences uint
+	Postings  uint
+	Tokens    uint
+}
+
+func statsMain(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pTop := flags.Uint("top", 10, "Number of top terms")
+	pJson := flags.Bool("json", false, "Output raw JSON")
+	flags.Parse(args)
+
+	req, err := http.NewRequest("GET", *pHost+"/admin/stats?top="+strconv.FormatUint(uint64(*pTop), 10), nil)
+	if err != nil {
+		return err
+	}
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	if *pJson {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+	var s stats
+	if err := json.Unmarshal(body, &s); err != nil {
+		return err
+	}
+	return renderStats(os.Stdout, &s)
+}
+
+func renderStats(w io.Writer, s *stats) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "documents\t%d\n", s.Documents)
+	fmt.Fprintf(tw, "tokens\t%d\n", s.Tokens)
+	fmt.Fprintf(tw, "postings\t%d\n", s.Postings)
+	fmt.Fprintf(tw, "sentences\t%d\n", s.Sentences)
+	if s.StaleDocuments > 0 {
+		fmt.Fprintf(tw, "stale\t%d (run reindex)\n", s.StaleDocuments)
+	}
+	if len(s.TopTerms) > 0 {
+		fmt.Fprintln(tw, "\nTOKEN\tDOCUMENTS")
+		for _, term := range s.TopTerms {
+			fmt.Fprintf(tw, "%s\t%d\n", term.Token, term.DocumentCount)
+		}
+	}
+	return tw.Flush()
+}
+
+func deleteMain(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pUri := flags.String("uri", "", "URI of the document to delete")
+	flags.Parse(args)
+
+	if *pUri == "" {
+		return fmt.Errorf("Error: empty URI!\n")
+	}
+	return deleteDocument(*pHost, *pUri)
+}
+
+func reindexMain(args []string) error {
+	flags := flag.NewFlagSet("reindex", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	flags.Parse(args)
+
+	req, err := http.NewRequest("POST", *pHost+"/admin/reindex", nil)
+	if err != nil {
+		return err
+	}
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Documents uint `json:"documents"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+	fmt.Printf("reindexed %d documents\n", result.Documents)
+	return nil
+}
+
+func compactMain(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	flags.Parse(args)
+
+	req, err := http.NewRequest("POST", *pHost+"/admin/compact", nil)
+	if err != nil {
+		return err
+	}
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var report compactReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	return renderCompact(os.Stdout, &report)
+}
+
+func renderCompact(w io.Writer, report *compactReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "documents\t%d\n", report.Documents)
+	fmt.Fprintf(tw, "sentences\t%d\n", report.Sentences)
+	fmt.Fprintf(tw, "postings\t%d\n", report.Postings)
+	fmt.Fprintf(tw, "tokens\t%d\n", report.Tokens)
+	return tw.Flush()
+}
+
+// サーバーのインデックスのスナップショットをファイルに保存する
+func snapshotMain(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pOutput := flags.String("o", "", "Output file")
+	flags.Parse(args)
+
+	if *pOutput == "" {
+		return fmt.Errorf("Error: empty output file!\n")
+	}
+	req, err := http.NewRequest("POST", *pHost+"/admin/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, string(body))
+	}
+
+	// 途中で切れたファイルを残さないように、書き終わってから置き換える
+	file, err := ioutil.TempFile(filepath.Dir(*pOutput), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	size, err := io.Copy(file, resp.Body)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), *pOutput); err != nil {
+		return err
+	}
+	fmt.Printf("saved %d bytes to %s\n", size, *pOutput)
+	return nil
+}
+
+// スナップショットを空のインデックスに取り込む。取り込む前にサーバーがチェックサムを確かめる
+func restoreMain(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pFile := flags.String("file", "", "Snapshot file")
+	flags.Parse(args)
+
+	if *pFile == "" {
+		return fmt.Errorf("Error: empty snapshot file!\n")
+	}
+	file, err := os.Open(*pFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	req, err := http.NewRequest("POST", *pHost+"/admin/restore", file)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var report snapshotReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	return renderSnapshotReport(os.Stdout, &report)
+}
+
+func renderSnapshotReport(w io.Writer, report *snapshotReport) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "documents\t%d\n", report.Documents)
+	fmt.Fprintf(tw, "tokens\t%d\n", report.Tokens)
+	fmt.Fprintf(tw, "postings\t%d\n", report.Postings)
+	return tw.Flush()
+}
+
+// 全ドキュメントを1行1件のJSONで出力する。-oがなければ標準出力に書く
+func exportMain(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pOutput := flags.String("o", "", "Output file")
+	flags.Parse(args)
+
+	resp, err := http.Get(*pHost + "/export")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET /export: %s", string(body))
+	}
+	if *pOutput == "" {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	// 途中で切れたファイルを残さないように、書き終わってから置き換える
+	file, err := ioutil.TempFile(filepath.Dir(*pOutput), ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), *pOutput)
+}
+
+// エクスポートしたファイルをサーバーの今の設定で解析して登録する
+func importMain(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pFile := flags.String("file", "", "Export file")
+	flags.Parse(args)
+
+	if *pFile == "" {
+		return fmt.Errorf("Error: empty export file!\n")
+	}
+	file, err := os.Open(*pFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	req, err := http.NewRequest("POST", *pHost+"/import", file)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var report importReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	renderImportReport(os.Stdout, &report)
+	if len(report.Failures) > 0 {
+		return fmt.Errorf("import: %d documents skipped", len(report.Failures))
+	}
+	return nil
+}
+
+// 登録できなかった行を先に表示する
+func renderImportReport(w io.Writer, report *importReport) {
+	for _, failure := range report.Failures {
+		fmt.Fprintf(w, "line %d: %s: %s\n", failure.Line, failure.Uri, failure.Error)
+	}
+	fmt.Fprintf(w, "imported %d documents\n", report.Documents)
+}
+
+func fsckMain(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	flags.Parse(args)
+
+	req, err := http.NewRequest("GET", *pHost+"/admin/fsck", nil)
+	if err != nil {
+		return err
+	}
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var report fsckReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return err
+	}
+	if problems := renderFsck(os.Stdout, &report); problems > 0 {
+		return fmt.Errorf("fsck: %d problems found", problems)
+	}
+	return nil
+}
+
+// 見つかった問題の数を返す
+func renderFsck(w io.Writer, report *fsckReport) int {
+	for _, posting := range report.OrphanPostings {
+		fmt.Fprintf(w, "orphan posting: token=%d document=%d\n", posting.TokenID, posting.DocumentID)
+	}
+	for _, token := range report.DuplicateTokens {
+		fmt.Fprintf(w, "duplicate token: %q x%d\n", token.Token, token.Count)
+	}
+	for _, mismatch := range report.TokenCountMismatches {
+		fmt.Fprintf(w, "token count mismatch: id=%d uri=%s document=%d sentences=%d\n", mismatch.DocumentID, mismatch.Uri, mismatch.TokenCount, mismatch.SentenceTokenCount)
+	}
+	problems := len(report.OrphanPostings) + len(report.DuplicateTokens) + len(report.TokenCountMismatches)
+	if problems == 0 {
+		fmt.Fprintln(w, "ok")
+	}
+	return problems
+}
+
+// ユーザー辞書をサーバーの辞書と組み合わせてサンプルの文章を解析する
+func dictMain(args []string) error {
+	flags := flag.NewFlagSet("dict", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pFile := flags.String("file", "", "User dictionary file")
+	flags.Parse(args)
+
+	if *pFile == "" {
+		return fmt.Errorf("Error: empty user dictionary!\n")
+	}
+	userDictionary, err := ioutil.ReadFile(*pFile)
+	if err != nil {
+		return err
+	}
+	reqBody, err := json.Marshal(map[string]string{
+		"user_dictionary": string(userDictionary),
+		"text":            strings.Join(flags.Args(), " "),
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", *pHost+"/admin/dictionary/validate", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	var tokens []dictionaryToken
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return err
+	}
+	return renderDictionaryTokens(os.Stdout, tokens)
+}
+
+// ユーザー辞書の単語には*を付ける
+func renderDictionaryTokens(w io.Writer, tokens []dictionaryToken) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SURFACE\tBASE\tREADING\tPOS\tUSER")
+	for _, token := range tokens {
+		user := ""
+		if token.User {
+			user = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", token.Surface, token.BaseForm, token.Reading, strings.Join(token.POS, "-"), user)
+	}
+	return tw.Flush()
+}
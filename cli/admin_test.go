@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderStats(t *testing.T) {
+	var s stats
+	json.Unmarshal([]byte(`{"Documents":1,"Tokens":20,"Postings":300,"Sentences":4,"TopTerms":[{"Token":"スモモ","DocumentCount":1}]}`), &s)
+	buf := bytes.Buffer{}
+	renderStats(&buf, &s)
+
+	if diff := cmp.Diff(
+		`documents  1
+tokens     20
+postings   300
+sentences  4
+
+TOKEN  DOCUMENTS
+スモモ    1
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderCompact(t *testing.T) {
+	buf := bytes.Buffer{}
+	renderCompact(&buf, &compactReport{Sentences: 4, Postings: 3, Tokens: 2})
+
+	if diff := cmp.Diff(
+		`documents  0
+sentences  4
+postings   3
+tokens     2
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderSnapshotReport(t *testing.T) {
+	buf := bytes.Buffer{}
+	renderSnapshotReport(&buf, &snapshotReport{Documents: 12, Tokens: 300, Postings: 4000})
+
+	if diff := cmp.Diff(
+		`documents  12
+tokens     300
+postings   4000
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderImportReport(t *testing.T) {
+	var report importReport
+	json.Unmarshal([]byte(`{"Documents":2,"Failures":[{"Line":3,"Uri":"uri","Error":"unsupported language: de"}]}`), &report)
+	buf := bytes.Buffer{}
+	renderImportReport(&buf, &report)
+
+	if diff := cmp.Diff(
+		`line 3: uri: unsupported language: de
+imported 2 documents
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderFsck(t *testing.T) {
+	var report fsckReport
+	json.Unmarshal([]byte(`{"OrphanPostings":[{"TokenID":3,"DocumentID":5}],"DuplicateTokens":[{"Token":"モモ","Count":2}],"TokenCountMismatches":[{"DocumentID":1,"Uri":"uri","TokenCount":10,"SentenceTokenCount":7}]}`), &report)
+	buf := bytes.Buffer{}
+	problems := renderFsck(&buf, &report)
+
+	if diff := cmp.Diff(3, problems); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		`orphan posting: token=3 document=5
+duplicate token: "モモ" x2
+token count mismatch: id=1 uri=uri document=10 sentences=7
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	buf.Reset()
+	if diff := cmp.Diff(0, renderFsck(&buf, &fsckReport{})); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff("ok\n", buf.String()); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderDictionaryTokens(t *testing.T) {
+	buf := bytes.Buffer{}
+	renderDictionaryTokens(&buf, []dictionaryToken{
+		{Surface: "朝青龍", BaseForm: "朝青龍", Reading: "アサショウリュウ", POS: []string{"カスタム人名"}, User: true},
+		{Surface: "が", BaseForm: "が", Reading: "ガ", POS: []string{"助詞", "格助詞", "一般"}},
+	})
+
+	if diff := cmp.Diff(
+		`SURFACE  BASE  READING   POS        USER
+朝青龍      朝青龍   アサショウリュウ  カスタム人名     *
+が        が     ガ         助詞-格助詞-一般  
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
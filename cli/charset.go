@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+var metaCharsetRegexp = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-zA-Z0-9_\-:.]+)`)
+
+// レスポンスの文字コードを判定してUTF-8に変換する
+// Content-Type、<meta charset>、バイト列の順に判定する
+func decodeBody(body []byte, contentType string) (string, error) {
+	charset, err := detectCharset(body, contentType)
+	if err != nil {
+		return "", err
+	}
+	if charset == "utf-8" {
+		return string(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))), nil
+	}
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return "", fmt.Errorf("unsupported charset %q: %w", charset, err)
+	}
+	decoded, err := encoding.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func detectCharset(body []byte, contentType string) (string, error) {
+	if contentType != "" {
+		if _, params, err := mime.ParseMediaType(contentType); err == nil {
+			if charset, ok := params["charset"]; ok {
+				return normalizeCharset(charset)
+			}
+		}
+	}
+
+	head := body
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	if m := metaCharsetRegexp.FindSubmatch(head); m != nil {
+		return normalizeCharset(string(m[1]))
+	}
+
+	return sniffCharset(body)
+}
+
+func normalizeCharset(charset string) (string, error) {
+	encoding, err := htmlindex.Get(strings.Trim(charset, `"' `))
+	if err != nil {
+		return "", fmt.Errorf("unsupported charset %q", charset)
+	}
+	return htmlindex.Name(encoding)
+}
+
+func sniffCharset(body []byte) (string, error) {
+	if bytes.HasPrefix(body, []byte("\xef\xbb\xbf")) {
+		return "utf-8", nil
+	}
+	if bytes.Contains(body, []byte("\x1b$B")) || bytes.Contains(body, []byte("\x1b$@")) {
+		return "iso-2022-jp", nil
+	}
+	if utf8.Valid(body) {
+		return "utf-8", nil
+	}
+
+	sjis, sjisOk := scoreShiftJIS(body)
+	eucjp, eucjpOk := scoreEUCJP(body)
+	switch {
+	case sjisOk && eucjpOk:
+		if eucjp >= sjis {
+			return "euc-jp", nil
+		}
+		return "shift_jis", nil
+	case sjisOk:
+		return "shift_jis", nil
+	case eucjpOk:
+		return "euc-jp", nil
+	}
+	return "", fmt.Errorf("cannot determine charset")
+}
+
+// Shift_JISとして正しいバイト列か判定し、ひらがな・カタカナの数をスコアとして返す
+func scoreShiftJIS(body []byte) (int, bool) {
+	score := 0
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c < 0x80 || (0xa1 <= c && c <= 0xdf):
+		case (0x81 <= c && c <= 0x9f) || (0xe0 <= c && c <= 0xfc):
+			if i+1 >= len(body) {
+				return 0, false
+			}
+			d := body[i+1]
+			if d < 0x40 || d == 0x7f || d > 0xfc {
+				return 0, false
+			}
+			if c == 0x82 || c == 0x83 {
+				score++
+			}
+			i++
+		default:
+			return 0, false
+		}
+	}
+	return score, true
+}
+
+// EUC-JPとして正しいバイト列か判定し、ひらがな・カタカナの数をスコアとして返す
+func scoreEUCJP(body []byte) (int, bool) {
+	score := 0
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c < 0x80:
+		case c == 0x8e:
+			if i+1 >= len(body) || body[i+1] < 0xa1 || body[i+1] > 0xdf {
+				return 0, false
+			}
+			i++
+		case c == 0x8f:
+			if i+2 >= len(body) || body[i+1] < 0xa1 || body[i+2] < 0xa1 || body[i+1] == 0xff || body[i+2] == 0xff {
+				return 0, false
+			}
+			i += 2
+		case 0xa1 <= c && c <= 0xfe:
+			if i+1 >= len(body) || body[i+1] < 0xa1 || body[i+1] == 0xff {
+				return 0, false
+			}
+			if c == 0xa4 || c == 0xa5 {
+				score++
+			}
+			i++
+		default:
+			return 0, false
+		}
+	}
+	return score, true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/text/encoding/japanese"
+)
+
+const charsetTestText = "<html><body>すもももももももものうち。カタカナ</body></html>"
+
+func TestDecodeBodyContentType(t *testing.T) {
+	body, _ := japanese.ShiftJIS.NewEncoder().String(charsetTestText)
+	actual, err := decodeBody([]byte(body), "text/html; charset=Shift_JIS")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(charsetTestText, actual); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDecodeBodyMetaCharset(t *testing.T) {
+	text := `<html><head><meta http-equiv="Content-Type" content="text/html; charset=EUC-JP"></head>すもも</html>`
+	body, _ := japanese.EUCJP.NewEncoder().String(text)
+	actual, err := decodeBody([]byte(body), "text/html")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(text, actual); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDecodeBodySniff(t *testing.T) {
+	for _, encoding := range []struct {
+		name  string
+		bytes func(string) (string, error)
+	}{
+		{"utf-8", func(s string) (string, error) { return s, nil }},
+		{"shift_jis", japanese.ShiftJIS.NewEncoder().String},
+		{"euc-jp", japanese.EUCJP.NewEncoder().String},
+		{"iso-2022-jp", japanese.ISO2022JP.NewEncoder().String},
+	} {
+		body, _ := encoding.bytes(charsetTestText)
+		charset, err := detectCharset([]byte(body), "")
+		if err != nil {
+			t.Error(err)
+		}
+		if diff := cmp.Diff(encoding.name, charset); diff != "" {
+			t.Errorf(diff)
+		}
+		actual, err := decodeBody([]byte(body), "")
+		if err != nil {
+			t.Error(err)
+		}
+		if diff := cmp.Diff(charsetTestText, actual); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestDecodeBodyUnknown(t *testing.T) {
+	if _, err := decodeBody([]byte{0xff, 0xfe, 0x80, 0xff}, ""); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := decodeBody([]byte("test"), "text/html; charset=x-unknown"); err == nil {
+		t.Error("expected error")
+	}
+}
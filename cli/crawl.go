@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func crawlMain(args []string) error {
+	flags := flag.NewFlagSet("crawl", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pDepth := flags.Int("depth", 1, "Maximum link depth from the seed URLs")
+	pSameHost := flags.Bool("same-host", true, "Only follow links on the seed hosts")
+	pRobots := flags.Bool("robots", true, "Respect robots.txt")
+	pRate := flags.Duration("rate", time.Second, "Minimum interval between requests to the same host")
+	pConcurrency := flags.Int("concurrency", 4, "Number of concurrent fetches")
+	pState := flags.String("state", "", "Frontier file for resuming the crawl")
+	pUserAgent := flags.String("user-agent", "searcher", "User-Agent")
+	pRetries := flags.Int("retries", 3, "Number of retries for failed URLs")
+	include := stringsFlag{}
+	exclude := stringsFlag{}
+	flags.Var(&include, "include", "Regexp of paths to follow (repeatable)")
+	flags.Var(&exclude, "exclude", "Regexp of paths to skip (repeatable)")
+	flags.Parse(args)
+
+	frontier, err := newFrontier(*pState)
+	if err != nil {
+		return err
+	}
+	defer frontier.Close()
+
+	c, err := newCrawler(crawlerConfig{
+		Host:        *pHost,
+		UserAgent:   *pUserAgent,
+		MaxDepth:    *pDepth,
+		SameHost:    *pSameHost,
+		Robots:      *pRobots,
+		Interval:    *pRate,
+		Concurrency: *pConcurrency,
+		Retries:     *pRetries,
+		Include:     include,
+		Exclude:     exclude,
+	}, frontier)
+	if err != nil {
+		return err
+	}
+	if len(flags.Args()) == 0 && len(frontier.queue) == 0 {
+		return fmt.Errorf("Error: empty seed URL!\n")
+	}
+	return c.Crawl(flags.Args())
+}
+
+type crawlerConfig struct {
+	Host        string
+	UserAgent   string
+	MaxDepth    int
+	SameHost    bool
+	Robots      bool
+	Interval    time.Duration
+	Concurrency int
+	// 失敗したURLをやり直す回数。やり直しても失敗したURLは、次に再開したときにまたやり直す
+	Retries int
+	Include []string
+	Exclude []string
+}
+
+func newCrawler(config crawlerConfig, frontier *frontier) (*crawler, error) {
+	c := &crawler{
+		config:    config,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		frontier:  frontier,
+		seedHosts: map[string]struct{}{},
+		robots:    map[string]*hostRobots{},
+		limiter:   newHostLimiter(),
+		regist:    registHTML,
+	}
+	for _, pattern := range config.Include {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.include = append(c.include, r)
+	}
+	for _, pattern := range config.Exclude {
+		r, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		c.exclude = append(c.exclude, r)
+	}
+	return c, nil
+}
+
+type crawler struct {
+	config    crawlerConfig
+	client    *http.Client
+	frontier  *frontier
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	seedHosts map[string]struct{}
+
+	robotsLock sync.Mutex
+	robots     map[string]*hostRobots
+	limiter    *hostLimiter
+	regist     func(host string, uri string, page *page) ([]byte, error)
+}
+
+func (c *crawler) Crawl(seeds []string) error {
+	for _, seed := range seeds {
+		u, err := url.Parse(seed)
+		if err != nil {
+			return err
+		}
+		c.seedHosts[u.Host] = struct{}{}
+		if _, err := c.frontier.Push(u.String(), 0); err != nil {
+			return err
+		}
+	}
+	// 再開時はフロンティアに残っているURLのホストをシードとして扱う
+	for _, entry := range c.frontier.queue {
+		if u, err := url.Parse(entry.Url); err == nil {
+			c.seedHosts[u.Host] = struct{}{}
+		}
+	}
+
+	concurrency := c.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				entry, ok := c.frontier.Pop()
+				if !ok {
+					return
+				}
+				err := c.visit(entry)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				if err == nil || !retryable(err) {
+					err = c.frontier.Done(entry)
+				} else {
+					err = c.frontier.Retry(entry, entry.Retries < c.config.Retries)
+				}
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *crawler) visit(entry frontierEntry) error {
+	u, err := url.Parse(entry.Url)
+	if err != nil {
+		return err
+	}
+	interval := c.config.Interval
+	if c.config.Robots {
+		robots := c.robotsFor(u)
+		if !robots.Allowed(u.RequestURI()) {
+			return nil
+		}
+		if robots.crawlDelay > interval {
+			interval = robots.crawlDelay
+		}
+	}
+	c.limiter.Wait(u.Host, interval)
+
+	// リンクをたどるために本文が必要なので条件付きリクエストは使わない
+	page, err := fetchPage(c.client, u.String(), c.config.UserAgent, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := c.regist(c.config.Host, u.String(), page); err != nil {
+		return err
+	}
+	fmt.Println(u.String())
+
+	if entry.Depth >= c.config.MaxDepth {
+		return nil
+	}
+	for _, link := range extractLinks(page.Url, page.Body) {
+		if !c.follow(link) {
+			continue
+		}
+		if _, err := c.frontier.Push(link.String(), entry.Depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 登録しないContent-Typeや見つからないページは、やり直しても変わらない
+func retryable(err error) bool {
+	if errors.Is(err, errUnsupportedContentType) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return !status.permanent()
+	}
+	return true
+}
+
+func (c *crawler) follow(u *url.URL) bool {
+	if c.config.SameHost {
+		if _, ok := c.seedHosts[u.Host]; !ok {
+			return false
+		}
+	}
+	path := u.RequestURI()
+	for _, r := range c.exclude {
+		if r.MatchString(path) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, r := range c.include {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ホストごとのrobots.txt、取得はホストごとに一度だけ
+type hostRobots struct {
+	once   sync.Once
+	robots *robots
+}
+
+// ホストごとにrobots.txtを一度だけ取得する。取得できなければすべて許可する。
+// 取得中も他のホストのワーカーは止めない
+func (c *crawler) robotsFor(u *url.URL) *robots {
+	key := u.Scheme + "://" + u.Host
+	c.robotsLock.Lock()
+	entry, ok := c.robots[key]
+	if !ok {
+		entry = &hostRobots{}
+		c.robots[key] = entry
+	}
+	c.robotsLock.Unlock()
+	entry.once.Do(func() {
+		entry.robots = c.fetchRobots(key)
+	})
+	return entry.robots
+}
+
+func (c *crawler) fetchRobots(key string) *robots {
+	r := &robots{rules: []robotsRule{}}
+	req, err := http.NewRequest("GET", key+"/robots.txt", nil)
+	if err != nil {
+		return r
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return r
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return r
+	}
+	if parsed, err := parseRobots(resp.Body, c.config.UserAgent); err == nil {
+		r = parsed
+	}
+	return r
+}
+
+var linkRegexp = regexp.MustCompile(`(?is)<a\s[^>]*?href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+func extractLinks(base *url.URL, body string) []*url.URL {
+	links := []*url.URL{}
+	for _, m := range linkRegexp.FindAllStringSubmatch(body, -1) {
+		href := html.UnescapeString(strings.TrimSpace(m[1] + m[2] + m[3]))
+		ref, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+		link := base.ResolveReference(ref)
+		if link.Scheme != "http" && link.Scheme != "https" {
+			continue
+		}
+		link.Fragment = ""
+		links = append(links, link)
+	}
+	return links
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{
+		next: map[string]time.Time{},
+	}
+}
+
+// ホストごとのリクエスト間隔を制御する
+type hostLimiter struct {
+	lock sync.Mutex
+	next map[string]time.Time
+}
+
+func (l *hostLimiter) Wait(host string, interval time.Duration) {
+	l.lock.Lock()
+	now := time.Now()
+	at := l.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[host] = at.Add(interval)
+	l.lock.Unlock()
+	time.Sleep(time.Until(at))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExtractLinks(t *testing.T) {
+	base, _ := url.Parse("http://example.com/dir/index.html")
+	links := extractLinks(base, `<a href="a.html#top">a</a><A class="x" HREF='/b?x=1&amp;y=2'>b</A><a href=mailto:test@example.com>m</a>`)
+
+	actual := []string{}
+	for _, link := range links {
+		actual = append(actual, link.String())
+	}
+	if diff := cmp.Diff(
+		[]string{"http://example.com/dir/a.html", "http://example.com/b?x=1&y=2"},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestCrawl(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/a">a</a><a href="/private">p</a><a href="/skip/x">s</a><a href="http://other.example.com/">o</a>`)
+	})
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/b">b</a><a href="/">top</a>`)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/c">c</a>`)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	frontier, _ := newFrontier("")
+	c, _ := newCrawler(crawlerConfig{
+		MaxDepth:    2,
+		SameHost:    true,
+		Robots:      true,
+		Concurrency: 2,
+		Exclude:     []string{"^/skip/"},
+	}, frontier)
+	registered := []string{}
+	lock := sync.Mutex{}
+	c.regist = func(host string, uri string, page *page) ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		registered = append(registered, uri)
+		return nil, nil
+	}
+
+	if err := c.Crawl([]string{server.URL + "/"}); err != nil {
+		t.Error(err)
+	}
+	sort.Strings(registered)
+	if diff := cmp.Diff(
+		[]string{server.URL + "/", server.URL + "/a", server.URL + "/b"},
+		registered,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestCrawlRetry(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<a href="/flaky">f</a><a href="/down">d</a><a href="/missing">m</a><a href="/image.png">i</a><a href="/robots.txt">r</a>`)
+	})
+	flaky := 0
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if flaky++; flaky == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "flaky")
+	})
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x89, 'P', 'N', 'G'})
+	})
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, "User-agent: *\n")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+	frontier, _ := newFrontier(path)
+	c, _ := newCrawler(crawlerConfig{
+		MaxDepth:    1,
+		SameHost:    true,
+		Concurrency: 1,
+		Retries:     2,
+	}, frontier)
+	registered := []string{}
+	c.regist = func(host string, uri string, page *page) ([]byte, error) {
+		registered = append(registered, uri)
+		return nil, nil
+	}
+	if err := c.Crawl([]string{server.URL + "/"}); err != nil {
+		t.Error(err)
+	}
+	frontier.Close()
+	// HTMLとテキストだけを登録し、一時的に失敗したページはやり直す
+	sort.Strings(registered)
+	if diff := cmp.Diff(
+		[]string{server.URL + "/", server.URL + "/flaky", server.URL + "/robots.txt"},
+		registered,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// やり直しても失敗したページだけが未処理のまま残る
+	frontier, _ = newFrontier(path)
+	defer frontier.Close()
+	if diff := cmp.Diff(
+		[]frontierEntry{{Url: server.URL + "/down", Depth: 1, Retries: 3}},
+		frontier.queue,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRobotsForSlowHost(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+	}))
+	defer fast.Close()
+
+	frontier, _ := newFrontier("")
+	c, _ := newCrawler(crawlerConfig{}, frontier)
+	slowURL, _ := url.Parse(slow.URL + "/")
+	fastURL, _ := url.Parse(fast.URL + "/")
+
+	done := make(chan *robots, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- c.robotsFor(slowURL)
+		}()
+	}
+	// 遅いホストの取得中でも他のホストは待たない
+	if c.robotsFor(fastURL).Allowed("/private") {
+		t.Error("fast host: /private should be disallowed")
+	}
+	close(release)
+	// 同じホストは一度だけ取得して、待っていた方も同じ結果を使う
+	if first, second := <-done, <-done; first != second || first.Allowed("/") {
+		t.Error("slow host: robots.txt should be shared and disallow /")
+	}
+}
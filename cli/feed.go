@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// 入れ子になったサイトマップインデックスをたどる上限
+const maxSitemapDepth = 5
+
+func feedMain(args []string) error {
+	flags := flag.NewFlagSet("feed", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pRate := flags.Duration("rate", time.Second, "Minimum interval between requests to the same host")
+	pUserAgent := flags.String("user-agent", "searcher", "User-Agent")
+	pForce := flags.Bool("force", false, "Register entries even if they have not changed")
+	flags.Parse(args)
+
+	if len(flags.Args()) == 0 {
+		return fmt.Errorf("Error: empty sitemap or feed URL!\n")
+	}
+
+	f := &feeder{
+		host:      *pHost,
+		userAgent: *pUserAgent,
+		interval:  *pRate,
+		force:     *pForce,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		limiter:   newHostLimiter(),
+		regist:    registHTML,
+	}
+	for _, feedUrl := range flags.Args() {
+		entries, err := f.entries(feedUrl, 0)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := f.visit(entry); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	return nil
+}
+
+type feedEntry struct {
+	Url     string
+	Updated time.Time
+}
+
+type feeder struct {
+	host      string
+	userAgent string
+	interval  time.Duration
+	force     bool
+	client    *http.Client
+	limiter   *hostLimiter
+	regist    func(host string, uri string, page *page) ([]byte, error)
+}
+
+// サイトマップ、RSS、Atomからエントリを取り出す。サイトマップインデックスは再帰的にたどる
+func (f *feeder) entries(feedUrl string, depth int) ([]feedEntry, error) {
+	body, err := f.get(feedUrl)
+	if err != nil {
+		return nil, err
+	}
+	document, err := parseFeed(body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", feedUrl, err)
+	}
+
+	entries := document.entries()
+	if len(document.Sitemaps) > 0 {
+		if depth >= maxSitemapDepth {
+			return nil, fmt.Errorf("%s: sitemap index nested too deeply", feedUrl)
+		}
+		for _, sitemap := range document.Sitemaps {
+			children, err := f.entries(strings.TrimSpace(sitemap.Loc), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, children...)
+		}
+	}
+	return entries, nil
+}
+
+func (f *feeder) get(rawurl string) ([]byte, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	f.limiter.Wait(u.Host, f.interval)
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", rawurl, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// sitemap.xml.gz
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return body, nil
+}
+
+func (f *feeder) visit(entry feedEntry) error {
+	var indexed *indexed
+	if !f.force {
+		_indexed, err := indexedDocument(f.host, entry.Url)
+		if err != nil {
+			return err
+		}
+		if _indexed != nil && !entry.Updated.IsZero() && !entry.Updated.After(_indexed.Time) {
+			return nil
+		}
+		indexed = _indexed
+	}
+
+	u, err := url.Parse(entry.Url)
+	if err != nil {
+		return err
+	}
+	f.limiter.Wait(u.Host, f.interval)
+	page, err := fetchPage(f.client, entry.Url, f.userAgent, indexed)
+	if err == errNotModified {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.regist(f.host, entry.Url, page); err != nil {
+		return err
+	}
+	fmt.Println(entry.Url)
+	return nil
+}
+
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod"`
+}
+
+type rssItem struct {
+	Link    string `xml:"link"`
+	PubDate string `xml:"pubDate"`
+	Date    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomEntry struct {
+	Links     []atomLink `xml:"link"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+}
+
+// urlset、sitemapindex、rss、rdf:RDF、feedのいずれかのルート要素に対応する
+type feedDocument struct {
+	XMLName  xml.Name
+	Urls     []sitemapEntry `xml:"url"`
+	Sitemaps []sitemapEntry `xml:"sitemap"`
+	Channel  struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func parseFeed(body []byte) (*feedDocument, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		encoding, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return encoding.NewDecoder().Reader(input), nil
+	}
+	var document feedDocument
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	switch document.XMLName.Local {
+	case "urlset", "sitemapindex", "rss", "RDF", "feed":
+	default:
+		return nil, fmt.Errorf("unknown feed format <%s>", document.XMLName.Local)
+	}
+	return &document, nil
+}
+
+func (d *feedDocument) entries() []feedEntry {
+	entries := []feedEntry{}
+	for _, u := range d.Urls {
+		entries = append(entries, feedEntry{Url: strings.TrimSpace(u.Loc), Updated: parseFeedTime(u.Lastmod)})
+	}
+	for _, item := range append(d.Channel.Items, d.Items...) {
+		updated := parseFeedTime(item.PubDate)
+		if updated.IsZero() {
+			updated = parseFeedTime(item.Date)
+		}
+		entries = append(entries, feedEntry{Url: strings.TrimSpace(item.Link), Updated: updated})
+	}
+	for _, entry := range d.Entries {
+		link := ""
+		for _, l := range entry.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				link = l.Href
+				break
+			}
+		}
+		if link == "" {
+			continue
+		}
+		updated := parseFeedTime(entry.Updated)
+		if updated.IsZero() {
+			updated = parseFeedTime(entry.Published)
+		}
+		entries = append(entries, feedEntry{Url: strings.TrimSpace(link), Updated: updated})
+	}
+	return entries
+}
+
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	time.RFC822Z,
+	time.RFC822,
+}
+
+// 解釈できない日時はゼロ値として扱い、常に登録する
+func parseFeedTime(str string) time.Time {
+	str = strings.TrimSpace(str)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseFeedSitemap(t *testing.T) {
+	document, err := parseFeed([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://example.com/a</loc><lastmod>2021-05-01</lastmod></url>
+	<url><loc> http://example.com/b </loc></url>
+</urlset>`))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]feedEntry{
+			{Url: "http://example.com/a", Updated: time.Date(2021, time.May, 1, 0, 0, 0, 0, time.UTC)},
+			{Url: "http://example.com/b"},
+		},
+		document.entries(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestParseFeedRSS(t *testing.T) {
+	document, err := parseFeed([]byte(`<?xml version="1.0"?>
+<rss version="2.0"><channel>
+	<item><link>http://example.com/a</link><pubDate>Sat, 01 May 2021 10:00:00 +0000</pubDate></item>
+</channel></rss>`))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]feedEntry{
+			{Url: "http://example.com/a", Updated: time.Date(2021, time.May, 1, 10, 0, 0, 0, time.UTC)},
+		},
+		document.entries(),
+		cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) }),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestParseFeedAtom(t *testing.T) {
+	document, err := parseFeed([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<entry>
+		<link rel="edit" href="http://example.com/edit/a"/>
+		<link rel="alternate" href="http://example.com/a"/>
+		<updated>2021-05-01T10:00:00Z</updated>
+	</entry>
+</feed>`))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]feedEntry{
+			{Url: "http://example.com/a", Updated: time.Date(2021, time.May, 1, 10, 0, 0, 0, time.UTC)},
+		},
+		document.entries(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestParseFeedUnknown(t *testing.T) {
+	if _, err := parseFeed([]byte(`<html></html>`)); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFeeder(t *testing.T) {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sitemap_index.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<sitemapindex><sitemap><loc>%s/sitemap.xml.gz</loc></sitemap></sitemapindex>`, server.URL)
+	})
+	mux.HandleFunc("/sitemap.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		fmt.Fprintf(gz, `<urlset>
+			<url><loc>%[1]s/old</loc><lastmod>2021-01-01</lastmod></url>
+			<url><loc>%[1]s/new</loc><lastmod>2021-06-01</lastmod></url>
+			<url><loc>%[1]s/unknown</loc></url>
+		</urlset>`, server.URL)
+		gz.Close()
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/document", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Time":"2021-03-01T00:00:00Z"}`)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<p>page</p>")
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	registered := []string{}
+	f := &feeder{
+		host:    server.URL,
+		client:  http.DefaultClient,
+		limiter: newHostLimiter(),
+		regist: func(host string, uri string, page *page) ([]byte, error) {
+			registered = append(registered, uri)
+			return nil, nil
+		},
+	}
+	entries, err := f.entries(server.URL+"/sitemap_index.xml", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, entry := range entries {
+		if err := f.visit(entry); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if diff := cmp.Diff(
+		[]string{server.URL + "/new", server.URL + "/unknown"},
+		registered,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+type frontierEntry struct {
+	Url   string `json:"url"`
+	Depth int    `json:"depth"`
+	Done  bool   `json:"done,omitempty"`
+	// 失敗した回数
+	Retries int `json:"retries,omitempty"`
+}
+
+// 重複排除付きのクロールキュー
+// pathを指定した場合は追記形式でディスクに保存し、再開時に未処理のURLから続きを行う
+type frontier struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	seen     map[string]struct{}
+	queue    []frontierEntry
+	inflight int
+	file     *os.File
+	encoder  *json.Encoder
+}
+
+func newFrontier(path string) (*frontier, error) {
+	f := &frontier{
+		seen:  map[string]struct{}{},
+		queue: []frontierEntry{},
+	}
+	f.cond = sync.NewCond(&f.lock)
+	if path == "" {
+		return f, nil
+	}
+
+	if err := f.load(path); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.file = file
+	f.encoder = json.NewEncoder(file)
+	return f, nil
+}
+
+func (f *frontier) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := []frontierEntry{}
+	positions := map[string]int{}
+	done := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry frontierEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// 書き込み途中で落ちた行は無視する
+			continue
+		}
+		if entry.Done {
+			done[entry.Url] = struct{}{}
+			continue
+		}
+		// 失敗した回数は後から書いた行のものを使う
+		if i, ok := positions[entry.Url]; ok {
+			entries[i].Retries = entry.Retries
+			continue
+		}
+		f.seen[entry.Url] = struct{}{}
+		positions[entry.Url] = len(entries)
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := done[entry.Url]; !ok {
+			f.queue = append(f.queue, entry)
+		}
+	}
+	return nil
+}
+
+// 未訪問のURLであればキューに追加する
+func (f *frontier) Push(url string, depth int) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.seen[url]; ok {
+		return false, nil
+	}
+	entry := frontierEntry{Url: url, Depth: depth}
+	if f.encoder != nil {
+		if err := f.encoder.Encode(entry); err != nil {
+			return false, err
+		}
+	}
+	f.seen[url] = struct{}{}
+	f.queue = append(f.queue, entry)
+	f.cond.Signal()
+	return true, nil
+}
+
+// キューから取り出す。キューが空で処理中のものもなければfalseを返す
+func (f *frontier) Pop() (frontierEntry, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.queue) == 0 {
+		if f.inflight == 0 {
+			return frontierEntry{}, false
+		}
+		f.cond.Wait()
+	}
+	entry := f.queue[0]
+	f.queue = f.queue[1:]
+	f.inflight++
+	return entry, true
+}
+
+func (f *frontier) Done(entry frontierEntry) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inflight--
+	f.cond.Broadcast()
+	if f.encoder != nil {
+		entry.Done = true
+		if err := f.encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 失敗したURLを未処理のまま残し、失敗した回数を記録する。requeueならキューの最後に戻してもう一度試す
+func (f *frontier) Retry(entry frontierEntry, requeue bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.inflight--
+	entry.Retries++
+	if requeue {
+		f.queue = append(f.queue, entry)
+	}
+	f.cond.Broadcast()
+	if f.encoder != nil {
+		if err := f.encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *frontier) Close() error {
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
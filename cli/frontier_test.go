@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFrontierResume(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "frontier")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontier.jsonl")
+
+	f, _ := newFrontier(path)
+	f.Push("http://example.com/", 0)
+	f.Push("http://example.com/a", 1)
+	f.Push("http://example.com/", 0)
+	entry, _ := f.Pop()
+	f.Done(entry)
+	f.Close()
+
+	f, _ = newFrontier(path)
+	defer f.Close()
+	if ok, _ := f.Push("http://example.com/", 0); ok {
+		t.Error("visited url was pushed again")
+	}
+	actual := []frontierEntry{}
+	for {
+		entry, ok := f.Pop()
+		if !ok {
+			break
+		}
+		actual = append(actual, entry)
+		f.Done(entry)
+	}
+
+	if diff := cmp.Diff(
+		[]frontierEntry{{Url: "http://example.com/a", Depth: 1}},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// globをパス全体にマッチする正規表現に変換する。"**"はディレクトリをまたぐ
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	buf := strings.Builder{}
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			buf.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+type globPattern struct {
+	regexp   *regexp.Regexp
+	anchored bool
+}
+
+// "/"を含まないパターンはファイル名に、含むパターンは相対パス全体にマッチする
+func newGlobPattern(glob string) (*globPattern, error) {
+	anchored := strings.Contains(strings.TrimSuffix(glob, "/"), "/")
+	r, err := globToRegexp(strings.TrimPrefix(glob, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return &globPattern{regexp: r, anchored: anchored}, nil
+}
+
+func (p *globPattern) Match(rel string) bool {
+	if p.anchored {
+		return p.regexp.MatchString(rel)
+	}
+	return p.regexp.MatchString(path.Base(rel))
+}
+
+type ignoreRule struct {
+	pattern *globPattern
+	negate  bool
+	dirOnly bool
+}
+
+// ディレクトリごとの.gitignoreを積み上げて判定する
+type gitignore struct {
+	// ルートからの相対パス -> そのディレクトリの.gitignoreのルール
+	rules map[string][]ignoreRule
+}
+
+func newGitignore() *gitignore {
+	return &gitignore{rules: map[string][]ignoreRule{}}
+}
+
+// dirにある.gitignoreを読み込み、そのディレクトリのルールを置き換える。relはルートからの相対パス
+func (g *gitignore) Load(dir string, rel string) error {
+	file, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		delete(g.rules, rel)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rules := []ignoreRule{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		pattern, err := newGlobPattern(line)
+		if err != nil {
+			continue
+		}
+		rule.pattern = pattern
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	g.rules[rel] = rules
+	return nil
+}
+
+// 浅いディレクトリのルールから順に見て、最後にマッチしたルールに従う
+func (g *gitignore) Ignored(rel string, isDir bool) bool {
+	ignored := false
+	parts := strings.Split(rel, "/")
+	for i := 0; i < len(parts); i++ {
+		base, sub := ".", rel
+		if i > 0 {
+			base = strings.Join(parts[:i], "/")
+			sub = strings.Join(parts[i:], "/")
+		}
+		for _, rule := range g.rules[base] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.Match(sub) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGlobPattern(t *testing.T) {
+	actual := map[string]bool{}
+	for _, c := range []struct {
+		glob string
+		path string
+	}{
+		{"*.md", "README.md"},
+		{"*.md", "docs/guide.md"},
+		{"docs/*.md", "docs/guide.md"},
+		{"docs/*.md", "docs/a/guide.md"},
+		{"docs/**/*.md", "docs/a/b/guide.md"},
+		{"**/vendor", "a/b/vendor"},
+		{"/build", "build"},
+		{"file?.txt", "file1.txt"},
+		{"[!a]*.txt", "a.txt"},
+	} {
+		pattern, err := newGlobPattern(c.glob)
+		if err != nil {
+			t.Error(err)
+		}
+		actual[c.glob+" "+c.path] = pattern.Match(c.path)
+	}
+
+	if diff := cmp.Diff(
+		map[string]bool{
+			"*.md README.md":                 true,
+			"*.md docs/guide.md":             true,
+			"docs/*.md docs/guide.md":        true,
+			"docs/*.md docs/a/guide.md":      false,
+			"docs/**/*.md docs/a/b/guide.md": true,
+			"**/vendor a/b/vendor":           true,
+			"/build build":                   true,
+			"file?.txt file1.txt":            true,
+			"[!a]*.txt a.txt":                false,
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gitignore")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("# comment\n*.log\n!keep.log\nbuild/\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", ".gitignore"), []byte("/local.txt\n"), 0644)
+
+	g := newGitignore()
+	g.Load(dir, ".")
+	g.Load(filepath.Join(dir, "sub"), "sub")
+
+	actual := map[string]bool{
+		"a.log":         g.Ignored("a.log", false),
+		"keep.log":      g.Ignored("keep.log", false),
+		"build":         g.Ignored("build", true),
+		"build file":    g.Ignored("build", false),
+		"sub/local.txt": g.Ignored("sub/local.txt", false),
+		"local.txt":     g.Ignored("local.txt", false),
+		"sub/x/a.log":   g.Ignored("sub/x/a.log", false),
+	}
+	if diff := cmp.Diff(
+		map[string]bool{
+			"a.log":         true,
+			"keep.log":      false,
+			"build":         true,
+			"build file":    false,
+			"sub/local.txt": true,
+			"local.txt":     false,
+			"sub/x/a.log":   true,
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// 読み直すとそのディレクトリのルールは置き換わる
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.tmp\n"), 0644)
+	g.Load(dir, ".")
+	g.Load(dir, ".")
+	os.Remove(filepath.Join(dir, "sub", ".gitignore"))
+	g.Load(filepath.Join(dir, "sub"), "sub")
+
+	actual = map[string]bool{
+		"a.log":         g.Ignored("a.log", false),
+		"a.tmp":         g.Ignored("a.tmp", false),
+		"sub/local.txt": g.Ignored("sub/local.txt", false),
+	}
+	if diff := cmp.Diff(
+		map[string]bool{
+			"a.log":         false,
+			"a.tmp":         true,
+			"sub/local.txt": false,
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(1, len(g.rules["."])); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -3,6 +3,9 @@ module github.com/hrntknr/searcher/cli
 go 1.16
 
 require (
-	github.com/k3a/html2text v1.0.7
-	github.com/smartystreets/goconvey v1.6.4 // indirect
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/google/go-cmp v0.5.5
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae // indirect
+	golang.org/x/text v0.3.4
 )
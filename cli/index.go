@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// 登録対象の拡張子。htmlはサーバー側で構造を解析する
+var indexExtensions = map[string]bool{
+	".html": true, ".htm": true,
+	".txt": false, ".md": false, ".markdown": false, ".rst": false, ".adoc": false, ".org": false,
+	".go": false, ".py": false, ".rb": false, ".js": false, ".ts": false, ".jsx": false, ".tsx": false,
+	".java": false, ".kt": false, ".scala": false, ".c": false, ".h": false, ".cc": false, ".cpp": false,
+	".hpp": false, ".rs": false, ".swift": false, ".php": false, ".sh": false, ".sql": false,
+	".yml": false, ".yaml": false, ".toml": false, ".json": false, ".xml": false, ".css": false,
+}
+
+func indexMain(args []string) error {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pWatch := flags.Bool("watch", false, "Watch for changes and keep the index up to date")
+	pGitignore := flags.Bool("gitignore", true, "Respect .gitignore files")
+	include := stringsFlag{}
+	exclude := stringsFlag{}
+	flags.Var(&include, "include", "Glob of files to index (repeatable)")
+	flags.Var(&exclude, "exclude", "Glob of files to skip (repeatable)")
+	flags.Parse(args)
+
+	if len(flags.Args()) == 0 {
+		return fmt.Errorf("Error: empty path!\n")
+	}
+
+	for _, root := range flags.Args() {
+		ix, err := newIndexer(*pHost, root, *pGitignore, include, exclude)
+		if err != nil {
+			return err
+		}
+		if err := ix.Walk(); err != nil {
+			return err
+		}
+		if *pWatch {
+			defer ix.Close()
+			go func() {
+				if err := ix.Watch(); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}()
+		}
+	}
+	if *pWatch {
+		select {}
+	}
+	return nil
+}
+
+func newIndexer(host string, root string, useGitignore bool, include []string, exclude []string) (*indexer, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	ix := &indexer{
+		host:         host,
+		root:         abs,
+		useGitignore: useGitignore,
+		gitignore:    newGitignore(),
+		indexed:      map[string]struct{}{},
+		registHTML:   registHTML,
+		regist:       regist,
+		delete:       deleteDocument,
+	}
+	for _, glob := range include {
+		pattern, err := newGlobPattern(glob)
+		if err != nil {
+			return nil, err
+		}
+		ix.include = append(ix.include, pattern)
+	}
+	for _, glob := range exclude {
+		pattern, err := newGlobPattern(glob)
+		if err != nil {
+			return nil, err
+		}
+		ix.exclude = append(ix.exclude, pattern)
+	}
+	return ix, nil
+}
+
+type indexer struct {
+	host         string
+	root         string
+	useGitignore bool
+	gitignore    *gitignore
+	include      []*globPattern
+	exclude      []*globPattern
+
+	lock    sync.Mutex
+	indexed map[string]struct{}
+	watcher *fsnotify.Watcher
+
+	registHTML func(host string, uri string, page *page) ([]byte, error)
+	regist     func(host string, uri string, body string) ([]byte, error)
+	delete     func(host string, uri string) error
+}
+
+func (ix *indexer) Walk() error {
+	return ix.walk(ix.root)
+}
+
+func (ix *indexer) walk(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if ix.skipDir(path) {
+				return filepath.SkipDir
+			}
+			if ix.useGitignore {
+				if err := ix.gitignore.Load(path, ix.rel(path)); err != nil {
+					return err
+				}
+			}
+			if ix.watcher != nil {
+				return ix.watcher.Add(path)
+			}
+			return nil
+		}
+		if !ix.target(path) {
+			return nil
+		}
+		if err := ix.registFile(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return nil
+	})
+}
+
+func (ix *indexer) rel(path string) string {
+	rel, err := filepath.Rel(ix.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (ix *indexer) skipDir(path string) bool {
+	if path == ix.root {
+		return false
+	}
+	if filepath.Base(path) == ".git" {
+		return true
+	}
+	rel := ix.rel(path)
+	if ix.useGitignore && ix.gitignore.Ignored(rel, true) {
+		return true
+	}
+	for _, pattern := range ix.exclude {
+		if pattern.Match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ix *indexer) target(path string) bool {
+	if _, ok := indexExtensions[strings.ToLower(filepath.Ext(path))]; !ok {
+		return false
+	}
+	rel := ix.rel(path)
+	if ix.useGitignore && ix.gitignore.Ignored(rel, false) {
+		return false
+	}
+	for _, pattern := range ix.exclude {
+		if pattern.Match(rel) {
+			return false
+		}
+	}
+	if len(ix.include) == 0 {
+		return true
+	}
+	for _, pattern := range ix.include {
+		if pattern.Match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func fileUri(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+func (ix *indexer) registFile(path string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// バイナリは登録しない
+	if bytes.IndexByte(body, 0) >= 0 {
+		return nil
+	}
+	decoded, err := decodeBody(body, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	uri := fileUri(path)
+	if indexExtensions[strings.ToLower(filepath.Ext(path))] {
+		_, err = ix.registHTML(ix.host, uri, &page{Body: decoded})
+	} else {
+		_, err = ix.regist(ix.host, uri, decoded)
+	}
+	if err != nil {
+		return err
+	}
+	ix.lock.Lock()
+	ix.indexed[path] = struct{}{}
+	ix.lock.Unlock()
+	fmt.Println(uri)
+	return nil
+}
+
+// 削除されたパス以下で登録済みのファイルをすべて削除する
+func (ix *indexer) removePath(path string) error {
+	ix.lock.Lock()
+	removed := []string{}
+	for indexed := range ix.indexed {
+		if indexed == path || strings.HasPrefix(indexed, path+string(filepath.Separator)) {
+			removed = append(removed, indexed)
+			delete(ix.indexed, indexed)
+		}
+	}
+	ix.lock.Unlock()
+
+	for _, path := range removed {
+		if err := ix.delete(ix.host, fileUri(path)); err != nil {
+			return err
+		}
+		fmt.Println("deleted", fileUri(path))
+	}
+	return nil
+}
+
+// inotifyで変更を監視する。書き込みが落ち着いてから再登録する
+func (ix *indexer) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	ix.watcher = watcher
+	if err := filepath.Walk(ix.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if ix.skipDir(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	}); err != nil {
+		return err
+	}
+
+	const debounce = 500 * time.Millisecond
+	timers := map[string]*time.Timer{}
+	ready := make(chan string)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			path := event.Name
+			if timer, ok := timers[path]; ok {
+				timer.Stop()
+			}
+			timers[path] = time.AfterFunc(debounce, func() {
+				ready <- path
+			})
+		case path := <-ready:
+			delete(timers, path)
+			if err := ix.sync(path); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// パスの現在の状態に合わせて登録、削除する
+func (ix *indexer) sync(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if filepath.Base(path) == ".gitignore" {
+			return ix.gitignore.Load(filepath.Dir(path), ix.rel(filepath.Dir(path)))
+		}
+		return ix.removePath(path)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return ix.walk(path)
+	}
+	if filepath.Base(path) == ".gitignore" {
+		return ix.gitignore.Load(filepath.Dir(path), ix.rel(filepath.Dir(path)))
+	}
+	if !ix.target(path) {
+		return nil
+	}
+	return ix.registFile(path)
+}
+
+func (ix *indexer) Close() error {
+	if ix.watcher != nil {
+		return ix.watcher.Close()
+	}
+	return nil
+}
+
+func regist(host string, uri string, body string) ([]byte, error) {
+	reqBody, err := json.Marshal(ReqBody{
+		Uri:  uri,
+		Body: body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		host+"/regist",
+		bytes.NewBuffer(reqBody),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(req)
+}
+
+func deleteDocument(host string, uri string) error {
+	req, err := http.NewRequest("DELETE", host+"/document?uri="+url.QueryEscape(uri), nil)
+	if err != nil {
+		return err
+	}
+	_, err = doRequest(req)
+	return err
+}
+
+type ReqBody struct {
+	Uri  string `json:"uri"`
+	Body string `json:"body"`
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIndexer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "index")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		".gitignore":        "ignored/\n",
+		"README.md":         "# searcher",
+		"docs/index.html":   "<p>html</p>",
+		"docs/draft.md":     "draft",
+		"src/main.go":       "package main",
+		"ignored/a.md":      "ignored",
+		".git/config":       "[core]",
+		"image.png":         "\x89PNG",
+		"docs/binary.txt":   "a\x00b",
+		"docs/sub/guide.md": "guide",
+	}
+	for name, body := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644)
+	}
+
+	ix, _ := newIndexer("", dir, true, nil, []string{"draft.md"})
+	registered := []string{}
+	deleted := []string{}
+	ix.regist = func(host string, uri string, body string) ([]byte, error) {
+		registered = append(registered, uri)
+		return nil, nil
+	}
+	ix.registHTML = func(host string, uri string, page *page) ([]byte, error) {
+		registered = append(registered, "html:"+uri)
+		return nil, nil
+	}
+	ix.delete = func(host string, uri string) error {
+		deleted = append(deleted, uri)
+		return nil
+	}
+	if err := ix.Walk(); err != nil {
+		t.Error(err)
+	}
+
+	sort.Strings(registered)
+	if diff := cmp.Diff(
+		[]string{
+			"file://" + filepath.ToSlash(dir) + "/README.md",
+			"file://" + filepath.ToSlash(dir) + "/docs/sub/guide.md",
+			"file://" + filepath.ToSlash(dir) + "/src/main.go",
+			"html:file://" + filepath.ToSlash(dir) + "/docs/index.html",
+		},
+		registered,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	os.RemoveAll(filepath.Join(dir, "docs"))
+	if err := ix.sync(filepath.Join(dir, "docs")); err != nil {
+		t.Error(err)
+	}
+	sort.Strings(deleted)
+	if diff := cmp.Diff(
+		[]string{
+			"file://" + filepath.ToSlash(dir) + "/docs/index.html",
+			"file://" + filepath.ToSlash(dir) + "/docs/sub/guide.md",
+		},
+		deleted,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
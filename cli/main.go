@@ -3,24 +3,69 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
-
-	"github.com/k3a/html2text"
+	"net/url"
+	"os"
+	"time"
 )
 
 func main() {
-	if err := _main(); err != nil {
-		panic(err)
+	if err := _main(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
-func _main() error {
-	pUrl := flag.String("url", "", "URL")
-	pHost := flag.String("host", "http://localhost:8080", "Host")
-	flag.Parse()
+func _main(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "crawl":
+			return crawlMain(args[1:])
+		case "sitemap", "feed":
+			return feedMain(args[1:])
+		case "recrawl":
+			return recrawlMain(args[1:])
+		case "index":
+			return indexMain(args[1:])
+		case "search":
+			return searchMain(args[1:])
+		case "repl":
+			return replMain(args[1:])
+		case "stats":
+			return statsMain(args[1:])
+		case "delete":
+			return deleteMain(args[1:])
+		case "reindex":
+			return reindexMain(args[1:])
+		case "fsck":
+			return fsckMain(args[1:])
+		case "compact":
+			return compactMain(args[1:])
+		case "snapshot":
+			return snapshotMain(args[1:])
+		case "restore":
+			return restoreMain(args[1:])
+		case "export":
+			return exportMain(args[1:])
+		case "import":
+			return importMain(args[1:])
+		case "dict":
+			return dictMain(args[1:])
+		}
+	}
+	return registMain(args)
+}
+
+func registMain(args []string) error {
+	flags := flag.NewFlagSet("regist", flag.ExitOnError)
+	pUrl := flags.String("url", "", "URL")
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	flags.Parse(args)
 	url := *pUrl
 	host := *pHost
 
@@ -28,52 +73,193 @@ func _main() error {
 		return fmt.Errorf("Error: empty URL!\n")
 	}
 
-	resp, err := http.Get(url)
+	indexed, err := indexedDocument(host, url)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	html, err := ioutil.ReadAll(resp.Body)
+	page, err := fetchPage(http.DefaultClient, url, "", indexed)
+	if err == errNotModified {
+		fmt.Println("not modified")
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	plain := html2text.HTML2Text(string(html))
 
-	body, err := json.Marshal(ReqBody{
-		Uri:  url,
-		Body: plain,
-	})
+	result, err := registHTML(host, url, page)
 	if err != nil {
 		return err
 	}
+	fmt.Print(string(result))
+	return nil
+}
+
+var (
+	errNotModified            = errors.New("not modified")
+	errUnsupportedContentType = errors.New("unsupported content type")
+)
+
+// 登録するContent-Type
+var fetchContentTypes = map[string]struct{}{
+	"text/html":  {},
+	"text/plain": {},
+}
+
+// 200と304以外のステータス
+type statusError struct {
+	url        string
+	status     string
+	statusCode int
+}
 
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %s", e.url, e.status)
+}
+
+// やり直しても結果が変わらないステータスならtrue
+func (e *statusError) permanent() bool {
+	return e.statusCode >= 400 && e.statusCode < 500 && e.statusCode != http.StatusTooManyRequests
+}
+
+type page struct {
+	Url          *url.URL
+	Body         string
+	ETag         string
+	LastModified string
+}
+
+// indexedを指定した場合は条件付きリクエストを送り、変更がなければerrNotModifiedを返す。
+// HTMLとテキスト以外は本文を読まずにerrUnsupportedContentTypeを返す
+func fetchPage(client *http.Client, rawurl string, userAgent string, indexed *indexed) (*page, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	if indexed != nil {
+		if indexed.ETag != "" {
+			req.Header.Set("If-None-Match", indexed.ETag)
+		}
+		if indexed.LastModified != "" {
+			req.Header.Set("If-Modified-Since", indexed.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{url: rawurl, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	// Content-Typeがなければ本文から判断する
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if _, ok := fetchContentTypes[mediaType]; err != nil || !ok {
+			return nil, fmt.Errorf("%s: %w: %s", rawurl, errUnsupportedContentType, contentType)
+		}
+	}
+
+	html, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType == "" {
+		mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(html))
+		if _, ok := fetchContentTypes[mediaType]; !ok {
+			return nil, fmt.Errorf("%s: %w: %s", rawurl, errUnsupportedContentType, mediaType)
+		}
+	}
+	decoded, err := decodeBody(html, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rawurl, err)
+	}
+	return &page{
+		Url:          resp.Request.URL,
+		Body:         decoded,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// サーバー側でHTMLの構造を解析するため、HTMLのまま登録する
+func registHTML(host string, uri string, page *page) ([]byte, error) {
+	query := url.Values{}
+	query.Set("uri", uri)
+	if page.ETag != "" {
+		query.Set("etag", page.ETag)
+	}
+	if page.LastModified != "" {
+		query.Set("last_modified", page.LastModified)
+	}
 	req, err := http.NewRequest(
 		"POST",
-		host+"/regist",
-		bytes.NewBuffer(body),
+		host+"/regist?"+query.Encode(),
+		bytes.NewBufferString(page.Body),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "text/html")
+	return doRequest(req)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	registResp, err := client.Do(req)
+// 変更がなかったドキュメントのインデックスした時刻を今にする
+func touchDocument(host string, uri string) error {
+	req, err := http.NewRequest("POST", host+"/touch?uri="+url.QueryEscape(uri), nil)
 	if err != nil {
 		return err
 	}
-	defer registResp.Body.Close()
+	_, err = doRequest(req)
+	return err
+}
+
+type indexed struct {
+	Time         time.Time
+	ETag         string
+	LastModified string
+}
 
-	result, err := ioutil.ReadAll(registResp.Body)
+// サーバーに登録済みのドキュメントを取得する。未登録ならnil
+func indexedDocument(host string, uri string) (*indexed, error) {
+	resp, err := http.Get(host + "/document?uri=" + url.QueryEscape(uri))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Print(string(result))
-	return nil
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /document: unexpected status %s", resp.Status)
+	}
+	var document indexed
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return nil, err
+	}
+	return &document, nil
 }
 
-type ReqBody struct {
-	Uri  string `json:"uri"`
-	Body string `json:"body"`
+func doRequest(req *http.Request) ([]byte, error) {
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, string(result))
+	}
+	return result, nil
 }
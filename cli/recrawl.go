@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func recrawlMain(args []string) error {
+	flags := flag.NewFlagSet("recrawl", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pAge := flags.Duration("age", 24*time.Hour, "Revisit documents indexed longer ago than this")
+	pInterval := flags.Duration("interval", 0, "Repeat the re-crawl at this interval (0 runs once)")
+	pRate := flags.Duration("rate", time.Second, "Minimum interval between requests to the same host")
+	pUserAgent := flags.String("user-agent", "searcher", "User-Agent")
+	flags.Parse(args)
+
+	r := &recrawler{
+		host:      *pHost,
+		userAgent: *pUserAgent,
+		interval:  *pRate,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		limiter:   newHostLimiter(),
+		regist:    registHTML,
+		touch:     touchDocument,
+	}
+	for {
+		if err := r.Recrawl(time.Now().Add(-*pAge)); err != nil {
+			return err
+		}
+		if *pInterval <= 0 {
+			return nil
+		}
+		time.Sleep(*pInterval)
+	}
+}
+
+type recrawler struct {
+	host      string
+	userAgent string
+	interval  time.Duration
+	client    *http.Client
+	limiter   *hostLimiter
+	regist    func(host string, uri string, page *page) ([]byte, error)
+	touch     func(host string, uri string) error
+}
+
+type indexedDocumentWithUri struct {
+	Uri string
+	indexed
+}
+
+// before より前にインデックスされたドキュメントを条件付きリクエストで再取得する
+func (r *recrawler) Recrawl(before time.Time) error {
+	// 再登録したドキュメントは一覧から外れるため、先に一覧を取り切る
+	documents := []indexedDocumentWithUri{}
+	const count = 100
+	for offset := 0; ; offset += count {
+		query := url.Values{}
+		query.Set("before", before.UTC().Format(time.RFC3339))
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("count", strconv.Itoa(count))
+		resp, err := http.Get(r.host + "/documents?" + query.Encode())
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET /documents: unexpected status %s", resp.Status)
+		}
+		page := []indexedDocumentWithUri{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		documents = append(documents, page...)
+		if len(page) < count {
+			break
+		}
+	}
+
+	for _, document := range documents {
+		document := document
+		if err := r.visit(document.Uri, &document.indexed); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	return nil
+}
+
+func (r *recrawler) visit(uri string, indexed *indexed) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	// ローカルファイルなどクロールで取得できないドキュメントは対象外
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil
+	}
+	r.limiter.Wait(u.Host, r.interval)
+	page, err := fetchPage(r.client, uri, r.userAgent, indexed)
+	if err == errNotModified {
+		// 時刻を更新しないと次の再クロールでも一覧に残り続ける
+		return r.touch(r.host, uri)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := r.regist(r.host, uri, page); err != nil {
+		return err
+	}
+	fmt.Println(uri)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRecrawl(t *testing.T) {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/documents", func(w http.ResponseWriter, r *http.Request) {
+		if diff := cmp.Diff("2021-05-01T00:00:00Z", r.URL.Query().Get("before")); diff != "" {
+			t.Errorf(diff)
+		}
+		fmt.Fprintf(w, `[
+			{"Uri":"%[1]s/unchanged","ETag":"\"v1\""},
+			{"Uri":"%[1]s/changed","ETag":"\"v1\""},
+			{"Uri":"%[1]s/modified-since","LastModified":"Sat, 01 May 2021 00:00:00 GMT"},
+			{"Uri":"file:///tmp/local.txt"}
+		]`, server.URL)
+	})
+	mux.HandleFunc("/unchanged", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "<p>unchanged</p>")
+	})
+	mux.HandleFunc("/changed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v2"`)
+		fmt.Fprint(w, "<p>changed</p>")
+	})
+	mux.HandleFunc("/modified-since", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "<p>modified</p>")
+	})
+	server = httptest.NewServer(mux)
+	defer server.Close()
+
+	registered := map[string]string{}
+	touched := []string{}
+	r := &recrawler{
+		host:    server.URL,
+		client:  http.DefaultClient,
+		limiter: newHostLimiter(),
+		regist: func(host string, uri string, page *page) ([]byte, error) {
+			registered[uri] = page.ETag
+			return nil, nil
+		},
+		touch: func(host string, uri string) error {
+			touched = append(touched, uri)
+			return nil
+		},
+	}
+	if err := r.Recrawl(time.Date(2021, time.May, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Error(err)
+	}
+
+	if diff := cmp.Diff(
+		map[string]string{server.URL + "/changed": `"v2"`},
+		registered,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		[]string{server.URL + "/unchanged", server.URL + "/modified-since"},
+		touched,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRecrawlDocumentsStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unknown index", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	r := &recrawler{
+		host:    server.URL,
+		client:  http.DefaultClient,
+		limiter: newHostLimiter(),
+	}
+	if err := r.Recrawl(time.Now()); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const replHelp = `:n, :next        next page
+:p, :prev        previous page
+:count N         results per page
+:json            toggle JSON output
+:history         show history
+!N               run the Nth query in history
+:q, :quit        quit`
+
+func replMain(args []string) error {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pCount := flags.Uint("count", 10, "Count")
+	pLang := flags.String("lang", "", "Analyze queries in this language (default: all languages)")
+	pPrefix := flags.Bool("prefix", false, "Match the last word as a prefix")
+	pHistory := flags.String("history", defaultHistoryPath(), "History file")
+	flags.Parse(args)
+
+	r := &repl{
+		host:        *pHost,
+		count:       *pCount,
+		lang:        *pLang,
+		prefix:      *pPrefix,
+		historyPath: *pHistory,
+		color:       isTerminal(os.Stdout),
+	}
+	if err := r.loadHistory(); err != nil {
+		return err
+	}
+
+	// 端末なら行編集と上下キーでの履歴を使う
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(int(os.Stdin.Fd()), state)
+		term := terminal.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "> ")
+		r.out = term
+		for {
+			line, err := term.ReadLine()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if quit := r.exec(line); quit {
+				return nil
+			}
+		}
+	}
+
+	r.out = os.Stdout
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if quit := r.exec(scanner.Text()); quit {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".searcher_history")
+}
+
+type repl struct {
+	host        string
+	count       uint
+	lang        string
+	prefix      bool
+	historyPath string
+	color       bool
+	json        bool
+	out         io.Writer
+
+	history []string
+	query   string
+	offset  uint
+}
+
+func (r *repl) loadHistory() error {
+	if r.historyPath == "" {
+		return nil
+	}
+	file, err := os.Open(r.historyPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *repl) appendHistory(query string) {
+	r.history = append(r.history, query)
+	if r.historyPath == "" {
+		return
+	}
+	file, err := os.OpenFile(r.historyPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, query)
+}
+
+// 1行を実行し、終了する場合はtrueを返す
+func (r *repl) exec(line string) bool {
+	line = strings.TrimSpace(line)
+	fields := strings.Fields(line)
+	switch {
+	case line == "":
+		return false
+	case line == ":q" || line == ":quit":
+		return true
+	case line == ":h" || line == ":help":
+		fmt.Fprintln(r.out, replHelp)
+		return false
+	case line == ":n" || line == ":next":
+		if r.query == "" {
+			return false
+		}
+		r.offset += r.count
+	case line == ":p" || line == ":prev":
+		if r.query == "" {
+			return false
+		}
+		if r.offset < r.count {
+			r.offset = 0
+		} else {
+			r.offset -= r.count
+		}
+	case fields[0] == ":count":
+		if len(fields) != 2 {
+			fmt.Fprintln(r.out, "usage: :count N")
+			return false
+		}
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil || count == 0 {
+			fmt.Fprintln(r.out, "usage: :count N")
+			return false
+		}
+		r.count = uint(count)
+		if r.query == "" {
+			return false
+		}
+	case line == ":json":
+		r.json = !r.json
+		return false
+	case line == ":history":
+		for i, query := range r.history {
+			fmt.Fprintf(r.out, "%5d  %s\n", i+1, query)
+		}
+		return false
+	case strings.HasPrefix(line, "!"):
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 1 || n > len(r.history) {
+			fmt.Fprintln(r.out, "no such history")
+			return false
+		}
+		r.query = r.history[n-1]
+		r.offset = 0
+		fmt.Fprintln(r.out, r.query)
+	case strings.HasPrefix(line, ":"):
+		fmt.Fprintln(r.out, replHelp)
+		return false
+	default:
+		r.query = line
+		r.offset = 0
+		r.appendHistory(line)
+	}
+
+	results, err := search(r.host, r.query, r.lang, r.prefix, r.offset, r.count)
+	if err != nil {
+		fmt.Fprintln(r.out, err)
+		return false
+	}
+	if r.json {
+		json.NewEncoder(r.out).Encode(results)
+		return false
+	}
+	if err := renderResults(r.out, r.query, results, r.offset, r.color); err != nil {
+		fmt.Fprintln(r.out, err)
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRepl(t *testing.T) {
+	queries := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "repl")
+	defer os.RemoveAll(dir)
+
+	out := bytes.Buffer{}
+	r := &repl{
+		host:        server.URL,
+		count:       10,
+		historyPath: filepath.Join(dir, "history"),
+		out:         &out,
+	}
+	for _, line := range []string{"pen", ":n", ":count 5", ":p", "apple", "!1"} {
+		if r.exec(line) {
+			t.Error("unexpected quit")
+		}
+	}
+	if !r.exec(":q") {
+		t.Error("expected quit")
+	}
+
+	if diff := cmp.Diff(
+		[]string{
+			"count=10&k=pen&offset=0",
+			"count=10&k=pen&offset=10",
+			"count=5&k=pen&offset=10",
+			"count=5&k=pen&offset=5",
+			"count=5&k=apple&offset=0",
+			"count=5&k=pen&offset=0",
+		},
+		queries,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	history, _ := ioutil.ReadFile(filepath.Join(dir, "history"))
+	if diff := cmp.Diff("pen\napple\n", string(history)); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type robotsRule struct {
+	path  string
+	allow bool
+}
+
+type robots struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// robots.txtを解析し、userAgentに該当するグループのルールを返す
+// 該当するグループがなければ"*"のグループを使う
+func parseRobots(r io.Reader, userAgent string) (*robots, error) {
+	type group struct {
+		agents     []string
+		rules      []robotsRule
+		crawlDelay time.Duration
+	}
+	groups := []*group{}
+	var current *group
+	inAgents := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &group{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			inAgents = true
+		case "allow", "disallow":
+			inAgents = false
+			if current == nil || (key == "disallow" && value == "") {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{path: value, allow: key == "allow"})
+		case "crawl-delay":
+			inAgents = false
+			if current == nil {
+				continue
+			}
+			if delay, err := strconv.ParseFloat(value, 64); err == nil {
+				current.crawlDelay = time.Duration(delay * float64(time.Second))
+			}
+		default:
+			inAgents = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	userAgent = strings.ToLower(userAgent)
+	var matched, wildcard *group
+	for _, g := range groups {
+		for _, agent := range g.agents {
+			if agent == "*" && wildcard == nil {
+				wildcard = g
+			} else if agent != "*" && strings.Contains(userAgent, agent) && matched == nil {
+				matched = g
+			}
+		}
+	}
+	if matched == nil {
+		matched = wildcard
+	}
+	if matched == nil {
+		return &robots{rules: []robotsRule{}}, nil
+	}
+	return &robots{
+		rules:      matched.rules,
+		crawlDelay: matched.crawlDelay,
+	}, nil
+}
+
+// 最長一致したルールに従う。同じ長さならAllowを優先
+func (r *robots) Allowed(path string) bool {
+	allowed := true
+	length := -1
+	for _, rule := range r.rules {
+		if !matchRobotsPath(rule.path, path) {
+			continue
+		}
+		if len(rule.path) > length || (len(rule.path) == length && rule.allow) {
+			allowed = rule.allow
+			length = len(rule.path)
+		}
+	}
+	return allowed
+}
+
+// "*"は任意の文字列、末尾の"$"は終端にマッチする
+func matchRobotsPath(pattern string, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if anchored && rest != "" {
+		if len(parts) == 1 {
+			return false
+		}
+		return strings.HasSuffix(path, parts[len(parts)-1])
+	}
+	return true
+}
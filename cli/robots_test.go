@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRobots(t *testing.T) {
+	r, err := parseRobots(strings.NewReader(`
+# comment
+User-agent: otherbot
+Disallow: /
+
+User-agent: *
+Disallow: /private/
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 2
+`), "searcher")
+	if err != nil {
+		t.Error(err)
+	}
+
+	actual := map[string]bool{}
+	for _, path := range []string{"/", "/private/a", "/private/public/a", "/a.pdf", "/a.pdf?x=1"} {
+		actual[path] = r.Allowed(path)
+	}
+	if diff := cmp.Diff(
+		map[string]bool{
+			"/":                 true,
+			"/private/a":        false,
+			"/private/public/a": true,
+			"/a.pdf":            false,
+			"/a.pdf?x=1":        true,
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(2*time.Second, r.crawlDelay); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestParseRobotsUserAgent(t *testing.T) {
+	r, _ := parseRobots(strings.NewReader(`
+User-agent: *
+Disallow:
+
+User-agent: searcher
+User-agent: otherbot
+Disallow: /
+`), "searcher/1.0")
+
+	if diff := cmp.Diff(false, r.Allowed("/index.html")); diff != "" {
+		t.Errorf(diff)
+	}
+}
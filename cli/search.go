@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+)
+
+// 1件あたりに表示する文章の数と長さ
+const (
+	maxSnippetSentences = 3
+	maxSnippetLength    = 120
+)
+
+func searchMain(args []string) error {
+	flags := flag.NewFlagSet("search", flag.ExitOnError)
+	pHost := flags.String("host", "http://localhost:8080", "Host")
+	pOffset := flags.Uint("offset", 0, "Offset")
+	pCount := flags.Uint("count", 10, "Count")
+	pLang := flags.String("lang", "", "Analyze the query in this language (default: all languages)")
+	pPrefix := flags.Bool("prefix", false, "Match the last word as a prefix")
+	pJson := flags.Bool("json", false, "Output raw JSON")
+	pColor := flags.Bool("color", isTerminal(os.Stdout), "Highlight matches with ANSI colors")
+	flags.Parse(args)
+
+	query := strings.Join(flags.Args(), " ")
+	if query == "" {
+		return fmt.Errorf("Error: empty query!\n")
+	}
+	results, err := search(*pHost, query, *pLang, *pPrefix, *pOffset, *pCount)
+	if err != nil {
+		return err
+	}
+	if *pJson {
+		return json.NewEncoder(os.Stdout).Encode(results)
+	}
+	return renderResults(os.Stdout, query, results, *pOffset, *pColor)
+}
+
+type searchResult struct {
+	Uri       string
+	Score     float64
+	Sentences []string
+}
+
+func search(host string, query string, lang string, prefix bool, offset, count uint) ([]searchResult, error) {
+	params := url.Values{}
+	params.Set("k", query)
+	if lang != "" {
+		params.Set("lang", lang)
+	}
+	if prefix {
+		params.Set("prefix", "true")
+	}
+	params.Set("offset", strconv.FormatUint(uint64(offset), 10))
+	params.Set("count", strconv.FormatUint(uint64(count), 10))
+	req, err := http.NewRequest("GET", host+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	results := []searchResult{}
+	if err := json.Unmarshal(body, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func renderResults(w io.Writer, query string, results []searchResult, offset uint, color bool) error {
+	if len(results) == 0 {
+		_, err := fmt.Fprintln(w, "no results")
+		return err
+	}
+	highlighter := newHighlighter(query, color)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tSCORE\tURI")
+	for i, result := range results {
+		fmt.Fprintf(tw, "%d\t%.4f\t%s\n", int(offset)+i+1, result.Score, result.Uri)
+		for j, sentence := range result.Sentences {
+			if j >= maxSnippetSentences {
+				break
+			}
+			fmt.Fprintf(tw, "    %s\n", highlighter.Highlight(truncate(sentence, maxSnippetLength)))
+		}
+	}
+	return tw.Flush()
+}
+
+func truncate(str string, length int) string {
+	if utf8.RuneCountInString(str) <= length {
+		return str
+	}
+	return string([]rune(str)[:length]) + "…"
+}
+
+type highlighter struct {
+	regexp *regexp.Regexp
+	color  bool
+}
+
+// クエリの単語を文章中から探して強調する
+func newHighlighter(query string, color bool) *highlighter {
+	terms := strings.Fields(query)
+	sort.Slice(terms, func(i, j int) bool {
+		return len(terms[i]) > len(terms[j])
+	})
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	h := &highlighter{color: color}
+	if len(quoted) > 0 {
+		h.regexp = regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+	}
+	return h
+}
+
+func (h *highlighter) Highlight(sentence string) string {
+	if h.regexp == nil {
+		return sentence
+	}
+	return h.regexp.ReplaceAllStringFunc(sentence, func(match string) string {
+		if h.color {
+			return "\x1b[1;33m" + match + "\x1b[0m"
+		}
+		return "**" + match + "**"
+	})
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
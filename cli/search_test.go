@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSearch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if diff := cmp.Diff("count=5&k=%E3%81%99%E3%82%82%E3%82%82&lang=ja&offset=10&prefix=true", r.URL.RawQuery); diff != "" {
+			t.Errorf(diff)
+		}
+		fmt.Fprint(w, `[{"Uri":"uri","Score":1.5,"Sentences":["すもももももももものうち"]}]`)
+	}))
+	defer server.Close()
+
+	results, err := search(server.URL, "すもも", "ja", true, 10, 5)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]searchResult{{Uri: "uri", Score: 1.5, Sentences: []string{"すもももももももものうち"}}},
+		results,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestRenderResults(t *testing.T) {
+	buf := bytes.Buffer{}
+	renderResults(&buf, "すもも Pen", []searchResult{
+		{Uri: "https://example.com/a", Score: 0.652, Sentences: []string{"すもももももももものうち", "This is a pen.", "3", "4"}},
+		{Uri: "b", Score: 0.1, Sentences: []string{}},
+	}, 10, false)
+
+	if diff := cmp.Diff(
+		`#   SCORE   URI
+11  0.6520  https://example.com/a
+    **すもも**もももももものうち
+    This is a **pen**.
+    3
+12  0.1000  b
+`,
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
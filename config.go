@@ -1,12 +1,85 @@
 package main
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
 type config struct {
 	Listen string
 	Dsn    string
+	// 0ならバックグラウンドのコンパクションを行わない
+	CompactInterval time.Duration `mapstructure:"compact_interval"`
+	// defaultインデックスの設定。名前付きインデックスを作るときに指定しなかった項目にも使う
+	Index indexConfig `mapstructure:",squash"`
+	// posting_storeがfileかsegmentのときのディレクトリ
+	PostingDir string `mapstructure:"posting_dir"`
+	// 登録と削除のログのファイル、起動時に途中で止まった操作をやり直す。空なら書かない
+	WAL string
+	// 保存先に書き出し済みの操作をログから消す間隔
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+	// 名前付きインデックスのポスティングリストとログを置くディレクトリ、インデックスごとに分ける
+	IndexDir string `mapstructure:"index_dir"`
+	// 名前付きインデックスで指定できる辞書とストップワードのファイルを置くディレクトリ、空なら指定できない
+	DataDir string `mapstructure:"data_dir"`
+}
+
+// インデックスごとのアナライザと保存先の設定
+type indexConfig struct {
+	// 日本語のトークンの形、surface、base、reading、combined
+	TokenForm string `mapstructure:"token_form" json:"token_form"`
+	// 日本語のトークンを品詞で絞り込む、「名詞-数」のように細分類も指定できる
+	POSInclude []string `mapstructure:"pos_include" json:"pos_include"`
+	POSExclude []string `mapstructure:"pos_exclude" json:"pos_exclude"`
+	// 日本語のシステム辞書、ipaかkagome形式の辞書ファイルのパス
+	Dictionary string `json:"dictionary"`
+	// kagome形式のユーザー辞書のパス
+	UserDictionary string `mapstructure:"user_dictionary" json:"user_dictionary"`
+	// 日本語を文字n-gramでも登録して部分一致できるようにする。0なら使わない
+	Ngram int `json:"ngram"`
+	// n-gramで一致したときのスコアの重み
+	NgramWeight float64 `mapstructure:"ngram_weight" json:"ngram_weight"`
+	// 入力途中の語を前方一致させるために登録するトークンの先頭部分の最大文字数。0なら使わない
+	EdgeNgram int `mapstructure:"edge_ngram" json:"edge_ngram"`
+	// 前方一致で一致したときのスコアの重み
+	EdgeNgramWeight float64 `mapstructure:"edge_ngram_weight" json:"edge_ngram_weight"`
+	// 言語コードごとのアナライザの設定
+	Analyzers map[string]analyzerConfig `json:"analyzers"`
+	// 圧縮したポスティングリストの保存先、sql、fileかsegment
+	PostingStore string `mapstructure:"posting_store" json:"posting_store"`
+	// posting_storeがsegmentのときの設定
+	Segment segmentConfig `json:"segment"`
+}
+
+type segmentConfig struct {
+	// メモリに溜めるポスティング数、超えたらセグメントファイルに書き出す
+	FlushSize int `mapstructure:"flush_size" json:"flush_size"`
+	// 同じ大きさのセグメントがいくつ並んだらまとめるか
+	MergeFactor int `mapstructure:"merge_factor" json:"merge_factor"`
+	// バックグラウンドでセグメントを書き出してまとめる間隔、0なら行わない。すべてのインデックスで共通
+	MergeInterval time.Duration `mapstructure:"merge_interval" json:"-"`
+	// 登録と削除をバックグラウンドで行うゴルーチンの数。0ならリクエストの中で行う
+	IndexWorkers int `mapstructure:"index_workers" json:"index_workers"`
+}
+
+// 登録と削除をバックグラウンドで行うゴルーチンの数。segment以外の保存先ではリクエストの中で行う
+func (c *indexConfig) indexWorkers() int {
+	if c.PostingStore != postingStoreSegment {
+		return 0
+	}
+	return c.Segment.IndexWorkers
+}
+
+type analyzerConfig struct {
+	// ステミングに使う言語、空なら言語コードと同じ、noneなら使わない
+	Stemmer string `json:"stemmer"`
+	// 1行1語のストップワードのファイル、空なら組み込みのリスト
+	StopWords string `mapstructure:"stop_words" json:"stop_words"`
+	// 文の分割方法、kagomeかrule。空なら日本語はkagome、それ以外はrule
+	SentenceSplitter string `mapstructure:"sentence_splitter" json:"sentence_splitter"`
+	// 1文の最大文字数、0なら300
+	MaxSentenceLength int `mapstructure:"max_sentence_length" json:"max_sentence_length"`
 }
 
 func loadConfig(fileName string, path []string) (*config, error) {
@@ -16,6 +89,17 @@ func loadConfig(fileName string, path []string) (*config, error) {
 	}
 	viper.SetDefault("Listen", "0.0.0.0:8000")
 	viper.SetDefault("Dsn", "user:pass@tcp(127.0.0.1:3306)/searcher?charset=utf8&parseTime=True&loc=Local")
+	viper.SetDefault("token_form", tokenFormReading)
+	viper.SetDefault("pos_exclude", []string{"助詞", "助動詞", "記号"})
+	viper.SetDefault("dictionary", dictionaryIPA)
+	viper.SetDefault("ngram_weight", 0.5)
+	viper.SetDefault("edge_ngram_weight", 0.8)
+	viper.SetDefault("posting_store", postingStoreSQL)
+	viper.SetDefault("segment.flush_size", defaultSegmentFlushSize)
+	viper.SetDefault("segment.merge_factor", defaultSegmentMergeFactor)
+	viper.SetDefault("segment.merge_interval", time.Minute)
+	viper.SetDefault("segment.index_workers", defaultIndexWorkers)
+	viper.SetDefault("checkpoint_interval", time.Minute)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
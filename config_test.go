@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -13,6 +14,16 @@ func TestLoadConfig1(t *testing.T) {
 		config{
 			Listen: "0.0.0.0:8000",
 			Dsn:    "user:pass@tcp(127.0.0.1:3306)/searcher?charset=utf8&parseTime=True&loc=Local",
+			Index: indexConfig{
+				TokenForm:       "reading",
+				POSExclude:      []string{"助詞", "助動詞", "記号"},
+				Dictionary:      "ipa",
+				NgramWeight:     0.5,
+				EdgeNgramWeight: 0.8,
+				PostingStore:    "sql",
+				Segment:         segmentConfig{FlushSize: 10000, MergeFactor: 4, MergeInterval: time.Minute, IndexWorkers: 4},
+			},
+			CheckpointInterval: time.Minute,
 		},
 		*actual,
 	)
@@ -26,8 +37,29 @@ func TestLoadConfig2(t *testing.T) {
 
 	if diff := cmp.Diff(
 		config{
-			Listen: "127.0.0.1:3000",
-			Dsn:    "test:test@tcp(127.0.0.1:3306)/searcher?charset=utf8&parseTime=True&loc=Local",
+			Listen:          "127.0.0.1:3000",
+			Dsn:             "test:test@tcp(127.0.0.1:3306)/searcher?charset=utf8&parseTime=True&loc=Local",
+			CompactInterval: time.Hour,
+			Index: indexConfig{
+				TokenForm:       "combined",
+				POSInclude:      []string{"名詞"},
+				POSExclude:      []string{"名詞-数"},
+				Dictionary:      "ipa",
+				UserDictionary:  "test/userdict.txt",
+				Ngram:           2,
+				NgramWeight:     0.3,
+				EdgeNgram:       10,
+				EdgeNgramWeight: 0.6,
+				Analyzers: map[string]analyzerConfig{
+					"en": {Stemmer: "none", StopWords: "test/stopwords.txt", SentenceSplitter: "rule", MaxSentenceLength: 200},
+				},
+				PostingStore: "segment",
+				Segment:      segmentConfig{FlushSize: 5000, MergeFactor: 4, MergeInterval: 30 * time.Second, IndexWorkers: 2},
+			},
+			PostingDir:         "/var/lib/searcher/postings",
+			WAL:                "/var/lib/searcher/wal.log",
+			CheckpointInterval: 10 * time.Second,
+			IndexDir:           "/var/lib/searcher/indexes",
 		},
 		*actual,
 	); diff != "" {
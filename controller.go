@@ -1,64 +1,448 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/hrntknr/searcher/types"
 )
 
-func newController(config *config, service Service) (*controller, error) {
+const namedServiceKey = "service"
+
+func newController(config *config, indexes *indexManager, dictionaryValidator DictionaryValidator) (*controller, error) {
 	router := gin.New()
+	// defaultは消せないので返さない
+	service, _, err := indexes.Acquire(defaultIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultService := func(c *gin.Context) (Service, bool) {
+		return service, true
+	}
+	// 名前付きインデックスはリクエストが終わるまで使い、その間は削除を待たせる
+	named := router.Group("/indexes/:name", func(c *gin.Context) {
+		service, release, err := indexes.Acquire(c.Param("name"))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		defer release()
+		c.Set(namedServiceKey, service)
+		c.Next()
+	})
+	namedService := func(c *gin.Context) (Service, bool) {
+		return c.MustGet(namedServiceKey).(Service), true
+	}
+	// インデックスを指定しなければdefaultを使う。/searchはindexesで複数を指定できる
+	indexRoutes(router, defaultService, indexes)
+	indexRoutes(named, namedService, nil)
+	// 管理用の操作もインデックスごと。辞書の検証は設定ファイルの辞書を使うので/adminだけ
+	admin := router.Group("/admin")
+	adminRoutes(admin, defaultService)
+	adminRoutes(named.Group("/admin"), namedService)
+
+	router.GET("/indexes", func(c *gin.Context) {
+		c.JSON(200, indexes.List())
+	})
+	// 指定しなかった設定はdefaultのものを使う
+	router.POST("/indexes", func(c *gin.Context) {
+		var body CreateIndexBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		index, err := indexes.Create(body.Name, body.Config)
+		if errors.Is(err, errInvalidIndexName) || errors.Is(err, errInvalidIndexConfig) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errIndexExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, index)
+	})
+	router.DELETE("/indexes/:name", func(c *gin.Context) {
+		err := indexes.Delete(c.Param("name"))
+		if errors.Is(err, errInvalidIndexName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errIndexNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, nil)
+	})
+
+	// ユーザー辞書を今のシステム辞書と組み合わせてサンプルの文章を解析する
+	admin.POST("/dictionary/validate", func(c *gin.Context) {
+		var body ValidateDictionaryBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		tokens, err := dictionaryValidator.ValidateUserDictionary(strings.NewReader(body.UserDictionary), body.Text)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, tokens)
+	})
+
+	return &controller{
+		router: router,
+		config: config,
+	}, nil
+}
+
+// インデックスごとの管理用の操作。indexはindexRoutesと同じ
+func adminRoutes(routes gin.IRoutes, index func(c *gin.Context) (Service, bool)) {
+	routes.GET("/stats", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		top := uint(10)
+		if c.Query("top") != "" {
+			_top, err := strconv.ParseUint(c.Query("top"), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			top = uint(_top)
+		}
+		stats, err := service.Stats(top)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, stats)
+	})
+	routes.POST("/reindex", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		count, err := service.Reindex()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "documents": count})
+			return
+		}
+		c.JSON(200, gin.H{"documents": count})
+	})
+	routes.GET("/fsck", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		report, err := service.Fsck()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, report)
+	})
+	routes.POST("/compact", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		report, err := service.Compact()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, report)
+	})
+
+	// 書いている間も登録や削除は続けられる。途中で失敗したスナップショットはチェックサムがないので取り込めない
+	routes.POST("/snapshot", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		c.Header("Content-Type", "application/gzip")
+		c.Header("Content-Disposition", `attachment; filename="searcher.snapshot.gz"`)
+		if _, err := service.Snapshot(c.Writer); err != nil {
+			if !c.Writer.Written() {
+				c.Header("Content-Type", "")
+				c.Header("Content-Disposition", "")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("snapshot: %v", err)
+		}
+	})
+	routes.POST("/restore", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		report, err := service.Restore(c.Request.Body)
+		if errors.Is(err, errInvalidSnapshot) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errIndexNotEmpty) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, report)
+	})
+}
+
+// インデックスごとの登録と検索。indexはリクエストのインデックスを返し、なければレスポンスを書いてfalseを返す
+// federatedがあれば、/searchのindexesでまとめて検索できる
+func indexRoutes(routes gin.IRoutes, index func(c *gin.Context) (Service, bool), federated *indexManager) {
+	routes.POST("/regist", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		if c.ContentType() == "text/html" {
+			uri := c.Query("uri")
+			if uri == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "uri is required"})
+				return
+			}
+			body, err := c.GetRawData()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			err = service.RegistHTML(uri, string(body), types.DocumentMeta{
+				ETag:         c.Query("etag"),
+				LastModified: c.Query("last_modified"),
+				Lang:         c.Query("lang"),
+			})
+			if errors.Is(err, errUnsupportedLanguage) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(200, nil)
+			return
+		}
 
-	router.POST("/regist", func(c *gin.Context) {
 		var body RegistBody
 		if err := c.ShouldBindJSON(&body); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		if err := service.Regist(body.Uri, body.Body); err != nil {
+		err := service.Regist(body.Uri, body.Body, body.DocumentMeta)
+		if errors.Is(err, errUnsupportedLanguage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(200, nil)
 	})
 
-	router.GET("/search", func(c *gin.Context) {
-		var count uint
-		if c.Query("count") == "" {
-			count = 10
-		} else {
-			_count, err := strconv.ParseUint(c.Query("count"), 10, 64)
+	routes.GET("/document", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		document, err := service.Document(c.Query("uri"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if document == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
+			return
+		}
+		c.JSON(200, document)
+	})
+
+	routes.DELETE("/document", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		ok, err := service.Delete(c.Query("uri"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
+			return
+		}
+		c.JSON(200, nil)
+	})
+
+	// 再取得して変更がなかったドキュメントは、登録し直さずに時刻だけを今にする
+	routes.POST("/touch", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		ok, err := service.Touch(c.Query("uri"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "document not found"})
+			return
+		}
+		c.JSON(200, nil)
+	})
+
+	routes.GET("/documents", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		offset, count, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		before := time.Now()
+		if c.Query("before") != "" {
+			_before, err := time.Parse(time.RFC3339, c.Query("before"))
 			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			before = _before
+		}
+		documents, err := service.DocumentsBefore(before, offset, count)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, documents)
+	})
+
+	// 解析結果を含まないので、アナライザの設定が違うサーバーにも取り込める
+	routes.GET("/export", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		c.Header("Content-Type", "application/x-ndjson")
+		if _, err := service.Export(c.Writer); err != nil {
+			if !c.Writer.Written() {
+				c.Header("Content-Type", "")
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			count = uint(_count)
+			log.Printf("export: %v", err)
 		}
-		var offset uint
-		if c.Query("offset") == "" {
-			offset = 0
-		} else {
-			_offset, err := strconv.ParseUint(c.Query("offset"), 10, 64)
+	})
+
+	routes.POST("/import", func(c *gin.Context) {
+		service, ok := index(c)
+		if !ok {
+			return
+		}
+		report, err := service.Import(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "documents": report.Documents})
+			return
+		}
+		c.JSON(200, report)
+	})
+
+	routes.GET("/search", func(c *gin.Context) {
+		offset, count, err := parsePaging(c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// 入力途中の検索では最後の語を前方一致させる
+		prefix := false
+		if c.Query("prefix") != "" {
+			prefix, err = strconv.ParseBool(c.Query("prefix"))
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			offset = uint(_offset)
 		}
-		result, err := service.Search(c.Query("k"), offset, count)
+		var result []types.SearchResult
+		if federated != nil && c.Query("indexes") != "" {
+			// 失敗して除いたインデックスはヘッダで返す
+			var skipped []string
+			result, skipped, err = federated.Search(strings.Split(c.Query("indexes"), ","), c.Query("k"), c.Query("lang"), prefix, offset, count)
+			if len(skipped) > 0 {
+				c.Header("X-Skipped-Indexes", strings.Join(skipped, ","))
+			}
+		} else {
+			service, ok := index(c)
+			if !ok {
+				return
+			}
+			result, err = service.Search(c.Query("k"), c.Query("lang"), prefix, offset, count)
+		}
+		if errors.Is(err, errUnsupportedLanguage) || errors.Is(err, errInvalidIndexName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, errIndexNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 		c.JSON(200, result)
 	})
+}
 
-	return &controller{
-		router: router,
-		config: config,
-	}, nil
+func parsePaging(c *gin.Context) (uint, uint, error) {
+	var count uint
+	if c.Query("count") == "" {
+		count = 10
+	} else {
+		_count, err := strconv.ParseUint(c.Query("count"), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		count = uint(_count)
+	}
+	var offset uint
+	if c.Query("offset") == "" {
+		offset = 0
+	} else {
+		_offset, err := strconv.ParseUint(c.Query("offset"), 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		offset = uint(_offset)
+	}
+	return offset, count, nil
 }
 
 type controller struct {
@@ -66,15 +450,34 @@ type controller struct {
 	config *config
 }
 
-func (c *controller) start() error {
-	err := c.router.Run(c.config.Listen)
-	if err != nil {
+// ctxが終わったら新しい接続を断り、実行中のリクエストが終わるまで待って返る
+func (c *controller) start(ctx context.Context) error {
+	server := &http.Server{Addr: c.config.Listen, Handler: c.router}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
 		return err
+	case <-ctx.Done():
+		return server.Shutdown(context.Background())
 	}
-	return nil
 }
 
 type RegistBody struct {
 	Uri  string `json:"uri"`
 	Body string `json:"body"`
+	types.DocumentMeta
+}
+
+type CreateIndexBody struct {
+	Name string `json:"name"`
+	// インデックスの設定、config.ymlと同じ項目
+	Config json.RawMessage `json:"config"`
+}
+
+type ValidateDictionaryBody struct {
+	UserDictionary string `json:"user_dictionary"`
+	Text           string `json:"text"`
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/mock/gomock"
@@ -23,14 +27,14 @@ func TestControllerRegist(t *testing.T) {
 	defer ctrl.Finish()
 	serviceMock := mock.NewMockService(ctrl)
 	gomock.InOrder(
-		serviceMock.EXPECT().Regist("test", "すもももももももものうち"),
+		serviceMock.EXPECT().Regist("test", "すもももももももものうち", types.DocumentMeta{ETag: "\"etag\""}),
 	)
 
 	config, _ := loadConfig("config", []string{"test"})
-	controller, _ := newController(config, serviceMock)
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
 	w := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("POST", "/regist", bytes.NewBufferString("{\"uri\":\"test\",\"body\":\"すもももももももものうち\"}"))
+	req, _ := http.NewRequest("POST", "/regist", bytes.NewBufferString("{\"uri\":\"test\",\"body\":\"すもももももももものうち\",\"etag\":\"\\\"etag\\\"\"}"))
 	controller.router.ServeHTTP(w, req)
 
 	if diff := cmp.Diff(
@@ -41,12 +45,432 @@ func TestControllerRegist(t *testing.T) {
 	}
 }
 
+func TestControllerRegistHTML(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().RegistHTML("test", "<p>すもももももももものうち</p>", types.DocumentMeta{LastModified: "Wed, 21 Oct 2015 07:28:00 GMT", Lang: "ja"}),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/regist?uri=test&last_modified=Wed%2C%2021%20Oct%202015%2007%3A28%3A00%20GMT&lang=ja", bytes.NewBufferString("<p>すもももももももものうち</p>"))
+	req.Header.Set("Content-Type", "text/html; charset=utf-8")
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		200,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerRegistUnsupportedLanguage(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Regist("test", "body", types.DocumentMeta{Lang: "xx"}).Return(fmt.Errorf("%w: xx", errUnsupportedLanguage)),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/regist", bytes.NewBufferString(`{"uri":"test","body":"body","lang":"xx"}`))
+	req.Header.Set("Content-Type", "application/json")
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		400,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerDocument(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Document("uri").Return(&types.Document{
+			Uri:  "uri",
+			Time: time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
+		}, nil),
+		serviceMock.EXPECT().Document("notfound").Return(nil, nil),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", "/document?uri=uri", nil)
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		200,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	var document types.Document
+	json.Unmarshal(w.Body.Bytes(), &document)
+	if diff := cmp.Diff(
+		time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
+		document.Time,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/document?uri=notfound", nil)
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		404,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Delete("uri").Return(true, nil),
+		serviceMock.EXPECT().Delete("notfound").Return(false, nil),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("DELETE", "/document?uri=uri", nil)
+	controller.router.ServeHTTP(w, req)
+	if diff := cmp.Diff(
+		200,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/document?uri=notfound", nil)
+	controller.router.ServeHTTP(w, req)
+	if diff := cmp.Diff(
+		404,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerTouch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Touch("uri").Return(true, nil),
+		serviceMock.EXPECT().Touch("notfound").Return(false, nil),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("POST", "/touch?uri=uri", nil)
+	controller.router.ServeHTTP(w, req)
+	if diff := cmp.Diff(
+		200,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/touch?uri=notfound", nil)
+	controller.router.ServeHTTP(w, req)
+	if diff := cmp.Diff(
+		404,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerDocuments(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().DocumentsBefore(time.Date(2021, time.May, 1, 0, 0, 0, 0, time.UTC), uint(0), uint(100)).Return(
+			[]*types.Document{{Uri: "uri"}}, nil,
+		),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+	w := httptest.NewRecorder()
+
+	req, _ := http.NewRequest("GET", "/documents?before=2021-05-01T00:00:00Z&count=100", nil)
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		200,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	documents := []types.Document{}
+	json.Unmarshal(w.Body.Bytes(), &documents)
+	if diff := cmp.Diff(
+		"uri",
+		documents[0].Uri,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerAdmin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Stats(uint(3)).Return(&types.Stats{Documents: 1, TopTerms: []types.TermCount{}}, nil),
+		serviceMock.EXPECT().Reindex().Return(uint(5), nil),
+		serviceMock.EXPECT().Fsck().Return(&types.FsckReport{OrphanPostings: []types.OrphanPosting{{TokenID: 1, DocumentID: 2}}}, nil),
+		serviceMock.EXPECT().Compact().Return(&types.CompactReport{Tokens: 2}, nil),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/admin/stats?top=3", `{"Documents":1,"Tokens":0,"Postings":0,"Sentences":0,"TopTerms":[],"StaleDocuments":0}`},
+		{"POST", "/admin/reindex", `{"documents":5}`},
+		{"GET", "/admin/fsck", `{"OrphanPostings":[{"TokenID":1,"DocumentID":2}],"DuplicateTokens":null,"TokenCountMismatches":null}`},
+		{"POST", "/admin/compact", `{"Documents":0,"Sentences":0,"Postings":0,"Tokens":2}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(
+			200,
+			w.Code,
+		); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(
+			c.body,
+			string(w.Body.Bytes()),
+		); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestControllerSnapshot(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Snapshot(gomock.Any()).DoAndReturn(func(w io.Writer) (*types.SnapshotReport, error) {
+			w.Write([]byte("snapshot"))
+			return &types.SnapshotReport{}, nil
+		}),
+		serviceMock.EXPECT().Snapshot(gomock.Any()).Return(nil, fmt.Errorf("error")),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+
+	for _, c := range []struct {
+		code        int
+		contentType string
+		body        string
+	}{
+		{200, "application/gzip", "snapshot"},
+		// 書き始める前の失敗はエラーを返す
+		{500, "application/json; charset=utf-8", `{"error":"error"}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/snapshot", nil)
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.contentType, w.Header().Get("Content-Type")); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.body, w.Body.String()); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestControllerRestore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Restore(gomock.Any()).Return(&types.SnapshotReport{Documents: 1, Tokens: 2, Postings: 3}, nil),
+		serviceMock.EXPECT().Restore(gomock.Any()).Return(nil, fmt.Errorf("%w: checksum mismatch", errInvalidSnapshot)),
+		serviceMock.EXPECT().Restore(gomock.Any()).Return(nil, errIndexNotEmpty),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+
+	for _, c := range []struct {
+		code int
+		body string
+	}{
+		{200, `{"Documents":1,"Tokens":2,"Postings":3}`},
+		{400, `{"error":"invalid snapshot: checksum mismatch"}`},
+		{409, `{"error":"index is not empty"}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/restore", bytes.NewBufferString("snapshot"))
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.body, w.Body.String()); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestControllerExport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Export(gomock.Any()).DoAndReturn(func(w io.Writer) (uint, error) {
+			w.Write([]byte(`{"uri":"uri"}` + "\n"))
+			return 1, nil
+		}),
+		serviceMock.EXPECT().Export(gomock.Any()).Return(uint(0), fmt.Errorf("error")),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+
+	for _, c := range []struct {
+		code        int
+		contentType string
+		body        string
+	}{
+		{200, "application/x-ndjson", `{"uri":"uri"}` + "\n"},
+		{500, "application/json; charset=utf-8", `{"error":"error"}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/export", nil)
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.contentType, w.Header().Get("Content-Type")); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.body, w.Body.String()); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestControllerImport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	gomock.InOrder(
+		serviceMock.EXPECT().Import(gomock.Any()).Return(&types.ImportReport{
+			Documents: 1,
+			Failures:  []types.ImportFailure{{Line: 2, Error: "invalid export"}},
+		}, nil),
+		serviceMock.EXPECT().Import(gomock.Any()).Return(&types.ImportReport{Documents: 3}, fmt.Errorf("error")),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
+
+	for _, c := range []struct {
+		code int
+		body string
+	}{
+		{200, `{"Documents":1,"Failures":[{"Line":2,"Uri":"","Error":"invalid export"}]}`},
+		// 途中で失敗しても登録できた件数を返す
+		{500, `{"documents":3,"error":"error"}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/import", bytes.NewBufferString(`{"uri":"uri"}`))
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.body, w.Body.String()); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
+func TestControllerValidateDictionary(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	serviceMock := mock.NewMockService(ctrl)
+	validatorMock := mock.NewMockDictionaryValidator(ctrl)
+	gomock.InOrder(
+		validatorMock.EXPECT().ValidateUserDictionary(gomock.Any(), "朝青龍").Return([]types.DictionaryToken{
+			{Surface: "朝青龍", BaseForm: "朝青龍", Reading: "アサショウリュウ", POS: []string{"カスタム人名"}, User: true},
+		}, nil),
+		validatorMock.EXPECT().ValidateUserDictionary(gomock.Any(), "朝青龍").Return(nil, fmt.Errorf("invalid format: 朝青龍")),
+	)
+
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), validatorMock)
+
+	for _, c := range []struct {
+		code int
+		body string
+	}{
+		{200, `[{"Surface":"朝青龍","BaseForm":"朝青龍","Reading":"アサショウリュウ","POS":["カスタム人名"],"User":true}]`},
+		{400, `{"error":"invalid format: 朝青龍"}`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/admin/dictionary/validate", bytes.NewBufferString(`{"user_dictionary":"朝青龍,朝青龍,アサショウリュウ,カスタム人名","text":"朝青龍"}`))
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf(diff)
+		}
+		if diff := cmp.Diff(c.body, w.Body.String()); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
+
 func TestControllerSearch(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 	serviceMock := mock.NewMockService(ctrl)
 	gomock.InOrder(
-		serviceMock.EXPECT().Search("すもも", uint(11), uint(12)).Return(
+		serviceMock.EXPECT().Search("すもも", "ja", true, uint(11), uint(12)).Return(
 			[]types.SearchResult{{
 				Uri:       "uri",
 				Score:     10,
@@ -56,10 +480,10 @@ func TestControllerSearch(t *testing.T) {
 	)
 
 	config, _ := loadConfig("config", []string{"test"})
-	controller, _ := newController(config, serviceMock)
+	controller, _ := newController(config, newTestIndexManager(t, serviceMock), nil)
 	w := httptest.NewRecorder()
 
-	req, _ := http.NewRequest("GET", "/search?k=すもも&offset=11&count=12", nil)
+	req, _ := http.NewRequest("GET", "/search?k=すもも&lang=ja&prefix=true&offset=11&count=12", nil)
 	controller.router.ServeHTTP(w, req)
 
 	if diff := cmp.Diff(
@@ -75,4 +499,107 @@ func TestControllerSearch(t *testing.T) {
 	); diff != "" {
 		t.Errorf(diff)
 	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/search?k=すもも&prefix=maybe", nil)
+	controller.router.ServeHTTP(w, req)
+
+	if diff := cmp.Diff(
+		400,
+		w.Code,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestControllerIndexes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultMock := mock.NewMockService(ctrl)
+	docsMock := mock.NewMockService(ctrl)
+	docsMock.EXPECT().Search("すもも", "", false, uint(0), uint(10)).Return([]types.SearchResult{{Uri: "uri", Score: 1}}, nil)
+	docsMock.EXPECT().SearchScores("すもも", "", false, uint(federatedSample)).Return([]float64{1}, nil)
+	defaultMock.EXPECT().SearchScores("すもも", "", false, uint(federatedSample)).Return([]float64{}, nil)
+	docsMock.EXPECT().Search("すもも", "", false, uint(0), uint(1)).Return([]types.SearchResult{{Uri: "uri", Score: 1}}, nil)
+	docsMock.EXPECT().Regist("uri", "すもも", types.DocumentMeta{}).Return(nil)
+	docsMock.EXPECT().Stats(uint(10)).Return(&types.Stats{Documents: 1, TopTerms: []types.TermCount{}}, nil)
+	docsMock.EXPECT().Compact().Return(&types.CompactReport{Tokens: 2}, nil)
+	docsMock.EXPECT().Close().Return(nil)
+
+	indexes, _ := newIndexManager(defaultMock, indexConfig{TokenForm: "reading"}, "", &testIndexBackend{
+		services: map[string]Service{"docs": docsMock},
+	})
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, indexes, nil)
+
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		result string
+	}{
+		{"POST", "/indexes", `{"name":"docs","config":{"ngram":2}}`, 200, ""},
+		{"POST", "/indexes", `{"name":"docs"}`, 409, `{"error":"index already exists: docs"}`},
+		{"POST", "/indexes", `{"name":"Docs"}`, 400, `{"error":"invalid index name: Docs"}`},
+		{"POST", "/indexes/docs/regist", `{"uri":"uri","body":"すもも"}`, 200, "null"},
+		{"GET", "/indexes/docs/search?k=すもも", "", 200, `[{"Uri":"uri","Score":1,"Sentences":null}]`},
+		{"GET", "/indexes/blog/search?k=すもも", "", 404, `{"error":"index not found: blog"}`},
+		{"GET", "/indexes/docs/admin/stats", "", 200, `{"Documents":1,"Tokens":0,"Postings":0,"Sentences":0,"TopTerms":[],"StaleDocuments":0}`},
+		{"POST", "/indexes/docs/admin/compact", "", 200, `{"Documents":0,"Sentences":0,"Postings":0,"Tokens":2}`},
+		{"GET", "/indexes/blog/admin/fsck", "", 404, `{"error":"index not found: blog"}`},
+		{"GET", "/search?k=すもも&indexes=default,docs", "", 200, `[{"Uri":"uri","Score":1,"Sentences":null,"Index":"docs"}]`},
+		{"GET", "/search?k=すもも&indexes=docs,blog", "", 404, `{"error":"index not found: blog"}`},
+		{"GET", "/search?k=すもも&indexes=,", "", 400, `{"error":"invalid index name: no index"}`},
+		{"DELETE", "/indexes/default", "", 400, `{"error":"invalid index name: default cannot be deleted"}`},
+		{"DELETE", "/indexes/docs", "", 200, "null"},
+		{"DELETE", "/indexes/docs", "", 404, `{"error":"index not found: docs"}`},
+		{"GET", "/indexes", "", 200, `[{"Name":"default","CreatedAt":"0001-01-01T00:00:00Z","Config":{"token_form":"reading","pos_include":null,"pos_exclude":null,"dictionary":"","user_dictionary":"","ngram":0,"ngram_weight":0,"edge_ngram":0,"edge_ngram_weight":0,"analyzers":null,"posting_store":"","segment":{"flush_size":0,"merge_factor":0,"index_workers":0}}}]`},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.path, bytes.NewBufferString(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		controller.router.ServeHTTP(w, req)
+
+		if diff := cmp.Diff(c.code, w.Code); diff != "" {
+			t.Errorf("%s %s: %s", c.method, c.path, diff)
+		}
+		if c.result == "" {
+			continue
+		}
+		if diff := cmp.Diff(c.result, w.Body.String()); diff != "" {
+			t.Errorf("%s %s: %s", c.method, c.path, diff)
+		}
+	}
+}
+
+func TestControllerFederatedSearchSkip(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultMock := mock.NewMockService(ctrl)
+	docsMock := mock.NewMockService(ctrl)
+	docsMock.EXPECT().SearchScores("pen", "xx", false, uint(federatedSample)).Return([]float64{1}, nil)
+	defaultMock.EXPECT().SearchScores("pen", "xx", false, uint(federatedSample)).Return(nil, fmt.Errorf("%w: xx", errUnsupportedLanguage))
+	docsMock.EXPECT().Search("pen", "xx", false, uint(0), uint(1)).Return([]types.SearchResult{{Uri: "uri", Score: 1}}, nil)
+
+	indexes, _ := newIndexManager(defaultMock, indexConfig{}, "", &testIndexBackend{
+		indexes:  []*types.Index{{Name: "docs", Config: `{}`}},
+		services: map[string]Service{"docs": docsMock},
+	})
+	config, _ := loadConfig("config", []string{"test"})
+	controller, _ := newController(config, indexes, nil)
+
+	// 失敗したインデックスは除いて、名前をヘッダで返す
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/search?k=pen&lang=xx&indexes=default,docs", nil)
+	controller.router.ServeHTTP(w, req)
+	if diff := cmp.Diff(200, w.Code); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(`[{"Uri":"uri","Score":1,"Sentences":null,"Index":"docs"}]`, w.Body.String()); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff("default", w.Header().Get("X-Skipped-Indexes")); diff != "" {
+		t.Errorf(diff)
+	}
 }
@@ -1,22 +1,51 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
 	"github.com/hrntknr/searcher/types"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
 )
 
 type DB interface {
 	// 全ドキュメント数
 	CountDocument() (uint, error)
-	// ドキュメントの中の単語数
-	CountTermInDocument(documentID uint) (uint, error)
+	// 指定した言語で、アナライザのバージョンが異なるドキュメント数
+	CountStaleDocument(lang string, version string) (uint, error)
+	// 全トークン数
+	CountToken() (uint, error)
+	// 全ポスティング数
+	CountPosting() (uint, error)
+	// 全センテンス数
+	CountSentence() (uint, error)
+	// 出現ドキュメント数の多いトークン
+	TopTerms(limit uint) ([]types.TermCount, error)
 
 	// URIからドキュメントに
 	DocumentFromUri(uri string) (*types.Document, error)
 	// IDからドキュメントを取得
 	DocumentFromID(id uint) (*types.Document, error)
+	// 指定時刻より前にインデックスされたドキュメントを古い順に取得
+	DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error)
+	// 指定したIDより後のドキュメントをID順に取得
+	DocumentsAfterID(id uint, count uint) ([]*types.Document, error)
+	// 指定したIDのドキュメントの単語数をまとめて取得。langを指定すると言語が一致するものだけ
+	DocumentLengths(ids []uint, lang string) (map[uint]uint, error)
 	// ドキュメントを作成
 	CreateDcoument(document *types.Document) (*types.Document, error)
+	// ドキュメントを更新
+	UpdateDocument(document *types.Document) (*types.Document, error)
+	// ドキュメントを削除、センテンス、ポスティングもまとめて消す
+	DeleteDocument(documentID uint) error
+	// URIのドキュメントのインデックスした時刻だけを変える。存在しなければfalse
+	TouchDocument(uri string, t time.Time) (bool, error)
 
 	// トークン文字列からトークンに
 	TokenFromString(token string) (*types.Token, error)
@@ -24,28 +53,88 @@ type DB interface {
 	TokenFromID(id uint) (*types.Token, error)
 	// トークンを作成
 	CreateToken(token *types.Token) (*types.Token, error)
+	// トークンの出現割合の最大を、より大きければ更新
+	UpdateTokenMaxTermRatio(tokenID uint, ratio float64) error
 
-	// ポスティングリストを取得、センテンスのアソシエーションを結合
+	// ポスティングリストを圧縮したポスティングリストから取得、出現するセンテンスも含める
 	PostingList(tokenID uint) ([]*types.Posting, error)
-	// ポスティングを作成
-	CreatePosting(posting *types.Posting) (*types.Posting, error)
+	// ドキュメントID順に圧縮したポスティングリストを同じ時点の内容で取得、ないトークンは含めない
+	PostingBlocks(tokenIDs []uint) (map[uint][]byte, error)
+	// ドキュメントのポスティングを圧縮したポスティングリストに追加し、取り除くときのためにトークンを記録する
+	CreatePostings(documentID uint, postings []*types.Posting) error
 
 	// 複数IDからセンテンスを同時取得、ソートはID順
 	SentenceMultiFromID(ids []uint) ([]*types.Sentence, error)
+	// ドキュメントの中で、いずれかのトークンが出現するセンテンスのID
+	SentenceIDsFromPostings(documentID uint, tokenIDs []uint) ([]uint, error)
+	// ドキュメントのセンテンスを順番通りに取得
+	SentencesFromDocumentID(documentID uint) ([]*types.Sentence, error)
 	// センテンスを作成
 	CreateSentence(sentence *types.Sentence) (*types.Sentence, error)
-	// 指定したドキュメントのセンテンスを一括削除（更新用）、ついでにポスティング、アソシエーションも消す
+	// 指定したドキュメントのセンテンスを一括削除（更新用）、ついでに圧縮したポスティングリストからも取り除く
 	DeleteSentenceFromDocumentID(documentID uint) error
+
+	// ドキュメントが存在しない、または出現するセンテンスがないポスティング
+	OrphanPostings() ([]types.OrphanPosting, error)
+	// 同じ文字列で複数作られたトークン
+	DuplicateTokens() ([]types.DuplicateToken, error)
+	// TokenCountがセンテンスの合計と一致しないドキュメント
+	TokenCountMismatches() ([]types.TokenCountMismatch, error)
+
+	// 論理削除済みの行と参照されなくなったトークン、ドキュメントが存在しないポスティングを物理削除
+	Compact() (*types.CompactReport, error)
+	// ポスティングリストの保存先がセグメントなら、書き出してまとめる
+	MergePostings() (*types.MergeReport, error)
+	// ポスティングリストの保存先がセグメントなら、メモリの内容を書き出す
+	FlushPostings() error
+
+	// 同じ時点のドキュメント、トークン、ポスティングをスナップショットに書く。
+	// その時点の内容を読めるようになったらreadyを呼ぶ。呼ばれなければ書き終わるまで書き込みを止めておく
+	Snapshot(w io.Writer, ready func()) (*types.SnapshotReport, error)
+	// スナップショットを1つのトランザクションで取り込む。失敗したら取り込んだものを残さない
+	Restore(r io.Reader) (*types.SnapshotReport, error)
 }
 
-func newDb(db *gorm.DB) (*dbImpl, error) {
+// postingStoreがnilなら、圧縮したポスティングリストも同じSQLに保存する。
+// dbのテーブル名に接頭辞があれば、SQLに直接書いたテーブル名にも付ける
+func newDb(db *gorm.DB, postingStore postingStore) (*dbImpl, error) {
+	if postingStore == nil {
+		store, err := newSQLPostingStore(db)
+		if err != nil {
+			return nil, err
+		}
+		postingStore = store
+	}
+	prefix := ""
+	if naming, ok := db.NamingStrategy.(schema.NamingStrategy); ok {
+		prefix = naming.TablePrefix
+	}
 	return &dbImpl{
-		db: db,
+		db:           db,
+		postingStore: postingStore,
+		prefix:       prefix,
 	}, nil
 }
 
+// 行やトークンをまとめて読む件数
+const dbBatchSize = 100
+
 type dbImpl struct {
-	db *gorm.DB
+	db           *gorm.DB
+	postingStore postingStore
+	// 名前付きインデックスのテーブル名の接頭辞
+	prefix string
+}
+
+// SQLに直接書くテーブル名
+var sqlTableNames = regexp.MustCompile(`\b(document_tokens|posting_blocks|documents|sentences|tokens)\b`)
+
+// SQLに直接書いたテーブル名に接頭辞を付ける
+func (db *dbImpl) sql(query string) string {
+	if db.prefix == "" {
+		return query
+	}
+	return sqlTableNames.ReplaceAllString(query, db.prefix+"${1}")
 }
 
 func (db *dbImpl) CountDocument() (uint, error) {
@@ -56,12 +145,97 @@ func (db *dbImpl) CountDocument() (uint, error) {
 	return uint(count), nil
 }
 
-func (db *dbImpl) CountTermInDocument(documentID uint) (uint, error) {
-	var document types.Document
-	if err := db.db.Model(&types.Document{}).Where("id = ?", documentID).First(&document).Error; err != nil {
+func (db *dbImpl) CountStaleDocument(lang string, version string) (uint, error) {
+	var count int64
+	if err := db.db.Model(&types.Document{}).Where("lang = ? AND analyzer_version <> ?", lang, version).Count(&count).Error; err != nil {
 		return 0, err
 	}
-	return uint(document.TokenCount), nil
+	return uint(count), nil
+}
+
+func (db *dbImpl) CountToken() (uint, error) {
+	var count int64
+	if err := db.db.Model(&types.Token{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return uint(count), nil
+}
+
+func (db *dbImpl) CountPosting() (uint, error) {
+	count := uint(0)
+	err := db.eachPostingBlocks(db.db, db.postingStore, func(tokens []*types.Token, blocks map[uint][]byte) error {
+		for _, data := range blocks {
+			reader, err := newPostingBlockReader(data)
+			if err != nil {
+				return err
+			}
+			count += uint(reader.Len())
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (db *dbImpl) CountSentence() (uint, error) {
+	var count int64
+	if err := db.db.Model(&types.Sentence{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return uint(count), nil
+}
+
+// ドキュメント数はポスティングリストの先頭に書いてあるので、中身は展開しない
+func (db *dbImpl) TopTerms(limit uint) ([]types.TermCount, error) {
+	terms := []types.TermCount{}
+	err := db.eachPostingBlocks(db.db, db.postingStore, func(tokens []*types.Token, blocks map[uint][]byte) error {
+		for _, token := range tokens {
+			data, ok := blocks[token.ID]
+			if !ok {
+				continue
+			}
+			reader, err := newPostingBlockReader(data)
+			if err != nil {
+				return err
+			}
+			terms = append(terms, types.TermCount{Token: token.Token, DocumentCount: uint(reader.Len())})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(terms, func(i, j int) bool {
+		return terms[i].DocumentCount > terms[j].DocumentCount
+	})
+	if len(terms) > int(limit) {
+		terms = terms[:limit]
+	}
+	return terms, nil
+}
+
+// トークンをID順にまとめて読み、そのポスティングリストと一緒に渡す。ポスティングリストがないトークンはblocksに含めない
+func (db *dbImpl) eachPostingBlocks(tx *gorm.DB, postings postingLoader, fn func(tokens []*types.Token, blocks map[uint][]byte) error) error {
+	for lastID := uint(0); ; {
+		tokens := []*types.Token{}
+		if err := tx.Where("id > ?", lastID).Order("id").Limit(dbBatchSize).Find(&tokens).Error; err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(tokens))
+		for i, token := range tokens {
+			ids[i] = token.ID
+		}
+		blocks, err := postings.Load(ids)
+		if err != nil {
+			return err
+		}
+		if err := fn(tokens, blocks); err != nil {
+			return err
+		}
+		lastID = tokens[len(tokens)-1].ID
+	}
 }
 
 func (db *dbImpl) DocumentFromUri(uri string) (*types.Document, error) {
@@ -88,6 +262,49 @@ func (db *dbImpl) DocumentFromID(id uint) (*types.Document, error) {
 	return &document, nil
 }
 
+func (db *dbImpl) DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error) {
+	documents := []*types.Document{}
+	if err := db.db.Model(&types.Document{}).Where("time < ?", before).Order("time").Offset(int(offset)).Limit(int(count)).Find(&documents).Error; err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+func (db *dbImpl) TouchDocument(uri string, t time.Time) (bool, error) {
+	result := db.db.Model(&types.Document{}).Where("uri = ?", uri).Update("time", t)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (db *dbImpl) DocumentsAfterID(id uint, count uint) ([]*types.Document, error) {
+	documents := []*types.Document{}
+	if err := db.db.Model(&types.Document{}).Where("id > ?", id).Order("id").Limit(int(count)).Find(&documents).Error; err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+func (db *dbImpl) DocumentLengths(ids []uint, lang string) (map[uint]uint, error) {
+	rows := []struct {
+		ID         uint
+		TokenCount uint
+	}{}
+	query := db.db.Model(&types.Document{}).Select("id, token_count").Where("id IN ?", ids)
+	if lang != "" {
+		query = query.Where("lang = ?", lang)
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	lengths := make(map[uint]uint, len(rows))
+	for _, row := range rows {
+		lengths[row.ID] = row.TokenCount
+	}
+	return lengths, nil
+}
+
 func (db *dbImpl) CreateDcoument(document *types.Document) (*types.Document, error) {
 	if err := db.db.Model(&types.Document{}).Create(document).Error; err != nil {
 		return nil, err
@@ -95,6 +312,23 @@ func (db *dbImpl) CreateDcoument(document *types.Document) (*types.Document, err
 	return document, nil
 }
 
+func (db *dbImpl) UpdateDocument(document *types.Document) (*types.Document, error) {
+	if err := db.db.Save(document).Error; err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func (db *dbImpl) DeleteDocument(documentID uint) error {
+	if err := db.DeleteSentenceFromDocumentID(documentID); err != nil {
+		return err
+	}
+	if err := db.db.Delete(&types.Document{}, documentID).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
 func (db *dbImpl) TokenFromString(token string) (*types.Token, error) {
 	var tkn types.Token
 	err := db.db.Model(&types.Token{}).Where("token = ?", token).First(&tkn).Error
@@ -126,19 +360,127 @@ func (db *dbImpl) CreateToken(token *types.Token) (*types.Token, error) {
 	return token, nil
 }
 
+func (db *dbImpl) UpdateTokenMaxTermRatio(tokenID uint, ratio float64) error {
+	if err := db.db.Model(&types.Token{}).Where("id = ? AND max_term_ratio < ?", tokenID, ratio).Update("max_term_ratio", ratio).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
 func (db *dbImpl) PostingList(tokenID uint) ([]*types.Posting, error) {
-	lsit := []*types.Posting{}
-	if err := db.db.Model(&types.Posting{}).Where("token_id = ?", tokenID).Preload("Sentences").Find(&lsit).Error; err != nil {
+	blocks, err := db.postingStore.Load([]uint{tokenID})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodePostingBlocks(blocks[tokenID])
+	if err != nil {
 		return nil, err
 	}
-	return lsit, nil
+	list := make([]*types.Posting, len(entries))
+	if len(entries) == 0 {
+		return list, nil
+	}
+	documentIDs := make([]uint, len(entries))
+	for i, entry := range entries {
+		documentIDs[i] = entry.documentID
+	}
+	sentences := []*types.Sentence{}
+	if err := db.db.Model(&types.Sentence{}).Where("document_id IN ?", documentIDs).Find(&sentences).Error; err != nil {
+		return nil, err
+	}
+	type sentenceKey struct {
+		documentID uint
+		index      uint
+	}
+	sentenceMap := make(map[sentenceKey]*types.Sentence, len(sentences))
+	for _, sentence := range sentences {
+		sentenceMap[sentenceKey{sentence.DocumentID, sentence.Index}] = sentence
+	}
+	for i, entry := range entries {
+		posting := &types.Posting{
+			TokenID:       tokenID,
+			DocumentID:    entry.documentID,
+			TermFrequency: entry.termFrequency,
+			Positions:     entry.positions,
+			Sentences:     []*types.Sentence{},
+		}
+		for _, index := range entry.sentences {
+			if sentence, ok := sentenceMap[sentenceKey{entry.documentID, index}]; ok {
+				posting.Sentences = append(posting.Sentences, sentence)
+			}
+		}
+		list[i] = posting
+	}
+	return list, nil
 }
 
-func (db *dbImpl) CreatePosting(posting *types.Posting) (*types.Posting, error) {
-	if err := db.db.Model(&types.Posting{}).Create(posting).Error; err != nil {
-		return nil, err
+func (db *dbImpl) PostingBlocks(tokenIDs []uint) (map[uint][]byte, error) {
+	return db.postingStore.Load(tokenIDs)
+}
+
+// 先にトークンを記録してから追加するので、途中で失敗しても記録にないポスティングは残らない。
+// 同じトークンへの追加は直列になるので、ドキュメントの中ではトークンID順に追加する
+func (db *dbImpl) CreatePostings(documentID uint, postings []*types.Posting) error {
+	postings = append([]*types.Posting{}, postings...)
+	sort.Slice(postings, func(i, j int) bool {
+		return postings[i].TokenID < postings[j].TokenID
+	})
+	tokenIDs := make([]uint, len(postings))
+	for i, posting := range postings {
+		tokenIDs[i] = posting.TokenID
+	}
+	if err := db.db.Transaction(func(tx *gorm.DB) error {
+		return db.updateDocumentTokens(tx, documentID, func(current []uint) []uint {
+			return mergeTokenIDs(current, tokenIDs)
+		})
+	}); err != nil {
+		return err
 	}
-	return posting, nil
+	for _, posting := range postings {
+		if err := db.postingStore.Add(posting.TokenID, newPostingEntry(posting)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// センテンスはドキュメントの中での順番だけを保存する
+func newPostingEntry(posting *types.Posting) postingEntry {
+	indexes := map[uint]struct{}{}
+	for _, sentence := range posting.Sentences {
+		indexes[sentence.Index] = struct{}{}
+	}
+	entry := postingEntry{
+		documentID:    posting.DocumentID,
+		termFrequency: posting.TermFrequency,
+		positions:     posting.Positions,
+	}
+	for index := range indexes {
+		entry.sentences = append(entry.sentences, index)
+	}
+	sort.Slice(entry.sentences, func(i, j int) bool { return entry.sentences[i] < entry.sentences[j] })
+	return entry
+}
+
+// ドキュメントのトークンの記録を書き換える。同じドキュメントへの更新は直列になる。空にすると削除
+func (db *dbImpl) updateDocumentTokens(tx *gorm.DB, documentID uint, update func(current []uint) []uint) error {
+	// ポスティングリストと同じく、先に行を作ってある行だけをロックする
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&types.DocumentTokens{DocumentID: documentID}).Error; err != nil {
+		return err
+	}
+	var row types.DocumentTokens
+	if err := tx.Model(&types.DocumentTokens{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("document_id = ?", documentID).First(&row).Error; err != nil {
+		return err
+	}
+	current, err := decodeTokenIDs(row.Data)
+	if err != nil {
+		return err
+	}
+	tokenIDs := update(current)
+	if len(tokenIDs) == 0 {
+		return tx.Where("document_id = ?", documentID).Delete(&types.DocumentTokens{}).Error
+	}
+	return tx.Model(&types.DocumentTokens{}).Where("document_id = ?", documentID).Update("data", encodeTokenIDs(tokenIDs)).Error
 }
 
 func (db *dbImpl) SentenceMultiFromID(ids []uint) ([]*types.Sentence, error) {
@@ -149,6 +491,53 @@ func (db *dbImpl) SentenceMultiFromID(ids []uint) ([]*types.Sentence, error) {
 	return sentences, nil
 }
 
+func (db *dbImpl) SentenceIDsFromPostings(documentID uint, tokenIDs []uint) ([]uint, error) {
+	blocks, err := db.postingStore.Load(tokenIDs)
+	if err != nil {
+		return nil, err
+	}
+	indexes := map[uint]struct{}{}
+	for _, data := range blocks {
+		reader, err := newPostingBlockReader(data)
+		if err != nil {
+			return nil, err
+		}
+		if reader.Seek(documentID); !reader.Done() && reader.DocumentID() == documentID {
+			for _, index := range reader.Entry().sentences {
+				indexes[index] = struct{}{}
+			}
+		}
+		if err := reader.Err(); err != nil {
+			return nil, err
+		}
+	}
+	ids := []uint{}
+	if len(indexes) == 0 {
+		return ids, nil
+	}
+	list := make([]uint, 0, len(indexes))
+	for index := range indexes {
+		list = append(list, index)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	// indexはMySQLの予約語なので、列名はgormに書かせる
+	if err := db.db.Model(&types.Sentence{}).
+		Where(map[string]interface{}{"document_id": documentID, "index": list}).
+		Order("id").
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (db *dbImpl) SentencesFromDocumentID(documentID uint) ([]*types.Sentence, error) {
+	sentences := []*types.Sentence{}
+	if err := db.db.Model(&types.Sentence{}).Where("document_id = ?", documentID).Order(clause.OrderByColumn{Column: clause.Column{Name: "index"}}).Find(&sentences).Error; err != nil {
+		return nil, err
+	}
+	return sentences, nil
+}
+
 func (db *dbImpl) CreateSentence(sentence *types.Sentence) (*types.Sentence, error) {
 	if err := db.db.Model(&types.Sentence{}).Create(sentence).Error; err != nil {
 		return nil, err
@@ -156,31 +545,447 @@ func (db *dbImpl) CreateSentence(sentence *types.Sentence) (*types.Sentence, err
 	return sentence, nil
 }
 
+// SQLの保存先なら、圧縮したポスティングリストも同じトランザクションで取り除く。
+// それ以外はロールバックできないので、センテンスを消してから取り除き、取り除き終わるまでトークンの記録を残す。
+// 途中で失敗しても、登録し直すときか削除し直すときに残りを取り除く
 func (db *dbImpl) DeleteSentenceFromDocumentID(documentID uint) error {
+	_, transactional := db.postingStore.(*sqlPostingStore)
+	tokenIDs := []uint{}
 	if err := db.db.Transaction(func(tx *gorm.DB) error {
-		sentences := []*types.Sentence{}
-		if err := tx.Model(&types.Sentence{}).Where("document_id = ?", documentID).Preload("Postings").Find(&sentences).Error; err != nil {
+		if err := tx.Where("document_id = ?", documentID).Delete(&types.Sentence{}).Error; err != nil {
+			return err
+		}
+		var row types.DocumentTokens
+		err := tx.Where("document_id = ?", documentID).Limit(1).Find(&row).Error
+		if err != nil {
 			return err
 		}
-		if len(sentences) > 0 {
-			if err := tx.Model(&types.Sentence{}).Select("Postings").Delete(&sentences).Error; err != nil {
+		if tokenIDs, err = decodeTokenIDs(row.Data); err != nil {
+			return err
+		}
+		if !transactional || len(tokenIDs) == 0 {
+			return nil
+		}
+		store := &sqlPostingStore{db: tx, transaction: true}
+		for _, tokenID := range tokenIDs {
+			if err := store.Remove(tokenID, documentID); err != nil {
 				return err
 			}
-			postings := []int{}
-			for _, sentence := range sentences {
-				for _, posting := range sentence.Postings {
-					postings = append(postings, int(posting.ID))
-				}
+		}
+		return tx.Where("document_id = ?", documentID).Delete(&types.DocumentTokens{}).Error
+	}); err != nil {
+		return err
+	}
+	if transactional || len(tokenIDs) == 0 {
+		return nil
+	}
+	for _, tokenID := range tokenIDs {
+		if err := db.postingStore.Remove(tokenID, documentID); err != nil {
+			return err
+		}
+	}
+	return db.db.Where("document_id = ?", documentID).Delete(&types.DocumentTokens{}).Error
+}
+
+func (db *dbImpl) OrphanPostings() ([]types.OrphanPosting, error) {
+	orphans := []types.OrphanPosting{}
+	err := db.eachPostingBlocks(db.db, db.postingStore, func(tokens []*types.Token, blocks map[uint][]byte) error {
+		found, err := db.orphanPostings(db.db, tokens, blocks)
+		orphans = append(orphans, found...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// ポスティングリストのうち、ドキュメントが存在しないかセンテンスがないもの
+func (db *dbImpl) orphanPostings(tx *gorm.DB, tokens []*types.Token, blocks map[uint][]byte) ([]types.OrphanPosting, error) {
+	entries, existing, err := db.postingDocuments(tx, tokens, blocks)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []types.OrphanPosting{}
+	for _, token := range tokens {
+		for _, entry := range entries[token.ID] {
+			if _, ok := existing[entry.documentID]; ok && len(entry.sentences) > 0 {
+				continue
 			}
-			if len(postings) > 0 {
-				if err := tx.Model(&types.Posting{}).Delete(&types.Posting{}, postings).Error; err != nil {
+			orphans = append(orphans, types.OrphanPosting{TokenID: token.ID, DocumentID: entry.documentID})
+		}
+	}
+	return orphans, nil
+}
+
+// トークンごとに展開したポスティングリストと、そのうち論理削除されずに存在するドキュメント
+func (db *dbImpl) postingDocuments(tx *gorm.DB, tokens []*types.Token, blocks map[uint][]byte) (map[uint][]postingEntry, map[uint]struct{}, error) {
+	entries := map[uint][]postingEntry{}
+	documentIDs := map[uint]struct{}{}
+	for _, token := range tokens {
+		list, err := decodePostingBlocks(blocks[token.ID])
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[token.ID] = list
+		for _, entry := range list {
+			documentIDs[entry.documentID] = struct{}{}
+		}
+	}
+	ids := make([]uint, 0, len(documentIDs))
+	for id := range documentIDs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	existing := map[uint]struct{}{}
+	for start := 0; start < len(ids); start += dbBatchSize {
+		end := start + dbBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		found := []uint{}
+		if err := tx.Model(&types.Document{}).Where("id IN ?", ids[start:end]).Pluck("id", &found).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, id := range found {
+			existing[id] = struct{}{}
+		}
+	}
+	return entries, existing, nil
+}
+
+func (db *dbImpl) DuplicateTokens() ([]types.DuplicateToken, error) {
+	tokens := []types.DuplicateToken{}
+	if err := db.db.Model(&types.Token{}).
+		Select("token, count(*) AS count").
+		Group("token").
+		Having("count(*) > 1").
+		Order("token").
+		Scan(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (db *dbImpl) TokenCountMismatches() ([]types.TokenCountMismatch, error) {
+	mismatches := []types.TokenCountMismatch{}
+	if err := db.db.Model(&types.Document{}).
+		Select(db.sql("documents.id AS document_id, documents.uri, documents.token_count, COALESCE(SUM(sentences.token_count), 0) AS sentence_token_count")).
+		Joins(db.sql("LEFT JOIN sentences ON sentences.document_id = documents.id AND sentences.deleted_at IS NULL")).
+		Group(db.sql("documents.id, documents.uri, documents.token_count")).
+		Having(db.sql("documents.token_count <> COALESCE(SUM(sentences.token_count), 0)")).
+		Order(db.sql("documents.id")).
+		Scan(&mismatches).Error; err != nil {
+		return nil, err
+	}
+	return mismatches, nil
+}
+
+// 登録や削除が止まっている間に呼ぶ。
+// 先にドキュメントが存在しないポスティングを取り除き、ポスティングリストが空になったトークンと一緒に行を消す
+func (db *dbImpl) Compact() (*types.CompactReport, error) {
+	report := &types.CompactReport{}
+	unused := []uint{}
+	if err := db.eachPostingBlocks(db.db, db.postingStore, func(tokens []*types.Token, blocks map[uint][]byte) error {
+		entries, existing, err := db.postingDocuments(db.db, tokens, blocks)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			removed := 0
+			for _, entry := range entries[token.ID] {
+				if _, ok := existing[entry.documentID]; ok {
+					continue
+				}
+				if err := db.postingStore.Remove(token.ID, entry.documentID); err != nil {
 					return err
 				}
+				removed++
+			}
+			report.Postings += uint(removed)
+			if removed == len(entries[token.ID]) {
+				unused = append(unused, token.ID)
 			}
 		}
 		return nil
 	}); err != nil {
+		return nil, err
+	}
+
+	if err := db.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&types.Sentence{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Sentences = uint(result.RowsAffected)
+
+		result = tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&types.Document{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Documents = uint(result.RowsAffected)
+
+		// 削除し終わらなかったドキュメントの記録も、ポスティングを取り除いたので要らない
+		if err := tx.Where(db.sql("NOT EXISTS (SELECT 1 FROM documents WHERE documents.id = document_tokens.document_id)")).Delete(&types.DocumentTokens{}).Error; err != nil {
+			return err
+		}
+
+		result = tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&types.Token{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.Tokens = uint(result.RowsAffected)
+		for start := 0; start < len(unused); start += dbBatchSize {
+			end := start + dbBatchSize
+			if end > len(unused) {
+				end = len(unused)
+			}
+			result = tx.Unscoped().Delete(&types.Token{}, unused[start:end])
+			if result.Error != nil {
+				return result.Error
+			}
+			report.Tokens += uint(result.RowsAffected)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (db *dbImpl) MergePostings() (*types.MergeReport, error) {
+	store, ok := db.postingStore.(mergeablePostingStore)
+	if !ok {
+		return &types.MergeReport{}, nil
+	}
+	return store.Merge()
+}
+
+func (db *dbImpl) FlushPostings() error {
+	store, ok := db.postingStore.(mergeablePostingStore)
+	if !ok {
+		return nil
+	}
+	return store.Flush()
+}
+
+func (db *dbImpl) Restore(r io.Reader) (*types.SnapshotReport, error) {
+	var report *types.SnapshotReport
+	err := db.transaction(func(tx *dbImpl) error {
+		snapshot := newSnapshotImport()
+		var err error
+		report, err = readSnapshot(r, func(line *snapshotLine) error {
+			return snapshot.Line(tx, line)
+		})
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// fnの中の変更を1つのトランザクションで行う。失敗したらSQLの行を戻し、
+// SQL以外の保存先に追加したポスティングは取り除く
+func (db *dbImpl) transaction(fn func(tx *dbImpl) error) error {
+	var recording *recordingPostingStore
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		var store postingStore
+		if _, ok := db.postingStore.(*sqlPostingStore); ok {
+			store = &sqlPostingStore{db: tx, transaction: true}
+		} else {
+			recording = &recordingPostingStore{postingStore: db.postingStore}
+			store = recording
+		}
+		return fn(&dbImpl{db: tx, postingStore: store, prefix: db.prefix})
+	})
+	if err != nil && recording != nil {
+		for _, added := range recording.added {
+			if removeErr := db.postingStore.Remove(added.tokenID, added.documentID); removeErr != nil {
+				return fmt.Errorf("%w (remove postings: %v)", err, removeErr)
+			}
+		}
+	}
+	return err
+}
+
+// 追加したポスティングを覚えておく保存先。トランザクションが失敗したら取り除く
+type recordingPostingStore struct {
+	postingStore
+	added []recordedPosting
+}
+
+type recordedPosting struct {
+	tokenID    uint
+	documentID uint
+}
+
+func (s *recordingPostingStore) Add(tokenID uint, entry postingEntry) error {
+	s.added = append(s.added, recordedPosting{tokenID: tokenID, documentID: entry.documentID})
+	return s.postingStore.Add(tokenID, entry)
+}
+
+func (db *dbImpl) Snapshot(w io.Writer, ready func()) (*types.SnapshotReport, error) {
+	var report *types.SnapshotReport
+	err := db.db.Transaction(func(tx *gorm.DB) error {
+		// 最初に読んだ時点の内容が、トランザクションの終わりまで見える
+		var count int64
+		if err := tx.Model(&types.Document{}).Count(&count).Error; err != nil {
+			return err
+		}
+		postings, consistent, err := db.postingSnapshot(tx)
+		if err != nil {
+			return err
+		}
+		defer postings.Close()
+		if consistent {
+			ready()
+		}
+		writer, err := newSnapshotWriter(w)
+		if err != nil {
+			return err
+		}
+		sentenceIndexes, err := db.snapshotDocuments(tx, writer)
+		if err != nil {
+			return err
+		}
+		if err := db.snapshotTokens(tx, writer, postings, sentenceIndexes); err != nil {
+			return err
+		}
+		report, err = writer.Close()
+		return err
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	return report, err
+}
+
+// トランザクションと同じ時点のポスティングリスト。用意できなければ今の内容を読み、falseを返す
+func (db *dbImpl) postingSnapshot(tx *gorm.DB) (postingSnapshot, bool, error) {
+	switch store := db.postingStore.(type) {
+	case *sqlPostingStore:
+		return nopPostingSnapshot{&sqlPostingStore{db: tx}}, true, nil
+	case snapshotablePostingStore:
+		snapshot, err := store.Snapshot()
+		if err != nil {
+			return nil, false, err
+		}
+		return snapshot, true, nil
+	default:
+		return nopPostingSnapshot{db.postingStore}, false, nil
+	}
+}
+
+// ドキュメントを文章と一緒にID順に書く。ドキュメントごとに、文章の順番から書いた順番への対応を返す
+func (db *dbImpl) snapshotDocuments(tx *gorm.DB, writer *snapshotWriter) (map[uint]map[uint]uint, error) {
+	sentenceIndexes := map[uint]map[uint]uint{}
+	for lastID := uint(0); ; {
+		documents := []*types.Document{}
+		if err := tx.Where("id > ?", lastID).Order("id").Limit(snapshotBatch).Find(&documents).Error; err != nil {
+			return nil, err
+		}
+		if len(documents) == 0 {
+			return sentenceIndexes, nil
+		}
+		ids := make([]uint, len(documents))
+		for i, document := range documents {
+			ids[i] = document.ID
+		}
+		sentences := []*types.Sentence{}
+		if err := tx.Where("document_id IN ?", ids).Find(&sentences).Error; err != nil {
+			return nil, err
+		}
+		sort.Slice(sentences, func(i, j int) bool {
+			if sentences[i].DocumentID != sentences[j].DocumentID {
+				return sentences[i].DocumentID < sentences[j].DocumentID
+			}
+			return sentences[i].Index < sentences[j].Index
+		})
+		documentSentences := map[uint][]snapshotSentence{}
+		for _, sentence := range sentences {
+			if _, ok := sentenceIndexes[sentence.DocumentID]; !ok {
+				sentenceIndexes[sentence.DocumentID] = map[uint]uint{}
+			}
+			sentenceIndexes[sentence.DocumentID][sentence.Index] = uint(len(documentSentences[sentence.DocumentID]))
+			documentSentences[sentence.DocumentID] = append(documentSentences[sentence.DocumentID], snapshotSentence{
+				Sentence:   sentence.Sentence,
+				TokenCount: sentence.TokenCount,
+				Field:      sentence.Field,
+			})
+		}
+		for _, document := range documents {
+			if err := writer.Document(&snapshotDocument{
+				ID:              document.ID,
+				Uri:             document.Uri,
+				Time:            document.Time,
+				TokenCount:      document.TokenCount,
+				Title:           document.Title,
+				Description:     document.Description,
+				ETag:            document.ETag,
+				LastModified:    document.LastModified,
+				Lang:            document.Lang,
+				AnalyzerVersion: document.AnalyzerVersion,
+				Sentences:       documentSentences[document.ID],
+			}); err != nil {
+				return nil, err
+			}
+		}
+		lastID = documents[len(documents)-1].ID
+	}
+}
+
+// トークンをID順に書き、それぞれのあとにポスティングを書く。
+// 出現する文章は、圧縮したポスティングリストの順番を書いた順番にする
+func (db *dbImpl) snapshotTokens(tx *gorm.DB, writer *snapshotWriter, postings postingLoader, sentenceIndexes map[uint]map[uint]uint) error {
+	for lastID := uint(0); ; {
+		tokens := []*types.Token{}
+		if err := tx.Where("id > ?", lastID).Order("id").Limit(snapshotBatch).Find(&tokens).Error; err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(tokens))
+		for i, token := range tokens {
+			ids[i] = token.ID
+		}
+		blocks, err := postings.Load(ids)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			if err := writer.Token(&snapshotToken{
+				ID:           token.ID,
+				Token:        token.Token,
+				MaxTermRatio: token.MaxTermRatio,
+			}); err != nil {
+				return err
+			}
+			entries, err := decodePostingBlocks(blocks[token.ID])
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				// 削除済みの文章は含めない
+				indexes := []uint{}
+				for _, index := range entry.sentences {
+					if written, ok := sentenceIndexes[entry.documentID][index]; ok {
+						indexes = append(indexes, written)
+					}
+				}
+				// 文章がなければ、同じ時点のドキュメントではない
+				if len(indexes) == 0 {
+					continue
+				}
+				if err := writer.Posting(&snapshotPosting{
+					TokenID:       token.ID,
+					DocumentID:    entry.documentID,
+					TermFrequency: entry.termFrequency,
+					Positions:     entry.positions,
+					Sentences:     indexes,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		lastID = tokens[len(tokens)-1].ID
 	}
-	return nil
 }
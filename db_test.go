@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"regexp"
 	"testing"
 	"time"
@@ -13,9 +15,15 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
 func getDBMock() (*gorm.DB, sqlmock.Sqlmock, error) {
+	return getPrefixedDBMock("")
+}
+
+// テーブル名に接頭辞を付ける
+func getPrefixedDBMock(prefix string) (*gorm.DB, sqlmock.Sqlmock, error) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		return nil, nil, err
@@ -28,7 +36,8 @@ func getDBMock() (*gorm.DB, sqlmock.Sqlmock, error) {
 		PreferSimpleProtocol: true,
 	})
 	gdb, err := gorm.Open(dialector, &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent),
+		Logger:         logger.Default.LogMode(logger.Silent),
+		NamingStrategy: schema.NamingStrategy{TablePrefix: prefix},
 	})
 	if err != nil {
 		return nil, nil, err
@@ -39,7 +48,7 @@ func getDBMock() (*gorm.DB, sqlmock.Sqlmock, error) {
 
 func TestCountDocument(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT count(1) FROM "documents" WHERE "documents"."deleted_at" IS NULL`,
 	)).WillReturnRows(
@@ -54,26 +63,26 @@ func TestCountDocument(t *testing.T) {
 	assert.Equal(t, count, uint(100))
 }
 
-func TestCountTermInDocument(t *testing.T) {
+func TestCountStaleDocument(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "documents" WHERE id = $1 AND "documents"."deleted_at" IS NULL ORDER BY "documents"."id" LIMIT 1`,
-	)).WithArgs(1).WillReturnRows(
-		sqlmock.NewRows([]string{"token_count"}).
-			AddRow(10),
+		`SELECT count(1) FROM "documents" WHERE (lang = $1 AND analyzer_version <> $2) AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs("ja", "v2").WillReturnRows(
+		sqlmock.NewRows([]string{"count(1)"}).
+			AddRow(3),
 	)
 
-	count, err := db.CountTermInDocument(1)
+	count, err := db.CountStaleDocument("ja", "v2")
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Equal(t, count, uint(10))
+	assert.Equal(t, count, uint(3))
 }
 
 func TestDocumentFromUri(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT * FROM "documents" WHERE uri = $1 AND "documents"."deleted_at" IS NULL ORDER BY "documents"."id" LIMIT 1`,
 	)).WithArgs("uri").WillReturnRows(
@@ -102,7 +111,7 @@ func TestDocumentFromUri(t *testing.T) {
 
 func TestDocumentFromID(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT * FROM "documents" WHERE id = $1 AND "documents"."deleted_at" IS NULL ORDER BY "documents"."id" LIMIT 1`,
 	)).WithArgs(10).WillReturnRows(
@@ -129,12 +138,96 @@ func TestDocumentFromID(t *testing.T) {
 	}
 }
 
+func TestDocumentsBefore(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "documents" WHERE time < $1 AND "documents"."deleted_at" IS NULL ORDER BY time LIMIT 10 OFFSET 20`,
+	)).WithArgs(time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "uri", "time"}).
+			AddRow(1, "uri1", time.Date(2014, time.December, 1, 0, 0, 0, 0, time.UTC)).
+			AddRow(2, "uri2", time.Date(2014, time.December, 2, 0, 0, 0, 0, time.UTC)),
+	)
+
+	documents, err := db.DocumentsBefore(time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC), 20, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]*types.Document{
+			{Model: gorm.Model{ID: 1}, Uri: "uri1", Time: time.Date(2014, time.December, 1, 0, 0, 0, 0, time.UTC)},
+			{Model: gorm.Model{ID: 2}, Uri: "uri2", Time: time.Date(2014, time.December, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		documents,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTouchDocument(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	for _, affected := range []int64{1, 0} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(
+			`UPDATE "documents" SET "time"=$1,"updated_at"=$2 WHERE uri = $3`,
+		)).WithArgs(time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC), sqlmock.AnyArg(), "uri").WillReturnResult(
+			sqlmock.NewResult(0, affected),
+		)
+		mock.ExpectCommit()
+
+		ok, err := db.TouchDocument("uri", time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC))
+		if err != nil {
+			t.Error(err)
+		}
+		if diff := cmp.Diff(affected > 0, ok); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDocumentLengths(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT id, token_count FROM "documents" WHERE id IN ($1,$2,$3) AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs(1, 2, 3).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token_count"}).
+			AddRow(1, 10).
+			AddRow(2, 20),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT id, token_count FROM "documents" WHERE id IN ($1,$2,$3) AND lang = $4 AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs(1, 2, 3, "en").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token_count"}).
+			AddRow(3, 30),
+	)
+
+	lengths, err := db.DocumentLengths([]uint{1, 2, 3}, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint]uint{1: 10, 2: 20}, lengths); diff != "" {
+		t.Errorf(diff)
+	}
+	lengths, err = db.DocumentLengths([]uint{1, 2, 3}, "en")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint]uint{3: 30}, lengths); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
 func TestCreateDcoument(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectBegin()
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`INSERT INTO "documents" ("created_at","updated_at","deleted_at","uri","time","token_count") VALUES ($1,$2,$3,$4,$5,$6) RETURNING "id"`,
+		`INSERT INTO "documents" ("created_at","updated_at","deleted_at","uri","time","token_count","title","description","etag","last_modified","lang","analyzer_version") VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12) RETURNING "id"`,
 	)).WithArgs(
 		sqlmock.AnyArg(),
 		sqlmock.AnyArg(),
@@ -142,6 +235,12 @@ func TestCreateDcoument(t *testing.T) {
 		"uri",
 		time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
 		100,
+		"",
+		"",
+		"",
+		"",
+		"ja",
+		"",
 	).WillReturnRows(
 		sqlmock.NewRows([]string{"id"}).AddRow(10),
 	)
@@ -151,6 +250,7 @@ func TestCreateDcoument(t *testing.T) {
 		Uri:        "uri",
 		Time:       time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
 		TokenCount: 100,
+		Lang:       "ja",
 	})
 	if err != nil {
 		t.Error(err)
@@ -163,6 +263,7 @@ func TestCreateDcoument(t *testing.T) {
 			Uri:        "uri",
 			Time:       time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
 			TokenCount: 100,
+			Lang:       "ja",
 		},
 		document,
 		cmpopts.IgnoreFields(*document, "Model.CreatedAt"),
@@ -172,9 +273,67 @@ func TestCreateDcoument(t *testing.T) {
 	}
 }
 
+func TestUpdateDocument(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "documents" SET "created_at"=$1,"updated_at"=$2,"deleted_at"=$3,"uri"=$4,"time"=$5,"token_count"=$6,"title"=$7,"description"=$8,"etag"=$9,"last_modified"=$10,"lang"=$11,"analyzer_version"=$12 WHERE "id" = $13`,
+	)).WithArgs(
+		sqlmock.AnyArg(),
+		sqlmock.AnyArg(),
+		nil,
+		"uri",
+		time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
+		100,
+		"title",
+		"description",
+		"\"etag\"",
+		"",
+		"",
+		"",
+		10,
+	).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectCommit()
+
+	document, err := db.UpdateDocument(&types.Document{
+		Model: gorm.Model{
+			ID: 10,
+		},
+		Uri:         "uri",
+		Time:        time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
+		TokenCount:  100,
+		Title:       "title",
+		Description: "description",
+		ETag:        "\"etag\"",
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		&types.Document{
+			Model: gorm.Model{
+				ID: 10,
+			},
+			Uri:         "uri",
+			Time:        time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC),
+			TokenCount:  100,
+			Title:       "title",
+			Description: "description",
+			ETag:        "\"etag\"",
+		},
+		document,
+		cmpopts.IgnoreFields(*document, "Model.UpdatedAt"),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
 func TestTokenFromString(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT * FROM "tokens" WHERE token = $1 AND "tokens"."deleted_at" IS NULL ORDER BY "tokens"."id" LIMIT 1`,
 	)).WithArgs("token").WillReturnRows(
@@ -201,7 +360,7 @@ func TestTokenFromString(t *testing.T) {
 
 func TestTokenFromID(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT * FROM "tokens" WHERE id = $1 AND "tokens"."deleted_at" IS NULL ORDER BY "tokens"."id" LIMIT 1`,
 	)).WithArgs(10).WillReturnRows(
@@ -228,15 +387,16 @@ func TestTokenFromID(t *testing.T) {
 
 func TestCreateToken(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectBegin()
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`INSERT INTO "tokens" ("created_at","updated_at","deleted_at","token") VALUES ($1,$2,$3,$4) RETURNING "id"`,
+		`INSERT INTO "tokens" ("created_at","updated_at","deleted_at","token","max_term_ratio") VALUES ($1,$2,$3,$4,$5) RETURNING "id"`,
 	)).WithArgs(
 		sqlmock.AnyArg(),
 		sqlmock.AnyArg(),
 		nil,
 		"token",
+		0.0,
 	).WillReturnRows(
 		sqlmock.NewRows([]string{"id"}).AddRow(11),
 	)
@@ -263,28 +423,37 @@ func TestCreateToken(t *testing.T) {
 	}
 }
 
-func TestPostingList(t *testing.T) {
+func TestUpdateTokenMaxTermRatio(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "postings" WHERE token_id = $1 AND "postings"."deleted_at" IS NULL`,
-	)).WithArgs(10).WillReturnRows(
-		sqlmock.NewRows([]string{"id", "token_id", "document_id"}).
-			AddRow(10, 10, 1),
-	)
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "posting_sentences" WHERE "posting_sentences"."posting_id" = $1`,
-	)).WithArgs(10).WillReturnRows(
-		sqlmock.NewRows([]string{"id", "posting_id", "sentence_id"}).
-			AddRow(10, 10, 12).
-			AddRow(10, 10, 13),
+	db, _ := newDb(gdb, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "tokens" SET "max_term_ratio"=$1,"updated_at"=$2 WHERE id = $3 AND max_term_ratio < $4`,
+	)).WithArgs(0.5, sqlmock.AnyArg(), 1, 0.5).WillReturnResult(
+		sqlmock.NewResult(0, 1),
 	)
+	mock.ExpectCommit()
+
+	if err := db.UpdateTokenMaxTermRatio(1, 0.5); err != nil {
+		t.Error(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPostingList(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(10, postingEntry{documentID: 1, termFrequency: 2, positions: []uint{0, 4}, sentences: []uint{0, 2}})
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "sentences" WHERE "sentences"."id" IN ($1,$2) AND "sentences"."deleted_at" IS NULL`,
-	)).WithArgs(12, 13).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).
-			AddRow(12).
-			AddRow(13),
+		`SELECT * FROM "sentences" WHERE document_id IN ($1) AND "sentences"."deleted_at" IS NULL`,
+	)).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "document_id", "index"}).
+			AddRow(12, 1, 0).
+			AddRow(13, 1, 1).
+			AddRow(14, 1, 2),
 	)
 
 	ps, err := db.PostingList(10)
@@ -293,20 +462,14 @@ func TestPostingList(t *testing.T) {
 	}
 	if diff := cmp.Diff(
 		[]*types.Posting{{
-			Model: gorm.Model{
-				ID: 10,
+			TokenID:       10,
+			DocumentID:    1,
+			TermFrequency: 2,
+			Positions:     []uint{0, 4},
+			Sentences: []*types.Sentence{
+				{Model: gorm.Model{ID: 12}, DocumentID: 1, Index: 0},
+				{Model: gorm.Model{ID: 14}, DocumentID: 1, Index: 2},
 			},
-			TokenID:    10,
-			DocumentID: 1,
-			Sentences: []*types.Sentence{{
-				Model: gorm.Model{
-					ID: 12,
-				},
-			}, {
-				Model: gorm.Model{
-					ID: 13,
-				},
-			}},
 		}},
 		ps,
 	); diff != "" {
@@ -314,79 +477,77 @@ func TestPostingList(t *testing.T) {
 	}
 }
 
-func TestCreatePosting(t *testing.T) {
+func TestPostingBlocks(t *testing.T) {
+	gdb, _, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	data := encodePostingBlocks([]postingEntry{{documentID: 1, termFrequency: 1, positions: []uint{0}}})
+	store.Update(10, func([]byte) ([]byte, error) { return data, nil })
+
+	// ポスティングリストがないトークンは含めない
+	actual, err := db.PostingBlocks([]uint{10, 11})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint][]byte{10: data}, actual); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestCreatePostings(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
 	mock.ExpectBegin()
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`INSERT INTO "postings" ("created_at","updated_at","deleted_at","token_id","document_id") VALUES ($1,$2,$3,$4,$5) RETURNING "id"`,
-	)).WithArgs(
-		sqlmock.AnyArg(),
-		sqlmock.AnyArg(),
-		nil,
-		1,
-		2,
-	).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).AddRow(10),
+	mock.ExpectExec(regexp.QuoteMeta(
+		`INSERT INTO "document_tokens" ("document_id","data") VALUES ($1,$2) ON CONFLICT DO NOTHING`,
+	)).WithArgs(2, sqlmock.AnyArg()).WillReturnResult(
+		sqlmock.NewResult(1, 1),
 	)
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`INSERT INTO "sentences" ("created_at","updated_at","deleted_at","document_id","index","sentence","token_count") VALUES ($1,$2,$3,$4,$5,$6,$7) ON CONFLICT DO NOTHING RETURNING "id"`,
-	)).WithArgs(
-		sqlmock.AnyArg(),
-		sqlmock.AnyArg(),
-		nil,
-		2,
-		0,
-		"test",
-		4,
-	).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).AddRow(11),
+		`SELECT * FROM "document_tokens" WHERE document_id = $1 ORDER BY "document_tokens"."document_id" LIMIT 1 FOR UPDATE`,
+	)).WithArgs(2).WillReturnRows(
+		sqlmock.NewRows([]string{"document_id", "data"}).AddRow(2, encodeTokenIDs([]uint{3})),
 	)
+	// 前に記録したトークンも残す
 	mock.ExpectExec(regexp.QuoteMeta(
-		`INSERT INTO "posting_sentences" ("posting_id","sentence_id") VALUES ($1,$2) ON CONFLICT DO NOTHING`,
-	)).WithArgs(
-		10,
-		11,
-	).WillReturnResult(
+		`UPDATE "document_tokens" SET "data"=$1 WHERE document_id = $2`,
+	)).WithArgs(encodeTokenIDs([]uint{1, 3, 4}), 2).WillReturnResult(
 		sqlmock.NewResult(1, 1),
 	)
 	mock.ExpectCommit()
 
-	posting, err := db.CreatePosting(&types.Posting{
-		TokenID:    1,
-		DocumentID: 2,
-		Sentences: []*types.Sentence{{
-			DocumentID: 2,
-			Index:      0,
-			Sentence:   "test",
-			TokenCount: 4,
-		}},
-	})
-	if err != nil {
+	if err := db.CreatePostings(2, []*types.Posting{{
+		TokenID:       4,
+		DocumentID:    2,
+		TermFrequency: 1,
+		Positions:     []uint{2},
+		Sentences:     []*types.Sentence{{DocumentID: 2, Index: 1}},
+	}, {
+		TokenID:       1,
+		DocumentID:    2,
+		TermFrequency: 3,
+		Positions:     []uint{0, 4, 9},
+		Sentences: []*types.Sentence{
+			{DocumentID: 2, Index: 1},
+			{DocumentID: 2, Index: 0},
+			{DocumentID: 2, Index: 1},
+		},
+	}}); err != nil {
 		t.Error(err)
 	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// 文章はドキュメントの中での順番だけを重複なく保存する
+	data, _ := store.Load([]uint{1, 4})
 	if diff := cmp.Diff(
-		&types.Posting{
-			Model: gorm.Model{
-				ID: 10,
-			},
-			TokenID:    1,
-			DocumentID: 2,
-			Sentences: []*types.Sentence{{
-				Model: gorm.Model{
-					ID: 11,
-				},
-				DocumentID: 2,
-				Index:      0,
-				Sentence:   "test",
-				TokenCount: 4,
-			}},
+		map[uint][]byte{
+			1: encodePostingBlocks([]postingEntry{{documentID: 2, termFrequency: 3, positions: []uint{0, 4, 9}, sentences: []uint{0, 1}}}),
+			4: encodePostingBlocks([]postingEntry{{documentID: 2, termFrequency: 1, positions: []uint{2}, sentences: []uint{1}}}),
 		},
-		posting,
-		cmpopts.IgnoreFields(*posting, "Model.CreatedAt"),
-		cmpopts.IgnoreFields(*posting, "Model.UpdatedAt"),
-		cmpopts.IgnoreFields(*posting, "Sentences", "Model.CreatedAt"),
-		cmpopts.IgnoreFields(*posting, "Sentences", "Model.UpdatedAt"),
+		data,
 	); diff != "" {
 		t.Errorf(diff)
 	}
@@ -394,7 +555,7 @@ func TestCreatePosting(t *testing.T) {
 
 func TestSentenceMultiFromID(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectQuery(regexp.QuoteMeta(
 		`SELECT * FROM "sentences" WHERE "sentences"."id" IN ($1,$2,$3) AND "sentences"."deleted_at" IS NULL`,
 	)).WithArgs(
@@ -422,12 +583,72 @@ func TestSentenceMultiFromID(t *testing.T) {
 	}
 }
 
+func TestSentenceIDsFromPostings(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 5, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(1, postingEntry{documentID: 6, termFrequency: 1, positions: []uint{0}, sentences: []uint{3}})
+	store.Add(2, postingEntry{documentID: 5, termFrequency: 2, positions: []uint{1, 5}, sentences: []uint{0, 2}})
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT "id" FROM "sentences" WHERE "document_id" = $1 AND "index" IN ($2,$3) AND "sentences"."deleted_at" IS NULL ORDER BY id`,
+	)).WithArgs(5, 0, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).
+			AddRow(2).
+			AddRow(3),
+	)
+
+	ids, err := db.SentenceIDsFromPostings(5, []uint{1, 2, 3})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]uint{2, 3}, ids); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// ポスティングがなければ問い合わせない
+	ids, err = db.SentenceIDsFromPostings(7, []uint{1})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]uint{}, ids); diff != "" {
+		t.Errorf(diff)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSentenceIDsFromPostingsPrefix(t *testing.T) {
+	gdb, mock, _ := getPrefixedDBMock("index_docs_")
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "index_docs_posting_blocks" WHERE token_id IN ($1)`,
+	)).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"token_id", "data"}).
+			AddRow(1, encodePostingBlocks([]postingEntry{{documentID: 5, termFrequency: 1, positions: []uint{0}, sentences: []uint{1}}})),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT "id" FROM "index_docs_sentences" WHERE "document_id" = $1 AND "index" = $2 AND "index_docs_sentences"."deleted_at" IS NULL ORDER BY id`,
+	)).WithArgs(5, 1).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(2),
+	)
+
+	ids, err := db.SentenceIDsFromPostings(5, []uint{1})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]uint{2}, ids); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
 func TestCreateSentence(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	db, _ := newDb(gdb, nil)
 	mock.ExpectBegin()
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`INSERT INTO "sentences" ("created_at","updated_at","deleted_at","document_id","index","sentence","token_count") VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING "id"`,
+		`INSERT INTO "sentences" ("created_at","updated_at","deleted_at","document_id","index","sentence","token_count","field") VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING "id"`,
 	)).WithArgs(
 		sqlmock.AnyArg(),
 		sqlmock.AnyArg(),
@@ -436,6 +657,7 @@ func TestCreateSentence(t *testing.T) {
 		0,
 		"test",
 		100,
+		"body",
 	).WillReturnRows(
 		sqlmock.NewRows([]string{"id"}).AddRow(10),
 	)
@@ -446,6 +668,7 @@ func TestCreateSentence(t *testing.T) {
 		Index:      0,
 		Sentence:   "test",
 		TokenCount: 100,
+		Field:      "body",
 	})
 	if err != nil {
 		t.Error(err)
@@ -459,6 +682,7 @@ func TestCreateSentence(t *testing.T) {
 			Index:      0,
 			Sentence:   "test",
 			TokenCount: 100,
+			Field:      "body",
 		},
 		sentence,
 		cmpopts.IgnoreFields(*sentence, "Model.CreatedAt"),
@@ -470,53 +694,548 @@ func TestCreateSentence(t *testing.T) {
 
 func TestDeleteSentenceFromDocumentID(t *testing.T) {
 	gdb, mock, _ := getDBMock()
-	db, _ := newDb(gdb)
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Update(5, func([]byte) ([]byte, error) {
+		return encodePostingBlocks([]postingEntry{
+			{documentID: 10, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}},
+			{documentID: 20, termFrequency: 2, positions: []uint{1, 3}, sentences: []uint{0}},
+		}), nil
+	})
 	mock.ExpectBegin()
-	// mock.ExpectExec(regexp.QuoteMeta(
-	// 	`DELETE FROM "posting_sentences" WHERE "posting_sentences"."sentence_id" IN (NULL)`,
-	// )).WithArgs().WillReturnResult(
-	// 	sqlmock.NewResult(1, 1),
-	// )
-	// mock.ExpectExec(regexp.QuoteMeta(
-	// 	`UPDATE "sentences" SET "deleted_at"=$1 WHERE document_id = $2 AND "sentences"."deleted_at" IS NULL`,
-	// )).WithArgs(
-	// 	sqlmock.AnyArg(),
-	// 	10,
-	// ).WillReturnResult(
-	// 	sqlmock.NewResult(1, 1),
-	// )
-	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "sentences" WHERE document_id = $1 AND "sentences"."deleted_at" IS NULL`,
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "sentences" SET "deleted_at"=$1 WHERE document_id = $2 AND "sentences"."deleted_at" IS NULL`,
+	)).WithArgs(sqlmock.AnyArg(), 10).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "document_tokens" WHERE document_id = $1 LIMIT 1`,
 	)).WithArgs(10).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).AddRow(11),
+		sqlmock.NewRows([]string{"document_id", "data"}).AddRow(10, encodeTokenIDs([]uint{5})),
+	)
+	mock.ExpectCommit()
+	// ロールバックできない保存先からは、文章を消してから取り除き、最後に記録を消す
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "document_tokens" WHERE document_id = $1`,
+	)).WithArgs(10).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectCommit()
+	if err := db.DeleteSentenceFromDocumentID(10); err != nil {
+		t.Error(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// 圧縮したポスティングリストからも取り除かれる
+	data, _ := store.Load([]uint{5})
+	entries, err := decodePostingBlocks(data[5])
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 20, termFrequency: 2, positions: []uint{1, 3}, sentences: []uint{0}}},
+		entries,
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDeleteSentenceFromDocumentIDSQL(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	// SQLの保存先なら、ポスティングリストも同じトランザクションで取り除く
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "sentences" SET "deleted_at"=$1 WHERE document_id = $2 AND "sentences"."deleted_at" IS NULL`,
+	)).WithArgs(sqlmock.AnyArg(), 10).WillReturnResult(
+		sqlmock.NewResult(1, 1),
 	)
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "posting_sentences" WHERE "posting_sentences"."sentence_id" = $1`,
-	)).WithArgs(11).WillReturnRows(
-		sqlmock.NewRows([]string{"id", "sentence_id", "posting_id"}).AddRow(12, 11, 13),
+		`SELECT * FROM "document_tokens" WHERE document_id = $1 LIMIT 1`,
+	)).WithArgs(10).WillReturnRows(
+		sqlmock.NewRows([]string{"document_id", "data"}).AddRow(10, encodeTokenIDs([]uint{5})),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`INSERT INTO "posting_blocks" ("token_id","data","updated_at") VALUES ($1,$2,$3) ON CONFLICT DO NOTHING`,
+	)).WithArgs(5, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(
+		sqlmock.NewResult(0, 0),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "posting_blocks" WHERE token_id = $1 ORDER BY "posting_blocks"."token_id" LIMIT 1 FOR UPDATE`,
+	)).WithArgs(5).WillReturnRows(
+		sqlmock.NewRows([]string{"token_id", "data"}).
+			AddRow(5, encodePostingBlocks([]postingEntry{{documentID: 10, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}}})),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "posting_blocks" WHERE token_id = $1`,
+	)).WithArgs(5).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "document_tokens" WHERE document_id = $1`,
+	)).WithArgs(10).WillReturnResult(
+		sqlmock.NewResult(1, 1),
+	)
+	mock.ExpectCommit()
+	if err := db.DeleteSentenceFromDocumentID(10); err != nil {
+		t.Error(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteDocument(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`UPDATE "sentences" SET "deleted_at"=$1 WHERE document_id = $2 AND "sentences"."deleted_at" IS NULL`,
+	)).WithArgs(sqlmock.AnyArg(), 10).WillReturnResult(
+		sqlmock.NewResult(0, 0),
 	)
 	mock.ExpectQuery(regexp.QuoteMeta(
-		`SELECT * FROM "postings" WHERE "postings"."id" = $1 AND "postings"."deleted_at" IS NULL`,
-	)).WithArgs(13).WillReturnRows(
-		sqlmock.NewRows([]string{"id"}).AddRow(13),
+		`SELECT * FROM "document_tokens" WHERE document_id = $1 LIMIT 1`,
+	)).WithArgs(10).WillReturnRows(
+		sqlmock.NewRows([]string{"document_id", "data"}),
 	)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
 	mock.ExpectExec(regexp.QuoteMeta(
-		`DELETE FROM "posting_sentences" WHERE "posting_sentences"."sentence_id" = $1`,
-	)).WithArgs(11).WillReturnResult(
+		`UPDATE "documents" SET "deleted_at"=$1 WHERE "documents"."id" = $2 AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs(sqlmock.AnyArg(), 10).WillReturnResult(
 		sqlmock.NewResult(1, 1),
 	)
+	mock.ExpectCommit()
+	if err := db.DeleteDocument(10); err != nil {
+		t.Error(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCountToken(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT count(1) FROM "tokens" WHERE "tokens"."deleted_at" IS NULL`,
+	)).WillReturnRows(
+		sqlmock.NewRows([]string{"count(1)"}).
+			AddRow(200),
+	)
+
+	count, err := db.CountToken()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, count, uint(200))
+}
+
+func TestCountPosting(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(2, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{1}, sentences: []uint{0}})
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token"}).AddRow(1, "スモモ").AddRow(2, "モモ").AddRow(3, "もも"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	count, err := db.CountPosting()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, count, uint(3))
+}
+
+func TestCountSentence(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT count(1) FROM "sentences" WHERE "sentences"."deleted_at" IS NULL`,
+	)).WillReturnRows(
+		sqlmock.NewRows([]string{"count(1)"}).
+			AddRow(400),
+	)
+
+	count, err := db.CountSentence()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, count, uint(400))
+}
+
+func TestTopTerms(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(2, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{1}, sentences: []uint{0}})
+	store.Add(2, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(3, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{1}, sentences: []uint{0}})
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token"}).AddRow(1, "スモモ").AddRow(2, "モモ").AddRow(3, "もも").AddRow(4, "うち"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(4).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	terms, err := db.TopTerms(2)
+	if err != nil {
+		t.Error(err)
+	}
+	// 同じ数ならトークンID順
+	if diff := cmp.Diff(
+		[]types.TermCount{{Token: "モモ", DocumentCount: 2}, {Token: "スモモ", DocumentCount: 1}},
+		terms,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDocumentsAfterID(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "documents" WHERE id > $1 AND "documents"."deleted_at" IS NULL ORDER BY id LIMIT 2`,
+	)).WithArgs(10).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "uri"}).
+			AddRow(11, "uri11").
+			AddRow(13, "uri13"),
+	)
+
+	documents, err := db.DocumentsAfterID(10, 2)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]*types.Document{
+			{Model: gorm.Model{ID: 11}, Uri: "uri11"},
+			{Model: gorm.Model{ID: 13}, Uri: "uri13"},
+		},
+		documents,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestSentencesFromDocumentID(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "sentences" WHERE document_id = $1 AND "sentences"."deleted_at" IS NULL ORDER BY "index"`,
+	)).WithArgs(10).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "document_id", "index", "sentence", "field"}).
+			AddRow(1, 10, 0, "title", "title").
+			AddRow(2, 10, 1, "body", "body"),
+	)
+
+	sentences, err := db.SentencesFromDocumentID(10)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]*types.Sentence{
+			{Model: gorm.Model{ID: 1}, DocumentID: 10, Index: 0, Sentence: "title", Field: "title"},
+			{Model: gorm.Model{ID: 2}, DocumentID: 10, Index: 1, Sentence: "body", Field: "body"},
+		},
+		sentences,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestOrphanPostings(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	// 文章がない
+	store.Add(2, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{1}})
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token"}).AddRow(1, "スモモ").AddRow(2, "モモ"),
+	)
+	// ドキュメント2は削除されている
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT "id" FROM "documents" WHERE id IN ($1,$2) AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs(1, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	orphans, err := db.OrphanPostings()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]types.OrphanPosting{{TokenID: 1, DocumentID: 2}, {TokenID: 2, DocumentID: 1}},
+		orphans,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDuplicateTokens(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT token, count(*) AS count FROM "tokens" WHERE "tokens"."deleted_at" IS NULL GROUP BY "token" HAVING count(*) > 1 ORDER BY token`,
+	)).WillReturnRows(
+		sqlmock.NewRows([]string{"token", "count"}).
+			AddRow("モモ", 2),
+	)
+
+	tokens, err := db.DuplicateTokens()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]types.DuplicateToken{{Token: "モモ", Count: 2}}, tokens); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTokenCountMismatches(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	db, _ := newDb(gdb, nil)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT documents.id AS document_id, documents.uri, documents.token_count, COALESCE(SUM(sentences.token_count), 0) AS sentence_token_count FROM "documents" LEFT JOIN sentences ON sentences.document_id = documents.id AND sentences.deleted_at IS NULL WHERE "documents"."deleted_at" IS NULL GROUP BY documents.id, documents.uri, documents.token_count HAVING documents.token_count <> COALESCE(SUM(sentences.token_count), 0) ORDER BY documents.id`,
+	)).WillReturnRows(
+		sqlmock.NewRows([]string{"document_id", "uri", "token_count", "sentence_token_count"}).
+			AddRow(1, "uri", 10, 7),
+	)
+
+	mismatches, err := db.TokenCountMismatches()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]types.TokenCountMismatch{{DocumentID: 1, Uri: "uri", TokenCount: 10, SentenceTokenCount: 7}},
+		mismatches,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	store.Add(2, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{1}, sentences: []uint{0}})
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token"}).AddRow(1, "スモモ").AddRow(2, "モモ").AddRow(3, "もも"),
+	)
+	// ドキュメント2は削除されている
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT "id" FROM "documents" WHERE id IN ($1,$2) AND "documents"."deleted_at" IS NULL`,
+	)).WithArgs(1, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id"}).AddRow(1),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "sentences" WHERE deleted_at IS NOT NULL`,
+	)).WillReturnResult(
+		sqlmock.NewResult(0, 4),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "documents" WHERE deleted_at IS NOT NULL`,
+	)).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "document_tokens" WHERE NOT EXISTS (SELECT 1 FROM documents WHERE documents.id = document_tokens.document_id)`,
+	)).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "tokens" WHERE deleted_at IS NOT NULL`,
+	)).WillReturnResult(
+		sqlmock.NewResult(0, 1),
+	)
+	// ポスティングリストのないトークン
+	mock.ExpectExec(regexp.QuoteMeta(
+		`DELETE FROM "tokens" WHERE "tokens"."id" IN ($1,$2)`,
+	)).WithArgs(2, 3).WillReturnResult(
+		sqlmock.NewResult(0, 2),
+	)
+	mock.ExpectCommit()
+
+	report, err := db.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(&types.CompactReport{
+		Documents: 1,
+		Sentences: 4,
+		Postings:  2,
+		Tokens:    3,
+	}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	data, _ := store.Load([]uint{1, 2})
+	if diff := cmp.Diff(
+		map[uint][]byte{1: encodePostingBlocks([]postingEntry{{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}}})},
+		data,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newFilePostingStore(t.TempDir())
+	db, _ := newDb(gdb, store)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SAVEPOINT`)).WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectExec(regexp.QuoteMeta(
-		`UPDATE "sentences" SET "deleted_at"=$1 WHERE "sentences"."id" = $2 AND "sentences"."deleted_at" IS NULL`,
-	)).WithArgs(sqlmock.AnyArg(), 11).WillReturnResult(
+		`INSERT INTO "document_tokens" ("document_id","data") VALUES ($1,$2) ON CONFLICT DO NOTHING`,
+	)).WithArgs(2, sqlmock.AnyArg()).WillReturnResult(
 		sqlmock.NewResult(1, 1),
 	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "document_tokens" WHERE document_id = $1 ORDER BY "document_tokens"."document_id" LIMIT 1 FOR UPDATE`,
+	)).WithArgs(2).WillReturnRows(
+		sqlmock.NewRows([]string{"document_id", "data"}).AddRow(2, []byte{}),
+	)
 	mock.ExpectExec(regexp.QuoteMeta(
-		`UPDATE "postings" SET "deleted_at"=$1 WHERE "postings"."id" = $2 AND "postings"."deleted_at" IS NULL`,
-	)).WithArgs(sqlmock.AnyArg(), 13).WillReturnResult(
+		`UPDATE "document_tokens" SET "data"=$1 WHERE document_id = $2`,
+	)).WithArgs(encodeTokenIDs([]uint{1}), 2).WillReturnResult(
 		sqlmock.NewResult(1, 1),
 	)
+	mock.ExpectRollback()
+
+	err := db.transaction(func(tx *dbImpl) error {
+		if err := tx.CreatePostings(2, []*types.Posting{{
+			TokenID:       1,
+			DocumentID:    2,
+			TermFrequency: 1,
+			Positions:     []uint{3},
+			Sentences:     []*types.Sentence{{DocumentID: 2, Index: 0}},
+		}}); err != nil {
+			return err
+		}
+		return errors.New("error")
+	})
+	if err == nil {
+		t.Error("expected error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	// SQL以外の保存先に追加したポスティングは取り除き、前からあったものは残す
+	data, _ := store.Load([]uint{1})
+	if diff := cmp.Diff(
+		map[uint][]byte{1: encodePostingBlocks([]postingEntry{{documentID: 1, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}}})},
+		data,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newSegmentPostingStore(t.TempDir(), 100, 4)
+	db, _ := newDb(gdb, store)
+	store.Add(5, postingEntry{documentID: 1, termFrequency: 2, positions: []uint{0, 3}, sentences: []uint{0, 1}})
+	// スナップショットの時点にないドキュメント
+	store.Add(5, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}, sentences: []uint{0}})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT count(1) FROM "documents" WHERE "documents"."deleted_at" IS NULL`,
+	)).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "documents" WHERE id > $1 AND "documents"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "uri", "token_count", "lang"}).AddRow(1, "uri", 4, "ja"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "sentences" WHERE document_id IN ($1) AND "sentences"."deleted_at" IS NULL`,
+	)).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "document_id", "index", "sentence", "token_count", "field"}).
+			AddRow(11, 1, 1, "ペンです", 2, "body").
+			AddRow(10, 1, 0, "ペン", 2, "title"),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "documents" WHERE id > $1 AND "documents"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(0).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "token", "max_term_ratio"}).AddRow(5, "ペン", 0.5),
+	)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "tokens" WHERE id > $1 AND "tokens"."deleted_at" IS NULL ORDER BY id LIMIT 100`,
+	)).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"id"}))
 	mock.ExpectCommit()
-	if err := db.DeleteSentenceFromDocumentID(10); err != nil {
+
+	buf := bytes.Buffer{}
+	ready := false
+	report, err := db.Snapshot(&buf, func() {
+		ready = true
+		// 読める時点が決まったあとの変更は含めない
+		store.Add(5, postingEntry{documentID: 3, termFrequency: 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ready {
+		t.Errorf("ready should be called")
+	}
+	if diff := cmp.Diff(&types.SnapshotReport{Documents: 1, Tokens: 1, Postings: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Error(err)
 	}
+
+	lines := []*snapshotLine{}
+	if _, err := readSnapshot(&buf, func(line *snapshotLine) error {
+		lines = append(lines, line)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(
+		[]*snapshotLine{
+			{Document: &snapshotDocument{ID: 1, Uri: "uri", TokenCount: 4, Lang: "ja", Sentences: []snapshotSentence{
+				{Sentence: "ペン", TokenCount: 2, Field: "title"},
+				{Sentence: "ペンです", TokenCount: 2, Field: "body"},
+			}}},
+			{Token: &snapshotToken{ID: 5, Token: "ペン", MaxTermRatio: 0.5}},
+			{Posting: &snapshotPosting{TokenID: 5, DocumentID: 1, TermFrequency: 2, Positions: []uint{0, 3}, Sentences: []uint{0, 1}}},
+		},
+		lines,
+	); diff != "" {
+		t.Errorf(diff)
+	}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+var errInvalidExport = errors.New("invalid export")
+
+// 本文の文章をつなぐ区切り。どの文の分割でも段落の区切りになる
+const exportSentenceSeparator = "\n\n"
+
+// エクスポートの1行。解析結果は含まず、取り込むときに今の設定で解析し直す
+type exportDocument struct {
+	Uri          string       `json:"uri"`
+	Time         time.Time    `json:"time"`
+	Lang         string       `json:"lang,omitempty"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"last_modified,omitempty"`
+	Fields       exportFields `json:"fields"`
+	Body         string       `json:"body"`
+}
+
+// 本文以外のフィールド
+type exportFields struct {
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Headings    []string `json:"headings,omitempty"`
+}
+
+// 保存済みの文章からエクスポートの1行を作る
+func newExportDocument(document *types.Document, sentences []*types.Sentence) *exportDocument {
+	headings := []string{}
+	body := []string{}
+	for _, sentence := range sentences {
+		switch sentence.Field {
+		case fieldHeading:
+			headings = append(headings, sentence.Sentence)
+		case fieldBody:
+			body = append(body, sentence.Sentence)
+		}
+	}
+	return &exportDocument{
+		Uri:          document.Uri,
+		Time:         document.Time,
+		Lang:         document.Lang,
+		ETag:         document.ETag,
+		LastModified: document.LastModified,
+		Fields: exportFields{
+			// タイトルと説明は分割する前のものが残っている
+			Title:       document.Title,
+			Description: document.Description,
+			Headings:    headings,
+		},
+		Body: strings.Join(body, exportSentenceSeparator),
+	}
+}
+
+// 取り込むフィールドを登録するときの順番に並べる
+func (d *exportDocument) texts() []fieldText {
+	texts := []fieldText{
+		{field: fieldTitle, text: d.Fields.Title},
+		{field: fieldDescription, text: d.Fields.Description},
+	}
+	for _, heading := range d.Fields.Headings {
+		texts = append(texts, fieldText{field: fieldHeading, text: heading})
+	}
+	return append(texts, fieldText{field: fieldBody, text: d.Body})
+}
+
+// エクスポートを1行ずつ読む。空行は飛ばし、行番号は1から数える。
+// 読めない行はerrInvalidExportをvisitに渡して続ける
+func readExport(r io.Reader, visit func(line uint, document *exportDocument, err error) error) error {
+	reader := bufio.NewReader(r)
+	for line := uint(1); ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if data := bytes.TrimSpace(data); len(data) > 0 {
+			document := &exportDocument{}
+			var invalid error
+			if err := json.Unmarshal(data, document); err != nil {
+				invalid = fmt.Errorf("%w: %v", errInvalidExport, err)
+			} else if document.Uri == "" {
+				invalid = fmt.Errorf("%w: uri is required", errInvalidExport)
+			}
+			if err := visit(line, document, invalid); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
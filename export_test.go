@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
+)
+
+func TestNewExportDocument(t *testing.T) {
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+	document := newExportDocument(&types.Document{
+		Uri:         "uri",
+		Time:        indexed,
+		Title:       "ペンの話",
+		Description: "説明",
+		Lang:        "ja",
+		ETag:        "etag",
+	}, []*types.Sentence{
+		{Sentence: "ペンの話", Field: "title"},
+		{Sentence: "説明", Field: "description"},
+		{Sentence: "見出し", Field: "heading"},
+		{Sentence: "これはペンです。", Field: "body"},
+		{Sentence: "これはりんごです。", Field: "body"},
+	})
+	if diff := cmp.Diff(&exportDocument{
+		Uri:  "uri",
+		Time: indexed,
+		Lang: "ja",
+		ETag: "etag",
+		Fields: exportFields{
+			Title:       "ペンの話",
+			Description: "説明",
+			Headings:    []string{"見出し"},
+		},
+		Body: "これはペンです。\n\nこれはりんごです。",
+	}, document); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([]fieldText{
+		{field: "title", text: "ペンの話"},
+		{field: "description", text: "説明"},
+		{field: "heading", text: "見出し"},
+		{field: "body", text: "これはペンです。\n\nこれはりんごです。"},
+	}, document.texts(), cmp.AllowUnexported(fieldText{})); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestReadExport(t *testing.T) {
+	input := strings.Join([]string{
+		`{"uri":"a","body":"ペン"}`,
+		``,
+		`{"uri":"b"`,
+		`{"body":"りんご"}`,
+		// 最後の行は改行がなくてもよい
+		`{"uri":"c","fields":{"headings":["見出し"]}}`,
+	}, "\n")
+	type line struct {
+		Line    uint
+		Uri     string
+		Invalid bool
+	}
+	lines := []line{}
+	err := readExport(strings.NewReader(input), func(number uint, document *exportDocument, err error) error {
+		if err != nil && !errors.Is(err, errInvalidExport) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		lines = append(lines, line{Line: number, Uri: document.Uri, Invalid: err != nil})
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]line{
+		{Line: 1, Uri: "a"},
+		{Line: 3, Invalid: true},
+		{Line: 4, Invalid: true},
+		{Line: 5, Uri: "c"},
+	}, lines); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+// インデックスごとのスコアの分布を見積もる上位の件数
+const federatedSample = 100
+
+// 複数のインデックスをまとめて検索するときの1件
+type federatedHit struct {
+	index string
+	score float64
+	// インデックスの中での順位、同じスコアのときに使う
+	rank int
+}
+
+// 複数のインデックスを並列に検索してまとめる。
+// IDFや文書の長さはインデックスごとに計算されるので、そのままのスコアや1位との比は比べられない。
+// それぞれの上位federatedSample件の平均と標準偏差でzスコアにして、平均からどれだけ離れているかで並べる。
+// 分布はoffsetによらない上位から見積もるので、ページをまたいでも順番が変わらない。
+// 分布はスコアだけで見積もり、一致した文章はまとめたページに入った分だけ読む。
+// 解析できない言語などで失敗したインデックスは除いて、その名前を返す。すべて失敗したらエラー
+func (m *indexManager) Search(names []string, body string, lang string, prefix bool, offset, count uint) ([]types.SearchResult, []string, error) {
+	services := map[string]Service{}
+	releases := []func(){}
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := services[name]; ok {
+			continue
+		}
+		service, release, err := m.Acquire(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		releases = append(releases, release)
+		services[name] = service
+	}
+	if len(services) == 0 {
+		return nil, nil, fmt.Errorf("%w: no index", errInvalidIndexName)
+	}
+
+	// それぞれの上位offset+count件に入らないものは、まとめても範囲に入らない
+	limit := offset + count
+	if limit < federatedSample {
+		limit = federatedSample
+	}
+	wg := sync.WaitGroup{}
+	scores := make(map[string][]float64, len(services))
+	errs := map[string]error{}
+	resultsLock := sync.Mutex{}
+	for name, service := range services {
+		name, service := name, service
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := service.SearchScores(body, lang, prefix, limit)
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			scores[name] = result
+		}()
+	}
+	wg.Wait()
+
+	skipped := []string{}
+	for name, err := range errs {
+		log.Printf("federated search: index %s: %v", name, err)
+		skipped = append(skipped, name)
+	}
+	sort.Strings(skipped)
+	if len(scores) == 0 {
+		return nil, nil, fmt.Errorf("index %s: %w", skipped[0], errs[skipped[0]])
+	}
+
+	hits := []federatedHit{}
+	for name, result := range scores {
+		mean, stddev := scoreDistribution(result)
+		for rank, score := range result {
+			// 差がなければ分布でそろえられないので、そのままのスコアを使う
+			if stddev > 0 {
+				score = (score - mean) / stddev
+			}
+			hits = append(hits, federatedHit{index: name, score: score, rank: rank})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		if hits[i].index != hits[j].index {
+			return hits[i].index < hits[j].index
+		}
+		return hits[i].rank < hits[j].rank
+	})
+
+	merged := []types.SearchResult{}
+	if int(offset) >= len(hits) {
+		return merged, skipped, nil
+	}
+	hits = hits[offset:]
+	if len(hits) > int(count) {
+		hits = hits[:count]
+	}
+
+	// 同じインデックスの結果は順位の順に並ぶので、ページに入るのはインデックスごとに続いた順位になる
+	first := map[string]int{}
+	last := map[string]int{}
+	for _, hit := range hits {
+		if rank, ok := first[hit.index]; !ok || hit.rank < rank {
+			first[hit.index] = hit.rank
+		}
+		if hit.rank > last[hit.index] {
+			last[hit.index] = hit.rank
+		}
+	}
+	pages := make(map[string][]types.SearchResult, len(first))
+	for name := range first {
+		name, service := name, services[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := service.Search(body, lang, prefix, uint(first[name]), uint(last[name]-first[name]+1))
+			resultsLock.Lock()
+			defer resultsLock.Unlock()
+			if err != nil {
+				errs[name] = err
+				return
+			}
+			pages[name] = result
+		}()
+	}
+	wg.Wait()
+	for name := range first {
+		if err, ok := errs[name]; ok {
+			return nil, nil, fmt.Errorf("index %s: %w", name, err)
+		}
+	}
+
+	for _, hit := range hits {
+		// スコアを見積もったあとに削除されたドキュメントは除く
+		page := pages[hit.index]
+		if i := hit.rank - first[hit.index]; i < len(page) {
+			result := page[i]
+			result.Score = hit.score
+			result.Index = hit.index
+			merged = append(merged, result)
+		}
+	}
+	return merged, skipped, nil
+}
+
+// 高い順に並んだスコアの、上位federatedSample件の平均と標準偏差
+func scoreDistribution(scores []float64) (float64, float64) {
+	if len(scores) > federatedSample {
+		scores = scores[:federatedSample]
+	}
+	if len(scores) == 0 {
+		return 0, 0
+	}
+	sum := 0.0
+	for _, score := range scores {
+		sum += score
+	}
+	mean := sum / float64(len(scores))
+	variance := 0.0
+	for _, score := range scores {
+		variance += (score - mean) * (score - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(scores)))
+}
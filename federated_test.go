@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/hrntknr/searcher/mock"
+	"github.com/hrntknr/searcher/types"
+)
+
+func TestIndexManagerSearch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultService := mock.NewMockService(ctrl)
+	blog := mock.NewMockService(ctrl)
+	docs := mock.NewMockService(ctrl)
+	indexes, err := newIndexManager(defaultService, indexConfig{}, "", &testIndexBackend{
+		indexes:  []*types.Index{{Name: "blog", Config: `{}`}, {Name: "docs", Config: `{}`}},
+		services: map[string]Service{"blog": blog, "docs": docs},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// スコアの大きさがインデックスごとに違っても、それぞれの分布のzスコアでそろえる
+	blog.EXPECT().SearchScores("すもも", "ja", false, uint(federatedSample)).Return([]float64{8, 4, 2, 2}, nil).Times(2)
+	docs.EXPECT().SearchScores("すもも", "ja", false, uint(federatedSample)).Return([]float64{0.5, 0.25}, nil).Times(2)
+	// 文章はページに入った順位の分だけ読む
+	blog.EXPECT().Search("すもも", "ja", false, uint(0), uint(2)).Return([]types.SearchResult{
+		{Uri: "blog1", Score: 8, Sentences: []string{"すもも"}},
+		{Uri: "blog2", Score: 4},
+	}, nil)
+	docs.EXPECT().Search("すもも", "ja", false, uint(0), uint(1)).Return([]types.SearchResult{
+		{Uri: "docs1", Score: 0.5},
+	}, nil)
+	result, skipped, err := indexes.Search([]string{"docs", " blog", "docs"}, "すもも", "ja", false, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blogは平均4、標準偏差√6
+	if diff := cmp.Diff([]types.SearchResult{
+		{Uri: "blog1", Score: 4 / math.Sqrt(6), Sentences: []string{"すもも"}, Index: "blog"},
+		{Uri: "docs1", Score: 1, Index: "docs"},
+		{Uri: "blog2", Score: 0, Index: "blog"},
+	}, result, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([]string{}, skipped); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 次のページは前のページの続きになる
+	blog.EXPECT().Search("すもも", "ja", false, uint(1), uint(2)).Return([]types.SearchResult{
+		{Uri: "blog2", Score: 4},
+		{Uri: "blog3", Score: 2},
+	}, nil)
+	result, _, err = indexes.Search([]string{"blog", "docs"}, "すもも", "ja", false, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]types.SearchResult{
+		{Uri: "blog2", Score: 0, Index: "blog"},
+		{Uri: "blog3", Score: -2 / math.Sqrt(6), Index: "blog"},
+	}, result, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestIndexManagerSearchSkip(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultService := mock.NewMockService(ctrl)
+	blog := mock.NewMockService(ctrl)
+	indexes, err := newIndexManager(defaultService, indexConfig{}, "", &testIndexBackend{
+		indexes:  []*types.Index{{Name: "blog", Config: `{}`}},
+		services: map[string]Service{"blog": blog},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1つのインデックスが失敗しても、残りのインデックスの結果を返す
+	defaultService.EXPECT().SearchScores("pen", "en", false, uint(federatedSample)).Return([]float64{2}, nil)
+	blog.EXPECT().SearchScores("pen", "en", false, uint(federatedSample)).Return(nil, fmt.Errorf("%w: en", errUnsupportedLanguage))
+	defaultService.EXPECT().Search("pen", "en", false, uint(0), uint(1)).Return([]types.SearchResult{{Uri: "uri", Score: 2}}, nil)
+	result, skipped, err := indexes.Search([]string{"default", "blog"}, "pen", "en", false, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 差がなければそのままのスコアを使う
+	if diff := cmp.Diff([]types.SearchResult{{Uri: "uri", Score: 2, Index: "default"}}, result); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([]string{"blog"}, skipped); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestIndexManagerSearchInvalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultService := mock.NewMockService(ctrl)
+	defaultService.EXPECT().SearchScores("すもも", "xx", false, uint(federatedSample)).Return(nil, errUnsupportedLanguage)
+	indexes := newTestIndexManager(t, defaultService)
+
+	if _, _, err := indexes.Search([]string{"default", "blog"}, "すもも", "", false, 0, 10); !errors.Is(err, errIndexNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := indexes.Search([]string{"", " "}, "すもも", "", false, 0, 10); !errors.Is(err, errInvalidIndexName) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// すべてのインデックスが失敗したらエラー
+	if _, _, err := indexes.Search([]string{"default"}, "すもも", "xx", false, 0, 10); !errors.Is(err, errUnsupportedLanguage) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+)
+
+// snowballのGerman stemmer
+// https://snowballstem.org/algorithms/german/stemmer.html
+// github.com/kljensen/snowball にドイツ語がないので自前で実装する
+
+func isGermanVowel(r rune) bool {
+	switch r {
+	case 'a', 'e', 'i', 'o', 'u', 'y', 'ä', 'ö', 'ü':
+		return true
+	}
+	return false
+}
+
+func isGermanSEnding(r rune) bool {
+	return strings.ContainsRune("bdfghklmnrt", r)
+}
+
+func isGermanStEnding(r rune) bool {
+	return strings.ContainsRune("bdfghklmnt", r)
+}
+
+func stemGerman(word string) string {
+	w := []rune(strings.ReplaceAll(strings.ToLower(word), "ß", "ss"))
+
+	// 母音に挟まれたu、yは子音として扱う
+	for i := 1; i < len(w)-1; i++ {
+		if !isGermanVowel(w[i-1]) || !isGermanVowel(w[i+1]) {
+			continue
+		}
+		switch w[i] {
+		case 'u':
+			w[i] = 'U'
+		case 'y':
+			w[i] = 'Y'
+		}
+	}
+
+	r1 := germanRegion(w, 0)
+	r2 := germanRegion(w, r1)
+	if r1 < 3 {
+		r1 = 3
+	}
+
+	// Step 1
+	switch suffix := longestSuffix(w, "em", "ern", "er", "e", "en", "es", "s"); suffix {
+	case "em", "ern", "er":
+		if len(w)-len(suffix) >= r1 {
+			w = w[:len(w)-len(suffix)]
+		}
+	case "e", "en", "es":
+		if len(w)-len(suffix) >= r1 {
+			w = w[:len(w)-len(suffix)]
+			if hasSuffix(w, "niss") {
+				w = w[:len(w)-1]
+			}
+		}
+	case "s":
+		if len(w)-1 >= r1 && len(w) >= 2 && isGermanSEnding(w[len(w)-2]) {
+			w = w[:len(w)-1]
+		}
+	}
+
+	// Step 2
+	switch suffix := longestSuffix(w, "en", "er", "est", "st"); suffix {
+	case "en", "er", "est":
+		if len(w)-len(suffix) >= r1 {
+			w = w[:len(w)-len(suffix)]
+		}
+	case "st":
+		if len(w)-2 >= r1 && len(w) >= 6 && isGermanStEnding(w[len(w)-3]) {
+			w = w[:len(w)-2]
+		}
+	}
+
+	// Step 3
+	switch suffix := longestSuffix(w, "end", "ung", "ig", "ik", "isch", "lich", "heit", "keit"); suffix {
+	case "end", "ung":
+		if len(w)-len(suffix) >= r2 {
+			w = w[:len(w)-len(suffix)]
+			if hasSuffix(w, "ig") && len(w)-2 >= r2 && !hasSuffix(w[:len(w)-2], "e") {
+				w = w[:len(w)-2]
+			}
+		}
+	case "ig", "ik", "isch":
+		if len(w)-len(suffix) >= r2 && !hasSuffix(w[:len(w)-len(suffix)], "e") {
+			w = w[:len(w)-len(suffix)]
+		}
+	case "lich", "heit":
+		if len(w)-len(suffix) >= r2 {
+			w = w[:len(w)-len(suffix)]
+			if (hasSuffix(w, "er") || hasSuffix(w, "en")) && len(w)-2 >= r1 {
+				w = w[:len(w)-2]
+			}
+		}
+	case "keit":
+		if len(w)-len(suffix) >= r2 {
+			w = w[:len(w)-len(suffix)]
+			if hasSuffix(w, "lich") && len(w)-4 >= r2 {
+				w = w[:len(w)-4]
+			} else if hasSuffix(w, "ig") && len(w)-2 >= r2 {
+				w = w[:len(w)-2]
+			}
+		}
+	}
+
+	return strings.NewReplacer("U", "u", "Y", "y", "ä", "a", "ö", "o", "ü", "u").Replace(string(w))
+}
+
+// 母音の後の最初の子音の次の位置
+func germanRegion(w []rune, start int) int {
+	for i := start + 1; i < len(w); i++ {
+		if !isGermanVowel(w[i]) && isGermanVowel(w[i-1]) {
+			return i + 1
+		}
+	}
+	return len(w)
+}
+
+func hasSuffix(w []rune, suffix string) bool {
+	s := []rune(suffix)
+	if len(w) < len(s) {
+		return false
+	}
+	return string(w[len(w)-len(s):]) == suffix
+}
+
+func longestSuffix(w []rune, suffixes ...string) string {
+	longest := ""
+	for _, suffix := range suffixes {
+		if len(suffix) > len(longest) && hasSuffix(w, suffix) {
+			longest = suffix
+		}
+	}
+	return longest
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStemGerman(t *testing.T) {
+	for word, expected := range map[string]string{
+		"aufeinanderfolgenden": "aufeinanderfolg",
+		"kategorischen":        "kategor",
+		"häuser":               "haus",
+		"laufen":               "lauf",
+		"ergebnissen":          "ergebnis",
+		"straße":               "strass",
+		"ab":                   "ab",
+	} {
+		if diff := cmp.Diff(expected, stemGerman(word)); diff != "" {
+			t.Errorf("%s: %s", word, diff)
+		}
+	}
+}
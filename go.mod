@@ -9,6 +9,7 @@ require (
 	github.com/google/go-cmp v0.5.5
 	github.com/hrntknr/searcher/mock v0.0.0-00010101000000-000000000000
 	github.com/hrntknr/searcher/types v0.0.0-00010101000000-000000000000
+	github.com/ikawaha/kagome-dict v1.0.2
 	github.com/ikawaha/kagome-dict/ipa v1.0.2
 	github.com/ikawaha/kagome/v2 v2.4.4
 	github.com/kljensen/snowball v0.6.0
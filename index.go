@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hrntknr/searcher/types"
+	"gorm.io/gorm"
+)
+
+// 設定ファイルの設定で作る、最初からあるインデックス
+const defaultIndex = "default"
+
+var (
+	errIndexNotFound      = errors.New("index not found")
+	errIndexExists        = errors.New("index already exists")
+	errInvalidIndexName   = errors.New("invalid index name")
+	errInvalidIndexConfig = errors.New("invalid index config")
+)
+
+// テーブル名の接頭辞とディレクトリ名に使うので、英小文字と数字と_だけ
+var indexNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// 名前付きインデックスのテーブル名の接頭辞
+func indexTablePrefix(name string) string {
+	return "index_" + name + "_"
+}
+
+// インデックスの言語ごとのアナライザと文の分割
+type indexAnalysis struct {
+	analyzers         map[string]Analyzer
+	sentenceSplitters map[string]SentenceSplitter
+	// 日本語のトークナイザ、ユーザー辞書の検証に使う
+	tokenizer *tokenizerImpl
+}
+
+// 日本語はkagome、それ以外は空白などで区切ってsnowballでステミング
+func newIndexAnalysis(config *indexConfig) (*indexAnalysis, error) {
+	tokenizer, err := newTokenizer(config.TokenForm, config.Dictionary, config.UserDictionary)
+	if err != nil {
+		return nil, err
+	}
+	standardTokenizer, err := newStandardTokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	mappingChar := map[string]string{}
+	if err := json.Unmarshal([]byte(mappingCharData), &mappingChar); err != nil {
+		return nil, err
+	}
+	MappingCharFilter, err := newMappingCharFilter(mappingChar)
+	if err != nil {
+		return nil, err
+	}
+	lowercaseFilter, err := newLowercaseFilter()
+	if err != nil {
+		return nil, err
+	}
+	posFilter, err := newPOSFilter(config.POSInclude, config.POSExclude)
+	if err != nil {
+		return nil, err
+	}
+
+	analyzers := map[string]Analyzer{}
+	jaWordFilters, err := newLanguageWordFilters("ja", config.Analyzers["ja"], lowercaseFilter)
+	if err != nil {
+		return nil, err
+	}
+	analyzers["ja"], err = newAnalyzer(
+		tokenizer,
+		tokenizer.ForQuery(),
+		[]CharFilter{MappingCharFilter},
+		[]TermFilter{posFilter},
+		jaWordFilters,
+	)
+	if err != nil {
+		return nil, err
+	}
+	fields := []*analyzerField{}
+	if config.Ngram > 0 {
+		ngramTokenizer, err := newNgramTokenizer(config.Ngram)
+		if err != nil {
+			return nil, err
+		}
+		ngramAnalyzer, err := newAnalyzer(
+			ngramTokenizer,
+			ngramTokenizer,
+			[]CharFilter{MappingCharFilter},
+			[]TermFilter{},
+			[]WordFilter{lowercaseFilter},
+		)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, &analyzerField{name: "ngram", weight: config.NgramWeight, analyzer: ngramAnalyzer})
+	}
+	if config.EdgeNgram > 0 {
+		edgeNgramFilter, err := newEdgeNgramFilter(1, config.EdgeNgram)
+		if err != nil {
+			return nil, err
+		}
+		// 本来のトークンの先頭部分を登録する
+		edgeAnalyzer, err := newAnalyzer(
+			tokenizer,
+			tokenizer.ForQuery(),
+			[]CharFilter{MappingCharFilter},
+			[]TermFilter{posFilter},
+			append(append([]WordFilter{}, jaWordFilters...), edgeNgramFilter),
+		)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, &analyzerField{name: "edge", weight: config.EdgeNgramWeight, analyzer: edgeAnalyzer, prefix: true})
+	}
+	if len(fields) > 0 {
+		analyzers["ja"], err = newFieldAnalyzer(analyzers["ja"], fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, lang := range []string{"en", "de", "fr", "es", "ru", "sv", "no"} {
+		wordFilters, err := newLanguageWordFilters(lang, config.Analyzers[lang], lowercaseFilter)
+		if err != nil {
+			return nil, err
+		}
+		analyzers[lang], err = newAnalyzer(
+			standardTokenizer,
+			standardTokenizer,
+			[]CharFilter{MappingCharFilter},
+			[]TermFilter{},
+			wordFilters,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sentenceSplitters := map[string]SentenceSplitter{}
+	for lang := range analyzers {
+		sentenceSplitters[lang], err = newLanguageSentenceSplitter(lang, config.Analyzers[lang])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &indexAnalysis{
+		analyzers:         analyzers,
+		sentenceSplitters: sentenceSplitters,
+		tokenizer:         tokenizer,
+	}, nil
+}
+
+// 名前付きインデックスの定義と保存先
+type indexBackend interface {
+	// 保存済みの定義を作った順に返す
+	Indexes() ([]*types.Index, error)
+	// 保存先を開く、なければ作る。設定が正しくなければerrInvalidIndexConfig
+	Open(name string, config *indexConfig) (Service, error)
+	// 定義を保存する
+	Save(index *types.Index) error
+	// 保存先を閉じて、定義と一緒に消す。開けなかった作りかけの保存先も消す
+	Drop(name string) error
+	// 開いている保存先をすべて閉じる
+	Close() error
+}
+
+// defaultServiceは設定ファイルの設定で作ったインデックス。保存済みの名前付きインデックスはここで開く。
+// 名前付きインデックスで指定する辞書とストップワードのファイルはdataDirの中から読む
+func newIndexManager(defaultService Service, defaults indexConfig, dataDir string, backend indexBackend) (*indexManager, error) {
+	m := &indexManager{
+		defaults: defaults,
+		dataDir:  dataDir,
+		backend:  backend,
+		indexes: map[string]*namedIndex{
+			defaultIndex: {service: defaultService, index: &types.Index{Name: defaultIndex}},
+		},
+	}
+	defaultConfig, err := json.Marshal(&defaults)
+	if err != nil {
+		return nil, err
+	}
+	m.indexes[defaultIndex].index.Config = string(defaultConfig)
+
+	indexes, err := backend.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		config := indexConfig{}
+		if err := json.Unmarshal([]byte(index.Config), &config); err != nil {
+			return nil, fmt.Errorf("index %s: %w", index.Name, err)
+		}
+		service, err := backend.Open(index.Name, &config)
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %w", index.Name, err)
+		}
+		m.indexes[index.Name] = &namedIndex{service: service, index: index}
+	}
+	return m, nil
+}
+
+type indexManager struct {
+	// 名前付きインデックスで指定しなかった設定
+	defaults indexConfig
+	// 名前付きインデックスで指定できるファイルを置くディレクトリ、空なら指定できない
+	dataDir string
+	backend indexBackend
+	lock    sync.RWMutex
+	indexes map[string]*namedIndex
+}
+
+type namedIndex struct {
+	service Service
+	index   *types.Index
+	// 使い終わっていないリクエストなど。削除はこれが0になるのを待つ
+	refs sync.WaitGroup
+	// 削除中は新しく使わせない。保存先を消し終わるまで同じ名前では作れない
+	deleting bool
+}
+
+// 名前のインデックス、なければerrIndexNotFound。使い終わったらreleaseを呼ぶ
+func (m *indexManager) Acquire(name string) (Service, func(), error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	index, ok := m.indexes[name]
+	if !ok || index.deleting {
+		return nil, nil, fmt.Errorf("%w: %s", errIndexNotFound, name)
+	}
+	index.refs.Add(1)
+	return index.service, index.refs.Done, nil
+}
+
+// すべてのインデックスを名前をキーに返す。バックグラウンドの処理に使い、終わったらreleaseを呼ぶ
+func (m *indexManager) AcquireAll() (map[string]Service, func()) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	services := make(map[string]Service, len(m.indexes))
+	acquired := make([]*namedIndex, 0, len(m.indexes))
+	for name, index := range m.indexes {
+		if index.deleting {
+			continue
+		}
+		index.refs.Add(1)
+		services[name] = index.service
+		acquired = append(acquired, index)
+	}
+	return services, func() {
+		for _, index := range acquired {
+			index.refs.Done()
+		}
+	}
+}
+
+// defaultを先頭に、名前順に返す
+func (m *indexManager) List() []types.IndexInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	infos := make([]types.IndexInfo, 0, len(m.indexes))
+	for _, index := range m.indexes {
+		if index.deleting {
+			continue
+		}
+		infos = append(infos, indexInfo(index.index))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if (infos[i].Name == defaultIndex) != (infos[j].Name == defaultIndex) {
+			return infos[i].Name == defaultIndex
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+func indexInfo(index *types.Index) types.IndexInfo {
+	return types.IndexInfo{
+		Name:      index.Name,
+		CreatedAt: index.CreatedAt,
+		Config:    json.RawMessage(index.Config),
+	}
+}
+
+// 空のインデックスを作る。configで指定しなかった項目はdefaultの設定を引き継ぐ
+func (m *indexManager) Create(name string, config []byte) (*types.IndexInfo, error) {
+	if !indexNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %s", errInvalidIndexName, name)
+	}
+	// defaultの設定を書き換えないように、コピーに上書きする
+	defaults, err := json.Marshal(&m.defaults)
+	if err != nil {
+		return nil, err
+	}
+	merged := indexConfig{}
+	if err := json.Unmarshal(defaults, &merged); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(config)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(config))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&merged); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidIndexConfig, err)
+		}
+		requested := indexConfig{}
+		if err := json.Unmarshal(config, &requested); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidIndexConfig, err)
+		}
+		if err := m.resolveFiles(&merged, &requested); err != nil {
+			return nil, err
+		}
+	}
+	// 後からdefaultの設定が変わっても、同じ設定で開けるようにすべて保存する
+	resolved, err := json.Marshal(&merged)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.indexes[name]; ok {
+		return nil, fmt.Errorf("%w: %s", errIndexExists, name)
+	}
+	service, err := m.backend.Open(name, &merged)
+	if err != nil {
+		// 途中まで作った保存先は残さない
+		return nil, m.drop(name, err)
+	}
+	index := &types.Index{Name: name, Config: string(resolved)}
+	if err := m.backend.Save(index); err != nil {
+		return nil, m.drop(name, err)
+	}
+	m.indexes[name] = &namedIndex{service: service, index: index}
+	info := indexInfo(index)
+	return &info, nil
+}
+
+// 作れなかったインデックスの保存先を消し、作れなかった理由を返す
+func (m *indexManager) drop(name string, cause error) error {
+	if err := m.backend.Drop(name); err != nil {
+		return fmt.Errorf("%w (drop %s: %v)", cause, name, err)
+	}
+	return cause
+}
+
+// クライアントが指定した辞書とストップワードのファイルを、dataDirの中のパスにする。
+// サーバーの任意のファイルを読めないように、絶対パスやdataDirの外は断る
+func (m *indexManager) resolveFiles(merged *indexConfig, requested *indexConfig) error {
+	var err error
+	if requested.Dictionary != "" && requested.Dictionary != dictionaryIPA {
+		if merged.Dictionary, err = m.dataFile("dictionary", requested.Dictionary); err != nil {
+			return err
+		}
+	}
+	if requested.UserDictionary != "" {
+		if merged.UserDictionary, err = m.dataFile("user_dictionary", requested.UserDictionary); err != nil {
+			return err
+		}
+	}
+	for lang, analyzer := range requested.Analyzers {
+		if analyzer.StopWords == "" {
+			continue
+		}
+		if analyzer.StopWords, err = m.dataFile("analyzers."+lang+".stop_words", analyzer.StopWords); err != nil {
+			return err
+		}
+		merged.Analyzers[lang] = analyzer
+	}
+	return nil
+}
+
+func (m *indexManager) dataFile(key string, path string) (string, error) {
+	if m.dataDir == "" {
+		return "", fmt.Errorf("%w: %s requires data_dir", errInvalidIndexConfig, key)
+	}
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || outside(path) {
+		return "", fmt.Errorf("%w: %s must be a relative path in data_dir", errInvalidIndexConfig, key)
+	}
+	// シンボリックリンクでdata_dirの外を指していないか、たどった先で確かめる
+	dataDir, err := filepath.EvalSymlinks(m.dataDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dataDir, path))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %v", errInvalidIndexConfig, key, err)
+	}
+	rel, err := filepath.Rel(dataDir, resolved)
+	if err != nil || outside(rel) {
+		return "", fmt.Errorf("%w: %s must be a relative path in data_dir", errInvalidIndexConfig, key)
+	}
+	return resolved, nil
+}
+
+func outside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// インデックスをドキュメントと一緒に消す。defaultは消せない
+func (m *indexManager) Delete(name string) error {
+	if name == defaultIndex {
+		return fmt.Errorf("%w: %s cannot be deleted", errInvalidIndexName, name)
+	}
+	m.lock.Lock()
+	index, ok := m.indexes[name]
+	if !ok || index.deleting {
+		m.lock.Unlock()
+		return fmt.Errorf("%w: %s", errIndexNotFound, name)
+	}
+	index.deleting = true
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.indexes, name)
+		m.lock.Unlock()
+	}()
+
+	// 実行中のリクエストとキューの登録と削除を終えてから消す
+	index.refs.Wait()
+	if err := index.service.Close(); err != nil {
+		return err
+	}
+	return m.backend.Drop(name)
+}
+
+// すべてのインデックスのキューの登録と削除を終えて書き出してから、保存先を閉じる
+func (m *indexManager) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var result error
+	for name, index := range m.indexes {
+		if err := index.service.Close(); err != nil && result == nil {
+			result = fmt.Errorf("index %s: %w", name, err)
+		}
+	}
+	if err := m.backend.Close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+// 定義をSQLのindexesテーブルに、ドキュメントなどをインデックスごとに接頭辞を付けたテーブルに保存する。
+// ポスティングリストのファイルとログはdirの下のインデックスの名前のディレクトリに置く
+func newSQLIndexBackend(
+	db *gorm.DB,
+	open func(prefix string) (*gorm.DB, error),
+	dir string,
+	wal bool,
+	htmlFilter HTMLFilter,
+	languageDetector LanguageDetector,
+) (*sqlIndexBackend, error) {
+	if err := db.AutoMigrate(&types.Index{}); err != nil {
+		return nil, err
+	}
+	return &sqlIndexBackend{
+		db:               db,
+		open:             open,
+		dir:              dir,
+		wal:              wal,
+		htmlFilter:       htmlFilter,
+		languageDetector: languageDetector,
+		opened:           map[string]*openedIndex{},
+	}, nil
+}
+
+type sqlIndexBackend struct {
+	db *gorm.DB
+	// テーブル名に接頭辞を付けて、同じ接続を使う
+	open             func(prefix string) (*gorm.DB, error)
+	dir              string
+	wal              bool
+	htmlFilter       HTMLFilter
+	languageDetector LanguageDetector
+	lock             sync.Mutex
+	opened           map[string]*openedIndex
+}
+
+// 消すときに閉じるもの
+type openedIndex struct {
+	db           *gorm.DB
+	postingStore postingStore
+	wal          *writeAheadLog
+}
+
+func (b *sqlIndexBackend) Indexes() ([]*types.Index, error) {
+	indexes := []*types.Index{}
+	if err := b.db.Model(&types.Index{}).Order("id").Find(&indexes).Error; err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
+
+func (b *sqlIndexBackend) Open(name string, config *indexConfig) (Service, error) {
+	// ファイルのパスや中身を返さないように、詳しい理由はログにだけ書く
+	analysis, err := newIndexAnalysis(config)
+	if err != nil {
+		log.Printf("index %s: %v", name, err)
+		return nil, fmt.Errorf("%w: cannot load the analyzers, see the server log", errInvalidIndexConfig)
+	}
+	store := config.PostingStore
+	if (store != "" && store != postingStoreSQL || b.wal) && b.dir == "" {
+		return nil, fmt.Errorf("%w: index_dir is required for posting_store %s or wal", errInvalidIndexConfig, store)
+	}
+	// 書き出す前のセグメントとキューの操作は、ログがないと終了したときに失われる
+	if store == postingStoreSegment && !b.wal {
+		return nil, fmt.Errorf("%w: posting_store %s requires wal", errInvalidIndexConfig, store)
+	}
+
+	db, err := b.open(indexTablePrefix(name))
+	if err != nil {
+		return nil, err
+	}
+	// 途中で失敗しても、作ったものをDropで閉じて消せるように先に記録する
+	opened := &openedIndex{db: db}
+	b.lock.Lock()
+	b.opened[name] = opened
+	b.lock.Unlock()
+	if err := db.AutoMigrate(&types.Document{}, &types.Sentence{}, &types.Token{}, &types.PostingBlock{}, &types.DocumentTokens{}); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(b.dir, name)
+	postingStore, err := newPostingStore(store, db, filepath.Join(dir, "postings"), config.Segment)
+	if err != nil {
+		return nil, err
+	}
+	opened.postingStore = postingStore
+	indexDB, err := newDb(db, postingStore)
+	if err != nil {
+		return nil, err
+	}
+	var wal *writeAheadLog
+	if b.wal {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		wal, err = newWriteAheadLog(filepath.Join(dir, "wal.log"))
+		if err != nil {
+			return nil, err
+		}
+		opened.wal = wal
+	}
+	service, err := newService(
+		analysis.sentenceSplitters,
+		b.htmlFilter,
+		b.languageDetector,
+		analysis.analyzers,
+		indexDB,
+		wal,
+		config.indexWorkers(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+func (b *sqlIndexBackend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var result error
+	for _, opened := range b.opened {
+		if err := opened.close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	b.opened = map[string]*openedIndex{}
+	return result
+}
+
+func (opened *openedIndex) close() error {
+	if closer, ok := opened.postingStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	if opened.wal != nil {
+		return opened.wal.Close()
+	}
+	return nil
+}
+
+func (b *sqlIndexBackend) Save(index *types.Index) error {
+	return b.db.Model(&types.Index{}).Create(index).Error
+}
+
+// 開いていなくても、作りかけのテーブルとディレクトリを消す
+func (b *sqlIndexBackend) Drop(name string) error {
+	b.lock.Lock()
+	opened, ok := b.opened[name]
+	delete(b.opened, name)
+	b.lock.Unlock()
+
+	var db *gorm.DB
+	if ok {
+		// 書き出しやログへの追記が消したディレクトリに残らないように、先に閉じる
+		if err := opened.close(); err != nil {
+			return err
+		}
+		db = opened.db
+	} else {
+		var err error
+		if db, err = b.open(indexTablePrefix(name)); err != nil {
+			return err
+		}
+	}
+	if err := db.Migrator().DropTable(&types.DocumentTokens{}, &types.PostingBlock{}, &types.Token{}, &types.Sentence{}, &types.Document{}); err != nil {
+		return err
+	}
+	if b.dir != "" {
+		if err := os.RemoveAll(filepath.Join(b.dir, name)); err != nil {
+			return err
+		}
+	}
+	// 定義は物理削除して、同じ名前で作り直せるようにする
+	return b.db.Unscoped().Where("name = ?", name).Delete(&types.Index{}).Error
+}
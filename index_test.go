@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/mock"
+	"github.com/hrntknr/searcher/types"
+	"gorm.io/gorm"
+)
+
+// 定義をメモリに持ち、開くとservicesのServiceを返す
+type testIndexBackend struct {
+	indexes  []*types.Index
+	services map[string]Service
+	opened   []string
+	dropped  []string
+	saveErr  error
+	dropErr  error
+	closed   bool
+}
+
+func (b *testIndexBackend) Indexes() ([]*types.Index, error) {
+	return b.indexes, nil
+}
+
+func (b *testIndexBackend) Open(name string, config *indexConfig) (Service, error) {
+	if config.PostingStore == "unknown" {
+		return nil, fmt.Errorf("%w: unknown posting store", errInvalidIndexConfig)
+	}
+	b.opened = append(b.opened, name)
+	return b.services[name], nil
+}
+
+func (b *testIndexBackend) Save(index *types.Index) error {
+	if b.saveErr != nil {
+		return b.saveErr
+	}
+	b.indexes = append(b.indexes, index)
+	return nil
+}
+
+func (b *testIndexBackend) Drop(name string) error {
+	b.dropped = append(b.dropped, name)
+	return b.dropErr
+}
+
+func (b *testIndexBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+// defaultだけのインデックス
+func newTestIndexManager(t *testing.T, service Service) *indexManager {
+	t.Helper()
+	indexes, err := newIndexManager(service, indexConfig{}, "", &testIndexBackend{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexes
+}
+
+func TestIndexManager(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	defaultService := mock.NewMockService(ctrl)
+	blog := mock.NewMockService(ctrl)
+	docs := mock.NewMockService(ctrl)
+	backend := &testIndexBackend{
+		indexes:  []*types.Index{{Name: "blog", Config: `{"token_form":"surface"}`}},
+		services: map[string]Service{"blog": blog, "docs": docs},
+	}
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	dataDir, _ := filepath.EvalSymlinks(dir)
+	os.MkdirAll(filepath.Join(dataDir, "data", "stopwords"), 0755)
+	ioutil.WriteFile(filepath.Join(dataDir, "data", "user.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dataDir, "data", "stopwords", "en.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dataDir, "secret.txt"), nil, 0644)
+	os.Symlink(filepath.Join(dataDir, "secret.txt"), filepath.Join(dataDir, "data", "link.txt"))
+	indexes, err := newIndexManager(defaultService, indexConfig{TokenForm: "reading", PostingStore: "sql"}, filepath.Join(dataDir, "data"), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 保存済みのインデックスは作るときに開く
+	if diff := cmp.Diff([]string{"blog"}, backend.opened); diff != "" {
+		t.Errorf(diff)
+	}
+
+	info, err := indexes.Create("docs", []byte(`{"ngram":2,"user_dictionary":"user.txt","analyzers":{"en":{"stop_words":"stopwords/./en.txt"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 指定しなかった設定はdefaultを引き継いで保存する。ファイルはdata_dirの中のパスにする
+	config := indexConfig{}
+	if err := json.Unmarshal(info.Config, &config); err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(indexConfig{
+		TokenForm:      "reading",
+		PostingStore:   "sql",
+		Ngram:          2,
+		UserDictionary: filepath.Join(dataDir, "data", "user.txt"),
+		Analyzers:      map[string]analyzerConfig{"en": {StopWords: filepath.Join(dataDir, "data", "stopwords", "en.txt")}},
+	}, config); diff != "" {
+		t.Errorf(diff)
+	}
+	// data_dirの外のファイルは読めない
+	for _, config := range []string{
+		`{"user_dictionary":"/etc/passwd"}`,
+		`{"dictionary":"../../../etc/passwd"}`,
+		`{"analyzers":{"ja":{"stop_words":"stopwords/../../secret.txt"}}}`,
+		`{"user_dictionary":"link.txt"}`,
+	} {
+		if _, err := indexes.Create("wiki", []byte(config)); !errors.Is(err, errInvalidIndexConfig) {
+			t.Errorf("%s: expected invalid index config: %v", config, err)
+		}
+	}
+	if service, release, _ := indexes.Acquire("docs"); service != docs {
+		t.Errorf("unexpected service: %v", service)
+	} else {
+		release()
+	}
+	if service, release, _ := indexes.Acquire(defaultIndex); service != defaultService {
+		t.Errorf("unexpected service: %v", service)
+	} else {
+		release()
+	}
+
+	names := []string{}
+	for _, info := range indexes.List() {
+		names = append(names, info.Name)
+	}
+	if diff := cmp.Diff([]string{"default", "blog", "docs"}, names); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 使い終わっていないリクエストとキューの登録と削除を終えてから消す
+	_, release, err := indexes.Acquire("blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(chan error)
+	go func() {
+		deleted <- indexes.Delete("blog")
+	}()
+	// 削除中は使えず、一覧にも出ない
+	for {
+		_, acquired, err := indexes.Acquire("blog")
+		if err != nil {
+			break
+		}
+		acquired()
+		time.Sleep(time.Millisecond)
+	}
+	names = []string{}
+	for _, info := range indexes.List() {
+		names = append(names, info.Name)
+	}
+	if diff := cmp.Diff([]string{"default", "docs"}, names); diff != "" {
+		t.Errorf(diff)
+	}
+	select {
+	case err := <-deleted:
+		t.Fatalf("deleted before release: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	blog.EXPECT().Close().Return(nil)
+	release()
+	if err := <-deleted; err != nil {
+		t.Error(err)
+	}
+	if _, _, err := indexes.Acquire("blog"); !errors.Is(err, errIndexNotFound) {
+		t.Errorf("expected index not found: %v", err)
+	}
+	if diff := cmp.Diff([]string{"blog"}, backend.dropped); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 終了するときはすべてのインデックスを閉じてから保存先を閉じる
+	defaultService.EXPECT().Close().Return(nil)
+	docs.EXPECT().Close().Return(nil)
+	if err := indexes.Close(); err != nil {
+		t.Error(err)
+	}
+	if !backend.closed {
+		t.Errorf("backend should be closed")
+	}
+}
+
+func TestIndexManagerInvalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	backend := &testIndexBackend{services: map[string]Service{}}
+	indexes, _ := newIndexManager(mock.NewMockService(ctrl), indexConfig{}, "", backend)
+	indexes.Create("docs", nil)
+
+	for _, c := range []struct {
+		name   string
+		config string
+		err    error
+	}{
+		{"Docs", ``, errInvalidIndexName},
+		{"docs-blog", ``, errInvalidIndexName},
+		{"docs", ``, errIndexExists},
+		{"default", ``, errIndexExists},
+		{"blog", `{"unknown":1}`, errInvalidIndexConfig},
+		{"blog", `{"posting_store":"unknown"}`, errInvalidIndexConfig},
+		// data_dirがなければファイルを指定できない
+		{"blog", `{"user_dictionary":"user.txt"}`, errInvalidIndexConfig},
+	} {
+		if _, err := indexes.Create(c.name, []byte(c.config)); !errors.Is(err, c.err) {
+			t.Errorf("%s %s: expected %v: %v", c.name, c.config, c.err, err)
+		}
+	}
+	if err := indexes.Delete(defaultIndex); !errors.Is(err, errInvalidIndexName) {
+		t.Errorf("expected invalid index name: %v", err)
+	}
+	if err := indexes.Delete("blog"); !errors.Is(err, errIndexNotFound) {
+		t.Errorf("expected index not found: %v", err)
+	}
+
+	// 開けなかったときも、定義を保存できなかったときも、作りかけの保存先を消す
+	backend.saveErr = gorm.ErrInvalidTransaction
+	if _, err := indexes.Create("blog", nil); err != backend.saveErr {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"blog", "blog"}, backend.dropped); diff != "" {
+		t.Errorf(diff)
+	}
+	// 消せなかったことも返す
+	backend.dropErr = errors.New("drop error")
+	if _, err := indexes.Create("blog", nil); !errors.Is(err, backend.saveErr) || !strings.Contains(err.Error(), "drop error") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, _, err := indexes.Acquire("blog"); !errors.Is(err, errIndexNotFound) {
+		t.Errorf("expected index not found: %v", err)
+	}
+}
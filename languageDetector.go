@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type LanguageDetector interface {
+	// 文章の配列から言語コードを推定する
+	Detect(text []string) string
+}
+
+// 文字種と頻出語で判定する。判定できなければfallbackを返す
+func newLanguageDetector(languages []string, fallback string) (*languageDetectorImpl, error) {
+	detector := &languageDetectorImpl{
+		languages: map[string]struct{}{},
+		order:     languages,
+		fallback:  fallback,
+	}
+	for _, lang := range languages {
+		detector.languages[lang] = struct{}{}
+	}
+	if _, ok := detector.languages[fallback]; !ok {
+		return nil, fmt.Errorf("fallback language %s is not in languages", fallback)
+	}
+	return detector, nil
+}
+
+type languageDetectorImpl struct {
+	languages map[string]struct{}
+	// 頻出語の数が同じ場合は先に指定したものを優先
+	order    []string
+	fallback string
+}
+
+// 分かち書きする言語の頻出語
+var languageCommonWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "as", "was", "on", "are", "this", "be", "by", "not", "you"},
+	"de": {"der", "die", "und", "den", "das", "ist", "nicht", "mit", "sich", "des", "ein", "eine", "auf", "für", "von", "zu", "dem", "im", "auch", "es"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "un", "du", "que", "pour", "pas", "dans", "qui", "sur", "avec", "au", "ce", "il"},
+	"es": {"el", "la", "los", "las", "y", "que", "de", "es", "en", "por", "con", "para", "una", "un", "del", "se", "no"},
+	"sv": {"och", "att", "det", "som", "är", "en", "på", "för", "med", "av", "inte", "till", "den", "har", "jag"},
+	"no": {"og", "det", "er", "som", "på", "for", "med", "ikke", "til", "av", "har", "jeg", "en", "den", "at"},
+}
+
+// 漢字や仮名の1文字はラテン文字の数文字分の情報を持つので、この倍率で比べる
+const cjkLatinRatio = 3
+
+func (d *languageDetectorImpl) Detect(text []string) string {
+	var kana, han, cyrillic, latin int
+	for _, text := range text {
+		for _, r := range text {
+			switch {
+			case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+				kana++
+			case unicode.Is(unicode.Han, r):
+				han++
+			case unicode.Is(unicode.Cyrillic, r):
+				cyrillic++
+			case unicode.Is(unicode.Latin, r):
+				latin++
+			}
+		}
+	}
+
+	switch {
+	// 英語の文章に名前や引用で仮名が少し混ざっても日本語にはしない
+	case (kana+han)*cjkLatinRatio > latin:
+		return d.supported("ja")
+	case cyrillic > latin:
+		return d.supported("ru")
+	case latin == 0:
+		return d.fallback
+	}
+
+	words := map[string]int{}
+	for _, text := range text {
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r)
+		}) {
+			words[word]++
+		}
+	}
+	best, bestScore := "", 0
+	for _, lang := range d.order {
+		score := 0
+		for _, word := range languageCommonWords[lang] {
+			score += words[word]
+		}
+		if score > bestScore {
+			best, bestScore = lang, score
+		}
+	}
+	if best == "" {
+		return d.fallback
+	}
+	return best
+}
+
+func (d *languageDetectorImpl) supported(lang string) string {
+	if _, ok := d.languages[lang]; ok {
+		return lang
+	}
+	return d.fallback
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLanguageDetector(t *testing.T) {
+	detector, _ := newLanguageDetector([]string{"ja", "en", "de", "fr"}, "ja")
+
+	for _, c := range []struct {
+		text []string
+		lang string
+	}{
+		{[]string{"すもももももももものうち"}, "ja"},
+		{[]string{"東京都"}, "ja"},
+		{[]string{"Googleで検索した"}, "ja"},
+		{[]string{"The word ありがとう means thank you in Japanese and it is used often."}, "en"},
+		{[]string{"My teacher, Tanaka (田中), is from Tokyo."}, "en"},
+		{[]string{"The quick brown fox.", "It jumps over the lazy dog."}, "en"},
+		{[]string{"Die Häuser sind nicht mit der Straße verbunden."}, "de"},
+		{[]string{"Le chat est sur la table avec les enfants."}, "fr"},
+		// 未対応の言語はfallback
+		{[]string{"Съешь же ещё этих мягких французских булок"}, "ja"},
+		{[]string{"1234"}, "ja"},
+	} {
+		if diff := cmp.Diff(c.lang, detector.Detect(c.text)); diff != "" {
+			t.Errorf("%v: %s", c.text, diff)
+		}
+	}
+
+	if _, err := newLanguageDetector([]string{"en"}, "ja"); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
-	_ "embed"
-	"encoding/json"
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/hrntknr/searcher/types"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
-//go:embed data/stopWords.json
-var stopWordsData []byte
+//go:embed data/stopwords/*.txt
+var stopWordsFS embed.FS
 
 //go:embed data/mappingChar.json
 var mappingCharData []byte
@@ -36,37 +43,16 @@ func NewSearcher() (*Sercher, error) {
 		return nil, err
 	}
 
-	sentenceSplitter, err := newSentenceSplitter()
+	htmlFilter, err := newHTMLStripCharFilter()
 	if err != nil {
 		return nil, err
 	}
 
-	tokenizer, err := newTokenizer()
+	analysis, err := newIndexAnalysis(&config.Index)
 	if err != nil {
 		return nil, err
 	}
-
-	mappingChar := map[string]string{}
-	if err := json.Unmarshal([]byte(mappingCharData), &mappingChar); err != nil {
-		return nil, err
-	}
-	MappingCharFilter, err := newMappingCharFilter(mappingChar)
-	if err != nil {
-		return nil, err
-	}
-	lowercaseFilter, err := newLowercaseFilter()
-	if err != nil {
-		return nil, err
-	}
-	stopWords := []string{}
-	if err := json.Unmarshal([]byte(stopWordsData), &stopWords); err != nil {
-		return nil, err
-	}
-	stopWordFilter, err := newStopWordFilter(stopWords)
-	if err != nil {
-		return nil, err
-	}
-	stemmerFilter, err := newStemmerFilter()
+	languageDetector, err := newLanguageDetector([]string{"ja", "en", "de", "fr", "es", "ru", "sv", "no"}, "ja")
 	if err != nil {
 		return nil, err
 	}
@@ -84,39 +70,198 @@ func NewSearcher() (*Sercher, error) {
 	sqlDB.SetMaxOpenConns(100)
 	sqlDB.SetMaxIdleConns(0)
 
-	if err := sql.AutoMigrate(&types.Document{}, &types.Sentence{}, &types.Posting{}, &types.Token{}); err != nil {
+	if err := sql.AutoMigrate(&types.Document{}, &types.Sentence{}, &types.Token{}, &types.PostingBlock{}, &types.DocumentTokens{}); err != nil {
+		return nil, err
+	}
+	postingStore, err := newPostingStore(config.Index.PostingStore, sql, config.PostingDir, config.Index.Segment)
+	if err != nil {
 		return nil, err
 	}
-	db, err := newDb(sql)
+	db, err := newDb(sql, postingStore)
 	if err != nil {
 		return nil, err
 	}
+	// ログを書かなければ消すものもない
+	checkpointInterval := time.Duration(0)
+	if config.WAL != "" {
+		checkpointInterval = config.CheckpointInterval
+	}
+	// 名前付きインデックスもあるので、保存先がセグメントでなくても回す。セグメント以外では何もしない
+	mergeInterval := config.Index.Segment.MergeInterval
+
+	// 書き出す前のセグメントとキューの操作は、ログがないと終了したときに失われる
+	if config.Index.PostingStore == postingStoreSegment && config.WAL == "" {
+		return nil, fmt.Errorf("posting_store %s requires wal", postingStoreSegment)
+	}
+	// 登録と削除のログ。空なら書かない
+	var wal *writeAheadLog
+	if config.WAL != "" {
+		wal, err = newWriteAheadLog(config.WAL)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	service, err := newService(
-		sentenceSplitter,
-		tokenizer,
-		[]CharFilter{MappingCharFilter},
-		[]WordFilter{lowercaseFilter, stopWordFilter, stemmerFilter},
+		analysis.sentenceSplitters,
+		htmlFilter,
+		languageDetector,
+		analysis.analyzers,
 		db,
+		wal,
+		config.Index.indexWorkers(),
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	controller, err := newController(config, service)
+	// 名前付きインデックスはテーブル名に接頭辞を付けて、同じ接続を使う
+	backend, err := newSQLIndexBackend(sql, func(prefix string) (*gorm.DB, error) {
+		return gorm.Open(mysql.New(mysql.Config{Conn: sqlDB}), &gorm.Config{
+			Logger:         logger.Default.LogMode(logger.Silent),
+			NamingStrategy: schema.NamingStrategy{TablePrefix: prefix},
+		})
+	}, config.IndexDir, config.WAL != "", htmlFilter, languageDetector)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := newIndexManager(service, config.Index, config.DataDir, backend)
+	if err != nil {
+		return nil, err
+	}
+
+	controller, err := newController(config, indexes, analysis.tokenizer)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Sercher{
-		controller: controller,
+		controller:         controller,
+		indexes:            indexes,
+		wal:                wal,
+		compactInterval:    config.CompactInterval,
+		mergeInterval:      mergeInterval,
+		checkpointInterval: checkpointInterval,
 	}, nil
 }
 
 type Sercher struct {
 	controller *controller
+	indexes    *indexManager
+	// defaultインデックスのログ、nilなら書かない
+	wal             *writeAheadLog
+	compactInterval time.Duration
+	mergeInterval   time.Duration
+	// ログのチェックポイントの間隔
+	checkpointInterval time.Duration
 }
 
 func (s *Sercher) start() error {
-	return s.controller.start()
+	if err := s.recoverIndexes(); err != nil {
+		return err
+	}
+	if s.compactInterval > 0 {
+		go s.compactLoop()
+	}
+	if s.mergeInterval > 0 {
+		go s.mergeLoop()
+	}
+	if s.checkpointInterval > 0 {
+		go s.checkpointLoop()
+	}
+	// 止めるときは実行中のリクエストとキューの登録と削除を終えて、保存先に書き出してから終わる
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := s.controller.start(ctx)
+	if closeErr := s.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *Sercher) recoverIndexes() error {
+	services, release := s.indexes.AcquireAll()
+	defer release()
+	for name, service := range services {
+		// 前回途中で止まった登録と削除を終わらせてから受け付ける
+		recovery, err := service.Recover()
+		if err != nil {
+			return fmt.Errorf("index %s: %w", name, err)
+		}
+		if recovery.RolledForward > 0 || recovery.RolledBack > 0 {
+			log.Printf("recover %s: replayed=%d rolled_forward=%d rolled_back=%d",
+				name, recovery.Replayed, recovery.RolledForward, recovery.RolledBack)
+		}
+		// 辞書や設定を変えたあとは再インデックスするまで古いトークンのままになる
+		stale, err := service.StaleDocuments()
+		if err != nil {
+			return fmt.Errorf("index %s: %w", name, err)
+		}
+		if stale > 0 {
+			log.Printf("%d documents in %s were indexed with a different analyzer, run /admin/reindex", stale, name)
+		}
+	}
+	return nil
+}
+
+func (s *Sercher) close() error {
+	err := s.indexes.Close()
+	if s.wal != nil {
+		if walErr := s.wal.Close(); err == nil {
+			err = walErr
+		}
+	}
+	return err
+}
+
+func (s *Sercher) compactLoop() {
+	ticker := time.NewTicker(s.compactInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		services, release := s.indexes.AcquireAll()
+		for name, service := range services {
+			report, err := service.Compact()
+			if err != nil {
+				log.Printf("compact %s: %v", name, err)
+				continue
+			}
+			log.Printf("compact %s: documents=%d sentences=%d postings=%d tokens=%d",
+				name, report.Documents, report.Sentences, report.Postings, report.Tokens)
+		}
+		release()
+	}
+}
+
+func (s *Sercher) mergeLoop() {
+	ticker := time.NewTicker(s.mergeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		services, release := s.indexes.AcquireAll()
+		for name, service := range services {
+			report, err := service.Merge()
+			if err != nil {
+				log.Printf("merge %s: %v", name, err)
+				continue
+			}
+			if report.FlushedPostings > 0 || report.MergedSegments > 0 {
+				log.Printf("merge %s: flushed_postings=%d merged_segments=%d segments=%d",
+					name, report.FlushedPostings, report.MergedSegments, report.Segments)
+			}
+		}
+		release()
+	}
+}
+
+func (s *Sercher) checkpointLoop() {
+	ticker := time.NewTicker(s.checkpointInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		services, release := s.indexes.AcquireAll()
+		for name, service := range services {
+			if err := service.Checkpoint(); err != nil {
+				log.Printf("checkpoint %s: %v", name, err)
+			}
+		}
+		release()
+	}
 }
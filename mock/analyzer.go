@@ -0,0 +1,129 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: ../analyzer.go
+
+// Package mock is a generated GoMock package.
+package mock
+
+import (
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+	types "github.com/hrntknr/searcher/types"
+)
+
+// MockAnalyzer is a mock of Analyzer interface.
+type MockAnalyzer struct {
+	ctrl     *gomock.Controller
+	recorder *MockAnalyzerMockRecorder
+}
+
+// MockAnalyzerMockRecorder is the mock recorder for MockAnalyzer.
+type MockAnalyzerMockRecorder struct {
+	mock *MockAnalyzer
+}
+
+// NewMockAnalyzer creates a new mock instance.
+func NewMockAnalyzer(ctrl *gomock.Controller) *MockAnalyzer {
+	mock := &MockAnalyzer{ctrl: ctrl}
+	mock.recorder = &MockAnalyzerMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAnalyzer) EXPECT() *MockAnalyzerMockRecorder {
+	return m.recorder
+}
+
+// Analyze mocks base method.
+func (m *MockAnalyzer) Analyze(text []string) ([]string, [][]types.AnalyzedToken) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Analyze", text)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].([][]types.AnalyzedToken)
+	return ret0, ret1
+}
+
+// Analyze indicates an expected call of Analyze.
+func (mr *MockAnalyzerMockRecorder) Analyze(text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Analyze", reflect.TypeOf((*MockAnalyzer)(nil).Analyze), text)
+}
+
+// AnalyzePrefixQuery mocks base method.
+func (m *MockAnalyzer) AnalyzePrefixQuery(text string) []types.Query {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AnalyzePrefixQuery", text)
+	ret0, _ := ret[0].([]types.Query)
+	return ret0
+}
+
+// AnalyzePrefixQuery indicates an expected call of AnalyzePrefixQuery.
+func (mr *MockAnalyzerMockRecorder) AnalyzePrefixQuery(text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnalyzePrefixQuery", reflect.TypeOf((*MockAnalyzer)(nil).AnalyzePrefixQuery), text)
+}
+
+// AnalyzeQuery mocks base method.
+func (m *MockAnalyzer) AnalyzeQuery(text string) []types.Query {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AnalyzeQuery", text)
+	ret0, _ := ret[0].([]types.Query)
+	return ret0
+}
+
+// AnalyzeQuery indicates an expected call of AnalyzeQuery.
+func (mr *MockAnalyzerMockRecorder) AnalyzeQuery(text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AnalyzeQuery", reflect.TypeOf((*MockAnalyzer)(nil).AnalyzeQuery), text)
+}
+
+// Version mocks base method.
+func (m *MockAnalyzer) Version() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Version")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Version indicates an expected call of Version.
+func (mr *MockAnalyzerMockRecorder) Version() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Version", reflect.TypeOf((*MockAnalyzer)(nil).Version))
+}
+
+// Mockversioned is a mock of versioned interface.
+type Mockversioned struct {
+	ctrl     *gomock.Controller
+	recorder *MockversionedMockRecorder
+}
+
+// MockversionedMockRecorder is the mock recorder for Mockversioned.
+type MockversionedMockRecorder struct {
+	mock *Mockversioned
+}
+
+// NewMockversioned creates a new mock instance.
+func NewMockversioned(ctrl *gomock.Controller) *Mockversioned {
+	mock := &Mockversioned{ctrl: ctrl}
+	mock.recorder = &MockversionedMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *Mockversioned) EXPECT() *MockversionedMockRecorder {
+	return m.recorder
+}
+
+// Version mocks base method.
+func (m *Mockversioned) Version() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Version")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Version indicates an expected call of Version.
+func (mr *MockversionedMockRecorder) Version() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Version", reflect.TypeOf((*Mockversioned)(nil).Version))
+}
@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	types "github.com/hrntknr/searcher/types"
 )
 
 // MockCharFilter is a mock of CharFilter interface.
@@ -46,3 +47,54 @@ func (mr *MockCharFilterMockRecorder) Filter(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Filter", reflect.TypeOf((*MockCharFilter)(nil).Filter), arg0)
 }
+
+// MockHTMLFilter is a mock of HTMLFilter interface.
+type MockHTMLFilter struct {
+	ctrl     *gomock.Controller
+	recorder *MockHTMLFilterMockRecorder
+}
+
+// MockHTMLFilterMockRecorder is the mock recorder for MockHTMLFilter.
+type MockHTMLFilterMockRecorder struct {
+	mock *MockHTMLFilter
+}
+
+// NewMockHTMLFilter creates a new mock instance.
+func NewMockHTMLFilter(ctrl *gomock.Controller) *MockHTMLFilter {
+	mock := &MockHTMLFilter{ctrl: ctrl}
+	mock.recorder = &MockHTMLFilterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockHTMLFilter) EXPECT() *MockHTMLFilterMockRecorder {
+	return m.recorder
+}
+
+// Extract mocks base method.
+func (m *MockHTMLFilter) Extract(body string) *types.HTMLDocument {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Extract", body)
+	ret0, _ := ret[0].(*types.HTMLDocument)
+	return ret0
+}
+
+// Extract indicates an expected call of Extract.
+func (mr *MockHTMLFilterMockRecorder) Extract(body interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Extract", reflect.TypeOf((*MockHTMLFilter)(nil).Extract), body)
+}
+
+// Filter mocks base method.
+func (m *MockHTMLFilter) Filter(arg0 []string) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Filter", arg0)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// Filter indicates an expected call of Filter.
+func (mr *MockHTMLFilterMockRecorder) Filter(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Filter", reflect.TypeOf((*MockHTMLFilter)(nil).Filter), arg0)
+}
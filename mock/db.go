@@ -5,7 +5,9 @@
 package mock
 
 import (
+	io "io"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	types "github.com/hrntknr/searcher/types"
@@ -34,6 +36,21 @@ func (m *MockDB) EXPECT() *MockDBMockRecorder {
 	return m.recorder
 }
 
+// Compact mocks base method.
+func (m *MockDB) Compact() (*types.CompactReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compact")
+	ret0, _ := ret[0].(*types.CompactReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Compact indicates an expected call of Compact.
+func (mr *MockDBMockRecorder) Compact() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compact", reflect.TypeOf((*MockDB)(nil).Compact))
+}
+
 // CountDocument mocks base method.
 func (m *MockDB) CountDocument() (uint, error) {
 	m.ctrl.T.Helper()
@@ -49,19 +66,64 @@ func (mr *MockDBMockRecorder) CountDocument() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountDocument", reflect.TypeOf((*MockDB)(nil).CountDocument))
 }
 
-// CountTermInDocument mocks base method.
-func (m *MockDB) CountTermInDocument(documentID uint) (uint, error) {
+// CountPosting mocks base method.
+func (m *MockDB) CountPosting() (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountPosting")
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountPosting indicates an expected call of CountPosting.
+func (mr *MockDBMockRecorder) CountPosting() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountPosting", reflect.TypeOf((*MockDB)(nil).CountPosting))
+}
+
+// CountSentence mocks base method.
+func (m *MockDB) CountSentence() (uint, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountTermInDocument", documentID)
+	ret := m.ctrl.Call(m, "CountSentence")
 	ret0, _ := ret[0].(uint)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CountTermInDocument indicates an expected call of CountTermInDocument.
-func (mr *MockDBMockRecorder) CountTermInDocument(documentID interface{}) *gomock.Call {
+// CountSentence indicates an expected call of CountSentence.
+func (mr *MockDBMockRecorder) CountSentence() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountTermInDocument", reflect.TypeOf((*MockDB)(nil).CountTermInDocument), documentID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountSentence", reflect.TypeOf((*MockDB)(nil).CountSentence))
+}
+
+// CountStaleDocument mocks base method.
+func (m *MockDB) CountStaleDocument(lang, version string) (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountStaleDocument", lang, version)
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountStaleDocument indicates an expected call of CountStaleDocument.
+func (mr *MockDBMockRecorder) CountStaleDocument(lang, version interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountStaleDocument", reflect.TypeOf((*MockDB)(nil).CountStaleDocument), lang, version)
+}
+
+// CountToken mocks base method.
+func (m *MockDB) CountToken() (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CountToken")
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CountToken indicates an expected call of CountToken.
+func (mr *MockDBMockRecorder) CountToken() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountToken", reflect.TypeOf((*MockDB)(nil).CountToken))
 }
 
 // CreateDcoument mocks base method.
@@ -79,19 +141,18 @@ func (mr *MockDBMockRecorder) CreateDcoument(document interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateDcoument", reflect.TypeOf((*MockDB)(nil).CreateDcoument), document)
 }
 
-// CreatePosting mocks base method.
-func (m *MockDB) CreatePosting(posting *types.Posting) (*types.Posting, error) {
+// CreatePostings mocks base method.
+func (m *MockDB) CreatePostings(documentID uint, postings []*types.Posting) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CreatePosting", posting)
-	ret0, _ := ret[0].(*types.Posting)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret := m.ctrl.Call(m, "CreatePostings", documentID, postings)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-// CreatePosting indicates an expected call of CreatePosting.
-func (mr *MockDBMockRecorder) CreatePosting(posting interface{}) *gomock.Call {
+// CreatePostings indicates an expected call of CreatePostings.
+func (mr *MockDBMockRecorder) CreatePostings(documentID, postings interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePosting", reflect.TypeOf((*MockDB)(nil).CreatePosting), posting)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePostings", reflect.TypeOf((*MockDB)(nil).CreatePostings), documentID, postings)
 }
 
 // CreateSentence mocks base method.
@@ -124,6 +185,20 @@ func (mr *MockDBMockRecorder) CreateToken(token interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateToken", reflect.TypeOf((*MockDB)(nil).CreateToken), token)
 }
 
+// DeleteDocument mocks base method.
+func (m *MockDB) DeleteDocument(documentID uint) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteDocument", documentID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteDocument indicates an expected call of DeleteDocument.
+func (mr *MockDBMockRecorder) DeleteDocument(documentID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteDocument", reflect.TypeOf((*MockDB)(nil).DeleteDocument), documentID)
+}
+
 // DeleteSentenceFromDocumentID mocks base method.
 func (m *MockDB) DeleteSentenceFromDocumentID(documentID uint) error {
 	m.ctrl.T.Helper()
@@ -168,6 +243,125 @@ func (mr *MockDBMockRecorder) DocumentFromUri(uri interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DocumentFromUri", reflect.TypeOf((*MockDB)(nil).DocumentFromUri), uri)
 }
 
+// DocumentLengths mocks base method.
+func (m *MockDB) DocumentLengths(ids []uint, lang string) (map[uint]uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DocumentLengths", ids, lang)
+	ret0, _ := ret[0].(map[uint]uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DocumentLengths indicates an expected call of DocumentLengths.
+func (mr *MockDBMockRecorder) DocumentLengths(ids, lang interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DocumentLengths", reflect.TypeOf((*MockDB)(nil).DocumentLengths), ids, lang)
+}
+
+// DocumentsAfterID mocks base method.
+func (m *MockDB) DocumentsAfterID(id, count uint) ([]*types.Document, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DocumentsAfterID", id, count)
+	ret0, _ := ret[0].([]*types.Document)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DocumentsAfterID indicates an expected call of DocumentsAfterID.
+func (mr *MockDBMockRecorder) DocumentsAfterID(id, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DocumentsAfterID", reflect.TypeOf((*MockDB)(nil).DocumentsAfterID), id, count)
+}
+
+// DocumentsBefore mocks base method.
+func (m *MockDB) DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DocumentsBefore", before, offset, count)
+	ret0, _ := ret[0].([]*types.Document)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DocumentsBefore indicates an expected call of DocumentsBefore.
+func (mr *MockDBMockRecorder) DocumentsBefore(before, offset, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DocumentsBefore", reflect.TypeOf((*MockDB)(nil).DocumentsBefore), before, offset, count)
+}
+
+// DuplicateTokens mocks base method.
+func (m *MockDB) DuplicateTokens() ([]types.DuplicateToken, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DuplicateTokens")
+	ret0, _ := ret[0].([]types.DuplicateToken)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DuplicateTokens indicates an expected call of DuplicateTokens.
+func (mr *MockDBMockRecorder) DuplicateTokens() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DuplicateTokens", reflect.TypeOf((*MockDB)(nil).DuplicateTokens))
+}
+
+// FlushPostings mocks base method.
+func (m *MockDB) FlushPostings() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FlushPostings")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FlushPostings indicates an expected call of FlushPostings.
+func (mr *MockDBMockRecorder) FlushPostings() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlushPostings", reflect.TypeOf((*MockDB)(nil).FlushPostings))
+}
+
+// MergePostings mocks base method.
+func (m *MockDB) MergePostings() (*types.MergeReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MergePostings")
+	ret0, _ := ret[0].(*types.MergeReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MergePostings indicates an expected call of MergePostings.
+func (mr *MockDBMockRecorder) MergePostings() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MergePostings", reflect.TypeOf((*MockDB)(nil).MergePostings))
+}
+
+// OrphanPostings mocks base method.
+func (m *MockDB) OrphanPostings() ([]types.OrphanPosting, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OrphanPostings")
+	ret0, _ := ret[0].([]types.OrphanPosting)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// OrphanPostings indicates an expected call of OrphanPostings.
+func (mr *MockDBMockRecorder) OrphanPostings() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OrphanPostings", reflect.TypeOf((*MockDB)(nil).OrphanPostings))
+}
+
+// PostingBlocks mocks base method.
+func (m *MockDB) PostingBlocks(tokenIDs []uint) (map[uint][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PostingBlocks", tokenIDs)
+	ret0, _ := ret[0].(map[uint][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PostingBlocks indicates an expected call of PostingBlocks.
+func (mr *MockDBMockRecorder) PostingBlocks(tokenIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PostingBlocks", reflect.TypeOf((*MockDB)(nil).PostingBlocks), tokenIDs)
+}
+
 // PostingList mocks base method.
 func (m *MockDB) PostingList(tokenID uint) ([]*types.Posting, error) {
 	m.ctrl.T.Helper()
@@ -183,6 +377,36 @@ func (mr *MockDBMockRecorder) PostingList(tokenID interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PostingList", reflect.TypeOf((*MockDB)(nil).PostingList), tokenID)
 }
 
+// Restore mocks base method.
+func (m *MockDB) Restore(r io.Reader) (*types.SnapshotReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Restore", r)
+	ret0, _ := ret[0].(*types.SnapshotReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Restore indicates an expected call of Restore.
+func (mr *MockDBMockRecorder) Restore(r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Restore", reflect.TypeOf((*MockDB)(nil).Restore), r)
+}
+
+// SentenceIDsFromPostings mocks base method.
+func (m *MockDB) SentenceIDsFromPostings(documentID uint, tokenIDs []uint) ([]uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SentenceIDsFromPostings", documentID, tokenIDs)
+	ret0, _ := ret[0].([]uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SentenceIDsFromPostings indicates an expected call of SentenceIDsFromPostings.
+func (mr *MockDBMockRecorder) SentenceIDsFromPostings(documentID, tokenIDs interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SentenceIDsFromPostings", reflect.TypeOf((*MockDB)(nil).SentenceIDsFromPostings), documentID, tokenIDs)
+}
+
 // SentenceMultiFromID mocks base method.
 func (m *MockDB) SentenceMultiFromID(ids []uint) ([]*types.Sentence, error) {
 	m.ctrl.T.Helper()
@@ -198,6 +422,51 @@ func (mr *MockDBMockRecorder) SentenceMultiFromID(ids interface{}) *gomock.Call
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SentenceMultiFromID", reflect.TypeOf((*MockDB)(nil).SentenceMultiFromID), ids)
 }
 
+// SentencesFromDocumentID mocks base method.
+func (m *MockDB) SentencesFromDocumentID(documentID uint) ([]*types.Sentence, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SentencesFromDocumentID", documentID)
+	ret0, _ := ret[0].([]*types.Sentence)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SentencesFromDocumentID indicates an expected call of SentencesFromDocumentID.
+func (mr *MockDBMockRecorder) SentencesFromDocumentID(documentID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SentencesFromDocumentID", reflect.TypeOf((*MockDB)(nil).SentencesFromDocumentID), documentID)
+}
+
+// Snapshot mocks base method.
+func (m *MockDB) Snapshot(w io.Writer, ready func()) (*types.SnapshotReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Snapshot", w, ready)
+	ret0, _ := ret[0].(*types.SnapshotReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Snapshot indicates an expected call of Snapshot.
+func (mr *MockDBMockRecorder) Snapshot(w, ready interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Snapshot", reflect.TypeOf((*MockDB)(nil).Snapshot), w, ready)
+}
+
+// TokenCountMismatches mocks base method.
+func (m *MockDB) TokenCountMismatches() ([]types.TokenCountMismatch, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TokenCountMismatches")
+	ret0, _ := ret[0].([]types.TokenCountMismatch)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TokenCountMismatches indicates an expected call of TokenCountMismatches.
+func (mr *MockDBMockRecorder) TokenCountMismatches() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TokenCountMismatches", reflect.TypeOf((*MockDB)(nil).TokenCountMismatches))
+}
+
 // TokenFromID mocks base method.
 func (m *MockDB) TokenFromID(id uint) (*types.Token, error) {
 	m.ctrl.T.Helper()
@@ -227,3 +496,62 @@ func (mr *MockDBMockRecorder) TokenFromString(token interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TokenFromString", reflect.TypeOf((*MockDB)(nil).TokenFromString), token)
 }
+
+// TopTerms mocks base method.
+func (m *MockDB) TopTerms(limit uint) ([]types.TermCount, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopTerms", limit)
+	ret0, _ := ret[0].([]types.TermCount)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopTerms indicates an expected call of TopTerms.
+func (mr *MockDBMockRecorder) TopTerms(limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopTerms", reflect.TypeOf((*MockDB)(nil).TopTerms), limit)
+}
+
+// TouchDocument mocks base method.
+func (m *MockDB) TouchDocument(uri string, t time.Time) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TouchDocument", uri, t)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TouchDocument indicates an expected call of TouchDocument.
+func (mr *MockDBMockRecorder) TouchDocument(uri, t interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TouchDocument", reflect.TypeOf((*MockDB)(nil).TouchDocument), uri, t)
+}
+
+// UpdateDocument mocks base method.
+func (m *MockDB) UpdateDocument(document *types.Document) (*types.Document, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateDocument", document)
+	ret0, _ := ret[0].(*types.Document)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateDocument indicates an expected call of UpdateDocument.
+func (mr *MockDBMockRecorder) UpdateDocument(document interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDocument", reflect.TypeOf((*MockDB)(nil).UpdateDocument), document)
+}
+
+// UpdateTokenMaxTermRatio mocks base method.
+func (m *MockDB) UpdateTokenMaxTermRatio(tokenID uint, ratio float64) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateTokenMaxTermRatio", tokenID, ratio)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateTokenMaxTermRatio indicates an expected call of UpdateTokenMaxTermRatio.
+func (mr *MockDBMockRecorder) UpdateTokenMaxTermRatio(tokenID, ratio interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateTokenMaxTermRatio", reflect.TypeOf((*MockDB)(nil).UpdateTokenMaxTermRatio), tokenID, ratio)
+}
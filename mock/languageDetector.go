@@ -0,0 +1,48 @@
+// Code generated by MockGen. DO NOT EDIT.
+// Source: ../languageDetector.go
+
+// Package mock is a generated GoMock package.
+package mock
+
+import (
+	reflect "reflect"
+
+	gomock "github.com/golang/mock/gomock"
+)
+
+// MockLanguageDetector is a mock of LanguageDetector interface.
+type MockLanguageDetector struct {
+	ctrl     *gomock.Controller
+	recorder *MockLanguageDetectorMockRecorder
+}
+
+// MockLanguageDetectorMockRecorder is the mock recorder for MockLanguageDetector.
+type MockLanguageDetectorMockRecorder struct {
+	mock *MockLanguageDetector
+}
+
+// NewMockLanguageDetector creates a new mock instance.
+func NewMockLanguageDetector(ctrl *gomock.Controller) *MockLanguageDetector {
+	mock := &MockLanguageDetector{ctrl: ctrl}
+	mock.recorder = &MockLanguageDetectorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockLanguageDetector) EXPECT() *MockLanguageDetectorMockRecorder {
+	return m.recorder
+}
+
+// Detect mocks base method.
+func (m *MockLanguageDetector) Detect(text []string) string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Detect", text)
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Detect indicates an expected call of Detect.
+func (mr *MockLanguageDetectorMockRecorder) Detect(text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Detect", reflect.TypeOf((*MockLanguageDetector)(nil).Detect), text)
+}
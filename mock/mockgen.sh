@@ -1,7 +1,9 @@
 #!/bin/bash
 cd $(dirname $0)
+mockgen -source ../analyzer.go -destination analyzer.go -package mock
 mockgen -source ../charFilter.go -destination charFilter.go -package mock
 mockgen -source ../db.go -destination db.go -package mock
+mockgen -source ../languageDetector.go -destination languageDetector.go -package mock
 mockgen -source ../sentenceSplitter.go -destination sentenceSplitter.go -package mock
 mockgen -source ../service.go -destination service.go -package mock
 mockgen -source ../tokenizer.go -destination tokenizer.go -package mock
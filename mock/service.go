@@ -5,7 +5,9 @@
 package mock
 
 import (
+	io "io"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	types "github.com/hrntknr/searcher/types"
@@ -34,31 +36,313 @@ func (m *MockService) EXPECT() *MockServiceMockRecorder {
 	return m.recorder
 }
 
+// Checkpoint mocks base method.
+func (m *MockService) Checkpoint() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Checkpoint")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Checkpoint indicates an expected call of Checkpoint.
+func (mr *MockServiceMockRecorder) Checkpoint() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Checkpoint", reflect.TypeOf((*MockService)(nil).Checkpoint))
+}
+
+// Close mocks base method.
+func (m *MockService) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockServiceMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockService)(nil).Close))
+}
+
+// Compact mocks base method.
+func (m *MockService) Compact() (*types.CompactReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Compact")
+	ret0, _ := ret[0].(*types.CompactReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Compact indicates an expected call of Compact.
+func (mr *MockServiceMockRecorder) Compact() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Compact", reflect.TypeOf((*MockService)(nil).Compact))
+}
+
+// Delete mocks base method.
+func (m *MockService) Delete(uri string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", uri)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockServiceMockRecorder) Delete(uri interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockService)(nil).Delete), uri)
+}
+
+// Document mocks base method.
+func (m *MockService) Document(uri string) (*types.Document, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Document", uri)
+	ret0, _ := ret[0].(*types.Document)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Document indicates an expected call of Document.
+func (mr *MockServiceMockRecorder) Document(uri interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Document", reflect.TypeOf((*MockService)(nil).Document), uri)
+}
+
+// DocumentsBefore mocks base method.
+func (m *MockService) DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DocumentsBefore", before, offset, count)
+	ret0, _ := ret[0].([]*types.Document)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DocumentsBefore indicates an expected call of DocumentsBefore.
+func (mr *MockServiceMockRecorder) DocumentsBefore(before, offset, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DocumentsBefore", reflect.TypeOf((*MockService)(nil).DocumentsBefore), before, offset, count)
+}
+
+// Export mocks base method.
+func (m *MockService) Export(w io.Writer) (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Export", w)
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Export indicates an expected call of Export.
+func (mr *MockServiceMockRecorder) Export(w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Export", reflect.TypeOf((*MockService)(nil).Export), w)
+}
+
+// Fsck mocks base method.
+func (m *MockService) Fsck() (*types.FsckReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Fsck")
+	ret0, _ := ret[0].(*types.FsckReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Fsck indicates an expected call of Fsck.
+func (mr *MockServiceMockRecorder) Fsck() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Fsck", reflect.TypeOf((*MockService)(nil).Fsck))
+}
+
+// Import mocks base method.
+func (m *MockService) Import(r io.Reader) (*types.ImportReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Import", r)
+	ret0, _ := ret[0].(*types.ImportReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Import indicates an expected call of Import.
+func (mr *MockServiceMockRecorder) Import(r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Import", reflect.TypeOf((*MockService)(nil).Import), r)
+}
+
+// Merge mocks base method.
+func (m *MockService) Merge() (*types.MergeReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Merge")
+	ret0, _ := ret[0].(*types.MergeReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Merge indicates an expected call of Merge.
+func (mr *MockServiceMockRecorder) Merge() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Merge", reflect.TypeOf((*MockService)(nil).Merge))
+}
+
+// Recover mocks base method.
+func (m *MockService) Recover() (*types.RecoveryReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Recover")
+	ret0, _ := ret[0].(*types.RecoveryReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Recover indicates an expected call of Recover.
+func (mr *MockServiceMockRecorder) Recover() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Recover", reflect.TypeOf((*MockService)(nil).Recover))
+}
+
 // Regist mocks base method.
-func (m *MockService) Regist(uri, body string) error {
+func (m *MockService) Regist(uri, body string, meta types.DocumentMeta) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Regist", uri, body)
+	ret := m.ctrl.Call(m, "Regist", uri, body, meta)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Regist indicates an expected call of Regist.
-func (mr *MockServiceMockRecorder) Regist(uri, body interface{}) *gomock.Call {
+func (mr *MockServiceMockRecorder) Regist(uri, body, meta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Regist", reflect.TypeOf((*MockService)(nil).Regist), uri, body, meta)
+}
+
+// RegistHTML mocks base method.
+func (m *MockService) RegistHTML(uri, body string, meta types.DocumentMeta) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RegistHTML", uri, body, meta)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RegistHTML indicates an expected call of RegistHTML.
+func (mr *MockServiceMockRecorder) RegistHTML(uri, body, meta interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegistHTML", reflect.TypeOf((*MockService)(nil).RegistHTML), uri, body, meta)
+}
+
+// Reindex mocks base method.
+func (m *MockService) Reindex() (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Reindex")
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Reindex indicates an expected call of Reindex.
+func (mr *MockServiceMockRecorder) Reindex() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Regist", reflect.TypeOf((*MockService)(nil).Regist), uri, body)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Reindex", reflect.TypeOf((*MockService)(nil).Reindex))
+}
+
+// Restore mocks base method.
+func (m *MockService) Restore(r io.Reader) (*types.SnapshotReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Restore", r)
+	ret0, _ := ret[0].(*types.SnapshotReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Restore indicates an expected call of Restore.
+func (mr *MockServiceMockRecorder) Restore(r interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Restore", reflect.TypeOf((*MockService)(nil).Restore), r)
 }
 
 // Search mocks base method.
-func (m *MockService) Search(str string, offset, count uint) ([]types.SearchResult, error) {
+func (m *MockService) Search(str, lang string, prefix bool, offset, count uint) ([]types.SearchResult, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Search", str, offset, count)
+	ret := m.ctrl.Call(m, "Search", str, lang, prefix, offset, count)
 	ret0, _ := ret[0].([]types.SearchResult)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Search indicates an expected call of Search.
-func (mr *MockServiceMockRecorder) Search(str, offset, count interface{}) *gomock.Call {
+func (mr *MockServiceMockRecorder) Search(str, lang, prefix, offset, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockService)(nil).Search), str, lang, prefix, offset, count)
+}
+
+// SearchScores mocks base method.
+func (m *MockService) SearchScores(str, lang string, prefix bool, count uint) ([]float64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SearchScores", str, lang, prefix, count)
+	ret0, _ := ret[0].([]float64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SearchScores indicates an expected call of SearchScores.
+func (mr *MockServiceMockRecorder) SearchScores(str, lang, prefix, count interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchScores", reflect.TypeOf((*MockService)(nil).SearchScores), str, lang, prefix, count)
+}
+
+// Snapshot mocks base method.
+func (m *MockService) Snapshot(w io.Writer) (*types.SnapshotReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Snapshot", w)
+	ret0, _ := ret[0].(*types.SnapshotReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Snapshot indicates an expected call of Snapshot.
+func (mr *MockServiceMockRecorder) Snapshot(w interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Snapshot", reflect.TypeOf((*MockService)(nil).Snapshot), w)
+}
+
+// StaleDocuments mocks base method.
+func (m *MockService) StaleDocuments() (uint, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StaleDocuments")
+	ret0, _ := ret[0].(uint)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StaleDocuments indicates an expected call of StaleDocuments.
+func (mr *MockServiceMockRecorder) StaleDocuments() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StaleDocuments", reflect.TypeOf((*MockService)(nil).StaleDocuments))
+}
+
+// Stats mocks base method.
+func (m *MockService) Stats(top uint) (*types.Stats, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Stats", top)
+	ret0, _ := ret[0].(*types.Stats)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Stats indicates an expected call of Stats.
+func (mr *MockServiceMockRecorder) Stats(top interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Stats", reflect.TypeOf((*MockService)(nil).Stats), top)
+}
+
+// Touch mocks base method.
+func (m *MockService) Touch(uri string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Touch", uri)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Touch indicates an expected call of Touch.
+func (mr *MockServiceMockRecorder) Touch(uri interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockService)(nil).Search), str, offset, count)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Touch", reflect.TypeOf((*MockService)(nil).Touch), uri)
 }
@@ -5,9 +5,11 @@
 package mock
 
 import (
+	io "io"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	types "github.com/hrntknr/searcher/types"
 )
 
 // MockTokenizer is a mock of Tokenizer interface.
@@ -34,10 +36,10 @@ func (m *MockTokenizer) EXPECT() *MockTokenizerMockRecorder {
 }
 
 // Analyze mocks base method.
-func (m *MockTokenizer) Analyze(text []string) [][]string {
+func (m *MockTokenizer) Analyze(text []string) [][]types.Term {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Analyze", text)
-	ret0, _ := ret[0].([][]string)
+	ret0, _ := ret[0].([][]types.Term)
 	return ret0
 }
 
@@ -46,3 +48,41 @@ func (mr *MockTokenizerMockRecorder) Analyze(text interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Analyze", reflect.TypeOf((*MockTokenizer)(nil).Analyze), text)
 }
+
+// MockDictionaryValidator is a mock of DictionaryValidator interface.
+type MockDictionaryValidator struct {
+	ctrl     *gomock.Controller
+	recorder *MockDictionaryValidatorMockRecorder
+}
+
+// MockDictionaryValidatorMockRecorder is the mock recorder for MockDictionaryValidator.
+type MockDictionaryValidatorMockRecorder struct {
+	mock *MockDictionaryValidator
+}
+
+// NewMockDictionaryValidator creates a new mock instance.
+func NewMockDictionaryValidator(ctrl *gomock.Controller) *MockDictionaryValidator {
+	mock := &MockDictionaryValidator{ctrl: ctrl}
+	mock.recorder = &MockDictionaryValidatorMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDictionaryValidator) EXPECT() *MockDictionaryValidatorMockRecorder {
+	return m.recorder
+}
+
+// ValidateUserDictionary mocks base method.
+func (m *MockDictionaryValidator) ValidateUserDictionary(userDictionary io.Reader, text string) ([]types.DictionaryToken, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ValidateUserDictionary", userDictionary, text)
+	ret0, _ := ret[0].([]types.DictionaryToken)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ValidateUserDictionary indicates an expected call of ValidateUserDictionary.
+func (mr *MockDictionaryValidatorMockRecorder) ValidateUserDictionary(userDictionary, text interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ValidateUserDictionary", reflect.TypeOf((*MockDictionaryValidator)(nil).ValidateUserDictionary), userDictionary, text)
+}
@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	types "github.com/hrntknr/searcher/types"
 )
 
 // MockWordFilter is a mock of WordFilter interface.
@@ -46,3 +47,40 @@ func (mr *MockWordFilterMockRecorder) Filter(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Filter", reflect.TypeOf((*MockWordFilter)(nil).Filter), arg0)
 }
+
+// MockTermFilter is a mock of TermFilter interface.
+type MockTermFilter struct {
+	ctrl     *gomock.Controller
+	recorder *MockTermFilterMockRecorder
+}
+
+// MockTermFilterMockRecorder is the mock recorder for MockTermFilter.
+type MockTermFilterMockRecorder struct {
+	mock *MockTermFilter
+}
+
+// NewMockTermFilter creates a new mock instance.
+func NewMockTermFilter(ctrl *gomock.Controller) *MockTermFilter {
+	mock := &MockTermFilter{ctrl: ctrl}
+	mock.recorder = &MockTermFilterMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTermFilter) EXPECT() *MockTermFilterMockRecorder {
+	return m.recorder
+}
+
+// FilterTerms mocks base method.
+func (m *MockTermFilter) FilterTerms(arg0 [][]types.Term) [][]types.Term {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FilterTerms", arg0)
+	ret0, _ := ret[0].([][]types.Term)
+	return ret0
+}
+
+// FilterTerms indicates an expected call of FilterTerms.
+func (mr *MockTermFilterMockRecorder) FilterTerms(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FilterTerms", reflect.TypeOf((*MockTermFilter)(nil).FilterTerms), arg0)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// 1ブロックに入れるポスティングの数
+const postingBlockSize = 128
+
+// 圧縮したポスティングリストの形式のバージョン
+const postingBlockVersion = 1
+
+var errInvalidPostingBlock = errors.New("invalid posting block")
+
+// 1ドキュメント分のポスティング
+type postingEntry struct {
+	documentID    uint
+	termFrequency uint
+	// ドキュメントの中でのトークンの位置
+	positions []uint
+	// トークンが出現する文章の、ドキュメントの中での順番。小さい順で重複しない
+	sentences []uint
+}
+
+// ドキュメントID順のポスティングを、差分と可変長整数で圧縮したブロックにする。
+//
+//	バージョン, ポスティング数, ブロック数
+//	ブロックごとに 最後のドキュメントIDの差分, バイト数 (スキップポインタ)
+//	ブロックごとに ポスティングごとに ドキュメントIDの差分, 出現回数, 位置の数, 位置の差分..., 文章の数, 文章の順番の差分...
+//
+// ドキュメントIDの差分は直前のポスティング(ブロックの先頭は直前のブロックの最後)から取る
+func encodePostingBlocks(entries []postingEntry) []byte {
+	if len(entries) == 0 {
+		return nil
+	}
+	header := []byte{}
+	body := []byte{}
+	blockCount := (len(entries) + postingBlockSize - 1) / postingBlockSize
+	header = appendUvarint(header, postingBlockVersion)
+	header = appendUvarint(header, uint64(len(entries)))
+	header = appendUvarint(header, uint64(blockCount))
+
+	last := uint(0)
+	for start := 0; start < len(entries); start += postingBlockSize {
+		end := start + postingBlockSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		block := encodePostingBlock(entries[start:end], last)
+		previous := entries[end-1].documentID
+		header = appendUvarint(header, uint64(previous-last))
+		header = appendUvarint(header, uint64(len(block)))
+		body = append(body, block...)
+		last = previous
+	}
+	return append(header, body...)
+}
+
+// 1ブロック分のポスティング。baseは直前のブロックの最後のドキュメントID
+func encodePostingBlock(entries []postingEntry, base uint) []byte {
+	block := []byte{}
+	previous := base
+	for _, entry := range entries {
+		block = appendUvarint(block, uint64(entry.documentID-previous))
+		block = appendUvarint(block, uint64(entry.termFrequency))
+		block = appendUvarint(block, uint64(len(entry.positions)))
+		position := uint(0)
+		for _, p := range entry.positions {
+			block = appendUvarint(block, uint64(p-position))
+			position = p
+		}
+		block = appendUvarint(block, uint64(len(entry.sentences)))
+		sentence := uint(0)
+		for _, index := range entry.sentences {
+			block = appendUvarint(block, uint64(index-sentence))
+			sentence = index
+		}
+		previous = entry.documentID
+	}
+	return block
+}
+
+// 最後のドキュメントより後のポスティングを、最後のブロックだけを展開して追加する。
+// 他のブロックはスキップポインタとバイト列をそのまま使う。後ろに追加できなければfalse
+func appendPostingEntry(data []byte, entry postingEntry) ([]byte, bool, error) {
+	reader, err := newPostingBlockReader(data)
+	if err != nil {
+		return nil, false, err
+	}
+	last := len(reader.skips) - 1
+	if last < 0 || reader.skips[last].last >= entry.documentID {
+		return nil, false, nil
+	}
+	reader.load(last)
+	if err := reader.Err(); err != nil {
+		return nil, false, err
+	}
+	// 最後のブロックに空きがあれば作り直し、なければ新しいブロックにする
+	keep := reader.skips
+	tail := []postingEntry{entry}
+	if len(reader.entries) < postingBlockSize {
+		keep = reader.skips[:last]
+		tail = append(append([]postingEntry{}, reader.entries...), entry)
+	}
+	base := uint(0)
+	bodyLength := 0
+	if len(keep) > 0 {
+		base = keep[len(keep)-1].last
+		bodyLength = keep[len(keep)-1].offset + keep[len(keep)-1].length
+	}
+	block := encodePostingBlock(tail, base)
+
+	header := []byte{}
+	header = appendUvarint(header, postingBlockVersion)
+	header = appendUvarint(header, uint64(reader.count+1))
+	header = appendUvarint(header, uint64(len(keep)+1))
+	for _, skip := range keep {
+		header = appendUvarint(header, uint64(skip.last-skip.base))
+		header = appendUvarint(header, uint64(skip.length))
+	}
+	header = appendUvarint(header, uint64(entry.documentID-base))
+	header = appendUvarint(header, uint64(len(block)))
+	result := make([]byte, 0, len(header)+bodyLength+len(block))
+	result = append(result, header...)
+	result = append(result, reader.data[:bodyLength]...)
+	return append(result, block...), true, nil
+}
+
+// すべてのポスティングを展開する
+func decodePostingBlocks(data []byte) ([]postingEntry, error) {
+	if len(data) == 0 {
+		return []postingEntry{}, nil
+	}
+	reader, err := newPostingBlockReader(data)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]postingEntry, 0, reader.Len())
+	for ; !reader.Done(); reader.Next() {
+		entries = append(entries, reader.entries[reader.index])
+	}
+	if err := reader.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ドキュメントのポスティングを追加、すでにあれば置き換える
+func upsertPostingEntry(entries []postingEntry, entry postingEntry) []postingEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].documentID >= entry.documentID
+	})
+	if i < len(entries) && entries[i].documentID == entry.documentID {
+		entries[i] = entry
+		return entries
+	}
+	entries = append(entries, postingEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	return entries
+}
+
+// ドキュメントのポスティングを取り除く
+func removePostingEntry(entries []postingEntry, documentID uint) []postingEntry {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].documentID >= documentID
+	})
+	if i < len(entries) && entries[i].documentID == documentID {
+		return append(entries[:i], entries[i+1:]...)
+	}
+	return entries
+}
+
+// 圧縮したポスティングリストにドキュメントのポスティングを追加、すでにあれば置き換える。
+// 新しいドキュメントはIDが大きいので、ほとんどは最後のブロックへの追加ですむ
+func addPostingEntry(data []byte, entry postingEntry) ([]byte, error) {
+	if len(data) > 0 {
+		appended, ok, err := appendPostingEntry(data, entry)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return appended, nil
+		}
+	}
+	entries, err := decodePostingBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	return encodePostingBlocks(upsertPostingEntry(entries, entry)), nil
+}
+
+// 圧縮したポスティングリストからドキュメントを取り除く、なければそのまま
+func removeDocumentPosting(data []byte, documentID uint) ([]byte, error) {
+	entries, err := decodePostingBlocks(data)
+	if err != nil {
+		return nil, err
+	}
+	count := len(entries)
+	if entries = removePostingEntry(entries, documentID); len(entries) == count {
+		return data, nil
+	}
+	return encodePostingBlocks(entries), nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+type postingSkip struct {
+	// 直前のブロックの最後のドキュメントID
+	base uint
+	// ブロックの最後のドキュメントID
+	last   uint
+	offset int
+	length int
+}
+
+// 圧縮したポスティングリストをドキュメントID順に読む。
+// スキップポインタで読み飛ばすブロックは展開しない
+type postingBlockReader struct {
+	data  []byte
+	count int
+	skips []postingSkip
+	block int
+	// 展開済みのブロック
+	entries []postingEntry
+	index   int
+	err     error
+}
+
+func newPostingBlockReader(data []byte) (*postingBlockReader, error) {
+	r := &postingBlockReader{}
+	offset := 0
+	read := func() (uint64, error) {
+		v, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return 0, errInvalidPostingBlock
+		}
+		offset += n
+		return v, nil
+	}
+	version, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if version != postingBlockVersion {
+		return nil, errInvalidPostingBlock
+	}
+	count, err := read()
+	if err != nil {
+		return nil, err
+	}
+	blockCount, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if blockCount > uint64(len(data)) {
+		return nil, errInvalidPostingBlock
+	}
+	r.count = int(count)
+	r.skips = make([]postingSkip, blockCount)
+	last := uint(0)
+	blockOffset := 0
+	for i := range r.skips {
+		delta, err := read()
+		if err != nil {
+			return nil, err
+		}
+		length, err := read()
+		if err != nil {
+			return nil, err
+		}
+		r.skips[i] = postingSkip{base: last, last: last + uint(delta), offset: blockOffset, length: int(length)}
+		last += uint(delta)
+		blockOffset += int(length)
+	}
+	r.data = data[offset:]
+	if blockOffset != len(r.data) {
+		return nil, errInvalidPostingBlock
+	}
+	r.load(0)
+	return r, nil
+}
+
+// ブロックを展開して先頭に移る
+func (r *postingBlockReader) load(block int) {
+	r.block = block
+	r.entries = r.entries[:0]
+	r.index = 0
+	if block >= len(r.skips) {
+		return
+	}
+	skip := r.skips[block]
+	data := r.data[skip.offset : skip.offset+skip.length]
+	offset := 0
+	read := func() uint64 {
+		if r.err != nil {
+			return 0
+		}
+		v, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			r.err = errInvalidPostingBlock
+			return 0
+		}
+		offset += n
+		return v
+	}
+	documentID := skip.base
+	for offset < len(data) && r.err == nil {
+		documentID += uint(read())
+		entry := postingEntry{documentID: documentID, termFrequency: uint(read())}
+		count := read()
+		if count > uint64(len(data)) {
+			r.err = errInvalidPostingBlock
+			break
+		}
+		entry.positions = make([]uint, count)
+		position := uint(0)
+		for i := range entry.positions {
+			position += uint(read())
+			entry.positions[i] = position
+		}
+		count = read()
+		if count > uint64(len(data)) {
+			r.err = errInvalidPostingBlock
+			break
+		}
+		sentence := uint(0)
+		for i := uint64(0); i < count; i++ {
+			sentence += uint(read())
+			entry.sentences = append(entry.sentences, sentence)
+		}
+		r.entries = append(r.entries, entry)
+	}
+	if r.err != nil {
+		r.block = len(r.skips)
+		r.entries = r.entries[:0]
+	}
+}
+
+// ポスティングの数
+func (r *postingBlockReader) Len() int {
+	return r.count
+}
+
+func (r *postingBlockReader) Done() bool {
+	return r.index >= len(r.entries)
+}
+
+func (r *postingBlockReader) DocumentID() uint {
+	return r.entries[r.index].documentID
+}
+
+func (r *postingBlockReader) TermFrequency() uint {
+	return r.entries[r.index].termFrequency
+}
+
+// 今のドキュメントのポスティング
+func (r *postingBlockReader) Entry() postingEntry {
+	return r.entries[r.index]
+}
+
+func (r *postingBlockReader) Next() {
+	r.index++
+	if r.index >= len(r.entries) && r.block < len(r.skips) {
+		r.load(r.block + 1)
+	}
+}
+
+// 指定したID以上のドキュメントまで進める。最後のドキュメントIDがそれより小さいブロックは展開しない
+func (r *postingBlockReader) Seek(documentID uint) {
+	if r.Done() || r.DocumentID() >= documentID {
+		return
+	}
+	if r.skips[r.block].last < documentID {
+		rest := r.skips[r.block+1:]
+		i := sort.Search(len(rest), func(i int) bool {
+			return rest[i].last >= documentID
+		})
+		r.load(r.block + 1 + i)
+	}
+	rest := r.entries[r.index:]
+	r.index += sort.Search(len(rest), func(i int) bool {
+		return rest[i].documentID >= documentID
+	})
+}
+
+// ブロックの展開に失敗していればエラー
+func (r *postingBlockReader) Err() error {
+	return r.err
+}
+
+// ドキュメントに含まれるトークンIDを、小さい順の差分と可変長整数で圧縮する
+func encodeTokenIDs(tokenIDs []uint) []byte {
+	data := []byte{}
+	prev := uint(0)
+	for _, id := range tokenIDs {
+		data = appendUvarint(data, uint64(id-prev))
+		prev = id
+	}
+	return data
+}
+
+func decodeTokenIDs(data []byte) ([]uint, error) {
+	tokenIDs := []uint{}
+	prev := uint(0)
+	for offset := 0; offset < len(data); {
+		v, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return nil, errInvalidPostingBlock
+		}
+		offset += n
+		prev += uint(v)
+		tokenIDs = append(tokenIDs, prev)
+	}
+	return tokenIDs, nil
+}
+
+// 小さい順で重複しないトークンIDをまとめる
+func mergeTokenIDs(a, b []uint) []uint {
+	merged := make([]uint, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
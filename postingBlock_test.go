@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncodePostingBlocks(t *testing.T) {
+	entries := []postingEntry{}
+	for i := uint(0); i < postingBlockSize*2+10; i++ {
+		entries = append(entries, postingEntry{
+			documentID:    i*3 + 1,
+			termFrequency: i%3 + 1,
+			positions:     []uint{i, i + 5, i + 1000}[:i%3+1],
+			// 文章がないポスティングも読める
+			sentences: []uint{0, 2, i + 3}[:i%3],
+		})
+		if i%3 == 0 {
+			entries[i].sentences = nil
+		}
+	}
+	data := encodePostingBlocks(entries)
+	actual, err := decodePostingBlocks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(entries, actual, cmp.AllowUnexported(postingEntry{})); diff != "" {
+		t.Errorf(diff)
+	}
+
+	reader, _ := newPostingBlockReader(data)
+	if diff := cmp.Diff(len(entries), reader.Len()); diff != "" {
+		t.Errorf(diff)
+	}
+	// 3つ目のブロックまでスキップポインタで読み飛ばす
+	reader.Seek(entries[postingBlockSize*2+3].documentID - 1)
+	if diff := cmp.Diff(2, reader.block); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(entries[postingBlockSize*2+3].documentID, reader.DocumentID()); diff != "" {
+		t.Errorf(diff)
+	}
+	// 戻らない
+	reader.Seek(1)
+	if diff := cmp.Diff(entries[postingBlockSize*2+3].documentID, reader.DocumentID()); diff != "" {
+		t.Errorf(diff)
+	}
+	reader.Seek(entries[len(entries)-1].documentID + 1)
+	if !reader.Done() {
+		t.Errorf("reader should be done")
+	}
+	if err := reader.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodePostingBlocksEmpty(t *testing.T) {
+	if data := encodePostingBlocks(nil); data != nil {
+		t.Errorf("unexpected data: %v", data)
+	}
+	entries, err := decodePostingBlocks(nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]postingEntry{}, entries, cmp.AllowUnexported(postingEntry{})); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestDecodePostingBlocksInvalid(t *testing.T) {
+	data := encodePostingBlocks([]postingEntry{{documentID: 1, termFrequency: 1, positions: []uint{300}}})
+	for _, data := range [][]byte{
+		{0xff},
+		{2, 1, 1, 1, 1, 0},
+		data[:len(data)-1],
+	} {
+		if _, err := decodePostingBlocks(data); err == nil {
+			t.Errorf("expected error: %v", data)
+		}
+	}
+}
+
+func TestUpsertPostingEntry(t *testing.T) {
+	entries := []postingEntry{{documentID: 1}, {documentID: 5}}
+	entries = upsertPostingEntry(entries, postingEntry{documentID: 3, termFrequency: 1})
+	entries = upsertPostingEntry(entries, postingEntry{documentID: 5, termFrequency: 2})
+	entries = upsertPostingEntry(entries, postingEntry{documentID: 7})
+	entries = removePostingEntry(entries, 1)
+	entries = removePostingEntry(entries, 4)
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 3, termFrequency: 1}, {documentID: 5, termFrequency: 2}, {documentID: 7}},
+		entries,
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestAddPostingEntry(t *testing.T) {
+	entries := []postingEntry{}
+	data := []byte(nil)
+	// 最後のブロックへの追加と新しいブロック、途中への追加と置き換え
+	for _, documentID := range append([]uint{2}, makeRange(4, postingBlockSize*2+10)...) {
+		entry := postingEntry{documentID: documentID, termFrequency: documentID % 3, positions: []uint{documentID, documentID + 2}}
+		var err error
+		if data, err = addPostingEntry(data, entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = upsertPostingEntry(entries, entry)
+		if diff := cmp.Diff(encodePostingBlocks(entries), data); diff != "" {
+			t.Fatalf("%d: %s", documentID, diff)
+		}
+	}
+	for _, entry := range []postingEntry{{documentID: 1, termFrequency: 1}, {documentID: 4, termFrequency: 5}} {
+		var err error
+		if data, err = addPostingEntry(data, entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = upsertPostingEntry(entries, entry)
+	}
+	if diff := cmp.Diff(encodePostingBlocks(entries), data); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func makeRange(from, to uint) []uint {
+	result := []uint{}
+	for i := from; i <= to; i++ {
+		result = append(result, i)
+	}
+	return result
+}
+
+func TestEncodeTokenIDs(t *testing.T) {
+	tokenIDs := []uint{1, 5, 6, 300, 70000}
+	actual, err := decodeTokenIDs(encodeTokenIDs(tokenIDs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tokenIDs, actual); diff != "" {
+		t.Errorf(diff)
+	}
+	// 記録がなければ空
+	if actual, _ := decodeTokenIDs(nil); len(actual) != 0 {
+		t.Errorf("unexpected token ids: %v", actual)
+	}
+	if _, err := decodeTokenIDs([]byte{0x80}); err != errInvalidPostingBlock {
+		t.Errorf("expected invalid posting block: %v", err)
+	}
+}
+
+func TestMergeTokenIDs(t *testing.T) {
+	if diff := cmp.Diff([]uint{1, 2, 3, 5, 8}, mergeTokenIDs([]uint{1, 3, 5}, []uint{2, 3, 8})); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff([]uint{1, 2}, mergeTokenIDs([]uint{}, []uint{1, 2})); diff != "" {
+		t.Errorf(diff)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/hrntknr/searcher/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 圧縮したポスティングリストの保存先
+const (
+	// SQLのテーブルにバイナリで保存
+	postingStoreSQL = "sql"
+	// ディレクトリにトークンごとのファイルで保存
+	postingStoreFile = "file"
+	// メモリに溜めて変更しないセグメントファイルに書き出し、バックグラウンドでまとめる
+	postingStoreSegment = "segment"
+)
+
+var errPostingStoreClosed = errors.New("posting store is closed")
+
+// 圧縮したポスティングリストを読む
+type postingLoader interface {
+	// 複数のトークンのポスティングリストを同じ時点の内容で取得、ないトークンは含めない
+	Load(tokenIDs []uint) (map[uint][]byte, error)
+}
+
+// トークンごとの圧縮したポスティングリストを読み書きする
+type postingStore interface {
+	postingLoader
+	// ドキュメントのポスティングを追加、すでにあれば置き換える
+	Add(tokenID uint, entry postingEntry) error
+	// ドキュメントのポスティングを取り除く
+	Remove(tokenID uint, documentID uint) error
+}
+
+// 今の時点の内容を、あとから変更されずに読める保存先
+type snapshotablePostingStore interface {
+	// 登録や削除が止まっている間に呼ぶ。写すのは一覧だけで、中身は読むときに読む
+	Snapshot() (postingSnapshot, error)
+}
+
+// ある時点のポスティングリスト。読み終わったら閉じる
+type postingSnapshot interface {
+	postingLoader
+	Close() error
+}
+
+// 閉じるものがないpostingSnapshot
+type nopPostingSnapshot struct {
+	postingLoader
+}
+
+func (nopPostingSnapshot) Close() error {
+	return nil
+}
+
+func newPostingStore(name string, db *gorm.DB, dir string, config segmentConfig) (postingStore, error) {
+	switch name {
+	case "", postingStoreSQL:
+		return newSQLPostingStore(db)
+	case postingStoreFile:
+		return newFilePostingStore(dir)
+	case postingStoreSegment:
+		return newSegmentPostingStore(dir, config.FlushSize, config.MergeFactor)
+	default:
+		return nil, fmt.Errorf("unknown posting store: %s", name)
+	}
+}
+
+func newSQLPostingStore(db *gorm.DB) (*sqlPostingStore, error) {
+	return &sqlPostingStore{
+		db: db,
+	}, nil
+}
+
+type sqlPostingStore struct {
+	db *gorm.DB
+	// dbがすでにトランザクションなら、セーブポイントを作らずにそのまま更新する
+	transaction bool
+}
+
+func (s *sqlPostingStore) Load(tokenIDs []uint) (map[uint][]byte, error) {
+	blocks := []*types.PostingBlock{}
+	if err := s.db.Model(&types.PostingBlock{}).Where("token_id IN ?", tokenIDs).Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	result := make(map[uint][]byte, len(blocks))
+	for _, block := range blocks {
+		result[block.TokenID] = block.Data
+	}
+	return result, nil
+}
+
+func (s *sqlPostingStore) Add(tokenID uint, entry postingEntry) error {
+	return s.Update(tokenID, func(data []byte) ([]byte, error) {
+		return addPostingEntry(data, entry)
+	})
+}
+
+func (s *sqlPostingStore) Remove(tokenID uint, documentID uint) error {
+	return s.Update(tokenID, func(data []byte) ([]byte, error) {
+		return removeDocumentPosting(data, documentID)
+	})
+}
+
+// 読んだポスティングリストを書き換える。同じトークンへの更新は直列になる。空にすると削除
+func (s *sqlPostingStore) Update(tokenID uint, update func(data []byte) ([]byte, error)) error {
+	if s.transaction {
+		return updatePostingBlock(s.db, tokenID, update)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return updatePostingBlock(tx, tokenID, update)
+	})
+}
+
+func updatePostingBlock(tx *gorm.DB, tokenID uint, update func(data []byte) ([]byte, error)) error {
+	// ない行をSELECT ... FOR UPDATEするとInnoDBではギャップロックになり、
+	// 新しいトークンを同時に登録するとデッドロックする。先に行を作り、ある行だけをロックする
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&types.PostingBlock{TokenID: tokenID}).Error; err != nil {
+		return err
+	}
+	// 行ロックで同じトークンへの更新を直列にする
+	var block types.PostingBlock
+	if err := tx.Model(&types.PostingBlock{}).Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_id = ?", tokenID).First(&block).Error; err != nil {
+		return err
+	}
+	data, err := update(block.Data)
+	if err != nil {
+		return err
+	}
+	// 作った行も空のままなら消すので、他からは見えない
+	if len(data) == 0 {
+		return tx.Where("token_id = ?", tokenID).Delete(&types.PostingBlock{}).Error
+	}
+	return tx.Model(&types.PostingBlock{}).Where("token_id = ?", tokenID).Update("data", data).Error
+}
+
+// 同じトークンへの更新を直列にするためのロックの数
+const filePostingStoreLocks = 64
+
+// スナップショットのディレクトリ。トークンのファイルとは名前が重ならない
+const filePostingSnapshotPattern = ".snapshot-*"
+
+// 1つのプロセスから使う前提で、ロックはプロセスの中だけで取る
+func newFilePostingStore(dir string) (*filePostingStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("posting dir is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// 閉じる前に止まったスナップショットを消す
+	snapshots, err := filepath.Glob(filepath.Join(dir, filePostingSnapshotPattern))
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if err := os.RemoveAll(snapshot); err != nil {
+			return nil, err
+		}
+	}
+	return &filePostingStore{
+		dir:   dir,
+		locks: make([]sync.Mutex, filePostingStoreLocks),
+	}, nil
+}
+
+type filePostingStore struct {
+	dir   string
+	locks []sync.Mutex
+}
+
+func (s *filePostingStore) path(tokenID uint) string {
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(tokenID), 10)+".postings")
+}
+
+func (s *filePostingStore) Load(tokenIDs []uint) (map[uint][]byte, error) {
+	result := make(map[uint][]byte, len(tokenIDs))
+	for _, tokenID := range tokenIDs {
+		data, err := s.load(tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			result[tokenID] = data
+		}
+	}
+	return result, nil
+}
+
+func (s *filePostingStore) Add(tokenID uint, entry postingEntry) error {
+	return s.Update(tokenID, func(data []byte) ([]byte, error) {
+		return addPostingEntry(data, entry)
+	})
+}
+
+func (s *filePostingStore) Remove(tokenID uint, documentID uint) error {
+	return s.Update(tokenID, func(data []byte) ([]byte, error) {
+		return removeDocumentPosting(data, documentID)
+	})
+}
+
+func (s *filePostingStore) load(tokenID uint) ([]byte, error) {
+	data, err := os.ReadFile(s.path(tokenID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// 読んだポスティングリストを書き換える。同じトークンへの更新は直列になる。空にすると削除
+func (s *filePostingStore) Update(tokenID uint, update func(data []byte) ([]byte, error)) error {
+	lock := &s.locks[tokenID%filePostingStoreLocks]
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, err := s.load(tokenID)
+	if err != nil {
+		return err
+	}
+	data, err := update(current)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		if err := os.Remove(s.path(tokenID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomic(s.path(tokenID), data)
+}
+
+// 今のファイルをハードリンクしたディレクトリを作る。
+// 更新は別のファイルに書いてから置き換えるので、リンクしたファイルはあとから変わらない
+func (s *filePostingStore) Snapshot() (postingSnapshot, error) {
+	for i := range s.locks {
+		s.locks[i].Lock()
+	}
+	defer func() {
+		for i := range s.locks {
+			s.locks[i].Unlock()
+		}
+	}()
+
+	dir, err := os.MkdirTemp(s.dir, filePostingSnapshotPattern)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.postings"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	for _, file := range files {
+		if err := os.Link(file, filepath.Join(dir, filepath.Base(file))); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return &filePostingSnapshot{filePostingStore{dir: dir}}, nil
+}
+
+// リンクしたディレクトリから読み、閉じたら消す
+type filePostingSnapshot struct {
+	store filePostingStore
+}
+
+func (s *filePostingSnapshot) Load(tokenIDs []uint) (map[uint][]byte, error) {
+	return s.store.Load(tokenIDs)
+}
+
+func (s *filePostingSnapshot) Close() error {
+	return os.RemoveAll(s.store.dir)
+}
+
+// 書きかけのファイルを読まないように、一時ファイルに書いてから置き換える
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
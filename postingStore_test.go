@@ -0,0 +1,146 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSQLPostingStore(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newSQLPostingStore(gdb)
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`SELECT * FROM "posting_blocks" WHERE token_id IN ($1,$2)`,
+	)).WithArgs(1, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"token_id", "data"}).AddRow(1, []byte{1, 2}),
+	)
+
+	data, err := store.Load([]uint{1, 2})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint][]byte{1: {1, 2}}, data); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestSQLPostingStoreUpdate(t *testing.T) {
+	gdb, mock, _ := getDBMock()
+	store, _ := newSQLPostingStore(gdb)
+	for _, c := range []struct {
+		current []byte
+		next    []byte
+	}{
+		// 新しいトークンも先に作った行をロックする
+		{nil, []byte{3}},
+		{[]byte{3}, []byte{3, 4}},
+		{[]byte{3, 4}, nil},
+	} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(
+			`INSERT INTO "posting_blocks" ("token_id","data","updated_at") VALUES ($1,$2,$3) ON CONFLICT DO NOTHING`,
+		)).WithArgs(1, []byte(nil), sqlmock.AnyArg()).WillReturnResult(
+			sqlmock.NewResult(0, 0),
+		)
+		mock.ExpectQuery(regexp.QuoteMeta(
+			`SELECT * FROM "posting_blocks" WHERE token_id = $1 ORDER BY "posting_blocks"."token_id" LIMIT 1 FOR UPDATE`,
+		)).WithArgs(1).WillReturnRows(
+			sqlmock.NewRows([]string{"token_id", "data"}).AddRow(1, c.current),
+		)
+		if c.next == nil {
+			mock.ExpectExec(regexp.QuoteMeta(
+				`DELETE FROM "posting_blocks" WHERE token_id = $1`,
+			)).WithArgs(1).WillReturnResult(
+				sqlmock.NewResult(0, 1),
+			)
+		} else {
+			mock.ExpectExec(regexp.QuoteMeta(
+				`UPDATE "posting_blocks" SET "data"=$1,"updated_at"=$2 WHERE token_id = $3`,
+			)).WithArgs(c.next, sqlmock.AnyArg(), 1).WillReturnResult(
+				sqlmock.NewResult(0, 1),
+			)
+		}
+		mock.ExpectCommit()
+	}
+
+	for _, next := range [][]byte{{3}, {3, 4}, nil} {
+		next := next
+		if err := store.Update(1, func(data []byte) ([]byte, error) {
+			return next, nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFilePostingStore(t *testing.T) {
+	store, _ := newFilePostingStore(t.TempDir())
+	for _, next := range [][]byte{{3}, {3, 4}} {
+		next := next
+		if err := store.Update(1, func(data []byte) ([]byte, error) {
+			return append(data, next[len(next)-1]), nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+	data, err := store.Load([]uint{1, 2})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint][]byte{1: {3, 4}}, data); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 空にすると削除
+	if err := store.Update(1, func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Error(err)
+	}
+	if data, _ := store.Load([]uint{1}); len(data) != 0 {
+		t.Errorf("unexpected data: %v", data)
+	}
+	if _, err := newFilePostingStore(""); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestFilePostingStoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := newFilePostingStore(dir)
+	store.Update(1, func([]byte) ([]byte, error) { return []byte{1}, nil })
+	store.Update(2, func([]byte) ([]byte, error) { return []byte{2}, nil })
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// スナップショットのあとの変更は見えない
+	store.Update(1, func([]byte) ([]byte, error) { return []byte{1, 1}, nil })
+	store.Update(2, func([]byte) ([]byte, error) { return nil, nil })
+	store.Update(3, func([]byte) ([]byte, error) { return []byte{3}, nil })
+	data, err := snapshot.Load([]uint{1, 2, 3})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint][]byte{1: {1}, 2: {2}}, data); diff != "" {
+		t.Errorf(diff)
+	}
+	if data, _ := store.Load([]uint{1, 2, 3}); !cmp.Equal(map[uint][]byte{1: {1, 1}, 3: {3}}, data) {
+		t.Errorf("unexpected data: %v", data)
+	}
+
+	// 閉じると消える。閉じる前に止まったものは開き直すときに消す
+	if err := snapshot.Close(); err != nil {
+		t.Error(err)
+	}
+	store.Snapshot()
+	newFilePostingStore(dir)
+	if snapshots, _ := filepath.Glob(filepath.Join(dir, filePostingSnapshotPattern)); len(snapshots) != 0 {
+		t.Errorf("unexpected snapshots: %v", snapshots)
+	}
+}
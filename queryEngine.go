@@ -0,0 +1,350 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// ドキュメントの単語数をまとめて取得する件数
+const documentLengthBatchSize = 256
+
+// 検索するトークンと、そのポスティングリスト
+type queryTerm struct {
+	tokenID      uint
+	postings     *postingBlockReader
+	maxTermRatio float64
+	// 副フィールドのトークンは単語数に数えないので、出現回数が単語数より多いことがある
+	subfield bool
+}
+
+type scoredDocument struct {
+	documentID uint
+	score      float64
+}
+
+// トークンを含むドキュメントのうち、スコアの高い順にk件を返す。
+// anyでなければすべてのトークンを、anyならいずれかのトークンを含むドキュメントが対象になる。
+// スコアはトークンごとの idf * 出現回数 / 単語数 の和で、idfは log(1 + 全件数 / ドキュメント頻度)。
+//
+// すべてのトークンを含む検索では短いリストから候補を出して他のリストはスキップポインタで読み飛ばす。
+// いずれかのトークンを含む検索はMaxScoreで、上限の低いトークンから足した上限が閾値以下になる分は候補を出さず、
+// 残りのリストから出た候補だけを読み飛ばしながら確かめる。
+// どちらも単語数を取得する前に出現回数から上限を見積もって上位に入らない候補を除き、
+// すべてのトークンの上限の和が閾値以下になったら打ち切る。
+// lengthsは候補のドキュメントの単語数をまとめて返し、結果に含めないドキュメントは返さない
+func topKDocuments(terms []*queryTerm, any bool, allCount uint, k int, lengths func(ids []uint) (map[uint]uint, error)) ([]scoredDocument, error) {
+	if k <= 0 || len(terms) == 0 {
+		return []scoredDocument{}, nil
+	}
+	cursors := []*postingCursor{}
+	upperBound := 0.0
+	for _, term := range terms {
+		if term.postings.Len() == 0 {
+			if any {
+				continue
+			}
+			return []scoredDocument{}, nil
+		}
+		cursor := newPostingCursor(term, allCount)
+		cursors = append(cursors, cursor)
+		upperBound += cursor.maxScore
+	}
+	if len(cursors) == 0 {
+		return []scoredDocument{}, nil
+	}
+	if any {
+		// 上限の低いリストから、候補を出さなくてよいものになる
+		sort.SliceStable(cursors, func(i, j int) bool {
+			return cursors[i].maxScore < cursors[j].maxScore
+		})
+	} else {
+		// 短いポスティングリストから候補を出し、他のリストは読み飛ばす
+		sort.Slice(cursors, func(i, j int) bool {
+			return cursors[i].postings.Len() < cursors[j].postings.Len()
+		})
+	}
+
+	top := &topKHeap{}
+	threshold := func() (float64, bool) {
+		if top.Len() < k {
+			return 0, false
+		}
+		return (*top)[0].score, true
+	}
+
+	type candidate struct {
+		documentID uint
+		tfs        []uint
+	}
+	batch := []candidate{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids := make([]uint, len(batch))
+		for i, c := range batch {
+			ids[i] = c.documentID
+		}
+		documentLengths, err := lengths(ids)
+		if err != nil {
+			return err
+		}
+		for _, c := range batch {
+			length, ok := documentLengths[c.documentID]
+			if !ok {
+				continue
+			}
+			pushTopK(top, k, scoredDocument{
+				documentID: c.documentID,
+				score:      documentScore(cursors, c.tfs, length),
+			})
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	next := nextAll
+	if any {
+		next = nextAny
+	}
+	for {
+		// 以降のドキュメントはIDが大きいので、同点でも上位には入らない
+		limit, ok := threshold()
+		if ok && upperBound <= limit {
+			break
+		}
+		tfs := make([]uint, len(cursors))
+		documentID, found := next(cursors, tfs, limit, ok)
+		if !found {
+			break
+		}
+		if ok && boundScore(cursors, tfs) <= limit {
+			continue
+		}
+		batch = append(batch, candidate{documentID: documentID, tfs: tfs})
+		if len(batch) < documentLengthBatchSize {
+			continue
+		}
+		if err := flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	for _, cursor := range cursors {
+		if err := cursor.postings.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]scoredDocument, top.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(top).(scoredDocument)
+	}
+	return result, nil
+}
+
+// すべてのトークンを含む次のドキュメントと、トークンごとの出現回数。終端に達したらfalse
+func nextAll(cursors []*postingCursor, tfs []uint, _ float64, _ bool) (uint, bool) {
+	documentID, ok := align(cursors)
+	if !ok {
+		return 0, false
+	}
+	for i, cursor := range cursors {
+		tfs[i] = cursor.termFrequency()
+	}
+	cursors[0].next()
+	return documentID, true
+}
+
+// いずれかのトークンを含む次のドキュメントと、トークンごとの出現回数。含まないトークンは0になる。
+// 上限の低い順に並んだカーソルのうち、上限の和が閾値以下になる先頭のものだけに含まれるドキュメントは上位に入らないので、
+// 残りのカーソルから候補を出す。候補がなくなったらfalse
+func nextAny(cursors []*postingCursor, tfs []uint, limit float64, limited bool) (uint, bool) {
+	essential := 0
+	if limited {
+		sum := 0.0
+		for essential < len(cursors) && sum+cursors[essential].maxScore <= limit {
+			sum += cursors[essential].maxScore
+			essential++
+		}
+	}
+	found := false
+	documentID := uint(0)
+	for _, cursor := range cursors[essential:] {
+		if cursor.done() {
+			continue
+		}
+		if !found || cursor.documentID() < documentID {
+			documentID = cursor.documentID()
+			found = true
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	for i, cursor := range cursors {
+		if i < essential {
+			if !cursor.seek(documentID) || cursor.documentID() != documentID {
+				continue
+			}
+			tfs[i] = cursor.termFrequency()
+			continue
+		}
+		if cursor.done() || cursor.documentID() != documentID {
+			continue
+		}
+		tfs[i] = cursor.termFrequency()
+		cursor.next()
+	}
+	return documentID, true
+}
+
+// すべてのカーソルが同じドキュメントを指すまで進める。終端に達したらfalse
+func align(cursors []*postingCursor) (uint, bool) {
+	lead := cursors[0]
+	for {
+		if lead.done() {
+			return 0, false
+		}
+		documentID := lead.documentID()
+		matched := true
+		for _, cursor := range cursors[1:] {
+			if !cursor.seek(documentID) {
+				return 0, false
+			}
+			if cursor.documentID() != documentID {
+				lead.seek(cursor.documentID())
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return documentID, true
+		}
+	}
+}
+
+func documentScore(cursors []*postingCursor, tfs []uint, length uint) float64 {
+	if length == 0 {
+		for _, tf := range tfs {
+			length += tf
+		}
+	}
+	result := 0.0
+	for i, cursor := range cursors {
+		result += cursor.idf * float64(tfs[i]) / float64(length)
+	}
+	return result
+}
+
+// 単語数が分からない段階でのスコアの上限。
+// 本来のトークンは位置ごとに1回しか出ないので、単語数はそれぞれの出現回数以上になる。
+// 副フィールドのトークンは単語数に数えないので、記録された出現回数の比の上限だけで見積もる
+func boundScore(cursors []*postingCursor, tfs []uint) float64 {
+	length := uint(1)
+	for i, cursor := range cursors {
+		if !cursor.subfield && tfs[i] > length {
+			length = tfs[i]
+		}
+	}
+	result := 0.0
+	for i, cursor := range cursors {
+		if tfs[i] == 0 {
+			continue
+		}
+		result += cursor.idf * math.Min(cursor.maxTermRatio, float64(tfs[i])/float64(length))
+	}
+	return result
+}
+
+// ドキュメントID順のポスティングリストを読み進める
+type postingCursor struct {
+	postings     *postingBlockReader
+	idf          float64
+	maxTermRatio float64
+	subfield     bool
+	// このトークンで得られるスコアの上限
+	maxScore float64
+}
+
+func newPostingCursor(term *queryTerm, allCount uint) *postingCursor {
+	idf := math.Log(1 + float64(allCount)/float64(term.postings.Len()))
+	cursor := &postingCursor{
+		postings:     term.postings,
+		idf:          idf,
+		maxTermRatio: term.maxTermRatio,
+		subfield:     term.subfield,
+	}
+	// 記録されていない古いトークンは、本来のトークンなら出現回数が単語数を超えないので1、
+	// 副フィールドのトークンなら上限なしとみなす
+	if cursor.maxTermRatio <= 0 {
+		cursor.maxTermRatio = 1
+		if term.subfield {
+			cursor.maxTermRatio = math.Inf(1)
+		}
+	}
+	cursor.maxScore = math.Inf(1)
+	if !math.IsInf(cursor.maxTermRatio, 1) {
+		cursor.maxScore = idf * cursor.maxTermRatio
+	}
+	return cursor
+}
+
+func (c *postingCursor) done() bool {
+	return c.postings.Done()
+}
+
+func (c *postingCursor) documentID() uint {
+	return c.postings.DocumentID()
+}
+
+// 出現回数を記録していない古いポスティングは1回とみなす
+func (c *postingCursor) termFrequency() uint {
+	if tf := c.postings.TermFrequency(); tf > 0 {
+		return tf
+	}
+	return 1
+}
+
+func (c *postingCursor) next() {
+	c.postings.Next()
+}
+
+// 指定したID以上のドキュメントまで進める。終端に達したらfalse
+func (c *postingCursor) seek(documentID uint) bool {
+	c.postings.Seek(documentID)
+	return !c.done()
+}
+
+// スコアの低いものが先頭に来るヒープ。同点ならIDの大きいものを低く扱う
+type topKHeap []scoredDocument
+
+func (h topKHeap) Len() int { return len(h) }
+func (h topKHeap) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score < h[j].score
+	}
+	return h[i].documentID > h[j].documentID
+}
+func (h topKHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *topKHeap) Push(x interface{}) { *h = append(*h, x.(scoredDocument)) }
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func pushTopK(h *topKHeap, k int, document scoredDocument) {
+	if h.Len() < k {
+		heap.Push(h, document)
+		return
+	}
+	if (topKHeap{document, (*h)[0]}).Less(1, 0) {
+		(*h)[0] = document
+		heap.Fix(h, 0)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testPostings(entries []postingEntry) *postingBlockReader {
+	reader, err := newPostingBlockReader(encodePostingBlocks(entries))
+	if err != nil {
+		panic(err)
+	}
+	return reader
+}
+
+func TestTopKDocuments(t *testing.T) {
+	terms := []*queryTerm{
+		{tokenID: 1, postings: testPostings([]postingEntry{
+			{documentID: 1, termFrequency: 1},
+			{documentID: 2, termFrequency: 3},
+			{documentID: 4, termFrequency: 1},
+			{documentID: 5, termFrequency: 2},
+		})},
+		{tokenID: 2, postings: testPostings([]postingEntry{
+			{documentID: 2, termFrequency: 1},
+			{documentID: 3, termFrequency: 1},
+			{documentID: 5, termFrequency: 1},
+		})},
+	}
+	lengths := map[uint]uint{1: 10, 2: 10, 3: 10, 4: 10, 5: 5}
+	documents, err := topKDocuments(terms, false, 10, 10, func(ids []uint) (map[uint]uint, error) {
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = lengths[id]
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 両方のトークンを含む2と5だけが一致する
+	idf1, idf2 := math.Log(1+10.0/4), math.Log(1+10.0/3)
+	if diff := cmp.Diff(
+		[]scoredDocument{
+			{documentID: 5, score: idf2*1/5 + idf1*2/5},
+			{documentID: 2, score: idf2*1/10 + idf1*3/10},
+		},
+		documents,
+		cmp.AllowUnexported(scoredDocument{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+// すべてのドキュメントに出る語でもスコアは正で、出現割合の高い順になる
+func TestTopKDocumentsRanking(t *testing.T) {
+	terms := []*queryTerm{
+		{tokenID: 1, postings: testPostings([]postingEntry{
+			{documentID: 1, termFrequency: 1},
+			{documentID: 2, termFrequency: 2},
+			{documentID: 3, termFrequency: 3},
+		})},
+	}
+	lengths := map[uint]uint{1: 2, 2: 10, 3: 10}
+	documents, err := topKDocuments(terms, false, 3, 10, func(ids []uint) (map[uint]uint, error) {
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = lengths[id]
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idf := math.Log(2)
+	if diff := cmp.Diff(
+		[]scoredDocument{
+			{documentID: 1, score: idf * 1 / 2},
+			{documentID: 3, score: idf * 3 / 10},
+			{documentID: 2, score: idf * 2 / 10},
+		},
+		documents,
+		cmp.AllowUnexported(scoredDocument{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTopKDocumentsFilter(t *testing.T) {
+	terms := []*queryTerm{
+		{tokenID: 1, postings: testPostings([]postingEntry{{documentID: 1, termFrequency: 1}, {documentID: 2, termFrequency: 1}})},
+	}
+	// 単語数が返らないドキュメントは結果に含めない
+	documents, err := topKDocuments(terms, false, 10, 10, func(ids []uint) (map[uint]uint, error) {
+		return map[uint]uint{2: 4}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(
+		[]scoredDocument{{documentID: 2, score: math.Log(1+10.0/2) / 4}},
+		documents,
+		cmp.AllowUnexported(scoredDocument{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTopKDocumentsPrune(t *testing.T) {
+	// 最初のドキュメントが上限に達しているので、以降は単語数を取得しない
+	entries := []postingEntry{}
+	for i := uint(1); i <= documentLengthBatchSize*3; i++ {
+		entries = append(entries, postingEntry{documentID: i, termFrequency: 1})
+	}
+	terms := []*queryTerm{{tokenID: 1, postings: testPostings(entries), maxTermRatio: 0.5}}
+	calls := 0
+	documents, err := topKDocuments(terms, false, 1000, 1, func(ids []uint) (map[uint]uint, error) {
+		calls++
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = 2
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, calls); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(uint(1), documents[0].documentID); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+// 副フィールドのトークンは単語数より多く出ることがあり、上位に入るドキュメントを除かない
+func TestTopKDocumentsSubfield(t *testing.T) {
+	entries := []postingEntry{}
+	lengths := map[uint]uint{}
+	for i := uint(1); i <= documentLengthBatchSize; i++ {
+		entries = append(entries, postingEntry{documentID: i, termFrequency: 2})
+		lengths[i] = 2
+	}
+	// 「東京タワー」は2語でbi-gramは4つある
+	entries = append(entries, postingEntry{documentID: documentLengthBatchSize + 1, termFrequency: 4})
+	lengths[documentLengthBatchSize+1] = 2
+	terms := []*queryTerm{{tokenID: 1, postings: testPostings(entries), maxTermRatio: 2, subfield: true}}
+	documents, err := topKDocuments(terms, false, 1000, 1, func(ids []uint) (map[uint]uint, error) {
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = lengths[id]
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(
+		[]scoredDocument{{documentID: documentLengthBatchSize + 1, score: math.Log(1+1000.0/float64(len(entries))) * 2}},
+		documents,
+		cmp.AllowUnexported(scoredDocument{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTopKDocumentsAny(t *testing.T) {
+	terms := []*queryTerm{
+		{tokenID: 1, postings: testPostings([]postingEntry{
+			{documentID: 1, termFrequency: 1},
+			{documentID: 2, termFrequency: 2},
+		})},
+		{tokenID: 2, postings: testPostings([]postingEntry{
+			{documentID: 2, termFrequency: 1},
+			{documentID: 3, termFrequency: 1},
+		})},
+	}
+	documents, err := topKDocuments(terms, true, 10, 10, func(ids []uint) (map[uint]uint, error) {
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = 4
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// どれかのトークンを含めば一致し、含むトークンが多いほど高い
+	idf := math.Log(1 + 10.0/2)
+	if diff := cmp.Diff(
+		[]scoredDocument{
+			{documentID: 2, score: idf*2/4 + idf*1/4},
+			{documentID: 1, score: idf * 1 / 4},
+			{documentID: 3, score: idf * 1 / 4},
+		},
+		documents,
+		cmp.AllowUnexported(scoredDocument{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTopKDocumentsAnyPrune(t *testing.T) {
+	// 上限の低いトークンだけを含むドキュメントは、閾値が決まったあとは候補にしない
+	high := []postingEntry{}
+	for i := uint(1); i <= documentLengthBatchSize; i++ {
+		high = append(high, postingEntry{documentID: i, termFrequency: 2})
+	}
+	low := []postingEntry{}
+	for i := uint(1000); i < 1000+documentLengthBatchSize*3; i++ {
+		low = append(low, postingEntry{documentID: i, termFrequency: 1})
+	}
+	terms := []*queryTerm{
+		{tokenID: 1, postings: testPostings(low), maxTermRatio: 0.01},
+		{tokenID: 2, postings: testPostings(high), maxTermRatio: 1},
+	}
+	calls := 0
+	documents, err := topKDocuments(terms, true, 10000, 1, func(ids []uint) (map[uint]uint, error) {
+		calls++
+		result := map[uint]uint{}
+		for _, id := range ids {
+			result[id] = 2
+		}
+		return result, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, calls); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(uint(1), documents[0].documentID); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+// 全件のスコアを計算して並べた結果と一致する
+func TestTopKDocumentsRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 100; n++ {
+		any := n%2 == 1
+		lengths := map[uint]uint{}
+		for id := uint(1); id <= 1000; id++ {
+			lengths[id] = uint(r.Intn(50) + 10)
+		}
+		terms := []*queryTerm{}
+		tfs := []map[uint]uint{}
+		for i := 0; i < r.Intn(4)+1; i++ {
+			// 副フィールドのトークンは単語数より多く出ることがある
+			term := &queryTerm{tokenID: uint(i), subfield: r.Intn(2) == 0}
+			maxTf := 5
+			if term.subfield {
+				maxTf = 80
+			}
+			entries := []postingEntry{}
+			tf := map[uint]uint{}
+			for id := uint(1); id <= 1000; id++ {
+				if r.Intn(3) != 0 {
+					continue
+				}
+				tf[id] = uint(r.Intn(maxTf) + 1)
+				entries = append(entries, postingEntry{documentID: id, termFrequency: tf[id]})
+				if ratio := float64(tf[id]) / float64(lengths[id]); ratio > term.maxTermRatio {
+					term.maxTermRatio = ratio
+				}
+			}
+			// 上限を記録していない古いトークン
+			if r.Intn(4) == 0 {
+				term.maxTermRatio = 0
+			}
+			term.postings = testPostings(entries)
+			terms = append(terms, term)
+			tfs = append(tfs, tf)
+		}
+
+		expected := []scoredDocument{}
+		for id := uint(1); id <= 1000; id++ {
+			score := 0.0
+			matched := 0
+			for i, tf := range tfs {
+				if _, ok := tf[id]; !ok {
+					continue
+				}
+				matched++
+				score += math.Log(1+1000/float64(len(tfs[i]))) * float64(tf[id]) / float64(lengths[id])
+			}
+			if (any && matched > 0) || matched == len(tfs) {
+				expected = append(expected, scoredDocument{documentID: id, score: score})
+			}
+		}
+		sort.SliceStable(expected, func(i, j int) bool {
+			return expected[i].score > expected[j].score
+		})
+		k := r.Intn(20) + 1
+		if len(expected) > k {
+			expected = expected[:k]
+		}
+
+		documents, err := topKDocuments(terms, any, 1000, k, func(ids []uint) (map[uint]uint, error) {
+			result := map[uint]uint{}
+			for _, id := range ids {
+				result[id] = lengths[id]
+			}
+			return result, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, documents, cmp.AllowUnexported(scoredDocument{}), cmp.Comparer(func(a, b float64) bool {
+			return math.Abs(a-b) < 1e-9
+		})); diff != "" {
+			t.Errorf(diff)
+		}
+	}
+}
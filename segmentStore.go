@@ -0,0 +1,847 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+const (
+	// 最初のセグメントを書き出すまでにメモリに溜めるポスティング数
+	defaultSegmentFlushSize = 10000
+	// 同じ大きさの段のセグメントがいくつ並んだらまとめるか
+	defaultSegmentMergeFactor = 4
+	// この大きさまでのセグメントは一番下の段として扱う
+	segmentMergeBaseSize = 1 << 16
+
+	segmentManifest  = "MANIFEST"
+	segmentExtension = ".segment"
+	segmentMagic     = "SSEG"
+	segmentVersion   = 2
+)
+
+var errInvalidSegment = errors.New("invalid segment")
+
+// バックグラウンドでポスティングリストを整理できる保存先
+type mergeablePostingStore interface {
+	Flush() error
+	Merge() (*types.MergeReport, error)
+}
+
+// 追加や削除はメモリのセグメントに溜め、いっぱいになったら変更しないセグメントファイルに書き出す。
+// 新しいセグメントで削除があったドキュメントは、古いセグメントのポスティングを使わない。
+// 登録し直すときは先に古いポスティングを削除するので、ドキュメントの途中で書き出しても古い方だけが消える。
+// 1つのプロセスから使う前提で、書き出していないセグメントはプロセスが終わると失われるので、walのログから戻す
+func newSegmentPostingStore(dir string, flushSize, mergeFactor int) (*segmentPostingStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("posting dir is required")
+	}
+	if flushSize <= 0 {
+		flushSize = defaultSegmentFlushSize
+	}
+	if mergeFactor < 2 {
+		mergeFactor = defaultSegmentMergeFactor
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &segmentPostingStore{
+		dir:         dir,
+		flushSize:   flushSize,
+		mergeFactor: mergeFactor,
+		memory:      newMemorySegment(),
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type segmentPostingStore struct {
+	dir         string
+	flushSize   int
+	mergeFactor int
+
+	lock sync.RWMutex
+	// 書き込み中のセグメント
+	memory *memorySegment
+	// ファイルに書き出している途中のセグメント、書き出せたらsegmentsに移す
+	flushing *segment
+	// 古い順の書き出したセグメント
+	segments []*segment
+	nextID   uint64
+
+	// 書き出しとまとめる処理、マニフェストの更新を直列にする
+	writeLock sync.Mutex
+	// 閉じたあとは変更も書き出しもしない
+	closed bool
+}
+
+// 変更しないセグメント。書き出したものはファイルから、書き出す前のものはメモリから読む
+type segment struct {
+	// ファイル名、書き出す前は空
+	name string
+	file *os.File
+	// トークンごとのポスティングリストのファイルの中の位置
+	index map[uint]segmentExtent
+	// 書き出す前のポスティングリスト
+	postings map[uint][]byte
+	// このセグメントで削除があったドキュメント
+	covered map[uint]struct{}
+	size    int
+	// ストアと読んでいるビューからの参照の数。0になったらファイルを閉じる
+	refs int32
+}
+
+type segmentExtent struct {
+	offset int64
+	length int
+}
+
+// トークンのポスティングリスト、なければfalse
+func (seg *segment) posting(tokenID uint) ([]byte, bool, error) {
+	if seg.file == nil {
+		data, ok := seg.postings[tokenID]
+		return data, ok, nil
+	}
+	extent, ok := seg.index[tokenID]
+	if !ok {
+		return nil, false, nil
+	}
+	data := make([]byte, extent.length)
+	if _, err := seg.file.ReadAt(data, extent.offset); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// トークンID順の、ポスティングリストがあるトークン
+func (seg *segment) tokenIDs() []uint {
+	tokenIDs := make([]uint, 0, len(seg.index)+len(seg.postings))
+	for tokenID := range seg.index {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	for tokenID := range seg.postings {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	sort.Slice(tokenIDs, func(i, j int) bool { return tokenIDs[i] < tokenIDs[j] })
+	return tokenIDs
+}
+
+func (seg *segment) acquire() {
+	atomic.AddInt32(&seg.refs, 1)
+}
+
+func (seg *segment) release() error {
+	if atomic.AddInt32(&seg.refs, -1) == 0 && seg.file != nil {
+		return seg.file.Close()
+	}
+	return nil
+}
+
+type memorySegment struct {
+	postings map[uint][]postingEntry
+	covered  map[uint]struct{}
+	count    int
+}
+
+func newMemorySegment() *memorySegment {
+	return &memorySegment{
+		postings: map[uint][]postingEntry{},
+		covered:  map[uint]struct{}{},
+	}
+}
+
+// マニフェストに書かれたセグメントを読み、書きかけや不要になったファイルを消す
+func (s *segmentPostingStore) open() error {
+	manifest, err := os.ReadFile(filepath.Join(s.dir, segmentManifest))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	live := map[string]struct{}{}
+	for _, name := range strings.Fields(string(manifest)) {
+		seg, err := openSegment(filepath.Join(s.dir, name))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		s.segments = append(s.segments, seg)
+		live[name] = struct{}{}
+		var id uint64
+		if _, err := fmt.Sscanf(name, "%d"+segmentExtension, &id); err == nil && id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, ok := live[file.Name()]; ok || file.Name() == segmentManifest {
+			continue
+		}
+		if strings.HasSuffix(file.Name(), segmentExtension) || strings.HasPrefix(file.Name(), ".tmp-") {
+			if err := os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *segmentPostingStore) Add(tokenID uint, entry postingEntry) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return errPostingStoreClosed
+	}
+	s.memory.postings[tokenID] = upsertPostingEntry(s.memory.postings[tokenID], entry)
+	s.memory.count++
+	full := s.memory.count >= s.flushSize
+	s.lock.Unlock()
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+func (s *segmentPostingStore) Remove(tokenID uint, documentID uint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errPostingStoreClosed
+	}
+	s.memory.covered[documentID] = struct{}{}
+	if entries, ok := s.memory.postings[tokenID]; ok {
+		if entries = removePostingEntry(entries, documentID); len(entries) == 0 {
+			delete(s.memory.postings, tokenID)
+		} else {
+			s.memory.postings[tokenID] = entries
+		}
+	}
+	return nil
+}
+
+func (s *segmentPostingStore) Load(tokenIDs []uint) (map[uint][]byte, error) {
+	view := s.view(tokenIDs)
+	defer view.Close()
+	return view.Load(tokenIDs)
+}
+
+// 今の時点の内容を読めるようにする。あとから追加や削除をしても、まとめてファイルが消えても変わらない
+func (s *segmentPostingStore) Snapshot() (postingSnapshot, error) {
+	return s.view(nil), nil
+}
+
+// セグメントの一覧と、メモリのセグメントの写し。tokenIDsがnilならメモリのすべてのトークンを写す。
+// 読み終わったら閉じる
+func (s *segmentPostingStore) view(tokenIDs []uint) segmentView {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	segments := append([]*segment{}, s.segments...)
+	if s.flushing != nil {
+		segments = append(segments, s.flushing)
+	}
+	for _, seg := range segments {
+		seg.acquire()
+	}
+	memory := &segment{postings: map[uint][]byte{}, covered: map[uint]struct{}{}}
+	if tokenIDs == nil {
+		for tokenID, entries := range s.memory.postings {
+			memory.postings[tokenID] = encodePostingBlocks(entries)
+		}
+	}
+	for _, tokenID := range tokenIDs {
+		if entries, ok := s.memory.postings[tokenID]; ok {
+			memory.postings[tokenID] = encodePostingBlocks(entries)
+		}
+	}
+	for documentID := range s.memory.covered {
+		memory.covered[documentID] = struct{}{}
+	}
+	return append(segments, memory)
+}
+
+// 古い順のセグメント。セグメント自体は変更されない
+type segmentView []*segment
+
+func (v segmentView) Close() error {
+	var result error
+	for _, seg := range v {
+		if err := seg.release(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// 要求されたトークンだけを、それぞれのセグメントから読んでまとめる
+func (v segmentView) Load(tokenIDs []uint) (map[uint][]byte, error) {
+	result := map[uint][]byte{}
+	for _, tokenID := range tokenIDs {
+		data, err := segmentPosting(v, tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			result[tokenID] = data
+		}
+	}
+	return result, nil
+}
+
+// 新しいセグメントで削除があったドキュメントを除いて、古い順のセグメントのポスティングリストをまとめる。
+// 同じドキュメントのポスティングが複数のセグメントにあれば新しい方を使う。
+// 1つのセグメントにしかなく、除くものもなければ展開せずにそのまま返す
+func segmentPosting(segments []*segment, tokenID uint) ([]byte, error) {
+	type source struct {
+		index int
+		data  []byte
+	}
+	sources := []source{}
+	for i, seg := range segments {
+		data, ok, err := seg.posting(tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			sources = append(sources, source{index: i, data: data})
+		}
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	if len(sources) == 1 && !coversDocuments(segments[sources[0].index+1:]) {
+		return sources[0].data, nil
+	}
+
+	result := []postingEntry{}
+	seen := map[uint]struct{}{}
+	changed := len(sources) > 1
+	for i := len(sources) - 1; i >= 0; i-- {
+		entries, err := decodePostingBlocks(sources[i].data)
+		if err != nil {
+			return nil, err
+		}
+	entry:
+		for _, entry := range entries {
+			if _, ok := seen[entry.documentID]; ok {
+				continue
+			}
+			for _, newer := range segments[sources[i].index+1:] {
+				if _, ok := newer.covered[entry.documentID]; ok {
+					changed = true
+					continue entry
+				}
+			}
+			seen[entry.documentID] = struct{}{}
+			result = append(result, entry)
+		}
+	}
+	if !changed {
+		return sources[0].data, nil
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].documentID < result[j].documentID
+	})
+	return encodePostingBlocks(result), nil
+}
+
+func coversDocuments(segments []*segment) bool {
+	for _, seg := range segments {
+		if len(seg.covered) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// メモリのセグメントをファイルに書き出す
+func (s *segmentPostingStore) Flush() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	_, err := s.flushLocked()
+	return err
+}
+
+func (s *segmentPostingStore) flushLocked() (uint, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return 0, errPostingStoreClosed
+	}
+	memory := s.memory
+	if memory.count == 0 && len(memory.covered) == 0 {
+		s.lock.Unlock()
+		return 0, nil
+	}
+	seg := &segment{postings: map[uint][]byte{}, covered: memory.covered, refs: 1}
+	for tokenID, entries := range memory.postings {
+		seg.postings[tokenID] = encodePostingBlocks(entries)
+	}
+	// 書き出している間も検索できるように、書き出し中のセグメントとして見せる
+	s.flushing = seg
+	s.memory = newMemorySegment()
+	s.lock.Unlock()
+
+	written, err := s.writeSegment(seg.tokenIDs(), func(tokenID uint) ([]byte, error) {
+		return seg.postings[tokenID], nil
+	}, seg.covered)
+	if err != nil {
+		// 書き出せなかった内容はメモリに戻し、次の書き出しでやり直す
+		s.lock.Lock()
+		s.memory = memory.apply(s.memory)
+		s.flushing = nil
+		s.lock.Unlock()
+		return 0, err
+	}
+	// 書き出せたセグメントだけを一覧に加え、以降はファイルから読む
+	s.lock.Lock()
+	s.segments = append(s.segments, written)
+	s.flushing = nil
+	s.lock.Unlock()
+	return uint(memory.count), s.writeManifest()
+}
+
+// 書き出せなかったメモリのセグメントに、その後の変更を重ねる
+func (m *memorySegment) apply(newer *memorySegment) *memorySegment {
+	for tokenID, entries := range m.postings {
+		kept := []postingEntry{}
+		for _, entry := range entries {
+			if _, ok := newer.covered[entry.documentID]; !ok {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.postings, tokenID)
+		} else {
+			m.postings[tokenID] = kept
+		}
+	}
+	for tokenID, entries := range newer.postings {
+		for _, entry := range entries {
+			m.postings[tokenID] = upsertPostingEntry(m.postings[tokenID], entry)
+		}
+	}
+	for documentID := range newer.covered {
+		m.covered[documentID] = struct{}{}
+	}
+	m.count += newer.count
+	return m
+}
+
+// トークンID順にポスティングリストを読みながらセグメントファイルに書き、開いたセグメントを返す
+func (s *segmentPostingStore) writeSegment(tokenIDs []uint, posting func(tokenID uint) ([]byte, error), covered map[uint]struct{}) (*segment, error) {
+	s.lock.Lock()
+	name := fmt.Sprintf("%d%s", s.nextID, segmentExtension)
+	s.nextID++
+	s.lock.Unlock()
+	writer, err := newSegmentWriter(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, tokenID := range tokenIDs {
+		data, err := posting(tokenID)
+		if err == nil && len(data) > 0 {
+			err = writer.Posting(tokenID, data)
+		}
+		if err != nil {
+			writer.Abort()
+			return nil, err
+		}
+	}
+	return writer.Close(filepath.Join(s.dir, name), covered)
+}
+
+// 書き出したセグメントをマニフェストに記録する。マニフェストにないファイルは次に開くときに消す
+func (s *segmentPostingStore) writeManifest() error {
+	s.lock.RLock()
+	names := []string{}
+	for _, seg := range s.segments {
+		if seg.name != "" {
+			names = append(names, seg.name)
+		}
+	}
+	s.lock.RUnlock()
+	return writeFileAtomic(filepath.Join(s.dir, segmentManifest), []byte(strings.Join(names, "\n")+"\n"))
+}
+
+// メモリのセグメントを書き出し、同じ大きさの段のセグメントが並んでいればまとめる
+func (s *segmentPostingStore) Merge() (*types.MergeReport, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	report := &types.MergeReport{}
+	flushed, err := s.flushLocked()
+	if err != nil {
+		return nil, err
+	}
+	report.FlushedPostings = flushed
+
+	for {
+		s.lock.RLock()
+		start, end := pickSegmentMerge(s.segments, s.mergeFactor)
+		run := append([]*segment{}, s.segments[start:end]...)
+		s.lock.RUnlock()
+		if len(run) == 0 {
+			break
+		}
+
+		// 一番古いセグメントまでまとめるなら、削除の記録は要らない
+		merged, err := s.mergeSegments(run, start == 0)
+		if err != nil {
+			return nil, err
+		}
+		// まとめている間に増えるのは新しいセグメントだけなので、位置は変わらない
+		s.lock.Lock()
+		s.segments = append(append(append([]*segment{}, s.segments[:start]...), merged), s.segments[end:]...)
+		s.lock.Unlock()
+		if err := s.writeManifest(); err != nil {
+			return nil, err
+		}
+		// 読んでいるビューがあれば、閉じるまでファイルは開いたまま読める
+		for _, seg := range run {
+			if err := seg.release(); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(filepath.Join(s.dir, seg.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, err
+			}
+		}
+		report.MergedSegments += uint(len(run))
+	}
+
+	s.lock.RLock()
+	report.Segments = uint(len(s.segments))
+	s.lock.RUnlock()
+	return report, nil
+}
+
+// 実行中の書き出しとまとめる処理を待って閉じる。書き出していない変更は捨てる
+func (s *segmentPostingStore) Close() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.memory = newMemorySegment()
+	var result error
+	for _, seg := range s.segments {
+		if err := seg.release(); err != nil && result == nil {
+			result = err
+		}
+	}
+	s.segments = nil
+	return result
+}
+
+// 書き出し済みで同じ段のセグメントがmergeFactor個並んでいる範囲、なければ空
+func pickSegmentMerge(segments []*segment, mergeFactor int) (int, int) {
+	level := func(seg *segment) int {
+		if seg.size <= segmentMergeBaseSize {
+			return 0
+		}
+		return int(math.Log(float64(seg.size)/segmentMergeBaseSize)/math.Log(float64(mergeFactor))) + 1
+	}
+	start := 0
+	for i, seg := range segments {
+		if seg.name == "" {
+			break
+		}
+		if level(seg) != level(segments[start]) {
+			start = i
+		}
+		if i-start+1 == mergeFactor {
+			return start, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// 古い順のセグメントを、トークンごとに読みながら1つのファイルにまとめる。purgeなら削除の記録を捨てる
+func (s *segmentPostingStore) mergeSegments(segments []*segment, purge bool) (*segment, error) {
+	tokens := map[uint]struct{}{}
+	covered := map[uint]struct{}{}
+	for _, seg := range segments {
+		for _, tokenID := range seg.tokenIDs() {
+			tokens[tokenID] = struct{}{}
+		}
+		if !purge {
+			for documentID := range seg.covered {
+				covered[documentID] = struct{}{}
+			}
+		}
+	}
+	tokenIDs := make([]uint, 0, len(tokens))
+	for tokenID := range tokens {
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	sort.Slice(tokenIDs, func(i, j int) bool { return tokenIDs[i] < tokenIDs[j] })
+	return s.writeSegment(tokenIDs, func(tokenID uint) ([]byte, error) {
+		return segmentPosting(segments, tokenID)
+	}, covered)
+}
+
+// セグメントファイルの形式
+//
+//	"SSEG", バージョン
+//	トークンID順のポスティングリスト
+//	索引: トークン数, トークンごとに トークンIDの差分, ポスティングリストのバイト数
+//	      登録か削除があったドキュメント数, ドキュメントIDの差分...
+//	索引の位置 (8バイト), ここまでのCRC32 (4バイト)
+//
+// 開くときは索引だけを読み、ポスティングリストは検索するトークンの分だけファイルから読む
+const segmentFooterSize = 12
+
+// 一時ファイルに先頭から書き、閉じるときに名前を変える
+type segmentWriter struct {
+	file     *os.File
+	buffer   *bufio.Writer
+	checksum hash.Hash32
+	offset   int64
+	tokenIDs []uint
+	index    map[uint]segmentExtent
+}
+
+func newSegmentWriter(dir string) (*segmentWriter, error) {
+	file, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	w := &segmentWriter{
+		file:     file,
+		buffer:   bufio.NewWriter(file),
+		checksum: crc32.NewIEEE(),
+		index:    map[uint]segmentExtent{},
+	}
+	header := appendUvarint([]byte(segmentMagic), segmentVersion)
+	if err := w.write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *segmentWriter) write(data []byte) error {
+	if _, err := w.buffer.Write(data); err != nil {
+		return err
+	}
+	w.checksum.Write(data)
+	w.offset += int64(len(data))
+	return nil
+}
+
+// トークンID順に渡す
+func (w *segmentWriter) Posting(tokenID uint, data []byte) error {
+	if len(w.tokenIDs) > 0 && tokenID <= w.tokenIDs[len(w.tokenIDs)-1] {
+		return fmt.Errorf("%w: token %d is out of order", errInvalidSegment, tokenID)
+	}
+	w.index[tokenID] = segmentExtent{offset: w.offset, length: len(data)}
+	w.tokenIDs = append(w.tokenIDs, tokenID)
+	return w.write(data)
+}
+
+// 索引を書いてディスクに書けてから名前を変え、読めるように開いたまま返す
+func (w *segmentWriter) Close(path string, covered map[uint]struct{}) (*segment, error) {
+	indexOffset := w.offset
+	index := appendUvarint(nil, uint64(len(w.tokenIDs)))
+	previous := uint(0)
+	for _, tokenID := range w.tokenIDs {
+		index = appendUvarint(index, uint64(tokenID-previous))
+		index = appendUvarint(index, uint64(w.index[tokenID].length))
+		previous = tokenID
+	}
+	documentIDs := make([]uint, 0, len(covered))
+	for documentID := range covered {
+		documentIDs = append(documentIDs, documentID)
+	}
+	sort.Slice(documentIDs, func(i, j int) bool { return documentIDs[i] < documentIDs[j] })
+	index = appendUvarint(index, uint64(len(documentIDs)))
+	previous = 0
+	for _, documentID := range documentIDs {
+		index = appendUvarint(index, uint64(documentID-previous))
+		previous = documentID
+	}
+	var footer [segmentFooterSize]byte
+	binary.BigEndian.PutUint64(footer[:8], uint64(indexOffset))
+	err := w.write(index)
+	if err == nil {
+		err = w.write(footer[:8])
+	}
+	if err == nil {
+		binary.BigEndian.PutUint32(footer[8:], w.checksum.Sum32())
+		_, err = w.buffer.Write(footer[8:])
+	}
+	if err == nil {
+		err = w.buffer.Flush()
+	}
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), path)
+	}
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	coveredSet := make(map[uint]struct{}, len(documentIDs))
+	for _, documentID := range documentIDs {
+		coveredSet[documentID] = struct{}{}
+	}
+	return &segment{
+		name:    filepath.Base(path),
+		file:    w.file,
+		index:   w.index,
+		covered: coveredSet,
+		size:    int(w.offset) + 4,
+		refs:    1,
+	}, nil
+}
+
+// 書きかけのファイルを消す
+func (w *segmentWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// チェックサムを確かめて、索引だけを読む
+func openSegment(path string) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := readSegmentIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg.name = filepath.Base(path)
+	seg.file = file
+	seg.refs = 1
+	return seg, nil
+}
+
+func readSegmentIndex(file *os.File) (*segment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	headerSize := int64(len(segmentMagic)) + 1
+	if size < headerSize+segmentFooterSize {
+		return nil, errInvalidSegment
+	}
+	checksum := crc32.NewIEEE()
+	if _, err := io.Copy(checksum, io.NewSectionReader(file, 0, size-4)); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := file.ReadAt(footer, size-segmentFooterSize); err != nil {
+		return nil, err
+	}
+	if checksum.Sum32() != binary.BigEndian.Uint32(footer[8:]) {
+		return nil, errInvalidSegment
+	}
+	header := make([]byte, headerSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(segmentMagic)) {
+		return nil, errInvalidSegment
+	}
+	if version, n := binary.Uvarint(header[len(segmentMagic):]); n <= 0 || version != segmentVersion {
+		return nil, errInvalidSegment
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[:8]))
+	if indexOffset < headerSize || indexOffset > size-segmentFooterSize {
+		return nil, errInvalidSegment
+	}
+	index := make([]byte, size-segmentFooterSize-indexOffset)
+	if _, err := file.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	seg, err := decodeSegmentIndex(index, headerSize, indexOffset)
+	if err != nil {
+		return nil, err
+	}
+	seg.size = int(size)
+	return seg, nil
+}
+
+// ポスティングリストはstartからendまでに並んでいる
+func decodeSegmentIndex(data []byte, start, end int64) (*segment, error) {
+	offset := 0
+	read := func() (uint64, error) {
+		v, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return 0, errInvalidSegment
+		}
+		offset += n
+		return v, nil
+	}
+	tokenCount, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if tokenCount > uint64(len(data)) {
+		return nil, errInvalidSegment
+	}
+	seg := &segment{index: map[uint]segmentExtent{}, covered: map[uint]struct{}{}}
+	position := start
+	previous := uint(0)
+	for i := uint64(0); i < tokenCount; i++ {
+		delta, err := read()
+		if err != nil {
+			return nil, err
+		}
+		length, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if length > uint64(end-position) {
+			return nil, errInvalidSegment
+		}
+		previous += uint(delta)
+		seg.index[previous] = segmentExtent{offset: position, length: int(length)}
+		position += int64(length)
+	}
+	if position != end {
+		return nil, errInvalidSegment
+	}
+	documentCount, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if documentCount > uint64(len(data)) {
+		return nil, errInvalidSegment
+	}
+	previous = 0
+	for i := uint64(0); i < documentCount; i++ {
+		delta, err := read()
+		if err != nil {
+			return nil, err
+		}
+		previous += uint(delta)
+		seg.covered[previous] = struct{}{}
+	}
+	if offset != len(data) {
+		return nil, errInvalidSegment
+	}
+	return seg, nil
+}
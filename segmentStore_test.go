@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
+)
+
+func loadSegmentEntries(t *testing.T, store *segmentPostingStore, tokenID uint) []postingEntry {
+	t.Helper()
+	data, err := store.Load([]uint{tokenID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := decodePostingBlocks(data[tokenID])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestSegmentPostingStore(t *testing.T) {
+	store, _ := newSegmentPostingStore(t.TempDir(), 2, 2)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{3}})
+	// 2件でセグメントに書き出される
+	if diff := cmp.Diff(1, len(store.segments)); diff != "" {
+		t.Errorf(diff)
+	}
+	// 書き出したセグメントのドキュメントを登録し直すと、古いポスティングは使わない
+	store.Remove(1, 2)
+	store.Add(2, postingEntry{documentID: 2, termFrequency: 2, positions: []uint{0, 1}})
+	store.Add(1, postingEntry{documentID: 3, termFrequency: 1, positions: []uint{5}})
+
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 1, termFrequency: 1, positions: []uint{0}}, {documentID: 3, termFrequency: 1, positions: []uint{5}}},
+		loadSegmentEntries(t, store, 1),
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 2, termFrequency: 2, positions: []uint{0, 1}}},
+		loadSegmentEntries(t, store, 2),
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	data, err := store.Load([]uint{3})
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(map[uint][]byte{}, data); diff != "" {
+		t.Errorf(diff)
+	}
+	if _, err := newSegmentPostingStore("", 0, 0); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestSegmentPostingStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := newSegmentPostingStore(dir, 100, 4)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{1}})
+	if _, err := store.Merge(); err != nil {
+		t.Error(err)
+	}
+	store.Remove(1, 1)
+	if _, err := store.Merge(); err != nil {
+		t.Error(err)
+	}
+	// マニフェストにない書きかけのセグメントは消す
+	orphan := filepath.Join(dir, "100"+segmentExtension)
+	os.WriteFile(orphan, []byte("broken"), 0644)
+
+	reopened, err := newSegmentPostingStore(dir, 100, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 2, termFrequency: 1, positions: []uint{1}}},
+		loadSegmentEntries(t, reopened, 1),
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan segment should be removed: %v", err)
+	}
+	// 新しいセグメントの名前は既存のものと重ならない
+	if diff := cmp.Diff(uint64(2), reopened.nextID); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestSegmentPostingStoreMerge(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := newSegmentPostingStore(dir, 1, 2)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1})
+	store.Remove(1, 1)
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 3})
+	// まとめる前に取った写しは、まとめて古いファイルが消えても読める
+	snapshot, _ := store.Snapshot()
+
+	report, err := store.Merge()
+	if err != nil {
+		t.Error(err)
+	}
+	// 3つのセグメントを2つずつまとめて1つになる
+	if diff := cmp.Diff(&types.MergeReport{MergedSegments: 4, Segments: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		[]postingEntry{{documentID: 2, termFrequency: 3, positions: []uint{}}},
+		loadSegmentEntries(t, store, 1),
+		cmp.AllowUnexported(postingEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// 一番古いセグメントまでまとめたので、削除の記録は残らない
+	if diff := cmp.Diff(0, len(store.segments[0].covered)); diff != "" {
+		t.Errorf(diff)
+	}
+	files, _ := os.ReadDir(dir)
+	if diff := cmp.Diff(2, len(files)); diff != "" {
+		t.Errorf(diff)
+	}
+	data, err := snapshot.Load([]uint{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(encodePostingBlocks([]postingEntry{{documentID: 2, termFrequency: 3, positions: []uint{}}}), data[1]); diff != "" {
+		t.Errorf(diff)
+	}
+	if err := snapshot.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenSegmentInvalid(t *testing.T) {
+	dir := t.TempDir()
+	posting := encodePostingBlocks([]postingEntry{{documentID: 1, termFrequency: 1}})
+	writer, err := newSegmentWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Posting(3, posting)
+	path := filepath.Join(dir, "0"+segmentExtension)
+	written, err := writer.Close(path, map[uint]struct{}{1: {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	written.release()
+
+	seg, err := openSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seg.release()
+	if diff := cmp.Diff(map[uint]struct{}{1: {}}, seg.covered); diff != "" {
+		t.Errorf(diff)
+	}
+	// ポスティングリストは索引の位置からファイルを読む
+	data, ok, err := seg.posting(3)
+	if err != nil || !ok {
+		t.Fatal(ok, err)
+	}
+	if diff := cmp.Diff(posting, data); diff != "" {
+		t.Errorf(diff)
+	}
+	if _, ok, _ := seg.posting(1); ok {
+		t.Errorf("unexpected posting")
+	}
+
+	content, _ := os.ReadFile(path)
+	corrupted := append([]byte{}, content...)
+	corrupted[len(segmentMagic)+1] ^= 0xff
+	for i, data := range [][]byte{
+		nil,
+		[]byte("SSEG"),
+		content[:len(content)-1],
+		corrupted,
+	} {
+		broken := filepath.Join(dir, fmt.Sprintf("broken%d%s", i, segmentExtension))
+		os.WriteFile(broken, data, 0644)
+		if _, err := openSegment(broken); err == nil {
+			t.Errorf("expected error: %v", data)
+		}
+	}
+}
+
+func TestSegmentPostingStoreFlushMidDocument(t *testing.T) {
+	store, _ := newSegmentPostingStore(t.TempDir(), 2, 4)
+	// ドキュメントの途中で書き出しても、先に書き出したトークンのポスティングは消えない
+	for tokenID := uint(1); tokenID <= 3; tokenID++ {
+		store.Add(tokenID, postingEntry{documentID: 5, termFrequency: 1, positions: []uint{tokenID}})
+	}
+	for tokenID := uint(1); tokenID <= 3; tokenID++ {
+		if diff := cmp.Diff(
+			[]postingEntry{{documentID: 5, termFrequency: 1, positions: []uint{tokenID}}},
+			loadSegmentEntries(t, store, tokenID),
+			cmp.AllowUnexported(postingEntry{}),
+		); diff != "" {
+			t.Errorf("token %d: %s", tokenID, diff)
+		}
+	}
+
+	// 登録し直すと、古い方は削除で消え、新しい方は途中で書き出しても残る
+	for tokenID := uint(1); tokenID <= 3; tokenID++ {
+		store.Remove(tokenID, 5)
+	}
+	for tokenID := uint(2); tokenID <= 4; tokenID++ {
+		store.Add(tokenID, postingEntry{documentID: 5, termFrequency: 2, positions: []uint{0, tokenID}})
+	}
+	if _, err := store.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	for tokenID := uint(1); tokenID <= 4; tokenID++ {
+		expected := []postingEntry{{documentID: 5, termFrequency: 2, positions: []uint{0, tokenID}}}
+		if tokenID == 1 {
+			expected = []postingEntry{}
+		}
+		if diff := cmp.Diff(expected, loadSegmentEntries(t, store, tokenID), cmp.AllowUnexported(postingEntry{})); diff != "" {
+			t.Errorf("token %d: %s", tokenID, diff)
+		}
+	}
+}
+
+func TestSegmentPostingStoreFlushError(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := newSegmentPostingStore(dir, 100, 2)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}})
+	store.Add(1, postingEntry{documentID: 2, termFrequency: 1, positions: []uint{0}})
+	// 書き出せなければセグメントの一覧に加えず、メモリに戻す
+	os.RemoveAll(dir)
+	if err := store.Flush(); err == nil {
+		t.Fatal("expected error")
+	}
+	if diff := cmp.Diff(0, len(store.segments)); diff != "" {
+		t.Errorf(diff)
+	}
+	store.Remove(1, 1)
+	store.Add(1, postingEntry{documentID: 3, termFrequency: 1, positions: []uint{0}})
+	if diff := cmp.Diff([]uint{2, 3}, segmentDocumentIDs(t, store, 1)); diff != "" {
+		t.Errorf(diff)
+	}
+
+	// 書き出せるようになれば、戻した内容も書き出す
+	os.MkdirAll(dir, 0755)
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(1, len(store.segments)); diff != "" {
+		t.Errorf(diff)
+	}
+	reopened, err := newSegmentPostingStore(dir, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint{2, 3}, segmentDocumentIDs(t, reopened, 1)); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func segmentDocumentIDs(t *testing.T, store *segmentPostingStore, tokenID uint) []uint {
+	t.Helper()
+	ids := []uint{}
+	for _, entry := range loadSegmentEntries(t, store, tokenID) {
+		ids = append(ids, entry.documentID)
+	}
+	return ids
+}
+
+func TestSegmentPostingStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := newSegmentPostingStore(dir, 100, 2)
+	store.Add(1, postingEntry{documentID: 1, termFrequency: 1, positions: []uint{0}})
+	if err := store.Close(); err != nil {
+		t.Error(err)
+	}
+	// 閉じたあとは変更も書き出しもしない
+	if err := store.Add(1, postingEntry{documentID: 2, termFrequency: 1}); !errors.Is(err, errPostingStoreClosed) {
+		t.Errorf("expected posting store closed: %v", err)
+	}
+	if err := store.Remove(1, 1); !errors.Is(err, errPostingStoreClosed) {
+		t.Errorf("expected posting store closed: %v", err)
+	}
+	if _, err := store.Merge(); !errors.Is(err, errPostingStoreClosed) {
+		t.Errorf("expected posting store closed: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension)); len(files) != 0 {
+		t.Errorf("unexpected segments: %v", files)
+	}
+}
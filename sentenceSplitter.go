@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"regexp"
 	"strings"
+	"unicode"
 
 	"github.com/ikawaha/kagome/v2/filter"
 )
@@ -30,3 +33,251 @@ func (sp *sentenceSplitterImpl) Split(body string) ([]string, error) {
 	}
 	return result, nil
 }
+
+// 文の分割方法
+const (
+	// kagomeの日本語の句点による分割
+	sentenceSplitterKagome = "kagome"
+	// 英語などの句読点とMarkdownを考慮した分割
+	sentenceSplitterRule = "rule"
+)
+
+const defaultMaxSentenceLength = 300
+
+// 言語ごとの設定から文の分割を作る
+func newLanguageSentenceSplitter(lang string, config analyzerConfig) (SentenceSplitter, error) {
+	name := config.SentenceSplitter
+	if name == "" {
+		name = sentenceSplitterRule
+		if lang == "ja" {
+			name = sentenceSplitterKagome
+		}
+	}
+	var splitter SentenceSplitter
+	var err error
+	switch name {
+	case sentenceSplitterKagome:
+		splitter, err = newSentenceSplitter()
+	case sentenceSplitterRule:
+		splitter, err = newRuleSentenceSplitter()
+	default:
+		return nil, fmt.Errorf("unknown sentence splitter: %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	maxLength := config.MaxSentenceLength
+	if maxLength == 0 {
+		maxLength = defaultMaxSentenceLength
+	}
+	return newMaxLengthSentenceSplitter(splitter, maxLength)
+}
+
+// ピリオドの後で文を区切らない略語。小文字、末尾のピリオドなし
+var sentenceAbbreviations = []string{
+	"e.g", "i.e", "etc", "vs", "cf", "approx", "al",
+	"mr", "mrs", "ms", "dr", "prof", "st", "jr", "sr",
+	"inc", "ltd", "co", "corp", "no", "fig", "vol", "p", "pp",
+	"jan", "feb", "mar", "apr", "jun", "jul", "aug", "sep", "sept", "oct", "nov", "dec",
+}
+
+// 英語などの句読点と日本語の句点で区切る。
+// Markdownの見出しやリストの項目、コードブロックの行はそれぞれ1文にする
+func newRuleSentenceSplitter() (*ruleSentenceSplitter, error) {
+	sp := &ruleSentenceSplitter{
+		abbreviations: map[string]struct{}{},
+	}
+	for _, abbreviation := range sentenceAbbreviations {
+		sp.abbreviations[abbreviation] = struct{}{}
+	}
+	return sp, nil
+}
+
+type ruleSentenceSplitter struct {
+	abbreviations map[string]struct{}
+}
+
+var (
+	markdownFence    = regexp.MustCompile("^\\s*(```|~~~)")
+	markdownHeading  = regexp.MustCompile(`^\s*#{1,6}\s+`)
+	markdownListItem = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	markdownQuote    = regexp.MustCompile(`^\s*>\s?`)
+)
+
+func (sp *ruleSentenceSplitter) Split(body string) ([]string, error) {
+	result := []string{}
+	paragraph := []string{}
+	flush := func() {
+		result = append(result, sp.splitParagraph(joinLines(paragraph))...)
+		paragraph = []string{}
+	}
+
+	code, quote := false, false
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		// コードブロックは句読点で区切らず1行1文
+		if markdownFence.MatchString(line) {
+			flush()
+			code = !code
+			continue
+		}
+		if code {
+			if line := strings.TrimSpace(line); line != "" {
+				result = append(result, line)
+			}
+			continue
+		}
+
+		// 引用は前の段落とつなげない
+		if markdownQuote.MatchString(line) != quote {
+			flush()
+			quote = !quote
+		}
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+		case markdownHeading.MatchString(line):
+			flush()
+			paragraph = append(paragraph, markdownHeading.ReplaceAllString(line, ""))
+			flush()
+		case markdownListItem.MatchString(line):
+			// リストの項目は改行で区切る
+			flush()
+			paragraph = append(paragraph, markdownListItem.ReplaceAllString(line, ""))
+		default:
+			paragraph = append(paragraph, markdownQuote.ReplaceAllString(line, ""))
+		}
+	}
+	flush()
+	return result, nil
+}
+
+// 段落の中の改行は、英語などでは空白に、日本語では詰める
+func joinLines(lines []string) string {
+	text := ""
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if text != "" && !isCJK(lastRune(text)) && !isCJK([]rune(line)[0]) {
+			text += " "
+		}
+		text += line
+	}
+	return text
+}
+
+func lastRune(str string) rune {
+	runes := []rune(str)
+	return runes[len(runes)-1]
+}
+
+func (sp *ruleSentenceSplitter) splitParagraph(text string) []string {
+	result := []string{}
+	runes := []rune(text)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		end := -1
+		switch runes[i] {
+		case '。', '！', '？', '!', '?':
+			end = i + 1
+		case '.':
+			if sp.isSentenceEnd(runes, i) {
+				end = i + 1
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		// 続く句読点や閉じ括弧、引用符も同じ文に含める
+		for end < len(runes) && strings.ContainsRune(".!?！？。」』）)\"'”’", runes[end]) {
+			end++
+		}
+		// 英語の句読点は空白が続くときだけ区切る
+		if runes[i] != '。' && runes[i] != '！' && runes[i] != '？' && end < len(runes) && !unicode.IsSpace(runes[end]) {
+			continue
+		}
+		if sentence := strings.TrimSpace(string(runes[start:end])); sentence != "" {
+			result = append(result, sentence)
+		}
+		start = end
+		i = end - 1
+	}
+	if sentence := strings.TrimSpace(string(runes[start:])); sentence != "" {
+		result = append(result, sentence)
+	}
+	return result
+}
+
+// 小数点、略語、イニシャル、小文字で続く文の途中のピリオドでは区切らない
+func (sp *ruleSentenceSplitter) isSentenceEnd(runes []rune, i int) bool {
+	if i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && !strings.ContainsRune("\"'”’)", runes[i+1]) {
+		return false
+	}
+	// ピリオドの前の語
+	j := i
+	for j > 0 && !unicode.IsSpace(runes[j-1]) && !strings.ContainsRune("(\"'“‘", runes[j-1]) {
+		j--
+	}
+	word := strings.ToLower(string(runes[j:i]))
+	if _, ok := sp.abbreviations[word]; ok {
+		return false
+	}
+	if w := []rune(word); len(w) == 1 && unicode.IsLetter(w[0]) {
+		return false
+	}
+	// 次の語が小文字で始まれば文は続いている
+	k := i + 1
+	for k < len(runes) && unicode.IsSpace(runes[k]) {
+		k++
+	}
+	if k < len(runes) && unicode.IsLower(runes[k]) {
+		return false
+	}
+	return true
+}
+
+// 長すぎる文を、空白や読点の位置でmaxLength文字以下に分ける
+func newMaxLengthSentenceSplitter(splitter SentenceSplitter, maxLength int) (*maxLengthSentenceSplitter, error) {
+	if maxLength < 1 {
+		return nil, fmt.Errorf("invalid max sentence length: %d", maxLength)
+	}
+	return &maxLengthSentenceSplitter{
+		splitter:  splitter,
+		maxLength: maxLength,
+	}, nil
+}
+
+type maxLengthSentenceSplitter struct {
+	splitter  SentenceSplitter
+	maxLength int
+}
+
+func (sp *maxLengthSentenceSplitter) Split(body string) ([]string, error) {
+	sentences, err := sp.splitter.Split(body)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, sentence := range sentences {
+		runes := []rune(sentence)
+		for len(runes) > sp.maxLength {
+			// 後半の区切りやすい位置で切る、なければ文字数で切る
+			cut := sp.maxLength
+			for i := sp.maxLength; i > sp.maxLength/2; i-- {
+				if unicode.IsSpace(runes[i]) || strings.ContainsRune("、,;；", runes[i-1]) {
+					cut = i
+					break
+				}
+			}
+			if part := strings.TrimSpace(string(runes[:cut])); part != "" {
+				result = append(result, part)
+			}
+			runes = []rune(strings.TrimSpace(string(runes[cut:])))
+		}
+		if len(runes) > 0 {
+			result = append(result, string(runes))
+		}
+	}
+	return result, nil
+}
@@ -29,3 +29,93 @@ func TestSentenceSplitter(t *testing.T) {
 		t.Errorf(diff)
 	}
 }
+
+func TestRuleSentenceSplitter(t *testing.T) {
+	splitter, _ := newRuleSentenceSplitter()
+	actual, _ := splitter.Split("# Getting started\n" +
+		"\n" +
+		"Install the tool, e.g. with Homebrew. Dr. Smith wrote version 1.5 of it!\n" +
+		"It works on macOS and\n" +
+		"Linux. 日本語も使え\n" +
+		"る。改行のない文\n" +
+		"\n" +
+		"- first item\n" +
+		"- second item. Has two sentences.\n" +
+		"1. numbered\n" +
+		"> He said \"stop.\" Then left.\n" +
+		"\n" +
+		"```go\n" +
+		"fmt.Println(\"a. b\")\n" +
+		"\n" +
+		"```\n")
+
+	if diff := cmp.Diff(
+		[]string{
+			"Getting started",
+			"Install the tool, e.g. with Homebrew.",
+			"Dr. Smith wrote version 1.5 of it!",
+			"It works on macOS and Linux.",
+			"日本語も使える。",
+			"改行のない文",
+			"first item",
+			"second item.",
+			"Has two sentences.",
+			"numbered",
+			"He said \"stop.\"",
+			"Then left.",
+			"fmt.Println(\"a. b\")",
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestMaxLengthSentenceSplitter(t *testing.T) {
+	splitter, _ := newRuleSentenceSplitter()
+	maxLengthSplitter, _ := newMaxLengthSentenceSplitter(splitter, 10)
+	actual, _ := maxLengthSplitter.Split("one two three four five. 長い長い長い長い、長い文です。")
+
+	if diff := cmp.Diff(
+		[]string{
+			"one two",
+			"three four",
+			"five.",
+			"長い長い長い長い、",
+			"長い文です。",
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newMaxLengthSentenceSplitter(splitter, 0); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestLanguageSentenceSplitter(t *testing.T) {
+	for _, c := range []struct {
+		lang     string
+		config   analyzerConfig
+		expected []string
+	}{
+		// 日本語はkagome、それ以外は規則で分割する
+		{"ja", analyzerConfig{}, []string{"Dr.Smith.すもも。"}},
+		{"en", analyzerConfig{}, []string{"Dr. Smith.", "すもも。"}},
+		{"ja", analyzerConfig{SentenceSplitter: "rule", MaxSentenceLength: 5}, []string{"Dr.", "Smith", ".", "すもも。"}},
+	} {
+		splitter, err := newLanguageSentenceSplitter(c.lang, c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, _ := splitter.Split("Dr. Smith. すもも。")
+		if diff := cmp.Diff(c.expected, actual); diff != "" {
+			t.Errorf("%s: %s", c.lang, diff)
+		}
+	}
+
+	if _, err := newLanguageSentenceSplitter("en", analyzerConfig{SentenceSplitter: "regexp"}); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,72 +19,357 @@ import (
 )
 
 type Service interface {
-	Regist(uri string, body string) error
-	Search(str string, offset, count uint) ([]types.SearchResult, error)
+	Regist(uri string, body string, meta types.DocumentMeta) error
+	RegistHTML(uri string, body string, meta types.DocumentMeta) error
+	Document(uri string) (*types.Document, error)
+	// ドキュメントを削除、存在しなければfalse
+	Delete(uri string) (bool, error)
+	// 変更がなかったドキュメントのインデックスした時刻を今にする、存在しなければfalse
+	Touch(uri string) (bool, error)
+	// 指定時刻より前にインデックスされたドキュメントを古い順に取得
+	DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error)
+	// 件数と出現ドキュメント数の多いトークン
+	Stats(top uint) (*types.Stats, error)
+	// 今のアナライザと違う設定でインデックスされたドキュメント数
+	StaleDocuments() (uint, error)
+	// 保存済みの文章から全ドキュメントのインデックスを作り直す
+	Reindex() (uint, error)
+	// インデックスの整合性を検査
+	Fsck() (*types.FsckReport, error)
+	// 論理削除済みの行と参照されなくなったトークンを物理削除
+	Compact() (*types.CompactReport, error)
+	// ポスティングリストのセグメントを書き出してまとめる
+	Merge() (*types.MergeReport, error)
+	// 起動時にログを再実行して、途中で止まった登録と削除を終わらせるか戻す
+	Recover() (*types.RecoveryReport, error)
+	// 保存先に書き出し済みの操作をログから消す
+	Checkpoint() error
+	// 同じ時点のインデックスをスナップショットに書く。書いている間も登録や削除は続けられる
+	Snapshot(w io.Writer) (*types.SnapshotReport, error)
+	// チェックサムを確かめてから、スナップショットを空のインデックスに取り込む
+	Restore(r io.Reader) (*types.SnapshotReport, error)
+	// 全ドキュメントをフィールドと本文の1行1件のJSONで書き、書いた件数を返す
+	Export(w io.Writer) (uint, error)
+	// エクスポートしたドキュメントを今の設定で解析して登録する。読めない行や言語は飛ばして結果に残す
+	Import(r io.Reader) (*types.ImportReport, error)
+	// langが空ならすべての言語で解析して検索する。prefixなら最後の語を前方一致で検索する
+	Search(str string, lang string, prefix bool, offset, count uint) ([]types.SearchResult, error)
+	// Searchと同じ順番の上位count件のスコアだけを返す。一致した文章は読まない
+	SearchScores(str string, lang string, prefix bool, count uint) ([]float64, error)
+	// 受け付けた登録と削除を終えて、保存先に書き出す。そのあとの登録と削除はerrServiceClosed
+	Close() error
 }
 
+const (
+	fieldBody        = "body"
+	fieldTitle       = "title"
+	fieldDescription = "description"
+	fieldHeading     = "heading"
+)
+
+// 登録と削除をバックグラウンドで行うゴルーチンの数の既定値
+const defaultIndexWorkers = 4
+
+var (
+	errUnsupportedLanguage = errors.New("unsupported language")
+	errServiceClosed       = errors.New("service is closed")
+)
+
+// sentenceSplitters、analyzersは言語コードごとの文の分割とアナライザ。walがnilならログを書かない。
+// workersが1以上なら、登録と削除はログに書いたら返り、そのゴルーチンで行う。0ならその場で行う
 func newService(
-	sentenceSplitter SentenceSplitter,
-	tokenizer Tokenizer,
-	charFilter []CharFilter,
-	wordFilter []WordFilter,
+	sentenceSplitters map[string]SentenceSplitter,
+	htmlFilter HTMLFilter,
+	languageDetector LanguageDetector,
+	analyzers map[string]Analyzer,
 	db DB,
+	wal *writeAheadLog,
+	workers int,
 ) (Service, error) {
-	return &serviceImpl{
-		sentenceSplitter: sentenceSplitter,
-		tokenizer:        tokenizer,
-		charFilter:       charFilter,
-		wordFilter:       wordFilter,
-		db:               db,
-	}, nil
+	if len(analyzers) == 0 {
+		return nil, fmt.Errorf("no analyzers")
+	}
+	languages := make([]string, 0, len(analyzers))
+	for lang := range analyzers {
+		if _, ok := sentenceSplitters[lang]; !ok {
+			return nil, fmt.Errorf("no sentence splitter for %s", lang)
+		}
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	s := &serviceImpl{
+		sentenceSplitters: sentenceSplitters,
+		htmlFilter:        htmlFilter,
+		languageDetector:  languageDetector,
+		analyzers:         analyzers,
+		languages:         languages,
+		db:                db,
+		wal:               wal,
+		pending:           map[string]int{},
+	}
+	for i := 0; i < workers; i++ {
+		queue := make(chan *walRecord, indexQueueSize)
+		s.queues = append(s.queues, queue)
+		s.workers.Add(1)
+		go s.work(queue)
+	}
+	return s, nil
 }
 
 type serviceImpl struct {
-	sentenceSplitter SentenceSplitter
-	tokenizer        Tokenizer
-	charFilter       []CharFilter
-	wordFilter       []WordFilter
-	db               DB
+	sentenceSplitters map[string]SentenceSplitter
+	htmlFilter        HTMLFilter
+	languageDetector  LanguageDetector
+	analyzers         map[string]Analyzer
+	languages         []string
+	db                DB
+	// nilならログを書かない
+	wal *writeAheadLog
+	// 登録中に作ったトークンがポスティングより先にコンパクションで消されないようにする。
+	// スナップショットが途中までの登録や削除を含まないようにもする
+	compactLock sync.RWMutex
+
+	// 空なら登録と削除をその場で行う。同じURIの操作は同じキューに入れて順番を保つ
+	queues  []chan *walRecord
+	workers sync.WaitGroup
+	// キューに入れている間は閉じない
+	closeLock sync.RWMutex
+	closed    bool
+	// URIごとのキューに入っていて終わっていない操作の数
+	pendingLock sync.Mutex
+	pending     map[string]int
 }
 
-func (s *serviceImpl) Regist(uri string, body string) error {
+// ワーカーごとのキューの長さ。いっぱいなら登録と削除はキューが空くまで待つ
+const indexQueueSize = 100
+
+func (s *serviceImpl) Regist(uri string, body string, meta types.DocumentMeta) error {
+	// 言語によって文の区切り方が違うので先に言語を決める
+	lang, err := s.language(meta.Lang, []string{body})
+	if err != nil {
+		return err
+	}
 	// ドキュメントを文章ごとの配列に分割
-	sentences, err := s.sentenceSplitter.Split(body)
+	sentences, err := s.sentenceSplitters[lang].Split(body)
 	if err != nil {
 		return err
 	}
-	// 前処理
-	for _, f := range s.charFilter {
-		sentences = f.Filter(sentences)
+	fields := make([]string, len(sentences))
+	for i := range fields {
+		fields[i] = fieldBody
 	}
-	// トークン化
-	sentencesTokens := s.tokenizer.Analyze(sentences)
-	// 後処理
-	for _, f := range s.wordFilter {
-		sentencesTokens = f.Filter(sentencesTokens)
+	return s.registAsync(&types.Document{
+		Uri:          uri,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Lang:         lang,
+	}, sentences, fields)
+}
+
+func (s *serviceImpl) RegistHTML(uri string, body string, meta types.DocumentMeta) error {
+	html := s.htmlFilter.Extract(body)
+
+	// <html lang>は対応している言語のときだけ使う
+	lang := meta.Lang
+	if lang == "" {
+		if _, ok := s.analyzers[normalizeLanguage(html.Lang)]; ok {
+			lang = html.Lang
+		}
+	}
+	text := append([]string{html.Title, html.Description}, html.Headings...)
+	lang, err := s.language(lang, append(text, html.Blocks...))
+	if err != nil {
+		return err
 	}
 
-	// tokenCount
+	// フィールドごとに文章に分割、ブロック要素は文の区切りとして扱う
+	texts := []fieldText{
+		{field: fieldTitle, text: html.Title},
+		{field: fieldDescription, text: html.Description},
+	}
+	for _, heading := range html.Headings {
+		texts = append(texts, fieldText{field: fieldHeading, text: heading})
+	}
+	for _, block := range html.Blocks {
+		texts = append(texts, fieldText{field: fieldBody, text: block})
+	}
+	sentences, fields, err := s.splitFields(lang, texts)
+	if err != nil {
+		return err
+	}
+
+	return s.registAsync(&types.Document{
+		Uri:          uri,
+		Title:        html.Title,
+		Description:  html.Description,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Lang:         lang,
+	}, sentences, fields)
+}
+
+// フィールドと、その文字列
+type fieldText struct {
+	field string
+	text  string
+}
+
+// 文字列ごとに文章に分割し、文章とそのフィールドを返す
+func (s *serviceImpl) splitFields(lang string, texts []fieldText) ([]string, []string, error) {
+	sentences := []string{}
+	fields := []string{}
+	for _, text := range texts {
+		splitted, err := s.sentenceSplitters[lang].Split(text.text)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, sentence := range splitted {
+			sentences = append(sentences, sentence)
+			fields = append(fields, text.field)
+		}
+	}
+	return sentences, fields, nil
+}
+
+// ワーカーがあればログに書いてキューに入れ、なければその場で登録する
+func (s *serviceImpl) registAsync(doc *types.Document, sentences []string, fields []string) error {
+	if s.queues == nil {
+		return s.regist(doc, sentences, fields)
+	}
+	if doc.Time.IsZero() {
+		doc.Time = time.Now()
+	}
+	return s.enqueue(&walRecord{
+		Op:        walRegist,
+		Uri:       doc.Uri,
+		Document:  doc,
+		Sentences: sentences,
+		Fields:    fields,
+	})
+}
+
+// ログに書いてからURIのキューに入れる。ログに書けたら、止まっても起動時に最後まで実行し直す
+func (s *serviceImpl) enqueue(record *walRecord) error {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		return errServiceClosed
+	}
+	if _, err := s.wal.Begin(record); err != nil {
+		return err
+	}
+	s.pendingLock.Lock()
+	s.pending[record.Uri]++
+	s.pendingLock.Unlock()
+	hash := fnv.New32a()
+	hash.Write([]byte(record.Uri))
+	s.queues[hash.Sum32()%uint32(len(s.queues))] <- record
+	return nil
+}
+
+// キューの操作を順に行う。失敗した操作はログに残り、起動時にやり直す
+func (s *serviceImpl) work(queue chan *walRecord) {
+	defer s.workers.Done()
+	for record := range queue {
+		var err error
+		switch record.Op {
+		case walRegist:
+			err = s.index(record.Document, record.Sentences, record.Fields)
+		case walDelete:
+			s.compactLock.RLock()
+			err = s.deleteDocument(record.Uri)
+			s.compactLock.RUnlock()
+		}
+		if err != nil {
+			log.Printf("%s %s: %v", record.Op, record.Uri, err)
+			s.wal.Abort(record.Seq)
+		} else if err := s.wal.Commit(record.Seq); err != nil {
+			log.Printf("%s %s: %v", record.Op, record.Uri, err)
+		}
+		s.pendingLock.Lock()
+		if s.pending[record.Uri]--; s.pending[record.Uri] == 0 {
+			delete(s.pending, record.Uri)
+		}
+		s.pendingLock.Unlock()
+	}
+}
+
+func (s *serviceImpl) regist(doc *types.Document, sentences []string, fields []string) error {
+	// 再インデックス時は元の時刻を引き継ぐ。ログから再実行しても同じ時刻になるように先に決める
+	if doc.Time.IsZero() {
+		doc.Time = time.Now()
+	}
+	// 途中で止まっても起動時に最後まで登録し直せるように、先にログに書く
+	seq, err := s.wal.Begin(&walRecord{
+		Op:        walRegist,
+		Uri:       doc.Uri,
+		Document:  doc,
+		Sentences: sentences,
+		Fields:    fields,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.index(doc, sentences, fields); err != nil {
+		s.wal.Abort(seq)
+		return err
+	}
+	return s.wal.Commit(seq)
+}
+
+func (s *serviceImpl) index(doc *types.Document, sentences []string, fields []string) error {
+	s.compactLock.RLock()
+	defer s.compactLock.RUnlock()
+
+	lang, err := s.language(doc.Lang, sentences)
+	if err != nil {
+		return err
+	}
+	analyzer := s.analyzers[lang]
+	sentences, sentencesTokens := analyzer.Analyze(sentences)
+
+	// tokenCount。同じ語の別の形は1語と数える
+	sentenceLengths := make([]int, len(sentencesTokens))
 	tokenCount := 0
-	for _, sentenceToken := range sentencesTokens {
-		tokenCount += len(sentenceToken)
+	for i, tokens := range sentencesTokens {
+		sentenceLengths[i] = tokenLength(tokens)
+		tokenCount += sentenceLengths[i]
 	}
 
 	// ドキュメントIDを作成、取得
-	document, err := s.db.DocumentFromUri(uri)
+	document, err := s.db.DocumentFromUri(doc.Uri)
 	if err != nil {
 		return err
 	}
 	if document == nil {
 		_document, err := s.db.CreateDcoument(&types.Document{
-			Uri:        uri,
-			TokenCount: uint(tokenCount),
-			Time:       time.Now(),
+			Uri:          doc.Uri,
+			TokenCount:   uint(tokenCount),
+			Time:         doc.Time,
+			Title:        doc.Title,
+			Description:  doc.Description,
+			ETag:         doc.ETag,
+			LastModified: doc.LastModified,
+			Lang:         lang,
+			// アナライザが変わったか判定するために記録する
+			AnalyzerVersion: analyzer.Version(),
 		})
 		if err != nil {
 			return err
 		}
 		document = _document
+	} else {
+		document.TokenCount = uint(tokenCount)
+		document.Time = doc.Time
+		document.Title = doc.Title
+		document.Description = doc.Description
+		document.ETag = doc.ETag
+		document.LastModified = doc.LastModified
+		document.Lang = lang
+		document.AnalyzerVersion = analyzer.Version()
+		if _, err := s.db.UpdateDocument(document); err != nil {
+			return err
+		}
 	}
 	// アップデート用に既存の文章を削除
 	if err := s.db.DeleteSentenceFromDocumentID(document.ID); err != nil {
@@ -95,7 +386,8 @@ func (s *serviceImpl) Regist(uri string, body string) error {
 				DocumentID: document.ID,
 				Index:      uint(i),
 				Sentence:   sentence,
-				TokenCount: uint(len(sentencesTokens[i])),
+				TokenCount: uint(sentenceLengths[i]),
+				Field:      fields[i],
 			})
 			if err != nil {
 				return err
@@ -108,24 +400,31 @@ func (s *serviceImpl) Regist(uri string, body string) error {
 		return err
 	}
 
-	// トークンをユニークキーにポスティングリストを作成
+	// トークンをユニークキーにポスティングリストを作成。
+	// ドキュメント中の位置は、前の文章の本来のトークンの位置の続きにする
 	positionList := map[string][]positionCache{}
-	pos := 0
+	offset := 0
 	for i, tokens := range sentencesTokens {
-		for j, token := range tokens {
-			if _, ok := positionList[token]; !ok {
-				positionList[token] = []positionCache{}
+		span := 0
+		for _, token := range tokens {
+			if _, ok := positionList[token.Text]; !ok {
+				positionList[token.Text] = []positionCache{}
 			}
-			positionList[token] = append(positionList[token], positionCache{
-				SentencePosition: uint(j),
-				PostingPosition:  uint(pos),
+			positionList[token.Text] = append(positionList[token.Text], positionCache{
+				SentencePosition: uint(token.Position),
+				PostingPosition:  uint(offset + token.Position),
 				Sentence:         dbSentences[i],
 			})
-			pos++
+			if token.Field == "" && token.Position+1 > span {
+				span = token.Position + 1
+			}
 		}
+		offset += span
 	}
 
-	// ポスティングリストを追加
+	// トークンを用意してから、ポスティングリストをまとめて追加
+	postings := make([]*types.Posting, 0, len(positionList))
+	postingsLock := sync.Mutex{}
 	egAddPostingList := errgroup.Group{}
 	for tokenStr, positions := range positionList {
 		tokenStr, positions := tokenStr, positions
@@ -144,16 +443,31 @@ func (s *serviceImpl) Regist(uri string, body string) error {
 				token = _token
 			}
 			sentences := make([]*types.Sentence, len(positions))
+			postingPositions := make([]uint, len(positions))
 			for i, position := range positions {
 				sentences[i] = position.Sentence
+				postingPositions[i] = position.PostingPosition
 			}
 
-			if _, err := s.db.CreatePosting(&types.Posting{
-				DocumentID: document.ID,
-				TokenID:    token.ID,
-				Sentences:  sentences,
-			}); err != nil {
-				return err
+			postingsLock.Lock()
+			postings = append(postings, &types.Posting{
+				DocumentID:    document.ID,
+				TokenID:       token.ID,
+				TermFrequency: uint(len(positions)),
+				Positions:     postingPositions,
+				Sentences:     sentences,
+			})
+			postingsLock.Unlock()
+			// 検索時にスコアの上限を見積もるため、出現割合の最大を記録する。
+			// 副フィールドのトークンしかなく単語数が0なら、スコアは検索したトークンの出現回数の和で割るので1を超えない
+			ratio := 1.0
+			if tokenCount > 0 {
+				ratio = float64(len(positions)) / float64(tokenCount)
+			}
+			if ratio > token.MaxTermRatio {
+				if err := s.db.UpdateTokenMaxTermRatio(token.ID, ratio); err != nil {
+					return err
+				}
 			}
 			return nil
 		})
@@ -162,23 +476,515 @@ func (s *serviceImpl) Regist(uri string, body string) error {
 		return err
 	}
 
-	return nil
+	sort.Slice(postings, func(i, j int) bool {
+		return postings[i].TokenID < postings[j].TokenID
+	})
+	return s.db.CreatePostings(document.ID, postings)
 }
 
-func (s *serviceImpl) Search(body string, offset, count uint) ([]types.SearchResult, error) {
-	b := []string{body}
-	// 前処理
-	for _, f := range s.charFilter {
-		b = f.Filter(b)
+// 言語の指定がなければ推定する。対応していない言語ならエラー
+func (s *serviceImpl) language(lang string, text []string) (string, error) {
+	lang = normalizeLanguage(lang)
+	if lang == "" {
+		lang = s.languageDetector.Detect(text)
+	}
+	if _, ok := s.analyzers[lang]; !ok {
+		return "", fmt.Errorf("%w: %s", errUnsupportedLanguage, lang)
 	}
-	// トークン化
-	bt := s.tokenizer.Analyze(b)
-	// 後処理
-	for _, f := range s.wordFilter {
-		bt = f.Filter(bt)
+	return lang, nil
+}
+
+func (s *serviceImpl) Document(uri string) (*types.Document, error) {
+	return s.db.DocumentFromUri(uri)
+}
+
+func (s *serviceImpl) Delete(uri string) (bool, error) {
+	document, err := s.db.DocumentFromUri(uri)
+	if err != nil {
+		return false, err
+	}
+	if s.queues != nil {
+		// キューに入っている登録がまだ終わっていなければ、そのあとに削除する
+		s.pendingLock.Lock()
+		pending := s.pending[uri] > 0
+		s.pendingLock.Unlock()
+		if document == nil && !pending {
+			return false, nil
+		}
+		return true, s.enqueue(&walRecord{Op: walDelete, Uri: uri})
+	}
+	if document == nil {
+		return false, nil
+	}
+	s.compactLock.RLock()
+	defer s.compactLock.RUnlock()
+	seq, err := s.wal.Begin(&walRecord{Op: walDelete, Uri: uri})
+	if err != nil {
+		return false, err
+	}
+	if err := s.db.DeleteDocument(document.ID); err != nil {
+		s.wal.Abort(seq)
+		return false, err
+	}
+	return true, s.wal.Commit(seq)
+}
+
+func (s *serviceImpl) Touch(uri string) (bool, error) {
+	return s.db.TouchDocument(uri, time.Now())
+}
+
+// URIのドキュメントがあれば削除する
+func (s *serviceImpl) deleteDocument(uri string) error {
+	document, err := s.db.DocumentFromUri(uri)
+	if err != nil {
+		return err
+	}
+	if document == nil {
+		return nil
+	}
+	return s.db.DeleteDocument(document.ID)
+}
+
+func (s *serviceImpl) Recover() (*types.RecoveryReport, error) {
+	report := &types.RecoveryReport{}
+	if s.wal == nil {
+		return report, nil
+	}
+	entries, err := s.wal.Entries()
+	if err != nil {
+		return nil, err
+	}
+	// 書き出す前に止まった保存先もあるので、チェックポイントより後に終わった操作も書いた順に実行し直す
+	// URIごとに最後に終わった操作。途中で止まった登録を取り消すときに前の版に戻す
+	previous := map[string]*walRecord{}
+	for _, entry := range entries {
+		record := entry.record
+		if entry.checkpointed {
+			previous[record.Uri] = record
+			continue
+		}
+		rolledBack := false
+		switch record.Op {
+		case walRegist:
+			err = s.index(record.Document, record.Sentences, record.Fields)
+			// 今の設定では解析できないドキュメントは前の版に戻す。終わっていた登録はそのまま
+			if errors.Is(err, errUnsupportedLanguage) {
+				if entry.committed {
+					err = nil
+				} else {
+					err = s.rollback(previous[record.Uri])
+					rolledBack = true
+				}
+			}
+		case walDelete:
+			err = s.deleteDocument(record.Uri)
+		default:
+			err = fmt.Errorf("unknown wal operation: %s", record.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", record.Op, record.Uri, err)
+		}
+		switch {
+		case rolledBack:
+			report.RolledBack++
+		case entry.committed:
+			report.Replayed++
+			previous[record.Uri] = record
+			continue
+		default:
+			report.RolledForward++
+			previous[record.Uri] = record
+		}
+		if err := s.wal.Commit(record.Seq); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Checkpoint(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// 途中で止まった登録を取り消して、前に終わった操作の状態に戻す。
+// ログに前の操作がなければ、保存先にあるものが前の版なのでそのまま残す
+func (s *serviceImpl) rollback(previous *walRecord) error {
+	if previous == nil {
+		return nil
+	}
+	if previous.Op == walDelete {
+		return s.deleteDocument(previous.Uri)
+	}
+	err := s.index(previous.Document, previous.Sentences, previous.Fields)
+	if errors.Is(err, errUnsupportedLanguage) {
+		return nil
+	}
+	return err
+}
+
+func (s *serviceImpl) Checkpoint() error {
+	if s.wal == nil {
+		return nil
+	}
+	// ここまでのログの内容を保存先に書き出してから消す
+	offset := s.wal.Offset()
+	if err := s.db.FlushPostings(); err != nil {
+		return err
+	}
+	return s.wal.Checkpoint(offset)
+}
+
+func (s *serviceImpl) Close() error {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.closeLock.Unlock()
+	s.workers.Wait()
+	// ログがなければ消すものもないので、書き出すだけにする
+	if s.wal == nil {
+		return s.db.FlushPostings()
+	}
+	return s.Checkpoint()
+}
+
+func (s *serviceImpl) DocumentsBefore(before time.Time, offset, count uint) ([]*types.Document, error) {
+	return s.db.DocumentsBefore(before, offset, count)
+}
+
+func (s *serviceImpl) Stats(top uint) (*types.Stats, error) {
+	stats := &types.Stats{}
+	eg := errgroup.Group{}
+	eg.Go(func() (err error) {
+		stats.Documents, err = s.db.CountDocument()
+		return
+	})
+	eg.Go(func() (err error) {
+		stats.Tokens, err = s.db.CountToken()
+		return
+	})
+	eg.Go(func() (err error) {
+		stats.Postings, err = s.db.CountPosting()
+		return
+	})
+	eg.Go(func() (err error) {
+		stats.Sentences, err = s.db.CountSentence()
+		return
+	})
+	eg.Go(func() (err error) {
+		stats.TopTerms, err = s.db.TopTerms(top)
+		return
+	})
+	eg.Go(func() (err error) {
+		stats.StaleDocuments, err = s.StaleDocuments()
+		return
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (s *serviceImpl) StaleDocuments() (uint, error) {
+	count := uint(0)
+	for _, lang := range s.languages {
+		c, err := s.db.CountStaleDocument(lang, s.analyzers[lang].Version())
+		if err != nil {
+			return 0, err
+		}
+		count += c
+	}
+	return count, nil
+}
+
+func (s *serviceImpl) Reindex() (uint, error) {
+	const batch = 100
+	count := uint(0)
+	lastID := uint(0)
+	for {
+		documents, err := s.db.DocumentsAfterID(lastID, batch)
+		if err != nil {
+			return count, err
+		}
+		for _, document := range documents {
+			dbSentences, err := s.db.SentencesFromDocumentID(document.ID)
+			if err != nil {
+				return count, err
+			}
+			sentences := make([]string, len(dbSentences))
+			fields := make([]string, len(dbSentences))
+			for i, sentence := range dbSentences {
+				sentences[i] = sentence.Sentence
+				fields[i] = sentence.Field
+			}
+			if err := s.regist(document, sentences, fields); err != nil {
+				return count, err
+			}
+			lastID = document.ID
+			count++
+		}
+		if len(documents) < batch {
+			return count, nil
+		}
 	}
-	tokens := bt[0]
-	if len(tokens) == 0 {
+}
+
+func (s *serviceImpl) Fsck() (*types.FsckReport, error) {
+	report := &types.FsckReport{}
+	eg := errgroup.Group{}
+	eg.Go(func() (err error) {
+		report.OrphanPostings, err = s.db.OrphanPostings()
+		return
+	})
+	eg.Go(func() (err error) {
+		report.DuplicateTokens, err = s.db.DuplicateTokens()
+		return
+	})
+	eg.Go(func() (err error) {
+		report.TokenCountMismatches, err = s.db.TokenCountMismatches()
+		return
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *serviceImpl) Compact() (*types.CompactReport, error) {
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	return s.db.Compact()
+}
+
+func (s *serviceImpl) Merge() (*types.MergeReport, error) {
+	return s.db.MergePostings()
+}
+
+func (s *serviceImpl) Snapshot(w io.Writer) (*types.SnapshotReport, error) {
+	// 途中の登録や削除が終わるのを待ち、同じ時点の内容を読めるようになったら再開する
+	s.compactLock.Lock()
+	once := sync.Once{}
+	ready := func() {
+		once.Do(s.compactLock.Unlock)
+	}
+	defer ready()
+	return s.db.Snapshot(w, ready)
+}
+
+func (s *serviceImpl) Restore(r io.Reader) (*types.SnapshotReport, error) {
+	// 取り込み始めてから壊れているとわからないように、先に全体を保存して確かめる
+	file, err := os.CreateTemp("", "searcher-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := readSnapshot(io.TeeReader(r, file), nil); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	count, err := s.db.CountDocument()
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errIndexNotEmpty
+	}
+	// 途中で失敗しても空のまま残し、もう一度取り込めるようにする
+	report, err := s.db.Restore(file)
+	if err != nil {
+		return nil, err
+	}
+	// 取り込んだ内容はログにないので、すぐに書き出す
+	if err := s.db.FlushPostings(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (s *serviceImpl) Export(w io.Writer) (uint, error) {
+	const batch = 100
+	// 書いている間に登録や削除されたドキュメントは、どちらの内容になるかわからない
+	encoder := json.NewEncoder(w)
+	count := uint(0)
+	lastID := uint(0)
+	for {
+		documents, err := s.db.DocumentsAfterID(lastID, batch)
+		if err != nil {
+			return count, err
+		}
+		for _, document := range documents {
+			sentences, err := s.db.SentencesFromDocumentID(document.ID)
+			if err != nil {
+				return count, err
+			}
+			if err := encoder.Encode(newExportDocument(document, sentences)); err != nil {
+				return count, err
+			}
+			lastID = document.ID
+			count++
+		}
+		if len(documents) < batch {
+			return count, nil
+		}
+	}
+}
+
+func (s *serviceImpl) Import(r io.Reader) (*types.ImportReport, error) {
+	report := &types.ImportReport{Failures: []types.ImportFailure{}}
+	err := readExport(r, func(line uint, document *exportDocument, err error) error {
+		if err == nil {
+			err = s.importDocument(document)
+		}
+		// 入力の問題なら次の行に進む
+		if errors.Is(err, errInvalidExport) || errors.Is(err, errUnsupportedLanguage) {
+			report.Failures = append(report.Failures, types.ImportFailure{
+				Line:  line,
+				Uri:   document.Uri,
+				Error: err.Error(),
+			})
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		report.Documents++
+		return nil
+	})
+	return report, err
+}
+
+// 登録と同じように言語を決めて文章に分割する。インデックスした時刻は引き継ぐ
+func (s *serviceImpl) importDocument(document *exportDocument) error {
+	texts := document.texts()
+	all := make([]string, len(texts))
+	for i, text := range texts {
+		all[i] = text.text
+	}
+	lang, err := s.language(document.Lang, all)
+	if err != nil {
+		return err
+	}
+	sentences, fields, err := s.splitFields(lang, texts)
+	if err != nil {
+		return err
+	}
+	return s.regist(&types.Document{
+		Uri:          document.Uri,
+		Time:         document.Time,
+		Title:        document.Fields.Title,
+		Description:  document.Fields.Description,
+		ETag:         document.ETag,
+		LastModified: document.LastModified,
+		Lang:         lang,
+	}, sentences, fields)
+}
+
+func (s *serviceImpl) Search(body string, lang string, prefix bool, offset, count uint) ([]types.SearchResult, error) {
+	// それぞれの上位offset+count件に入らないものは、まとめても範囲に入らない
+	documentList, err := s.rank(body, lang, prefix, int(offset+count))
+	if err != nil {
+		return nil, err
+	}
+
+	// 検索対象範囲を絞る
+	result := []types.SearchResult{}
+	if int(offset) >= len(documentList) {
+		return result, nil
+	}
+	documentList = documentList[offset:]
+	if len(documentList) > int(count) {
+		documentList = documentList[:count]
+	}
+	for _, match := range documentList {
+		// DBから一致した文章をひっぱってくる
+		sentenceIDs, err := s.db.SentenceIDsFromPostings(match.documentID, match.tokenIDs)
+		if err != nil {
+			return nil, err
+		}
+		sentenceStrs := []string{}
+		if len(sentenceIDs) > 0 {
+			sentences, err := s.db.SentenceMultiFromID(sentenceIDs)
+			if err != nil {
+				return nil, err
+			}
+			for _, sentence := range sentences {
+				sentenceStrs = append(sentenceStrs, sentence.Sentence)
+			}
+		}
+
+		document, err := s.db.DocumentFromID(match.documentID)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, types.SearchResult{
+			Uri:       document.Uri,
+			Score:     match.score,
+			Sentences: sentenceStrs,
+		})
+	}
+
+	return result, nil
+}
+
+func (s *serviceImpl) SearchScores(body string, lang string, prefix bool, count uint) ([]float64, error) {
+	documentList, err := s.rank(body, lang, prefix, int(count))
+	if err != nil {
+		return nil, err
+	}
+	if len(documentList) > int(count) {
+		documentList = documentList[:count]
+	}
+	scores := make([]float64, len(documentList))
+	for i, match := range documentList {
+		scores[i] = match.score
+	}
+	return scores, nil
+}
+
+// 一致したドキュメントをスコアの高い順に並べる。上位k件より後ろは含まないことがある
+func (s *serviceImpl) rank(body string, lang string, prefix bool, k int) ([]*searchMatch, error) {
+	// 言語の指定がなければすべての言語で解析する
+	languages := s.languages
+	if lang != "" {
+		lang = normalizeLanguage(lang)
+		if _, ok := s.analyzers[lang]; !ok {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedLanguage, lang)
+		}
+		languages = []string{lang}
+	}
+
+	// 同じトークン列になったものは1度だけ検索する
+	queries := []types.Query{}
+	queryMap := map[string]struct{}{}
+	for _, lang := range languages {
+		analyze := s.analyzers[lang].AnalyzeQuery
+		if prefix {
+			analyze = s.analyzers[lang].AnalyzePrefixQuery
+		}
+		for _, query := range analyze(body) {
+			if len(query.Tokens) == 0 {
+				continue
+			}
+			key := strings.Join(query.Tokens, "\x00")
+			if _, ok := queryMap[key]; ok {
+				continue
+			}
+			queryMap[key] = struct{}{}
+			queries = append(queries, query)
+		}
+	}
+	if len(queries) == 0 {
 		return nil, fmt.Errorf("invalid input")
 	}
 
@@ -188,12 +994,53 @@ func (s *serviceImpl) Search(body string, offset, count uint) ([]types.SearchRes
 		return nil, err
 	}
 
+	// 言語や副フィールドごとの上位をまとめる、同じドキュメントはスコアの高い方を使う
+	matches := map[uint]*searchMatch{}
+	for _, query := range queries {
+		_matches, err := s.match(query, lang, allCount, k)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range _matches {
+			match.score *= query.Weight
+			if current, ok := matches[match.documentID]; ok && current.score >= match.score {
+				continue
+			}
+			matches[match.documentID] = match
+		}
+	}
+	documentList := make([]*searchMatch, 0, len(matches))
+	for _, match := range matches {
+		documentList = append(documentList, match)
+	}
+
+	// スコアによって並べ替え
+	sort.Slice(documentList, func(i, j int) bool {
+		if documentList[i].score != documentList[j].score {
+			return documentList[i].score > documentList[j].score
+		}
+		return documentList[i].documentID < documentList[j].documentID
+	})
+
+	return documentList, nil
+}
+
+type searchMatch struct {
+	documentID uint
+	score      float64
+	tokenIDs   []uint
+}
+
+// クエリに一致するドキュメントのうち、スコアの高いk件
+func (s *serviceImpl) match(query types.Query, lang string, allCount uint, k int) ([]*searchMatch, error) {
 	// トークンを検索。ない場合はスキップ
 	dbTokens := []*types.Token{}
+	subfields := map[uint]bool{}
 	dbTokensLock := sync.Mutex{}
 	egListToken := errgroup.Group{}
-	for _, token := range tokens {
+	for i, token := range query.Tokens {
 		token := token
+		subfield := query.Fields != nil && query.Fields[i] != ""
 		egListToken.Go(func() error {
 			t, err := s.db.TokenFromString(token)
 			if err != nil && err != gorm.ErrRecordNotFound {
@@ -202,6 +1049,7 @@ func (s *serviceImpl) Search(body string, offset, count uint) ([]types.SearchRes
 			if t != nil {
 				dbTokensLock.Lock()
 				dbTokens = append(dbTokens, t)
+				subfields[t.ID] = subfield
 				dbTokensLock.Unlock()
 			}
 			return nil
@@ -212,112 +1060,69 @@ func (s *serviceImpl) Search(body string, offset, count uint) ([]types.SearchRes
 	}
 	// tokenがなければ絶望的、１つでも存在すればそれで検索する。（サジェスト的な）
 	if len(dbTokens) == 0 {
-		return []types.SearchResult{}, nil
+		return []*searchMatch{}, nil
 	}
 
-	// トークンごとにポスティングテーブルを取得
-	postingLists := map[uint][]*types.Posting{}
-	postingListsLock := sync.Mutex{}
-	egGetPostingLists := errgroup.Group{}
-	for _, token := range dbTokens {
-		token := token
-		egGetPostingLists.Go(func() error {
-
-			// トークンごとにポスティングテーブルを取得
-			postingList, err := s.db.PostingList(token.ID)
-			if err != nil {
-				return err
-			}
-			postingListsLock.Lock()
-			postingLists[token.ID] = postingList
-			postingListsLock.Unlock()
-			return nil
-		})
+	// トークンごとにドキュメントID順の圧縮したポスティングリストを、同じ時点の内容で取得
+	tokenIDs := make([]uint, len(dbTokens))
+	for i, token := range dbTokens {
+		tokenIDs[i] = token.ID
 	}
-	if err := egGetPostingLists.Wait(); err != nil {
+	blocks, err := s.db.PostingBlocks(tokenIDs)
+	if err != nil {
 		return nil, err
 	}
-
-	// ポスティングリストのANDを取る
-	documentList := []uint{}
-	postingCountByPage := map[uint]uint{}
-	for _, postingList := range postingLists {
-		for _, posting := range postingList {
-			if _, ok := postingCountByPage[posting.DocumentID]; !ok {
-				postingCountByPage[posting.DocumentID] = 0
-			}
-			postingCountByPage[posting.DocumentID] += 1
-			if postingCountByPage[posting.DocumentID] == uint(len(dbTokens)) {
-				documentList = append(documentList, posting.DocumentID)
+	terms := []*queryTerm{}
+	for _, token := range dbTokens {
+		data, ok := blocks[token.ID]
+		// ポスティングリストがなければ、すべてのトークンを含むドキュメントもない
+		if !ok {
+			if query.Any {
+				continue
 			}
+			return []*searchMatch{}, nil
 		}
-	}
-
-	// 各ページのスコアを計算
-	scores := map[uint]float64{}
-	for _, documentID := range documentList {
-		termCount, err := s.db.CountTermInDocument(documentID)
+		postings, err := newPostingBlockReader(data)
 		if err != nil {
 			return nil, err
 		}
-		for _, token := range dbTokens {
-			idf := math.Log(float64(allCount) / float64(len(postingLists[token.ID])+1))
-			tf := float64(len(postingLists[token.ID])) / float64(termCount)
-			scores[documentID] = tf * idf
-		}
+		terms = append(terms, &queryTerm{
+			tokenID:      token.ID,
+			postings:     postings,
+			maxTermRatio: token.MaxTermRatio,
+			subfield:     subfields[token.ID],
+		})
 	}
 
-	// スコアによって並べ替え
-	sort.Slice(documentList, func(i, j int) bool {
-		return scores[documentList[i]] > scores[documentList[j]]
+	// 候補のドキュメントの単語数はまとめて取得し、言語の指定があれば絞り込む
+	documents, err := topKDocuments(terms, query.Any, allCount, k, func(ids []uint) (map[uint]uint, error) {
+		return s.db.DocumentLengths(ids, lang)
 	})
-
-	// 検索対象範囲を絞る
-	result := []types.SearchResult{}
-	cursor := int(offset)
-	for len(result) < int(count) {
-		if len(documentList) <= cursor {
-			return result, nil
-		}
-		// 検索結果を追加、
-		documentID := documentList[cursor]
-		// 重複削除
-		sentenceMap := map[uint]struct{}{}
-		for _, token := range dbTokens {
-			for _, list := range postingLists[token.ID] {
-				for _, sentence := range list.Sentences {
-					sentenceMap[sentence.ID] = struct{}{}
-				}
-			}
-		}
-		// DBから文章をひっぱってくる
-		sentenceIDs := []uint{}
-		for sentenceID := range sentenceMap {
-			sentenceIDs = append(sentenceIDs, sentenceID)
-		}
-		sentences, err := s.db.SentenceMultiFromID(sentenceIDs)
-		if err != nil {
-			return nil, err
-		}
-		sentenceStrs := make([]string, len(sentences))
-		for i, sentence := range sentences {
-			sentenceStrs[i] = sentence.Sentence
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*searchMatch, len(documents))
+	for i, document := range documents {
+		matches[i] = &searchMatch{
+			documentID: document.documentID,
+			score:      document.score,
+			tokenIDs:   tokenIDs,
 		}
+	}
+	return matches, nil
+}
 
-		document, err := s.db.DocumentFromID(documentID)
-		if err != nil {
-			return nil, err
+// 文章の語の数。同じ位置のトークンは同じ語の別の形なので1つと数える。
+// 副フィールドのトークンは数えず、n-gramなどを足してもスコアの長さの補正は変わらない
+func tokenLength(tokens []types.AnalyzedToken) int {
+	positions := map[int]struct{}{}
+	for _, token := range tokens {
+		if token.Field != "" {
+			continue
 		}
-
-		result = append(result, types.SearchResult{
-			Uri:       document.Uri,
-			Score:     scores[documentID],
-			Sentences: sentenceStrs,
-		})
-		cursor++
+		positions[token.Position] = struct{}{}
 	}
-
-	return result, nil
+	return len(positions)
 }
 
 type positionCache struct {
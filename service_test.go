@@ -1,6 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,14 +23,22 @@ func TestServiceRegist(t *testing.T) {
 	tokenizer := mock.NewMockTokenizer(ctrl)
 	charFilter := mock.NewMockCharFilter(ctrl)
 	wordFilter := mock.NewMockWordFilter(ctrl)
+	languageDetector := mock.NewMockLanguageDetector(ctrl)
 	db := mock.NewMockDB(ctrl)
 	gomock.InOrder(
+		languageDetector.EXPECT().Detect([]string{"これはペンです。これはりんごです。:)。"}).Return("ja"),
 		sentenceSplitter.EXPECT().Split("これはペンです。これはりんごです。:)。").Return([]string{"これはペンです。", "これはりんごです。", ":)。"}, nil),
 		charFilter.EXPECT().Filter([]string{"これはペンです。", "これはりんごです。", ":)。"}).Return([]string{"これはペンです。", "これはりんごです。", "happy。"}),
-		tokenizer.EXPECT().Analyze([]string{"これはペンです。", "これはりんごです。", "happy。"}).Return([][]string{{"コレ", "ハ", "ペン", "デス", "。"}, {"コレ", "ハ", "リンゴ", "デス", "。"}, {"happy", "。"}}),
-		wordFilter.EXPECT().Filter([][]string{{"コレ", "ハ", "ペン", "デス", "。"}, {"コレ", "ハ", "リンゴ", "デス", "。"}, {"happy", "。"}}).Return([][]string{{"コレ", "ペン", "デス"}, {"コレ", "リンゴ", "デス"}, {"happy"}}),
+		tokenizer.EXPECT().Analyze([]string{"これはペンです。", "これはりんごです。", "happy。"}).Return(textTerms([][]string{{"コレ", "ハ", "ペン", "デス", "。"}, {"コレ", "ハ", "リンゴ", "デス", "。"}, {"happy", "。"}})),
+		// 単語フィルタには語ごとに1行で渡す
+		wordFilter.EXPECT().Filter([][]string{{"コレ"}, {"ハ"}, {"ペン"}, {"デス"}, {"。"}, {"コレ"}, {"ハ"}, {"リンゴ"}, {"デス"}, {"。"}, {"happy"}, {"。"}}).Return([][]string{{"コレ"}, {}, {"ペン"}, {"デス"}, {}, {"コレ"}, {}, {"リンゴ"}, {"デス"}, {}, {"happy"}, {}}),
 		db.EXPECT().DocumentFromUri("uri").Return(nil, nil),
-		db.EXPECT().CreateDcoument(gomock.Any()).Return(&types.Document{
+		db.EXPECT().CreateDcoument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+			if document.Lang != "ja" || document.AnalyzerVersion == "" {
+				t.Errorf("unexpected document: %+v", document)
+			}
+			return document, nil
+		}).Return(&types.Document{
 			Model: gorm.Model{
 				ID: 1,
 			},
@@ -67,18 +80,21 @@ func TestServiceRegist(t *testing.T) {
 		Index:      0,
 		Sentence:   "これはペンです。",
 		TokenCount: 3,
+		Field:      "body",
 	}).Return(thisispen, nil)
 	db.EXPECT().CreateSentence(&types.Sentence{
 		DocumentID: 1,
 		Index:      1,
 		Sentence:   "これはりんごです。",
 		TokenCount: 3,
+		Field:      "body",
 	}).Return(thisisapple, nil)
 	db.EXPECT().CreateSentence(&types.Sentence{
 		DocumentID: 1,
 		Index:      2,
 		Sentence:   "happy。",
 		TokenCount: 1,
+		Field:      "body",
 	}).Return(happy, nil)
 
 	db.EXPECT().TokenFromString("コレ").Return(&types.Token{
@@ -107,44 +123,822 @@ func TestServiceRegist(t *testing.T) {
 		},
 	}, nil)
 
-	db.EXPECT().CreatePosting(&types.Posting{
-		TokenID:    1,
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(1), float64(2)/7)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(2), float64(1)/7)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(3), float64(1)/7)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(4), float64(2)/7)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(5), float64(1)/7)
+	db.EXPECT().CreatePostings(uint(1), []*types.Posting{{
+		TokenID:       1,
+		DocumentID:    1,
+		TermFrequency: 2,
+		Positions:     []uint{0, 4},
+		Sentences:     []*types.Sentence{thisispen, thisisapple},
+	}, {
+		TokenID:       2,
+		DocumentID:    1,
+		TermFrequency: 1,
+		Positions:     []uint{2},
+		Sentences:     []*types.Sentence{thisispen},
+	}, {
+		TokenID:       3,
+		DocumentID:    1,
+		TermFrequency: 1,
+		Positions:     []uint{6},
+		Sentences:     []*types.Sentence{thisisapple},
+	}, {
+		TokenID:       4,
+		DocumentID:    1,
+		TermFrequency: 2,
+		Positions:     []uint{3, 7},
+		Sentences:     []*types.Sentence{thisispen, thisisapple},
+	}, {
+		TokenID:       5,
+		DocumentID:    1,
+		TermFrequency: 1,
+		Positions:     []uint{8},
+		Sentences:     []*types.Sentence{happy},
+	}})
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{charFilter}, []TermFilter{}, []WordFilter{wordFilter})
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": sentenceSplitter},
+		mock.NewMockHTMLFilter(ctrl),
+		languageDetector,
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	err := service.Regist("uri", "これはペンです。これはりんごです。:)。", types.DocumentMeta{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceRegistHTML(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	sentenceSplitter := mock.NewMockSentenceSplitter(ctrl)
+	htmlFilter := mock.NewMockHTMLFilter(ctrl)
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	gomock.InOrder(
+		htmlFilter.EXPECT().Extract("<html>").Return(&types.HTMLDocument{
+			Lang:     "ja-JP",
+			Title:    "ペン",
+			Headings: []string{},
+			Blocks:   []string{"これはペンです"},
+		}),
+		sentenceSplitter.EXPECT().Split("ペン").Return([]string{"ペン"}, nil),
+		sentenceSplitter.EXPECT().Split("").Return([]string{}, nil),
+		sentenceSplitter.EXPECT().Split("これはペンです").Return([]string{"これはペンです"}, nil),
+		tokenizer.EXPECT().Analyze([]string{"ペン", "これはペンです"}).Return(textTerms([][]string{{"ペン"}, {"コレ", "ペン"}})),
+		db.EXPECT().DocumentFromUri("uri").Return(&types.Document{
+			Model: gorm.Model{
+				ID: 1,
+			},
+			Uri:        "uri",
+			TokenCount: 10,
+		}, nil),
+		db.EXPECT().UpdateDocument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+			if document.TokenCount != 3 || document.Title != "ペン" || document.ETag != "etag" || document.Lang != "ja" {
+				t.Errorf("unexpected document: %+v", document)
+			}
+			return document, nil
+		}),
+		db.EXPECT().DeleteSentenceFromDocumentID(uint(1)).Return(nil),
+	)
+	title := &types.Sentence{Model: gorm.Model{ID: 1}}
+	body := &types.Sentence{Model: gorm.Model{ID: 2}}
+	db.EXPECT().CreateSentence(&types.Sentence{
 		DocumentID: 1,
-		Sentences:  []*types.Sentence{thisispen, thisisapple},
-	})
-	db.EXPECT().CreatePosting(&types.Posting{
-		TokenID:    2,
+		Index:      0,
+		Sentence:   "ペン",
+		TokenCount: 1,
+		Field:      "title",
+	}).Return(title, nil)
+	db.EXPECT().CreateSentence(&types.Sentence{
 		DocumentID: 1,
-		Sentences:  []*types.Sentence{thisispen},
+		Index:      1,
+		Sentence:   "これはペンです",
+		TokenCount: 2,
+		Field:      "body",
+	}).Return(body, nil)
+	// 出現割合の最大が既に大きいトークンは更新しない
+	db.EXPECT().TokenFromString("ペン").Return(&types.Token{Model: gorm.Model{ID: 1}, MaxTermRatio: 1}, nil)
+	db.EXPECT().TokenFromString("コレ").Return(nil, nil)
+	db.EXPECT().CreateToken(&types.Token{Token: "コレ"}).Return(&types.Token{Model: gorm.Model{ID: 2}}, nil)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(2), float64(1)/3)
+	db.EXPECT().CreatePostings(uint(1), []*types.Posting{{
+		TokenID:       1,
+		DocumentID:    1,
+		TermFrequency: 2,
+		Positions:     []uint{0, 2},
+		Sentences:     []*types.Sentence{title, body},
+	}, {
+		TokenID:       2,
+		DocumentID:    1,
+		TermFrequency: 1,
+		Positions:     []uint{1},
+		Sentences:     []*types.Sentence{body},
+	}})
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": sentenceSplitter},
+		htmlFilter,
+		// <html lang>があるので推定しない
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	if err := service.RegistHTML("uri", "<html>", types.DocumentMeta{ETag: "etag"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// 本来のトークンがすべて除かれても、副フィールドのトークンの出現割合は有限になる
+func TestServiceRegistSubfieldOnly(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	sentenceSplitter := mock.NewMockSentenceSplitter(ctrl)
+	analyzer := mock.NewMockAnalyzer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	sentenceSplitter.EXPECT().Split("の").Return([]string{"の"}, nil)
+	analyzer.EXPECT().Analyze([]string{"の"}).Return([]string{"の"}, [][]types.AnalyzedToken{{{Text: "ngram:の", Position: 0, Field: "ngram"}}})
+	analyzer.EXPECT().Version().Return("v1")
+	db.EXPECT().DocumentFromUri("uri").Return(nil, nil)
+	db.EXPECT().CreateDcoument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+		if document.TokenCount != 0 {
+			t.Errorf("unexpected document: %+v", document)
+		}
+		document.ID = 1
+		return document, nil
 	})
-	db.EXPECT().CreatePosting(&types.Posting{
-		TokenID:    3,
-		DocumentID: 1,
-		Sentences:  []*types.Sentence{thisisapple},
+	db.EXPECT().DeleteSentenceFromDocumentID(uint(1)).Return(nil)
+	sentence := &types.Sentence{Model: gorm.Model{ID: 1}}
+	db.EXPECT().CreateSentence(&types.Sentence{DocumentID: 1, Sentence: "の", Field: "body"}).Return(sentence, nil)
+	db.EXPECT().TokenFromString("ngram:の").Return(&types.Token{Model: gorm.Model{ID: 1}}, nil)
+	db.EXPECT().UpdateTokenMaxTermRatio(uint(1), float64(1))
+	db.EXPECT().CreatePostings(uint(1), []*types.Posting{{
+		TokenID:       1,
+		DocumentID:    1,
+		TermFrequency: 1,
+		Positions:     []uint{0},
+		Sentences:     []*types.Sentence{sentence},
+	}})
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": sentenceSplitter},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+	if err := service.Regist("uri", "の", types.DocumentMeta{Lang: "ja"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceDocument(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	db.EXPECT().DocumentFromUri("uri").Return(&types.Document{
+		Uri: "uri",
+	}, nil)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	document, err := service.Document("uri")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		&types.Document{Uri: "uri"},
+		document,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	gomock.InOrder(
+		db.EXPECT().DocumentFromUri("uri").Return(&types.Document{
+			Model: gorm.Model{
+				ID: 1,
+			},
+			Uri: "uri",
+		}, nil),
+		db.EXPECT().DeleteDocument(uint(1)).Return(nil),
+		db.EXPECT().DocumentFromUri("notfound").Return(nil, nil),
+	)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	ok, err := service.Delete("uri")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf(diff)
+	}
+	ok, err = service.Delete("notfound")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceRecover(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	seq, _ := wal.Begin(&walRecord{
+		Op:        walRegist,
+		Uri:       "a",
+		Document:  &types.Document{Uri: "a", Time: indexed, Lang: "ja"},
+		Sentences: []string{"ペン"},
+		Fields:    []string{fieldBody},
 	})
-	db.EXPECT().CreatePosting(&types.Posting{
-		TokenID:    4,
-		DocumentID: 1,
-		Sentences:  []*types.Sentence{thisispen, thisisapple},
+	wal.Commit(seq)
+	wal.Begin(&walRecord{Op: walDelete, Uri: "b"})
+	// 今は対応していない言語で登録しようとしていた
+	wal.Begin(&walRecord{
+		Op:        walRegist,
+		Uri:       "c",
+		Document:  &types.Document{Uri: "c", Time: indexed, Lang: "fr"},
+		Sentences: []string{"stylo"},
+		Fields:    []string{fieldBody},
 	})
-	db.EXPECT().CreatePosting(&types.Posting{
-		TokenID:    5,
-		DocumentID: 1,
-		Sentences:  []*types.Sentence{happy},
+
+	gomock.InOrder(
+		tokenizer.EXPECT().Analyze([]string{"ペン"}).Return(textTerms([][]string{{"ペン"}})),
+		db.EXPECT().DocumentFromUri("a").Return(nil, nil),
+		db.EXPECT().CreateDcoument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+			if !document.Time.Equal(indexed) {
+				t.Errorf("unexpected document: %+v", document)
+			}
+			document.ID = 1
+			return document, nil
+		}),
+		db.EXPECT().DeleteSentenceFromDocumentID(uint(1)).Return(nil),
+		db.EXPECT().CreateSentence(gomock.Any()).Return(&types.Sentence{Model: gorm.Model{ID: 8}}, nil),
+		db.EXPECT().TokenFromString("ペン").Return(&types.Token{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().UpdateTokenMaxTermRatio(uint(1), float64(1)),
+		db.EXPECT().CreatePostings(gomock.Any(), gomock.Any()),
+		db.EXPECT().DocumentFromUri("b").Return(&types.Document{Model: gorm.Model{ID: 2}}, nil),
+		db.EXPECT().DeleteDocument(uint(2)).Return(nil),
+		// ログに前の版がないので、保存先にある版を消さずに残す
+		db.EXPECT().FlushPostings().Return(nil),
+	)
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		wal,
+		0,
+	)
+
+	report, err := service.Recover()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(&types.RecoveryReport{Replayed: 1, RolledForward: 1, RolledBack: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	// すべて保存先に書き出したのでログは空になる
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff(0, len(entries)); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceRecoverRollback(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	seq, _ := wal.Begin(&walRecord{
+		Op:        walRegist,
+		Uri:       "a",
+		Document:  &types.Document{Uri: "a", Time: indexed, Lang: "ja"},
+		Sentences: []string{"ペン"},
+		Fields:    []string{fieldBody},
 	})
+	wal.Commit(seq)
+	// 前の版を登録し直そうとして止まった。今は対応していない言語
+	failed, _ := wal.Begin(&walRecord{
+		Op:        walRegist,
+		Uri:       "a",
+		Document:  &types.Document{Uri: "a", Time: indexed, Lang: "fr"},
+		Sentences: []string{"stylo"},
+		Fields:    []string{fieldBody},
+	})
+	wal.Abort(failed)
+	// 前の版はチェックポイントで書き出し済み
+	wal.Checkpoint(wal.Offset())
+
+	gomock.InOrder(
+		tokenizer.EXPECT().Analyze([]string{"ペン"}).Return(textTerms([][]string{{"ペン"}})),
+		db.EXPECT().DocumentFromUri("a").Return(&types.Document{Model: gorm.Model{ID: 1}, Uri: "a"}, nil),
+		db.EXPECT().UpdateDocument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+			if document.Lang != "ja" {
+				t.Errorf("unexpected document: %+v", document)
+			}
+			return document, nil
+		}),
+		db.EXPECT().DeleteSentenceFromDocumentID(uint(1)).Return(nil),
+		db.EXPECT().CreateSentence(gomock.Any()).Return(&types.Sentence{Model: gorm.Model{ID: 8}}, nil),
+		db.EXPECT().TokenFromString("ペン").Return(&types.Token{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().UpdateTokenMaxTermRatio(uint(1), float64(1)),
+		db.EXPECT().CreatePostings(gomock.Any(), gomock.Any()),
+		db.EXPECT().FlushPostings().Return(nil),
+	)
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		wal,
+		0,
+	)
+
+	// チェックポイントより前に終わった登録は実行し直さず、取り消すときの前の版にだけ使う
+	report, err := service.Recover()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(&types.RecoveryReport{RolledBack: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff(0, len(entries)); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceDeleteWAL(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	gomock.InOrder(
+		db.EXPECT().DocumentFromUri("uri").Return(&types.Document{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().DeleteDocument(uint(1)).Return(errors.New("error")),
+	)
+
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		wal,
+		0,
+	)
 
+	if _, err := service.Delete("uri"); err == nil {
+		t.Errorf("expected error")
+	}
+	// 失敗した削除は起動時にやり直す
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff(
+		[]walEntry{{record: &walRecord{Seq: 0, Op: walDelete, Uri: "uri"}}},
+		entries,
+		cmp.AllowUnexported(walEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceDeleteQueue(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	// 受け付けたときとワーカーが削除するとき、閉じたあと
+	db.EXPECT().DocumentFromUri("uri").Return(&types.Document{Model: gorm.Model{ID: 1}}, nil).Times(3)
+	db.EXPECT().DocumentFromUri("notfound").Return(nil, nil)
+	gomock.InOrder(
+		db.EXPECT().DeleteDocument(uint(1)).Return(nil),
+		db.EXPECT().FlushPostings().Return(nil),
+	)
+
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
 	service, _ := newService(
-		sentenceSplitter,
-		tokenizer,
-		[]CharFilter{charFilter},
-		[]WordFilter{wordFilter},
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
 		db,
+		wal,
+		1,
 	)
 
-	err := service.Regist("uri", "これはペンです。これはりんごです。:)。")
+	ok, err := service.Delete("uri")
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(true, ok); diff != "" {
+		t.Errorf(diff)
+	}
+	ok, err = service.Delete("notfound")
 	if err != nil {
 		t.Error(err)
 	}
+	if diff := cmp.Diff(false, ok); diff != "" {
+		t.Errorf(diff)
+	}
+	// 閉じるときにキューの削除を終えて書き出し、ログから消す
+	if err := service.Close(); err != nil {
+		t.Error(err)
+	}
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff([]walEntry{}, entries, cmp.AllowUnexported(walEntry{})); diff != "" {
+		t.Errorf(diff)
+	}
+	if _, err := service.Delete("uri"); !errors.Is(err, errServiceClosed) {
+		t.Errorf("expected service closed: %v", err)
+	}
+}
+
+func TestServiceRestore(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	// 1つのトランザクションの中で、スナップショットの行ごとに登録する
+	restore := func(r io.Reader) (*types.SnapshotReport, error) {
+		snapshot := newSnapshotImport()
+		return readSnapshot(r, func(line *snapshotLine) error {
+			return snapshot.Line(db, line)
+		})
+	}
+	gomock.InOrder(
+		db.EXPECT().CountDocument().Return(uint(0), nil),
+		db.EXPECT().Restore(gomock.Any()).DoAndReturn(restore),
+		db.EXPECT().CreateDcoument(&types.Document{Uri: "uri", Lang: "ja"}).Return(&types.Document{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().CreateSentence(&types.Sentence{DocumentID: 1, Index: 0, Sentence: "ペン", TokenCount: 1, Field: "body"}).Return(&types.Sentence{Model: gorm.Model{ID: 10}}, nil),
+		db.EXPECT().TokenFromString("ペン").Return(nil, nil),
+		db.EXPECT().CreateToken(&types.Token{Token: "ペン", MaxTermRatio: 1}).Return(&types.Token{Model: gorm.Model{ID: 2}}, nil),
+		db.EXPECT().CreatePostings(uint(1), []*types.Posting{{
+			TokenID:       2,
+			DocumentID:    1,
+			TermFrequency: 1,
+			Positions:     []uint{0},
+			Sentences:     []*types.Sentence{{Index: 0}},
+		}}),
+		db.EXPECT().FlushPostings().Return(nil),
+		// 空でなければ取り込まない
+		db.EXPECT().CountDocument().Return(uint(1), nil),
+		// 途中で失敗したら取り込んだものを戻すので、やり直せる
+		db.EXPECT().CountDocument().Return(uint(0), nil),
+		db.EXPECT().Restore(gomock.Any()).DoAndReturn(restore),
+		db.EXPECT().CreateDcoument(&types.Document{Uri: "uri", Lang: "ja"}).Return(nil, errors.New("error")),
+		db.EXPECT().CountDocument().Return(uint(0), nil),
+		db.EXPECT().Restore(gomock.Any()).Return(&types.SnapshotReport{}, nil),
+		db.EXPECT().FlushPostings().Return(nil),
+	)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	data := testSnapshot(t)
+	report, err := service.Restore(bytes.NewReader(data))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(&types.SnapshotReport{Documents: 1, Tokens: 1, Postings: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+	if _, err := service.Restore(bytes.NewReader(data)); !errors.Is(err, errIndexNotEmpty) {
+		t.Errorf("expected index not empty: %v", err)
+	}
+	// 壊れたスナップショットはインデックスを見る前に断る
+	if _, err := service.Restore(bytes.NewReader(data[:len(data)-10])); !errors.Is(err, errInvalidSnapshot) {
+		t.Errorf("expected invalid snapshot: %v", err)
+	}
+	if _, err := service.Restore(bytes.NewReader(data)); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := service.Restore(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServiceExport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+	gomock.InOrder(
+		db.EXPECT().DocumentsAfterID(uint(0), uint(100)).Return([]*types.Document{
+			{Model: gorm.Model{ID: 3}, Uri: "uri", Time: indexed, Title: "ペン", Lang: "ja"},
+		}, nil),
+		db.EXPECT().SentencesFromDocumentID(uint(3)).Return([]*types.Sentence{
+			{Sentence: "ペン", Field: "title"},
+			{Sentence: "これはペンです。", Field: "body"},
+		}, nil),
+	)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	buf := bytes.Buffer{}
+	count, err := service.Export(&buf)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(uint(1), count); diff != "" {
+		t.Errorf(diff)
+	}
+	if diff := cmp.Diff(
+		`{"uri":"uri","time":"2014-12-31T12:13:24Z","lang":"ja","fields":{"title":"ペン"},"body":"これはペンです。"}`+"\n",
+		buf.String(),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceImport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	sentenceSplitter := mock.NewMockSentenceSplitter(ctrl)
+	analyzer := mock.NewMockAnalyzer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+	gomock.InOrder(
+		sentenceSplitter.EXPECT().Split("ペン").Return([]string{"ペン"}, nil),
+		sentenceSplitter.EXPECT().Split("").Return([]string{}, nil),
+		sentenceSplitter.EXPECT().Split("これはペンです。").Return([]string{"これはペンです。"}, nil),
+		analyzer.EXPECT().Analyze([]string{"ペン", "これはペンです。"}).Return([]string{"ペン", "これはペンです。"}, [][]types.AnalyzedToken{{{Text: "ペン"}}, {{Text: "コレ"}, {Text: "ペン", Position: 1}}}),
+		db.EXPECT().DocumentFromUri("uri").Return(nil, nil),
+		analyzer.EXPECT().Version().Return("v1"),
+		// インデックスした時刻とタイトルを引き継ぐ
+		db.EXPECT().CreateDcoument(&types.Document{
+			Uri:             "uri",
+			Time:            indexed,
+			TokenCount:      3,
+			Title:           "ペン",
+			Lang:            "ja",
+			AnalyzerVersion: "v1",
+		}).Return(&types.Document{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().DeleteSentenceFromDocumentID(uint(1)).Return(nil),
+	)
+	db.EXPECT().CreateSentence(&types.Sentence{DocumentID: 1, Index: 0, Sentence: "ペン", TokenCount: 1, Field: "title"}).Return(&types.Sentence{Model: gorm.Model{ID: 1}}, nil)
+	db.EXPECT().CreateSentence(&types.Sentence{DocumentID: 1, Index: 1, Sentence: "これはペンです。", TokenCount: 2, Field: "body"}).Return(&types.Sentence{Model: gorm.Model{ID: 2}}, nil)
+	db.EXPECT().TokenFromString(gomock.Any()).Return(&types.Token{Model: gorm.Model{ID: 1}, MaxTermRatio: 1}, nil).Times(2)
+	db.EXPECT().CreatePostings(uint(1), gomock.Any())
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": sentenceSplitter},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	report, err := service.Import(strings.NewReader(strings.Join([]string{
+		`{"uri":"uri","time":"2014-12-31T12:13:24Z","lang":"ja","fields":{"title":"ペン"},"body":"これはペンです。"}`,
+		`{"uri":"broken"`,
+		`{"uri":"de","lang":"de","body":"Stift"}`,
+	}, "\n")))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(&types.ImportReport{
+		Documents: 1,
+		// 読めない行と対応していない言語は飛ばす
+		Failures: []types.ImportFailure{
+			{Line: 2, Error: "invalid export: unexpected end of JSON input"},
+			{Line: 3, Uri: "de", Error: "unsupported language: de"},
+		},
+	}, report); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceStats(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	db.EXPECT().CountDocument().Return(uint(1), nil)
+	db.EXPECT().CountToken().Return(uint(2), nil)
+	db.EXPECT().CountPosting().Return(uint(3), nil)
+	db.EXPECT().CountSentence().Return(uint(4), nil)
+	db.EXPECT().TopTerms(uint(5)).Return([]types.TermCount{{Token: "モモ", DocumentCount: 1}}, nil)
+	db.EXPECT().CountStaleDocument("ja", "v2").Return(uint(6), nil)
+	analyzer := mock.NewMockAnalyzer(ctrl)
+	analyzer.EXPECT().Version().Return("v2")
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	stats, err := service.Stats(5)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		&types.Stats{
+			Documents: 1,
+			Tokens:    2,
+			Postings:  3,
+			Sentences: 4,
+			TopTerms:  []types.TermCount{{Token: "モモ", DocumentCount: 1}},
+			// 言語ごとに今のアナライザのバージョンと比べる
+			StaleDocuments: 6,
+		},
+		stats,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceReindex(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tokenizer := mock.NewMockTokenizer(ctrl)
+	db := mock.NewMockDB(ctrl)
+	indexed := time.Date(2014, time.December, 31, 12, 13, 24, 0, time.UTC)
+	document := &types.Document{
+		Model: gorm.Model{
+			ID: 3,
+		},
+		Uri:        "uri",
+		Time:       indexed,
+		TokenCount: 5,
+		Lang:       "ja",
+	}
+	gomock.InOrder(
+		db.EXPECT().DocumentsAfterID(uint(0), uint(100)).Return([]*types.Document{document}, nil),
+		db.EXPECT().SentencesFromDocumentID(uint(3)).Return([]*types.Sentence{
+			{Model: gorm.Model{ID: 7}, DocumentID: 3, Index: 0, Sentence: "ペン", Field: "title"},
+		}, nil),
+		tokenizer.EXPECT().Analyze([]string{"ペン"}).Return(textTerms([][]string{{"ペン"}})),
+		db.EXPECT().DocumentFromUri("uri").Return(document, nil),
+		db.EXPECT().UpdateDocument(gomock.Any()).DoAndReturn(func(document *types.Document) (*types.Document, error) {
+			if document.TokenCount != 1 || !document.Time.Equal(indexed) {
+				t.Errorf("unexpected document: %+v", document)
+			}
+			return document, nil
+		}),
+		db.EXPECT().DeleteSentenceFromDocumentID(uint(3)).Return(nil),
+		db.EXPECT().CreateSentence(&types.Sentence{
+			DocumentID: 3,
+			Index:      0,
+			Sentence:   "ペン",
+			TokenCount: 1,
+			Field:      "title",
+		}).Return(&types.Sentence{Model: gorm.Model{ID: 8}}, nil),
+		db.EXPECT().TokenFromString("ペン").Return(&types.Token{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().UpdateTokenMaxTermRatio(uint(1), float64(1)),
+		db.EXPECT().CreatePostings(gomock.Any(), gomock.Any()),
+	)
+
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{}, []TermFilter{}, []WordFilter{})
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	count, err := service.Reindex()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(uint(1), count); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceFsck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	db.EXPECT().OrphanPostings().Return([]types.OrphanPosting{{TokenID: 1, DocumentID: 2}}, nil)
+	db.EXPECT().DuplicateTokens().Return([]types.DuplicateToken{{Token: "モモ", Count: 2}}, nil)
+	db.EXPECT().TokenCountMismatches().Return([]types.TokenCountMismatch{}, nil)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	report, err := service.Fsck()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		&types.FsckReport{
+			OrphanPostings:       []types.OrphanPosting{{TokenID: 1, DocumentID: 2}},
+			DuplicateTokens:      []types.DuplicateToken{{Token: "モモ", Count: 2}},
+			TokenCountMismatches: []types.TokenCountMismatch{},
+		},
+		report,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceCompact(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	db := mock.NewMockDB(ctrl)
+	db.EXPECT().Compact().Return(&types.CompactReport{Sentences: 3, Tokens: 2}, nil)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": mock.NewMockAnalyzer(ctrl)},
+		db,
+		nil,
+		0,
+	)
+
+	report, err := service.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		&types.CompactReport{Sentences: 3, Tokens: 2},
+		report,
+	); diff != "" {
+		t.Errorf(diff)
+	}
 }
 
 func TestServiceSearch(t *testing.T) {
@@ -156,48 +950,35 @@ func TestServiceSearch(t *testing.T) {
 	wordFilter := mock.NewMockWordFilter(ctrl)
 	db := mock.NewMockDB(ctrl)
 
-	gomock.InOrder(
-		charFilter.EXPECT().Filter([]string{"これ ペン ペンギン"}).Return([]string{"これ ペン ペンギン"}),
-		tokenizer.EXPECT().Analyze([]string{"これ ペン ペンギン"}).Return([][]string{{"コレ", "ペン", "ペンギン"}}),
-		wordFilter.EXPECT().Filter([][]string{{"コレ", "ペン", "ペンギン"}}).Return([][]string{{"コレ", "ペン", "ペンギン"}}),
-		db.EXPECT().CountDocument().Return(uint(100), nil),
-	)
+	analyze := func() {
+		gomock.InOrder(
+			charFilter.EXPECT().Filter([]string{"これ ペン ペンギン"}).Return([]string{"これ ペン ペンギン"}),
+			tokenizer.EXPECT().Analyze([]string{"これ ペン ペンギン"}).Return(textTerms([][]string{{"コレ", "ペン", "ペンギン"}})),
+			wordFilter.EXPECT().Filter([][]string{{"コレ"}, {"ペン"}, {"ペンギン"}}).Return([][]string{{"コレ"}, {"ペン"}, {"ペンギン"}}),
+			db.EXPECT().CountDocument().Return(uint(100), nil),
+		)
+	}
+	analyze()
+	// スコアだけの検索でも同じように一致させる
 	db.EXPECT().TokenFromString("コレ").Return(&types.Token{
 		Model: gorm.Model{
 			ID: 3,
 		},
-	}, nil)
+	}, nil).Times(2)
 	db.EXPECT().TokenFromString("ペン").Return(&types.Token{
 		Model: gorm.Model{
 			ID: 4,
 		},
-	}, nil)
-	db.EXPECT().TokenFromString("ペンギン").Return(nil, gorm.ErrRecordNotFound)
+	}, nil).Times(2)
+	db.EXPECT().TokenFromString("ペンギン").Return(nil, gorm.ErrRecordNotFound).Times(2)
 
-	db.EXPECT().PostingList(uint(3)).Return([]*types.Posting{{
-		TokenID:    3,
-		DocumentID: 5,
-		Sentences: []*types.Sentence{{
-			Model: gorm.Model{
-				ID: 2,
-			},
-		}, {
-			Model: gorm.Model{
-				ID: 2,
-			},
-		}},
-	}}, nil)
-	db.EXPECT().PostingList(uint(4)).Return([]*types.Posting{{
-		TokenID:    4,
-		DocumentID: 5,
-		Sentences: []*types.Sentence{{
-			Model: gorm.Model{
-				ID: 3,
-			},
-		}},
-	}}, nil)
-	db.EXPECT().CountTermInDocument(uint(5)).Return(uint(6), nil)
-	db.EXPECT().SentenceMultiFromID(gomock.Len(2)).Return([]*types.Sentence{
+	db.EXPECT().PostingBlocks(gomock.Len(2)).Return(map[uint][]byte{
+		3: encodePostingBlocks([]postingEntry{{documentID: 5, termFrequency: 2, positions: []uint{0, 2}}}),
+		4: encodePostingBlocks([]postingEntry{{documentID: 5, termFrequency: 1, positions: []uint{3}}}),
+	}, nil).Times(2)
+	db.EXPECT().DocumentLengths([]uint{5}, "").Return(map[uint]uint{5: 6}, nil).Times(2)
+	db.EXPECT().SentenceIDsFromPostings(uint(5), gomock.Len(2)).Return([]uint{2, 3}, nil)
+	db.EXPECT().SentenceMultiFromID([]uint{2, 3}).Return([]*types.Sentence{
 		{
 			Model: gorm.Model{
 				ID: 2,
@@ -224,15 +1005,18 @@ func TestServiceSearch(t *testing.T) {
 		Uri: "test",
 	}, nil)
 
+	analyzer, _ := newAnalyzer(tokenizer, tokenizer, []CharFilter{charFilter}, []TermFilter{}, []WordFilter{wordFilter})
 	service, _ := newService(
-		sentenceSplitter,
-		tokenizer,
-		[]CharFilter{charFilter},
-		[]WordFilter{wordFilter},
+		map[string]SentenceSplitter{"ja": sentenceSplitter},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
 		db,
+		nil,
+		0,
 	)
 
-	result, err := service.Search("これ ペン ペンギン", 0, 10)
+	result, err := service.Search("これ ペン ペンギン", "", false, 0, 10)
 	if err != nil {
 		t.Error(err)
 	}
@@ -240,11 +1024,137 @@ func TestServiceSearch(t *testing.T) {
 	if diff := cmp.Diff(
 		[]types.SearchResult{{
 			Uri:       "test",
-			Score:     0.6520038342380243,
+			Score:     2.30756025842063,
 			Sentences: []string{"これだよ、これ。", "ペンってすごい。"},
 		}},
 		result,
 	); diff != "" {
 		t.Errorf(diff)
 	}
+
+	// 文章とドキュメントは読まない
+	analyze()
+	scores, err := service.SearchScores("これ ペン ペンギン", "", false, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff([]float64{2.30756025842063}, scores); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestServiceSearchLang(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ja := mock.NewMockAnalyzer(ctrl)
+	en := mock.NewMockAnalyzer(ctrl)
+	db := mock.NewMockDB(ctrl)
+
+	gomock.InOrder(
+		en.EXPECT().AnalyzeQuery("pens").Return([]types.Query{{Tokens: []string{"pen"}, Weight: 1}}),
+		db.EXPECT().CountDocument().Return(uint(100), nil),
+		db.EXPECT().TokenFromString("pen").Return(&types.Token{Model: gorm.Model{ID: 1}}, nil),
+		db.EXPECT().PostingBlocks([]uint{1}).Return(map[uint][]byte{
+			1: encodePostingBlocks([]postingEntry{
+				{documentID: 5, termFrequency: 1, positions: []uint{1}},
+				{documentID: 6, termFrequency: 1, positions: []uint{3}},
+			}),
+		}, nil),
+		// 言語が一致しないドキュメントは単語数が返らない
+		db.EXPECT().DocumentLengths([]uint{5, 6}, "en").Return(map[uint]uint{6: 4}, nil),
+		db.EXPECT().SentenceIDsFromPostings(uint(6), []uint{1}).Return([]uint{3}, nil),
+	)
+	db.EXPECT().SentenceMultiFromID([]uint{3}).Return([]*types.Sentence{{Sentence: "I have a pen."}}, nil)
+	db.EXPECT().DocumentFromID(uint(6)).Return(&types.Document{Uri: "en"}, nil)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl), "en": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": ja, "en": en},
+		db,
+		nil,
+		0,
+	)
+
+	result, err := service.Search("pens", "en-US", false, 0, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]types.SearchResult{{
+			Uri:       "en",
+			Score:     0.9829564081810814,
+			Sentences: []string{"I have a pen."},
+		}},
+		result,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := service.Search("pens", "xx", false, 0, 10); !errors.Is(err, errUnsupportedLanguage) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestServiceSearchWeight(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	analyzer := mock.NewMockAnalyzer(ctrl)
+	db := mock.NewMockDB(ctrl)
+
+	analyzer.EXPECT().AnalyzeQuery("京タ").Return([]types.Query{
+		{Tokens: []string{"京", "タ"}, Weight: 1},
+		{Tokens: []string{"ngram:京タ"}, Weight: 0.5},
+	})
+	db.EXPECT().CountDocument().Return(uint(100), nil)
+	db.EXPECT().TokenFromString("京").Return(nil, nil)
+	db.EXPECT().TokenFromString("タ").Return(nil, nil)
+	db.EXPECT().TokenFromString("ngram:京タ").Return(&types.Token{Model: gorm.Model{ID: 2}}, nil)
+	db.EXPECT().PostingBlocks([]uint{2}).Return(map[uint][]byte{
+		2: encodePostingBlocks([]postingEntry{{documentID: 7, termFrequency: 1, positions: []uint{1}}}),
+	}, nil)
+	db.EXPECT().DocumentLengths([]uint{7}, "").Return(map[uint]uint{7: 4}, nil)
+	db.EXPECT().SentenceIDsFromPostings(uint(7), []uint{2}).Return([]uint{3}, nil)
+	db.EXPECT().SentenceMultiFromID([]uint{3}).Return([]*types.Sentence{{Sentence: "東京タワー"}}, nil)
+	db.EXPECT().DocumentFromID(uint(7)).Return(&types.Document{Uri: "tower"}, nil)
+
+	service, _ := newService(
+		map[string]SentenceSplitter{"ja": mock.NewMockSentenceSplitter(ctrl)},
+		mock.NewMockHTMLFilter(ctrl),
+		mock.NewMockLanguageDetector(ctrl),
+		map[string]Analyzer{"ja": analyzer},
+		db,
+		nil,
+		0,
+	)
+
+	// 形態素では一致しないがn-gramで見つかる、スコアは重みの分だけ低くなる
+	result, err := service.Search("京タ", "", false, 0, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]types.SearchResult{{
+			Uri:       "tower",
+			Score:     0.5768900646051575,
+			Sentences: []string{"東京タワー"},
+		}},
+		result,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTokenLength(t *testing.T) {
+	// 同じ語の別の形は1語、除いた語と副フィールドは数えない
+	if diff := cmp.Diff(2, tokenLength([]types.AnalyzedToken{
+		{Text: "橋", Position: 0},
+		{Text: "ハシ", Position: 0},
+		{Text: "渡る", Position: 2},
+		{Text: "ワタル", Position: 2},
+		{Text: "ngram:渡る", Position: 3, Field: "ngram"},
+	})); diff != "" {
+		t.Errorf(diff)
+	}
 }
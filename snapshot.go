@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+// スナップショットの形式
+const (
+	snapshotFormat = "searcher-snapshot"
+	// 読めるのはこのバージョンまで
+	snapshotVersion = 1
+	// 1度に読むドキュメントとトークンの数
+	snapshotBatch = 100
+)
+
+var (
+	errInvalidSnapshot = errors.New("invalid snapshot")
+	errIndexNotEmpty   = errors.New("index is not empty")
+)
+
+// スナップショットは1行1レコードのJSONをgzipで圧縮したもの。
+//
+//	header
+//	document... (ID順、文章を含む)
+//	token と、そのトークンの posting... を交互に
+//	trailer (件数と、ここまでの圧縮前のバイト列のSHA-256)
+//
+// IDは元のインデックスのもので、取り込むときに振り直す
+type snapshotLine struct {
+	Header   *snapshotHeader   `json:"header,omitempty"`
+	Document *snapshotDocument `json:"document,omitempty"`
+	Token    *snapshotToken    `json:"token,omitempty"`
+	Posting  *snapshotPosting  `json:"posting,omitempty"`
+	Trailer  *snapshotTrailer  `json:"trailer,omitempty"`
+}
+
+type snapshotHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type snapshotDocument struct {
+	ID              uint               `json:"id"`
+	Uri             string             `json:"uri"`
+	Time            time.Time          `json:"time"`
+	TokenCount      uint               `json:"token_count"`
+	Title           string             `json:"title,omitempty"`
+	Description     string             `json:"description,omitempty"`
+	ETag            string             `json:"etag,omitempty"`
+	LastModified    string             `json:"last_modified,omitempty"`
+	Lang            string             `json:"lang"`
+	AnalyzerVersion string             `json:"analyzer_version"`
+	Sentences       []snapshotSentence `json:"sentences"`
+}
+
+// 文章はドキュメントの中の順番で並べる
+type snapshotSentence struct {
+	Sentence   string `json:"sentence"`
+	TokenCount uint   `json:"token_count"`
+	Field      string `json:"field"`
+}
+
+type snapshotToken struct {
+	ID           uint    `json:"id"`
+	Token        string  `json:"token"`
+	MaxTermRatio float64 `json:"max_term_ratio"`
+}
+
+type snapshotPosting struct {
+	TokenID       uint   `json:"token_id"`
+	DocumentID    uint   `json:"document_id"`
+	TermFrequency uint   `json:"term_frequency"`
+	Positions     []uint `json:"positions"`
+	// 出現する文章のドキュメントの中での順番
+	Sentences []uint `json:"sentences"`
+}
+
+type snapshotTrailer struct {
+	Documents uint   `json:"documents"`
+	Tokens    uint   `json:"tokens"`
+	Postings  uint   `json:"postings"`
+	SHA256    string `json:"sha256"`
+}
+
+func newSnapshotWriter(w io.Writer) (*snapshotWriter, error) {
+	gz := gzip.NewWriter(w)
+	hash := sha256.New()
+	writer := &snapshotWriter{
+		gz:      gz,
+		hash:    hash,
+		encoder: json.NewEncoder(io.MultiWriter(gz, hash)),
+		report:  &types.SnapshotReport{},
+	}
+	if err := writer.encoder.Encode(&snapshotLine{Header: &snapshotHeader{
+		Format:    snapshotFormat,
+		Version:   snapshotVersion,
+		CreatedAt: time.Now(),
+	}}); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+type snapshotWriter struct {
+	gz      *gzip.Writer
+	hash    hash.Hash
+	encoder *json.Encoder
+	report  *types.SnapshotReport
+}
+
+func (w *snapshotWriter) Document(document *snapshotDocument) error {
+	w.report.Documents++
+	return w.encoder.Encode(&snapshotLine{Document: document})
+}
+
+func (w *snapshotWriter) Token(token *snapshotToken) error {
+	w.report.Tokens++
+	return w.encoder.Encode(&snapshotLine{Token: token})
+}
+
+func (w *snapshotWriter) Posting(posting *snapshotPosting) error {
+	w.report.Postings++
+	return w.encoder.Encode(&snapshotLine{Posting: posting})
+}
+
+// 件数とチェックサムを書いて閉じる。書かれなかったスナップショットは読めない
+func (w *snapshotWriter) Close() (*types.SnapshotReport, error) {
+	line, err := json.Marshal(&snapshotLine{Trailer: &snapshotTrailer{
+		Documents: w.report.Documents,
+		Tokens:    w.report.Tokens,
+		Postings:  w.report.Postings,
+		SHA256:    hex.EncodeToString(w.hash.Sum(nil)),
+	}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.gz.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	if err := w.gz.Close(); err != nil {
+		return nil, err
+	}
+	return w.report, nil
+}
+
+// スナップショットを先頭から読み、最後にチェックサムと件数を確かめる。
+// visitはチェックサムを確かめる前に呼ばれるので、取り込むときは先にvisitなしで読んでおく
+func readSnapshot(r io.Reader, visit func(line *snapshotLine) error) (*types.SnapshotReport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+	}
+	defer gz.Close()
+	reader := bufio.NewReader(gz)
+	hash := sha256.New()
+	report := &types.SnapshotReport{}
+	for first := true; ; first = false {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no trailer", errInvalidSnapshot)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+		}
+		line := &snapshotLine{}
+		if err := json.Unmarshal(data, line); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+		}
+		if first {
+			if line.Header == nil || line.Header.Format != snapshotFormat {
+				return nil, fmt.Errorf("%w: no header", errInvalidSnapshot)
+			}
+			if line.Header.Version > snapshotVersion {
+				return nil, fmt.Errorf("%w: unsupported version %d", errInvalidSnapshot, line.Header.Version)
+			}
+		}
+		if trailer := line.Trailer; trailer != nil {
+			if trailer.SHA256 != hex.EncodeToString(hash.Sum(nil)) {
+				return nil, fmt.Errorf("%w: checksum mismatch", errInvalidSnapshot)
+			}
+			if trailer.Documents != report.Documents || trailer.Tokens != report.Tokens || trailer.Postings != report.Postings {
+				return nil, fmt.Errorf("%w: count mismatch", errInvalidSnapshot)
+			}
+			// gzipの終わりまで読んで、圧縮したデータのチェックサムも確かめる
+			rest, err := reader.Peek(1)
+			if len(rest) > 0 {
+				return nil, fmt.Errorf("%w: data after trailer", errInvalidSnapshot)
+			}
+			if err != io.EOF {
+				return nil, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+			}
+			return report, nil
+		}
+		hash.Write(data)
+		switch {
+		case line.Document != nil:
+			report.Documents++
+		case line.Token != nil:
+			report.Tokens++
+		case line.Posting != nil:
+			report.Postings++
+		}
+		if visit != nil && !first {
+			if err := visit(line); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// 取り込み中に元のIDを今のインデックスのIDに変える
+type snapshotImport struct {
+	documents map[uint]uint
+	// 元のドキュメントIDごとの、作った文章の数
+	sentences map[uint]int
+	tokens    map[uint]uint
+}
+
+func newSnapshotImport() *snapshotImport {
+	return &snapshotImport{
+		documents: map[uint]uint{},
+		sentences: map[uint]int{},
+		tokens:    map[uint]uint{},
+	}
+}
+
+// 文章の順番を今のインデックスの文章にする
+func (i *snapshotImport) postingSentences(posting *snapshotPosting) ([]*types.Sentence, error) {
+	count := i.sentences[posting.DocumentID]
+	sentences := make([]*types.Sentence, len(posting.Sentences))
+	for j, index := range posting.Sentences {
+		if int(index) >= count {
+			return nil, fmt.Errorf("%w: sentence %d of document %d", errInvalidSnapshot, index, posting.DocumentID)
+		}
+		sentences[j] = &types.Sentence{Index: index}
+	}
+	return sentences, nil
+}
+
+// 1行を今のインデックスに登録する
+func (i *snapshotImport) Line(db DB, line *snapshotLine) error {
+	switch {
+	case line.Document != nil:
+		return i.document(db, line.Document)
+	case line.Token != nil:
+		return i.token(db, line.Token)
+	case line.Posting != nil:
+		return i.posting(db, line.Posting)
+	}
+	return nil
+}
+
+func (i *snapshotImport) document(db DB, document *snapshotDocument) error {
+	created, err := db.CreateDcoument(&types.Document{
+		Uri:             document.Uri,
+		Time:            document.Time,
+		TokenCount:      document.TokenCount,
+		Title:           document.Title,
+		Description:     document.Description,
+		ETag:            document.ETag,
+		LastModified:    document.LastModified,
+		Lang:            document.Lang,
+		AnalyzerVersion: document.AnalyzerVersion,
+	})
+	if err != nil {
+		return err
+	}
+	i.documents[document.ID] = created.ID
+	for index, sentence := range document.Sentences {
+		_, err := db.CreateSentence(&types.Sentence{
+			DocumentID: created.ID,
+			Index:      uint(index),
+			Sentence:   sentence.Sentence,
+			TokenCount: sentence.TokenCount,
+			Field:      sentence.Field,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	i.sentences[document.ID] = len(document.Sentences)
+	return nil
+}
+
+// 同じ文字列のトークンがあればそれを使う
+func (i *snapshotImport) token(db DB, token *snapshotToken) error {
+	existing, err := db.TokenFromString(token.Token)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		created, err := db.CreateToken(&types.Token{
+			Token:        token.Token,
+			MaxTermRatio: token.MaxTermRatio,
+		})
+		if err != nil {
+			return err
+		}
+		i.tokens[token.ID] = created.ID
+		return nil
+	}
+	if token.MaxTermRatio > existing.MaxTermRatio {
+		if err := db.UpdateTokenMaxTermRatio(existing.ID, token.MaxTermRatio); err != nil {
+			return err
+		}
+	}
+	i.tokens[token.ID] = existing.ID
+	return nil
+}
+
+func (i *snapshotImport) posting(db DB, posting *snapshotPosting) error {
+	documentID, ok := i.documents[posting.DocumentID]
+	if !ok {
+		return fmt.Errorf("%w: unknown document %d", errInvalidSnapshot, posting.DocumentID)
+	}
+	tokenID, ok := i.tokens[posting.TokenID]
+	if !ok {
+		return fmt.Errorf("%w: unknown token %d", errInvalidSnapshot, posting.TokenID)
+	}
+	sentences, err := i.postingSentences(posting)
+	if err != nil {
+		return err
+	}
+	return db.CreatePostings(documentID, []*types.Posting{{
+		TokenID:       tokenID,
+		DocumentID:    documentID,
+		TermFrequency: posting.TermFrequency,
+		Positions:     posting.Positions,
+		Sentences:     sentences,
+	}})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
+)
+
+func testSnapshot(t *testing.T) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	writer, _ := newSnapshotWriter(&buf)
+	writer.Document(&snapshotDocument{ID: 3, Uri: "uri", Lang: "ja", Sentences: []snapshotSentence{{Sentence: "ペン", TokenCount: 1, Field: "body"}}})
+	writer.Token(&snapshotToken{ID: 7, Token: "ペン", MaxTermRatio: 1})
+	writer.Posting(&snapshotPosting{TokenID: 7, DocumentID: 3, TermFrequency: 1, Positions: []uint{0}, Sentences: []uint{0}})
+	if _, err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// 圧縮前の内容を書き換える
+func rewriteSnapshot(t *testing.T, data []byte, rewrite func([]byte) []byte) []byte {
+	t.Helper()
+	gz, _ := gzip.NewReader(bytes.NewReader(data))
+	raw := bytes.Buffer{}
+	raw.ReadFrom(gz)
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write(rewrite(raw.Bytes()))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestReadSnapshot(t *testing.T) {
+	data := testSnapshot(t)
+	report, err := readSnapshot(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&types.SnapshotReport{Documents: 1, Tokens: 1, Postings: 1}, report); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestReadSnapshotInvalid(t *testing.T) {
+	data := testSnapshot(t)
+	for _, data := range [][]byte{
+		nil,
+		[]byte("not gzip"),
+		// 途中で切れている
+		rewriteSnapshot(t, data, func(raw []byte) []byte {
+			return raw[:bytes.LastIndex(raw[:len(raw)-1], []byte("\n"))+1]
+		}),
+		// 内容が書き換えられている
+		rewriteSnapshot(t, data, func(raw []byte) []byte {
+			return bytes.Replace(raw, []byte(`"uri":"uri"`), []byte(`"uri":"url"`), 1)
+		}),
+		rewriteSnapshot(t, data, func(raw []byte) []byte {
+			return bytes.Replace(raw, []byte(`"version":1`), []byte(`"version":2`), 1)
+		}),
+		rewriteSnapshot(t, data, func(raw []byte) []byte {
+			return append(raw, raw...)
+		}),
+	} {
+		if _, err := readSnapshot(bytes.NewReader(data), nil); !errors.Is(err, errInvalidSnapshot) {
+			t.Errorf("expected invalid snapshot: %v", err)
+		}
+	}
+}
@@ -1,46 +1,432 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/hrntknr/searcher/types"
+	"github.com/ikawaha/kagome-dict/dict"
 	"github.com/ikawaha/kagome-dict/ipa"
 	kagome "github.com/ikawaha/kagome/v2/tokenizer"
 )
 
 type Tokenizer interface {
-	Analyze(text []string) [][]string
+	Analyze(text []string) [][]types.Term
+}
+
+type DictionaryValidator interface {
+	// ユーザー辞書を読み込んで、サンプルの文章を形態素解析した結果を返す
+	ValidateUserDictionary(userDictionary io.Reader, text string) ([]types.DictionaryToken, error)
+}
+
+// トークンの文字列だけを取り出す
+func termTexts(terms [][]types.Term) [][]string {
+	result := make([][]string, len(terms))
+	for i, terms := range terms {
+		result[i] = make([]string, len(terms))
+		for j, term := range terms {
+			result[i][j] = term.Text
+		}
+	}
+	return result
 }
 
-func newTokenizer() (*tokenizerImpl, error) {
-	kagomeTokenizer, err := kagome.New(ipa.Dict(), kagome.OmitBosEos())
+// トークンとして使う形態素の形
+const (
+	// 表層形
+	tokenFormSurface = "surface"
+	// 基本形
+	tokenFormBase = "base"
+	// 読み
+	tokenFormReading = "reading"
+	// 表層形、基本形、読みをすべて登録する
+	tokenFormCombined = "combined"
+)
+
+// システム辞書の名前。それ以外はkagome形式の辞書ファイルのパスとして読み込む
+const dictionaryIPA = "ipa"
+
+// dictionaryが空ならIPA辞書、userDictionaryが空ならユーザー辞書なし
+func newTokenizer(form string, dictionary string, userDictionary string) (*tokenizerImpl, error) {
+	switch form {
+	case tokenFormSurface, tokenFormBase, tokenFormReading, tokenFormCombined:
+	default:
+		return nil, fmt.Errorf("unknown token form: %s", form)
+	}
+
+	systemDict, dictVersion, err := loadSystemDictionary(dictionary)
+	if err != nil {
+		return nil, err
+	}
+	options := []kagome.Option{kagome.OmitBosEos()}
+	userDictVersion := ""
+	if userDictionary != "" {
+		data, err := os.ReadFile(userDictionary)
+		if err != nil {
+			return nil, err
+		}
+		userDict, err := loadUserDictionary(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("user dictionary %s: %w", userDictionary, err)
+		}
+		options = append(options, kagome.UserDict(userDict))
+		userDictVersion = fingerprint(data)
+	}
+
+	kagomeTokenizer, err := kagome.New(systemDict, options...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &tokenizerImpl{
-		kagome: kagomeTokenizer,
+		kagome:  kagomeTokenizer,
+		dict:    systemDict,
+		form:    form,
+		version: strings.Join([]string{form, dictVersion, userDictVersion}, ":"),
 	}, nil
 }
 
+// 辞書と、辞書が変わったことを検出するための識別子
+func loadSystemDictionary(dictionary string) (*dict.Dict, string, error) {
+	if dictionary == "" || dictionary == dictionaryIPA {
+		return ipa.Dict(), dictionaryIPA, nil
+	}
+	data, err := os.ReadFile(dictionary)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, "", fmt.Errorf("dictionary %s: %w", dictionary, err)
+	}
+	systemDict, err := dict.Load(r, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("dictionary %s: %w", dictionary, err)
+	}
+	return systemDict, fingerprint(data), nil
+}
+
+// 1行に「見出し,分割したトークン,読み,品詞」。
+// kagomeは分割したトークンと読みを「/」でつないで返すので、「/」を含むものは登録できない
+func loadUserDictionary(r io.Reader) (*dict.UserDict, error) {
+	records, err := dict.NewUserDicRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		for _, field := range append(append([]string{}, record.Tokens...), record.Yomi...) {
+			if strings.Contains(field, userDictionarySeparator) {
+				return nil, fmt.Errorf("invalid user dictionary entry %s: tokens and readings cannot contain %q", record.Text, userDictionarySeparator)
+			}
+		}
+	}
+	return records.NewUserDict()
+}
+
+// kagomeがユーザー辞書の分割したトークンと読みをつなぐ区切り
+const userDictionarySeparator = "/"
+
+func fingerprint(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))[:16]
+}
+
 type tokenizerImpl struct {
-	kagome *kagome.Tokenizer
+	kagome  *kagome.Tokenizer
+	dict    *dict.Dict
+	form    string
+	query   bool
+	version string
+}
+
+// 検索クエリ用のトークナイザ
+// combinedでは漢字などを含む形態素は表層形だけ、かなだけの形態素は読みだけにする。
+// 漢字で検索すれば同音異義語を区別し、かなで検索すれば読みで一致する
+func (t *tokenizerImpl) ForQuery() *tokenizerImpl {
+	return &tokenizerImpl{
+		kagome:  t.kagome,
+		dict:    t.dict,
+		form:    t.form,
+		query:   true,
+		version: t.version,
+	}
+}
+
+// トークンの形と辞書が変わったらインデックスを作り直す必要がある
+func (t *tokenizerImpl) Version() string {
+	return t.version
 }
 
-func (t *tokenizerImpl) Analyze(text []string) [][]string {
-	result := make([][]string, len(text))
+func (t *tokenizerImpl) Analyze(text []string) [][]types.Term {
+	result := make([][]types.Term, len(text))
 	for i, text := range text {
-		tokens := t.kagome.Analyze(text, kagome.Search)
-		res := []string{}
-		for _, t := range tokens {
-			features := t.Features()
-			if features[1] == "空白" {
+		res := []types.Term{}
+		position := 0
+		for _, m := range morphemes(t.kagome.Analyze(text, kagome.Search)) {
+			if isSpace(m.pos) {
 				continue
 			}
-			kana := t.Surface
-			if len(features) >= 8 {
-				kana = features[7]
+			for _, form := range t.forms(m.surface, m.base, m.reading) {
+				res = append(res, types.Term{
+					Text:     form,
+					Surface:  m.surface,
+					Reading:  m.reading,
+					POS:      m.pos,
+					Start:    m.start,
+					End:      m.end,
+					Position: position,
+				})
 			}
-			res = append(res, kana)
+			position++
 		}
 		result[i] = res
 	}
 	return result
 }
+
+func (t *tokenizerImpl) ValidateUserDictionary(userDictionary io.Reader, text string) ([]types.DictionaryToken, error) {
+	userDict, err := loadUserDictionary(userDictionary)
+	if err != nil {
+		return nil, err
+	}
+	kagomeTokenizer, err := kagome.New(t.dict, kagome.OmitBosEos(), kagome.UserDict(userDict))
+	if err != nil {
+		return nil, err
+	}
+	result := []types.DictionaryToken{}
+	for _, m := range morphemes(kagomeTokenizer.Analyze(text, kagome.Search)) {
+		if isSpace(m.pos) {
+			continue
+		}
+		result = append(result, types.DictionaryToken{
+			Surface:  m.surface,
+			BaseForm: m.base,
+			Reading:  m.reading,
+			POS:      m.pos,
+			User:     m.user,
+		})
+	}
+	return result, nil
+}
+
+type morpheme struct {
+	surface string
+	base    string
+	reading string
+	// 品詞、品詞細分類
+	pos        []string
+	start, end int
+	// ユーザー辞書の単語
+	user bool
+}
+
+// IPA辞書とUniDicで素性の並びが違うので、辞書のメタ情報から基本形と読みを取り出す。
+// ユーザー辞書の単語は登録したトークンに分割する
+func morphemes(tokens []kagome.Token) []morpheme {
+	result := []morpheme{}
+	for _, token := range tokens {
+		if token.Class == kagome.USER {
+			features := token.Features()
+			surfaces := strings.Split(features[1], userDictionarySeparator)
+			readings := strings.Split(features[2], userDictionarySeparator)
+			// 区切りを含むトークンで数が合わなければ、分割せずに見出し全体を1つのトークンにする
+			if len(surfaces) != len(readings) {
+				surfaces = []string{token.Surface}
+				readings = []string{strings.Join(readings, "")}
+			}
+			start := token.Position
+			for i, surface := range surfaces {
+				// 分割したトークンが見出しと一致しなければ位置は見出し全体にする
+				s, e := token.Position, token.Position+len(token.Surface)
+				if strings.HasPrefix(token.Surface[start-token.Position:], surface) {
+					s, e = start, start+len(surface)
+					start = e
+				}
+				result = append(result, morpheme{
+					surface: surface,
+					base:    surface,
+					reading: readings[i],
+					pos:     token.POS(),
+					start:   s,
+					end:     e,
+					user:    true,
+				})
+			}
+			continue
+		}
+
+		pos := []string{}
+		for _, p := range token.POS() {
+			if p == "*" || p == "" {
+				break
+			}
+			pos = append(pos, p)
+		}
+		base, ok := token.BaseForm()
+		if !ok || base == "*" {
+			base = token.Surface
+		}
+		reading, ok := token.Reading()
+		if !ok || reading == "*" {
+			reading = token.Surface
+		}
+		result = append(result, morpheme{
+			surface: token.Surface,
+			base:    base,
+			reading: reading,
+			pos:     pos,
+			start:   token.Position,
+			end:     token.Position + len(token.Surface),
+		})
+	}
+	return result
+}
+
+// IPA辞書は「記号-空白」、UniDicは「空白」
+func isSpace(pos []string) bool {
+	for i := 0; i < 2 && i < len(pos); i++ {
+		if pos[i] == "空白" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tokenizerImpl) forms(surface string, base string, reading string) []string {
+	switch t.form {
+	case tokenFormSurface:
+		return []string{surface}
+	case tokenFormBase:
+		return []string{base}
+	case tokenFormReading:
+		return []string{reading}
+	}
+
+	if t.query {
+		if isKana(surface) {
+			return []string{reading}
+		}
+		return []string{surface}
+	}
+	// かなだけの形は読みと重複するので登録しない
+	forms := []string{}
+	for _, form := range []string{surface, base} {
+		if isKana(form) || form == reading {
+			continue
+		}
+		if len(forms) > 0 && forms[len(forms)-1] == form {
+			continue
+		}
+		forms = append(forms, form)
+	}
+	return append(forms, reading)
+}
+
+func isKana(str string) bool {
+	for _, r := range str {
+		if !unicode.In(r, unicode.Hiragana, unicode.Katakana) && r != 'ー' {
+			return false
+		}
+	}
+	return true
+}
+
+// 文字、数字の連続をトークンとする。分かち書きされた言語用
+func newStandardTokenizer() (*standardTokenizer, error) {
+	return &standardTokenizer{}, nil
+}
+
+type standardTokenizer struct {
+}
+
+func (t *standardTokenizer) Analyze(text []string) [][]types.Term {
+	result := make([][]types.Term, len(text))
+	for i, text := range text {
+		result[i] = []types.Term{}
+		start := -1
+		for j, r := range text + " " {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) {
+				if start < 0 {
+					start = j
+				}
+				continue
+			}
+			if start < 0 {
+				continue
+			}
+			result[i] = append(result[i], types.Term{
+				Text:     text[start:j],
+				Surface:  text[start:j],
+				Reading:  text[start:j],
+				Start:    start,
+				End:      j,
+				Position: len(result[i]),
+			})
+			start = -1
+		}
+	}
+	return result
+}
+
+// 漢字、かな、ハングルの連続を文字n-gramに分ける。形態素解析で拾えない新語などの部分一致に使う
+// n文字に満たない連続はそのままトークンにする
+func newNgramTokenizer(n int) (*ngramTokenizer, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid n-gram size: %d", n)
+	}
+	return &ngramTokenizer{
+		n: n,
+	}, nil
+}
+
+type ngramTokenizer struct {
+	n int
+}
+
+func (t *ngramTokenizer) Version() string {
+	return fmt.Sprintf("%d", t.n)
+}
+
+func (t *ngramTokenizer) Analyze(text []string) [][]types.Term {
+	result := make([][]types.Term, len(text))
+	for i, text := range text {
+		result[i] = []types.Term{}
+		// 連続の各文字のバイト位置
+		run := []int{}
+		for j, r := range text + " " {
+			if isCJK(r) {
+				run = append(run, j)
+				continue
+			}
+			if len(run) == 0 {
+				continue
+			}
+			run = append(run, j)
+			for k := 0; k+t.n < len(run) || k == 0; k++ {
+				end := run[len(run)-1]
+				if k+t.n < len(run) {
+					end = run[k+t.n]
+				}
+				result[i] = append(result[i], types.Term{
+					Text:     text[run[k]:end],
+					Surface:  text[run[k]:end],
+					Reading:  text[run[k]:end],
+					Start:    run[k],
+					End:      end,
+					Position: len(result[i]),
+				})
+			}
+			run = []int{}
+		}
+	}
+	return result
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) || r == 'ー' || r == '々'
+}
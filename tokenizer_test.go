@@ -1,10 +1,15 @@
 package main
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
+	"github.com/ikawaha/kagome-dict/dict"
+	"github.com/ikawaha/kagome-dict/ipa"
+	kagome "github.com/ikawaha/kagome/v2/tokenizer"
 )
 
 func init() {
@@ -13,9 +18,9 @@ func init() {
 }
 
 func TestAnalyze(t *testing.T) {
-	tokenizer, _ := newTokenizer()
+	tokenizer, _ := newTokenizer("reading", "", "")
 
-	actual := tokenizer.Analyze([]string{"すもももももももものうち"})
+	actual := termTexts(tokenizer.Analyze([]string{"すもももももももものうち"}))
 
 	if diff := cmp.Diff(
 		[][]string{{
@@ -34,9 +39,9 @@ func TestAnalyze(t *testing.T) {
 }
 
 func TestAnalyzeWhitespace(t *testing.T) {
-	tokenizer, _ := newTokenizer()
+	tokenizer, _ := newTokenizer("reading", "", "")
 
-	actual := tokenizer.Analyze([]string{" "})
+	actual := termTexts(tokenizer.Analyze([]string{" "}))
 
 	if diff := cmp.Diff(
 		[][]string{{}},
@@ -47,9 +52,9 @@ func TestAnalyzeWhitespace(t *testing.T) {
 }
 
 func TestAnalyzeSymbol(t *testing.T) {
-	tokenizer, _ := newTokenizer()
+	tokenizer, _ := newTokenizer("reading", "", "")
 
-	actual := tokenizer.Analyze([]string{"！？"})
+	actual := termTexts(tokenizer.Analyze([]string{"！？"}))
 
 	if diff := cmp.Diff(
 		[][]string{{
@@ -61,3 +66,189 @@ func TestAnalyzeSymbol(t *testing.T) {
 		t.Errorf(diff)
 	}
 }
+
+func TestTokenizerTerms(t *testing.T) {
+	tokenizer, _ := newTokenizer("combined", "", "")
+
+	if diff := cmp.Diff(
+		[][]types.Term{{
+			{Text: "橋", Surface: "橋", Reading: "ハシ", POS: []string{"名詞", "一般"}, Start: 0, End: 3, Position: 0},
+			{Text: "ハシ", Surface: "橋", Reading: "ハシ", POS: []string{"名詞", "一般"}, Start: 0, End: 3, Position: 0},
+			{Text: "ヲ", Surface: "を", Reading: "ヲ", POS: []string{"助詞", "格助詞", "一般"}, Start: 3, End: 6, Position: 1},
+		}},
+		tokenizer.Analyze([]string{"橋を"}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTokenizerForm(t *testing.T) {
+	for _, c := range []struct {
+		form     string
+		expected [][]string
+		query    [][]string
+	}{
+		{"surface", [][]string{{"橋", "を", "渡っ", "た"}}, [][]string{{"はし"}}},
+		{"base", [][]string{{"橋", "を", "渡る", "た"}}, [][]string{{"はし"}}},
+		{"reading", [][]string{{"ハシ", "ヲ", "ワタッ", "タ"}}, [][]string{{"ハシ"}}},
+		// 同じ位置に複数の形を登録、クエリはかななら読み、漢字なら表層形
+		{"combined", [][]string{{"橋", "ハシ", "ヲ", "渡っ", "渡る", "ワタッ", "タ"}}, [][]string{{"ハシ"}}},
+	} {
+		tokenizer, err := newTokenizer(c.form, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(c.expected, termTexts(tokenizer.Analyze([]string{"橋を渡った"}))); diff != "" {
+			t.Errorf("%s: %s", c.form, diff)
+		}
+		if diff := cmp.Diff(c.query, termTexts(tokenizer.ForQuery().Analyze([]string{"はし"}))); diff != "" {
+			t.Errorf("%s: %s", c.form, diff)
+		}
+	}
+
+	tokenizer, _ := newTokenizer("combined", "", "")
+	if diff := cmp.Diff([][]string{{"箸"}}, termTexts(tokenizer.ForQuery().Analyze([]string{"箸"}))); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newTokenizer("kanji", "", ""); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestTokenizerUserDictionary(t *testing.T) {
+	tokenizer, err := newTokenizer("reading", "ipa", "test/userdict.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ユーザー辞書の単語は登録したトークンに分割する
+	if diff := cmp.Diff(
+		[][]types.Term{{
+			{Text: "トウキョウ", Surface: "東京", Reading: "トウキョウ", POS: []string{"カスタム名詞"}, Start: 0, End: 6, Position: 0},
+			{Text: "スカイツリー", Surface: "スカイツリー", Reading: "スカイツリー", POS: []string{"カスタム名詞"}, Start: 6, End: 24, Position: 1},
+			{Text: "ヘ", Surface: "へ", Reading: "ヘ", POS: []string{"助詞", "格助詞", "一般"}, Start: 24, End: 27, Position: 2},
+		}},
+		tokenizer.Analyze([]string{"東京スカイツリーへ"}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newTokenizer("reading", "ipa", "test/notfound.txt"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := newTokenizer("reading", "test/notfound.dict", ""); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestTokenizerValidateUserDictionary(t *testing.T) {
+	tokenizer, _ := newTokenizer("reading", "", "")
+
+	actual, err := tokenizer.ValidateUserDictionary(strings.NewReader("朝青龍,朝青龍,アサショウリュウ,カスタム人名\n"), "朝青龍が勝つ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(
+		[]types.DictionaryToken{
+			{Surface: "朝青龍", BaseForm: "朝青龍", Reading: "アサショウリュウ", POS: []string{"カスタム人名"}, User: true},
+			{Surface: "が", BaseForm: "が", Reading: "ガ", POS: []string{"助詞", "格助詞", "一般"}},
+			{Surface: "勝つ", BaseForm: "勝つ", Reading: "カツ", POS: []string{"動詞", "自立"}},
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := tokenizer.ValidateUserDictionary(strings.NewReader("朝青龍,アサショウリュウ\n"), "朝青龍"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestTokenizerUserDictionarySeparator(t *testing.T) {
+	entry := "AC/DC,AC/DC,エーシーディーシー,カスタム名詞\n"
+	tokenizer, _ := newTokenizer("reading", "", "")
+	if _, err := tokenizer.ValidateUserDictionary(strings.NewReader(entry), "AC/DCを聴く"); err == nil {
+		t.Errorf("expected error")
+	}
+
+	// kagomeで直接読み込んだ辞書でも、数が合わなければ見出し全体を1つのトークンにする
+	records, _ := dict.NewUserDicRecords(strings.NewReader(entry))
+	userDict, _ := records.NewUserDict()
+	kagomeTokenizer, _ := kagome.New(ipa.Dict(), kagome.OmitBosEos(), kagome.UserDict(userDict))
+	actual := morphemes(kagomeTokenizer.Analyze("AC/DCを", kagome.Search))
+	if diff := cmp.Diff(
+		morpheme{surface: "AC/DC", base: "AC/DC", reading: "エーシーディーシー", pos: []string{"カスタム名詞"}, start: 0, end: 5, user: true},
+		actual[0],
+		cmp.AllowUnexported(morpheme{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTokenizerVersion(t *testing.T) {
+	ipa, _ := newTokenizer("reading", "", "")
+	user, _ := newTokenizer("reading", "", "test/userdict.txt")
+	combined, _ := newTokenizer("combined", "", "")
+
+	if ipa.Version() == user.Version() || ipa.Version() == combined.Version() {
+		t.Errorf("version should change with dictionary and form")
+	}
+	if diff := cmp.Diff(ipa.Version(), ipa.ForQuery().Version()); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestStandardTokenizer(t *testing.T) {
+	tokenizer, _ := newStandardTokenizer()
+
+	actual := termTexts(tokenizer.Analyze([]string{"Die Häuser, 2 große-Straßen.", ""}))
+
+	if diff := cmp.Diff(
+		[][]string{{"Die", "Häuser", "2", "große", "Straßen"}, {}},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if diff := cmp.Diff(
+		[][]types.Term{{
+			{Text: "Die", Surface: "Die", Reading: "Die", Start: 0, End: 3, Position: 0},
+			{Text: "Häuser", Surface: "Häuser", Reading: "Häuser", Start: 4, End: 11, Position: 1},
+		}},
+		tokenizer.Analyze([]string{"Die Häuser"}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestNgramTokenizer(t *testing.T) {
+	tokenizer, _ := newNgramTokenizer(2)
+
+	actual := termTexts(tokenizer.Analyze([]string{"東京タワー", "Go言語と愛", "abc"}))
+
+	if diff := cmp.Diff(
+		[][]string{
+			{"東京", "京タ", "タワ", "ワー"},
+			// 漢字などの連続ごとに分け、n文字に満たなければそのまま
+			{"言語", "語と", "と愛"},
+			{},
+		},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if diff := cmp.Diff(
+		[][]types.Term{{
+			{Text: "猫", Surface: "猫", Reading: "猫", Start: 3, End: 6, Position: 0},
+		}},
+		tokenizer.Analyze([]string{"a, 猫"}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newNgramTokenizer(0); err == nil {
+		t.Errorf("expected error")
+	}
+}
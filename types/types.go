@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,9 +9,24 @@ import (
 
 type Document struct {
 	gorm.Model
-	Uri        string
-	Time       time.Time
-	TokenCount uint
+	Uri          string
+	Time         time.Time
+	TokenCount   uint
+	Title        string
+	Description  string
+	ETag         string `gorm:"column:etag"`
+	LastModified string
+	Lang         string
+	// インデックスしたときのアナライザ。変わっていれば再インデックスが必要
+	AnalyzerVersion string
+}
+
+// 登録時に元のページから引き継ぐ情報
+type DocumentMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	// 空なら本文から推定する
+	Lang string `json:"lang"`
 }
 
 type Sentence struct {
@@ -19,23 +35,204 @@ type Sentence struct {
 	Index      uint
 	Sentence   string
 	TokenCount uint
-	Postings   []*Posting `gorm:"many2many:posting_sentences"`
+	Field      string
 }
 
+// ドキュメントごとのトークンの出現。行にはせず、圧縮したポスティングリストにだけ保存する
 type Posting struct {
-	gorm.Model
 	TokenID    uint
 	DocumentID uint
-	Sentences  []*Sentence `gorm:"many2many:posting_sentences"`
+	// ドキュメントの中での出現回数
+	TermFrequency uint
+	// ドキュメントの中での位置
+	Positions []uint
+	// トークンが出現する文章
+	Sentences []*Sentence
+}
+
+// トークンごとに圧縮したポスティングリスト
+type PostingBlock struct {
+	TokenID   uint `gorm:"primaryKey;autoIncrement:false"`
+	Data      []byte
+	UpdatedAt time.Time
+}
+
+// ドキュメントにポスティングがあるトークン。登録し直すときや削除するときに、圧縮したポスティングリストから取り除く
+type DocumentTokens struct {
+	DocumentID uint `gorm:"primaryKey;autoIncrement:false"`
+	// トークンID順の差分を可変長整数にしたもの
+	Data []byte
 }
 
 type Token struct {
 	gorm.Model
 	Token string
+	// 出現回数をドキュメントの単語数で割った値の最大、スコアの上限に使う
+	MaxTermRatio float64
 }
 
 type SearchResult struct {
 	Uri       string
 	Score     float64
 	Sentences []string
+	// 複数のインデックスをまとめて検索したときの、結果のインデックス
+	Index string `json:",omitempty"`
+}
+
+type HTMLDocument struct {
+	// <html lang>
+	Lang        string
+	Title       string
+	Description string
+	Headings    []string
+	Blocks      []string
+}
+
+type TermCount struct {
+	Token         string
+	DocumentCount uint
+}
+
+type Stats struct {
+	Documents uint
+	Tokens    uint
+	Postings  uint
+	Sentences uint
+	TopTerms  []TermCount
+	// 今のアナライザと違う設定でインデックスされたドキュメント
+	StaleDocuments uint
+}
+
+type DuplicateToken struct {
+	Token string
+	Count uint
+}
+
+type TokenCountMismatch struct {
+	DocumentID         uint
+	Uri                string
+	TokenCount         uint
+	SentenceTokenCount uint
+}
+
+// ドキュメントが存在しない、または出現する文章がないポスティング
+type OrphanPosting struct {
+	TokenID    uint
+	DocumentID uint
+}
+
+type FsckReport struct {
+	OrphanPostings       []OrphanPosting
+	DuplicateTokens      []DuplicateToken
+	TokenCountMismatches []TokenCountMismatch
+}
+
+// コンパクションで物理削除した行数
+type CompactReport struct {
+	Documents uint
+	Sentences uint
+	// 圧縮したポスティングリストから取り除いた、ドキュメントが存在しないポスティング
+	Postings uint
+	Tokens   uint
+}
+
+// セグメントのマージの結果
+type MergeReport struct {
+	// メモリからセグメントに書き出したポスティング数
+	FlushedPostings uint
+	// まとめたセグメントの数
+	MergedSegments uint
+	// 残ったセグメントの数
+	Segments uint
+}
+
+// スナップショットに書いた、または取り込んだ件数
+type SnapshotReport struct {
+	Documents uint
+	Tokens    uint
+	Postings  uint
+}
+
+// エクスポートから登録した結果
+type ImportReport struct {
+	Documents uint
+	// 登録できなかった行
+	Failures []ImportFailure
+}
+
+type ImportFailure struct {
+	// 1から数えた行番号
+	Line  uint
+	Uri   string
+	Error string
+}
+
+// 名前付きインデックスの定義
+type Index struct {
+	gorm.Model
+	Name string
+	// アナライザと保存先の設定のJSON
+	Config string
+}
+
+// 名前付きインデックスの一覧に返す情報
+type IndexInfo struct {
+	Name string
+	// defaultならゼロ値
+	CreatedAt time.Time
+	Config    json.RawMessage
+}
+
+// 起動時にログから再実行した操作の数
+type RecoveryReport struct {
+	// 終わっていた操作
+	Replayed uint
+	// 途中で止まっていて、最後まで実行した操作
+	RolledForward uint
+	// 途中で止まっていて、実行できずに取り消した登録
+	RolledBack uint
+}
+
+// トークナイザが返すトークン
+type Term struct {
+	// インデックスに使う文字列
+	Text    string
+	Surface string
+	Reading string
+	// 品詞、細分類まで。わからなければ空
+	POS []string
+	// 文章中のバイト位置
+	Start int
+	End   int
+	// 文章中で何番目の語か、同じ語の別の形は同じ値になる
+	Position int
+}
+
+// アナライザが返すインデックス用のトークン
+type AnalyzedToken struct {
+	Text string
+	// 文章中で何番目の語か。Term.Positionを引き継ぎ、同じ語の別の形は同じ値になる
+	Position int
+	// 副フィールドの名前、本来のトークンなら空。副フィールドの位置は副フィールドの中で数える
+	Field string
+}
+
+// 検索クエリのトークン列。すべてのトークンを含むドキュメントにWeightを掛けたスコアを付ける
+type Query struct {
+	Tokens []string
+	// トークンごとの副フィールドの名前、本来のトークンなら空。nilならすべて本来のトークン
+	Fields []string
+	Weight float64
+	// trueならいずれかのトークンを含むドキュメントも一致し、含むトークンのスコアの和を付ける
+	Any bool
+}
+
+// ユーザー辞書の検証結果
+type DictionaryToken struct {
+	Surface  string
+	BaseForm string
+	Reading  string
+	POS      []string
+	// ユーザー辞書の単語ならtrue
+	User bool
 }
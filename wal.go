@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/hrntknr/searcher/types"
+)
+
+// ログに書く操作
+const (
+	walRegist = "regist"
+	walDelete = "delete"
+	// Seqの操作が最後まで終わった
+	walCommit = "commit"
+	// ここより前に終わった操作は保存先に書き出し済み
+	walCheckpoint = "checkpoint"
+)
+
+// 長さとCRC32のヘッダ
+const walHeaderSize = 8
+
+type walRecord struct {
+	Seq uint64 `json:"seq"`
+	Op  string `json:"op"`
+	Uri string `json:"uri,omitempty"`
+	// 登録するドキュメントと、分割した文章とフィールド
+	Document  *types.Document `json:"document,omitempty"`
+	Sentences []string        `json:"sentences,omitempty"`
+	Fields    []string        `json:"fields,omitempty"`
+}
+
+// ログの操作と、最後まで終わったか
+type walEntry struct {
+	record    *walRecord
+	committed bool
+	// チェックポイントより前に終わっていて、実行し直さなくてよい。
+	// 後の操作を取り消すときの前の版として残している
+	checkpointed bool
+}
+
+// 登録と削除を始める前に操作の内容を書き、終わったらcommitを書く。
+// 起動時にログを再実行して、途中で止まった操作を最後まで終わらせる
+func newWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &writeAheadLog{path: path, file: file, active: map[uint64]struct{}{}}
+	frames, size, err := w.read()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// 書きかけで終わったレコードは捨てる
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	for _, frame := range frames {
+		if frame.record.Seq >= w.nextSeq {
+			w.nextSeq = frame.record.Seq + 1
+		}
+	}
+	w.size = size
+	return w, nil
+}
+
+type writeAheadLog struct {
+	path    string
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	nextSeq uint64
+	// 実行中の操作
+	active map[uint64]struct{}
+}
+
+// ログの1レコードと、書かれているバイト列
+type walFrame struct {
+	record *walRecord
+	data   []byte
+}
+
+// 先頭から壊れていないところまでのレコードと、そのバイト数
+func (w *writeAheadLog) read() ([]walFrame, int64, error) {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	frames := []walFrame{}
+	offset := 0
+	for len(data)-offset >= walHeaderSize {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		checksum := binary.BigEndian.Uint32(data[offset+4:])
+		if len(data)-offset-walHeaderSize < length {
+			break
+		}
+		payload := data[offset+walHeaderSize : offset+walHeaderSize+length]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		record := &walRecord{}
+		if err := json.Unmarshal(payload, record); err != nil {
+			break
+		}
+		frames = append(frames, walFrame{record: record, data: data[offset : offset+walHeaderSize+length]})
+		offset += walHeaderSize + length
+	}
+	return frames, int64(offset), nil
+}
+
+func encodeWALRecord(record *walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(payload))
+	return append(data, payload...), nil
+}
+
+func (w *writeAheadLog) append(record *walRecord, sync bool) error {
+	data, err := encodeWALRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	if sync {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// 操作を始める前に書く。ディスクに書けてから返る。nilなら何もしない
+func (w *writeAheadLog) Begin(record *walRecord) (uint64, error) {
+	if w == nil {
+		return 0, nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	record.Seq = w.nextSeq
+	w.nextSeq++
+	if err := w.append(record, true); err != nil {
+		return 0, err
+	}
+	w.active[record.Seq] = struct{}{}
+	return record.Seq, nil
+}
+
+// 操作が終わったら書く。失われても再実行するだけなので同期しない。nilなら何もしない
+func (w *writeAheadLog) Commit(seq uint64) error {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.active, seq)
+	return w.append(&walRecord{Seq: seq, Op: walCommit}, false)
+}
+
+// 操作が途中で失敗したら呼ぶ。ログには残り、起動時に最後まで実行し直す。nilなら何もしない
+func (w *writeAheadLog) Abort(seq uint64) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.active, seq)
+}
+
+// ログに残っている操作を書いた順に返す
+func (w *writeAheadLog) Entries() ([]walEntry, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	frames, _, err := w.read()
+	if err != nil {
+		return nil, err
+	}
+	return walEntries(frames), nil
+}
+
+func walEntries(frames []walFrame) []walEntry {
+	checkpoint := -1
+	for i, frame := range frames {
+		if frame.record.Op == walCheckpoint {
+			checkpoint = i
+		}
+	}
+	committed := map[uint64]bool{}
+	checkpointed := map[uint64]bool{}
+	for i, frame := range frames {
+		if frame.record.Op == walCommit {
+			committed[frame.record.Seq] = true
+			checkpointed[frame.record.Seq] = i < checkpoint
+		}
+	}
+	entries := []walEntry{}
+	for _, frame := range frames {
+		if frame.record.Op != walCommit && frame.record.Op != walCheckpoint {
+			entries = append(entries, walEntry{
+				record:       frame.record,
+				committed:    committed[frame.record.Seq],
+				checkpointed: checkpointed[frame.record.Seq],
+			})
+		}
+	}
+	return entries
+}
+
+// ここまでに書いたログのバイト数。チェックポイントの位置に使う
+func (w *writeAheadLog) Offset() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.size
+}
+
+// offsetまでに終わった操作をログから消し、その位置にチェックポイントを書く。
+// その内容は保存先に書き出し済みでなければならない。
+// 失敗した操作も、同じURIに後から終わった操作があれば要らない。
+// 終わっていない操作があるURIは、取り消すときのために前に終わった操作を残す
+func (w *writeAheadLog) Checkpoint(offset int64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	frames, _, err := w.read()
+	if err != nil {
+		return err
+	}
+	// offsetまでに書かれたレコード
+	checkpointed := 0
+	for position := int64(0); checkpointed < len(frames); checkpointed++ {
+		position += int64(len(frames[checkpointed].data))
+		if position > offset {
+			break
+		}
+	}
+	latest := map[string]uint64{}
+	done := map[uint64]bool{}
+	for _, entry := range walEntries(frames[:checkpointed]) {
+		if entry.committed {
+			done[entry.record.Seq] = true
+			latest[entry.record.Uri] = entry.record.Seq
+		}
+	}
+	// 最後に終わった操作より後に、終わっていない操作が残るURI
+	pending := map[string]bool{}
+	for _, entry := range walEntries(frames) {
+		if seq, ok := latest[entry.record.Uri]; ok && !done[entry.record.Seq] && entry.record.Seq > seq {
+			pending[entry.record.Uri] = true
+		}
+	}
+	previous := map[uint64]bool{}
+	for uri, seq := range latest {
+		if pending[uri] {
+			previous[seq] = true
+		}
+	}
+
+	marker, err := encodeWALRecord(&walRecord{Op: walCheckpoint})
+	if err != nil {
+		return err
+	}
+	current := []byte{}
+	kept := []byte{}
+	for i := 0; i <= len(frames); i++ {
+		if i == checkpointed && len(previous) > 0 {
+			kept = append(kept, marker...)
+		}
+		if i == len(frames) {
+			break
+		}
+		frame := frames[i]
+		current = append(current, frame.data...)
+		if i < checkpointed {
+			if frame.record.Op == walCheckpoint {
+				continue
+			}
+			if done[frame.record.Seq] && !previous[frame.record.Seq] {
+				continue
+			}
+			_, active := w.active[frame.record.Seq]
+			if seq, ok := latest[frame.record.Uri]; ok && !active && frame.record.Op != walCommit && seq > frame.record.Seq {
+				continue
+			}
+		}
+		kept = append(kept, frame.data...)
+	}
+	if bytes.Equal(kept, current) {
+		return nil
+	}
+	if err := writeFileAtomic(w.path, kept); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(kept))
+	return nil
+}
+
+func (w *writeAheadLog) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.file.Close()
+}
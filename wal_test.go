@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	wal, _ := newWriteAheadLog(path)
+	seq, err := wal.Begin(&walRecord{Op: walRegist, Uri: "a", Sentences: []string{"ペン"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Commit(seq)
+	wal.Begin(&walRecord{Op: walDelete, Uri: "b"})
+	wal.Close()
+
+	// 書きかけのレコードは捨てる
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, 0, 100, 1, 2})
+	file.Close()
+
+	wal, err = newWriteAheadLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := wal.Entries()
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(
+		[]walEntry{
+			{record: &walRecord{Seq: 0, Op: walRegist, Uri: "a", Sentences: []string{"ペン"}}, committed: true},
+			{record: &walRecord{Seq: 1, Op: walDelete, Uri: "b"}},
+		},
+		entries,
+		cmp.AllowUnexported(walEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// 続きから書く
+	seq, _ = wal.Begin(&walRecord{Op: walDelete, Uri: "c"})
+	if diff := cmp.Diff(uint64(2), seq); diff != "" {
+		t.Errorf(diff)
+	}
+	info, _ := os.Stat(path)
+	if diff := cmp.Diff(info.Size(), wal.Offset()); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestWriteAheadLogCheckpoint(t *testing.T) {
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	failed, _ := wal.Begin(&walRecord{Op: walRegist, Uri: "a"})
+	wal.Abort(failed)
+	running, _ := wal.Begin(&walRecord{Op: walRegist, Uri: "b"})
+	seq, _ := wal.Begin(&walRecord{Op: walRegist, Uri: "a"})
+	wal.Commit(seq)
+	seq, _ = wal.Begin(&walRecord{Op: walRegist, Uri: "b"})
+	wal.Commit(seq)
+	offset := wal.Offset()
+	// チェックポイントの位置より後に終わった操作は残す
+	seq, _ = wal.Begin(&walRecord{Op: walDelete, Uri: "c"})
+	wal.Commit(seq)
+
+	if err := wal.Checkpoint(offset); err != nil {
+		t.Error(err)
+	}
+	// 失敗した操作は後から終わった操作で要らなくなるが、実行中の操作は残す
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff(
+		[]walEntry{
+			{record: &walRecord{Seq: running, Op: walRegist, Uri: "b"}},
+			{record: &walRecord{Seq: seq, Op: walDelete, Uri: "c"}, committed: true},
+		},
+		entries,
+		cmp.AllowUnexported(walEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// チェックポイントのあとも追記できる
+	wal.Commit(running)
+	if err := wal.Checkpoint(wal.Offset()); err != nil {
+		t.Error(err)
+	}
+	if entries, _ := wal.Entries(); len(entries) != 0 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestWriteAheadLogCheckpointPrevious(t *testing.T) {
+	wal, _ := newWriteAheadLog(filepath.Join(t.TempDir(), "wal.log"))
+	previous, _ := wal.Begin(&walRecord{Op: walRegist, Uri: "a"})
+	wal.Commit(previous)
+	failed, _ := wal.Begin(&walRecord{Op: walRegist, Uri: "a"})
+	wal.Abort(failed)
+	seq, _ := wal.Begin(&walRecord{Op: walDelete, Uri: "b"})
+	wal.Commit(seq)
+
+	if err := wal.Checkpoint(wal.Offset()); err != nil {
+		t.Error(err)
+	}
+	// 失敗した操作を取り消すときのために前に終わった操作を残すが、実行し直さない
+	entries, _ := wal.Entries()
+	if diff := cmp.Diff(
+		[]walEntry{
+			{record: &walRecord{Seq: previous, Op: walRegist, Uri: "a"}, committed: true, checkpointed: true},
+			{record: &walRecord{Seq: failed, Op: walRegist, Uri: "a"}},
+		},
+		entries,
+		cmp.AllowUnexported(walEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	// チェックポイントより後に終わった操作は実行し直す
+	seq, _ = wal.Begin(&walRecord{Op: walRegist, Uri: "a"})
+	wal.Commit(seq)
+	entries, _ = wal.Entries()
+	if diff := cmp.Diff(
+		[]walEntry{
+			{record: &walRecord{Seq: previous, Op: walRegist, Uri: "a"}, committed: true, checkpointed: true},
+			{record: &walRecord{Seq: failed, Op: walRegist, Uri: "a"}},
+			{record: &walRecord{Seq: seq, Op: walRegist, Uri: "a"}, committed: true},
+		},
+		entries,
+		cmp.AllowUnexported(walEntry{}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+	if err := wal.Checkpoint(wal.Offset()); err != nil {
+		t.Error(err)
+	}
+	if entries, _ := wal.Entries(); len(entries) != 0 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
@@ -1,15 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
 
+	"github.com/hrntknr/searcher/types"
 	"github.com/kljensen/snowball/english"
+	"github.com/kljensen/snowball/french"
+	"github.com/kljensen/snowball/norwegian"
+	"github.com/kljensen/snowball/russian"
+	"github.com/kljensen/snowball/spanish"
+	"github.com/kljensen/snowball/swedish"
 )
 
+// トークンごとに働き、1つのトークンから0個以上のトークンを作る。
+// アナライザは語ごとに1行にして渡し、作ったトークンに元の語の位置を付ける
 type WordFilter interface {
 	Filter([][]string) [][]string
 }
 
+// 品詞などトークナイザが付けた情報を使うフィルタ。WordFilterより先に適用する
+type TermFilter interface {
+	FilterTerms([][]types.Term) [][]types.Term
+}
+
 func newLowercaseFilter() (*lowercaseFilter, error) {
 	return &lowercaseFilter{}, nil
 }
@@ -38,10 +56,78 @@ func newStopWordFilter(stopWords []string) (*stopWordFilter, error) {
 	return filter, nil
 }
 
+// 小文字化、言語ごとのストップワード、ステミングの順に適用する。日本語はステミングしない
+func newLanguageWordFilters(lang string, config analyzerConfig, lowercaseFilter WordFilter) ([]WordFilter, error) {
+	var r io.Reader
+	if config.StopWords != "" {
+		f, err := os.Open(config.StopWords)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		f, err := stopWordsFS.Open("data/stopwords/" + lang + ".txt")
+		if err != nil {
+			return nil, fmt.Errorf("no stop words for %s: %w", lang, err)
+		}
+		defer f.Close()
+		r = f
+	}
+	stopWords, err := loadStopWords(r)
+	if err != nil {
+		return nil, err
+	}
+	stopWordFilter, err := newStopWordFilter(stopWords)
+	if err != nil {
+		return nil, err
+	}
+	filters := []WordFilter{lowercaseFilter, stopWordFilter}
+
+	stemmer := config.Stemmer
+	if stemmer == "" && lang != "ja" {
+		stemmer = lang
+	}
+	if stemmer == "" || stemmer == "none" {
+		return filters, nil
+	}
+	stemmerFilter, err := newStemmerFilter(stemmer)
+	if err != nil {
+		return nil, err
+	}
+	return append(filters, stemmerFilter), nil
+}
+
+// 1行1語、空行と#で始まる行は無視する
+func loadStopWords(r io.Reader) ([]string, error) {
+	words := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return words, nil
+}
+
 type stopWordFilter struct {
 	stopWords map[string]struct{}
 }
 
+func (f *stopWordFilter) Version() string {
+	words := make([]string, 0, len(f.stopWords))
+	for word := range f.stopWords {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return fingerprint([]byte(strings.Join(words, "\n")))
+}
+
 func (f *stopWordFilter) Filter(tokens [][]string) [][]string {
 	newTokens := make([][]string, len(tokens))
 	for i, token := range tokens {
@@ -56,11 +142,40 @@ func (f *stopWordFilter) Filter(tokens [][]string) [][]string {
 	return newTokens
 }
 
-func newStemmerFilter() (*stemmerFilter, error) {
-	return &stemmerFilter{}, nil
+// languageは言語コード
+func newStemmerFilter(language string) (*stemmerFilter, error) {
+	var stem func(string) string
+	switch language {
+	case "en":
+		stem = func(word string) string { return english.Stem(word, false) }
+	case "fr":
+		stem = func(word string) string { return french.Stem(word, false) }
+	case "es":
+		stem = func(word string) string { return spanish.Stem(word, false) }
+	case "ru":
+		stem = func(word string) string { return russian.Stem(word, false) }
+	case "sv":
+		stem = func(word string) string { return swedish.Stem(word, false) }
+	case "no":
+		stem = func(word string) string { return norwegian.Stem(word, false) }
+	case "de":
+		stem = stemGerman
+	default:
+		return nil, fmt.Errorf("stemmer: unsupported language: %s", language)
+	}
+	return &stemmerFilter{
+		language: language,
+		stem:     stem,
+	}, nil
 }
 
 type stemmerFilter struct {
+	language string
+	stem     func(string) string
+}
+
+func (f *stemmerFilter) Version() string {
+	return f.language
 }
 
 func (f *stemmerFilter) Filter(tokens [][]string) [][]string {
@@ -68,9 +183,103 @@ func (f *stemmerFilter) Filter(tokens [][]string) [][]string {
 	for i, token := range tokens {
 		newTokens[i] = make([]string, len(tokens[i]))
 		for j, token := range token {
-			stemmed := english.Stem(token, false)
+			stemmed := f.stem(token)
 			newTokens[i][j] = stemmed
 		}
 	}
 	return newTokens
 }
+
+// トークンの先頭からmin〜max文字を取り出す。入力途中のクエリを前方一致させる副フィールド用
+func newEdgeNgramFilter(min int, max int) (*edgeNgramFilter, error) {
+	if min < 1 || max < min {
+		return nil, fmt.Errorf("invalid edge n-gram range: %d-%d", min, max)
+	}
+	return &edgeNgramFilter{
+		min: min,
+		max: max,
+	}, nil
+}
+
+type edgeNgramFilter struct {
+	min int
+	max int
+}
+
+func (f *edgeNgramFilter) Version() string {
+	return fmt.Sprintf("%d-%d", f.min, f.max)
+}
+
+func (f *edgeNgramFilter) Filter(tokens [][]string) [][]string {
+	newTokens := make([][]string, len(tokens))
+	for i, token := range tokens {
+		newTokens[i] = []string{}
+		for _, token := range token {
+			runes := []rune(token)
+			for n := f.min; n <= f.max && n <= len(runes); n++ {
+				newTokens[i] = append(newTokens[i], string(runes[:n]))
+			}
+		}
+	}
+	return newTokens
+}
+
+// 品詞が「名詞-数」のように細分類まで前方一致すれば対象とする
+// includeが空ならすべての品詞を残し、excludeに一致するものを除く。品詞のないトークンは常に残す
+func newPOSFilter(include []string, exclude []string) (*posFilter, error) {
+	filter := &posFilter{}
+	for _, tag := range include {
+		filter.include = append(filter.include, strings.Split(tag, "-"))
+	}
+	for _, tag := range exclude {
+		filter.exclude = append(filter.exclude, strings.Split(tag, "-"))
+	}
+	return filter, nil
+}
+
+type posFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+func (f *posFilter) Version() string {
+	return fmt.Sprintf("%v/%v", f.include, f.exclude)
+}
+
+func (f *posFilter) FilterTerms(terms [][]types.Term) [][]types.Term {
+	newTerms := make([][]types.Term, len(terms))
+	for i, terms := range terms {
+		newTerms[i] = []types.Term{}
+		for _, term := range terms {
+			if len(term.POS) > 0 {
+				if len(f.include) > 0 && !matchPOS(f.include, term.POS) {
+					continue
+				}
+				if matchPOS(f.exclude, term.POS) {
+					continue
+				}
+			}
+			newTerms[i] = append(newTerms[i], term)
+		}
+	}
+	return newTerms
+}
+
+func matchPOS(tags [][]string, pos []string) bool {
+	for _, tag := range tags {
+		if len(tag) > len(pos) {
+			continue
+		}
+		matched := true
+		for i := range tag {
+			if tag[i] != pos[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/hrntknr/searcher/types"
 )
 
 func TestLowercaseFilter(t *testing.T) {
@@ -33,7 +34,7 @@ func TestStopWordFilter(t *testing.T) {
 }
 
 func TestStemmerFilter(t *testing.T) {
-	filter, _ := newStemmerFilter()
+	filter, _ := newStemmerFilter("en")
 	actual := filter.Filter([][]string{{"it", "was", "raining"}})
 
 	diff := cmp.Diff(
@@ -44,3 +45,96 @@ func TestStemmerFilter(t *testing.T) {
 		t.Errorf(diff)
 	}
 }
+
+func TestStemmerFilterLanguage(t *testing.T) {
+	filter, _ := newStemmerFilter("fr")
+	actual := filter.Filter([][]string{{"continuellement"}})
+
+	if diff := cmp.Diff(
+		[][]string{{"continuel"}},
+		actual,
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newStemmerFilter("xx"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestPOSFilter(t *testing.T) {
+	filter, _ := newPOSFilter([]string{"名詞", "助詞-係助詞"}, []string{"名詞-数"})
+	actual := filter.FilterTerms([][]types.Term{{
+		{Text: "コレ", POS: []string{"名詞", "代名詞", "一般"}},
+		{Text: "ハ", POS: []string{"助詞", "係助詞"}},
+		{Text: "ヲ", POS: []string{"助詞", "格助詞", "一般"}},
+		{Text: "2", POS: []string{"名詞", "数"}},
+		{Text: "pen"},
+	}})
+
+	if diff := cmp.Diff(
+		[][]string{{"コレ", "ハ", "pen"}},
+		termTexts(actual),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestEdgeNgramFilter(t *testing.T) {
+	filter, _ := newEdgeNgramFilter(2, 3)
+
+	if diff := cmp.Diff(
+		[][]string{{"タワ", "タワー", "ab", "abc"}, {}},
+		filter.Filter([][]string{{"タワー", "a", "abcd"}, {}}),
+	); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := newEdgeNgramFilter(3, 2); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestLanguageWordFilters(t *testing.T) {
+	lowercaseFilter, _ := newLowercaseFilter()
+	apply := func(filters []WordFilter, tokens [][]string) [][]string {
+		for _, f := range filters {
+			tokens = f.Filter(tokens)
+		}
+		return tokens
+	}
+
+	for _, c := range []struct {
+		lang     string
+		config   analyzerConfig
+		tokens   [][]string
+		expected [][]string
+	}{
+		{"en", analyzerConfig{}, [][]string{{"The", "Running", "dogs"}}, [][]string{{"run", "dog"}}},
+		{"de", analyzerConfig{}, [][]string{{"Die", "Häuser", "und"}}, [][]string{{"haus"}}},
+		// 日本語はステミングしない
+		{"ja", analyzerConfig{}, [][]string{{"コレ", "ハシ"}}, [][]string{{"ハシ"}}},
+		// 表層形と基本形でも除く
+		{"ja", analyzerConfig{}, [][]string{{"これ", "は", "橋", "です", "事", "する"}}, [][]string{{"は", "橋"}}},
+		{"en", analyzerConfig{Stemmer: "none", StopWords: "test/stopwords.txt"}, [][]string{{"The", "Running", "dogs"}}, [][]string{{"the", "running"}}},
+		{"sv", analyzerConfig{Stemmer: "en"}, [][]string{{"och", "running"}}, [][]string{{"run"}}},
+	} {
+		filters, err := newLanguageWordFilters(c.lang, c.config, lowercaseFilter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(c.expected, apply(filters, c.tokens)); diff != "" {
+			t.Errorf("%s: %s", c.lang, diff)
+		}
+	}
+
+	if _, err := newLanguageWordFilters("xx", analyzerConfig{}, lowercaseFilter); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := newLanguageWordFilters("en", analyzerConfig{Stemmer: "xx"}, lowercaseFilter); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := newLanguageWordFilters("en", analyzerConfig{StopWords: "test/notfound.txt"}, lowercaseFilter); err == nil {
+		t.Errorf("expected error")
+	}
+}